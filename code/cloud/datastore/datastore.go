@@ -5,6 +5,8 @@ import (
 	"encoding/gob"
 	"errors"
 	"io"
+	"os"
+	"time"
 )
 
 // FileID is a hash as a string of bytes.
@@ -27,6 +29,8 @@ func init() {
 type File struct {
 	ID FileID // ID of the file (hash of chunk IDs).
 
+	Base FileID // ID of the version that this version was edited from, if it was edited from a synced copy.
+
 	Name string // The name of the file.
 
 	Path string // Path of the user's file.
@@ -35,7 +39,21 @@ type File struct {
 
 	Chunks Chunks // List of the file's chunk ID's.
 
+	Created time.Time // When the file was added to the cloud.
+
+	Modified time.Time // When the file's contents were last modified.
+
+	Mode os.FileMode // POSIX permission bits of the file.
+
+	ContentType string // MIME type of the file's contents.
+
+	Owner string // ID of the node, or name of the user, that owns the file.
+
+	Metadata map[string]string // Arbitrary user metadata.
+
 	reader FileIOReader // Reader used to access the file contents.
+
+	index chunkIndex
 }
 
 type Chunks struct {
@@ -72,6 +90,8 @@ type ChunkStore struct {
 // DataStore represents a collection of files.
 type DataStore struct {
 	Files []*File
+
+	index fileIndex
 }
 
 // NewFile creates a new File and computes its chunks using the provided chunk size.
@@ -90,6 +110,7 @@ func NewFile(reader FileIOReader, name string, chunkSize int) (*File, error) {
 	}
 
 	i := 0
+	contentType := ""
 	allContents := make([]byte, 0)
 	buffer := make([]byte, chunkSize)
 	stop := false
@@ -113,12 +134,19 @@ func NewFile(reader FileIOReader, name string, chunkSize int) (*File, error) {
 			ChunkOffset:    offset,
 			ContentSize:    uint64(numRead),
 		}
+		if i == 0 {
+			contentType = DetectContentType(name, buffer[:numRead])
+		}
 		allContents = append(allContents, buffer[:chunk.ContentSize]...)
 		chunks.Chunks = append(chunks.Chunks, chunk)
 		chunks.NumChunks++
 		i++
 	}
 
+	if chunks.NumChunks == 0 {
+		contentType = DetectContentType(name, nil)
+	}
+
 	// Compute file ID by hashing all of the chunk IDs.
 	id := generateFileID(chunks.Chunks)
 
@@ -134,42 +162,105 @@ func NewFile(reader FileIOReader, name string, chunkSize int) (*File, error) {
 		Name:   name,
 		Size:   uint64(fileSize),
 		Chunks: chunks,
+
+		ContentType: contentType,
 	}, nil
 }
 
 // GetChunkByID returns a chunk belonging to the file by its ID.
 // Returns nil if the chunk can not be found.
 func (file *File) GetChunkByID(chunkID ChunkID) *Chunk {
-	for _, chunk := range file.Chunks.Chunks {
-		if chunk.ID == chunkID {
-			return &chunk
-		}
+	i, ok := file.index.lookup(file.Chunks.Chunks, chunkID)
+	if !ok {
+		return nil
 	}
-	return nil
+	chunk := file.Chunks.Chunks[i]
+	return &chunk
+}
+
+// indexed returns the position of the file with the name, and of a file containing the chunk. -1 is returned for
+// any that can not be found.
+func (ds *DataStore) indexed(name string, chunkID ChunkID) (int, int) {
+	ds.index.mutex.Lock()
+	defer ds.index.mutex.Unlock()
+	if !ds.index.valid(ds.Files) {
+		ds.index.build(ds.Files)
+	}
+	byName, ok := ds.index.names[name]
+	if ok && ds.Files[byName].Name != name {
+		// A file was renamed in place.
+		ds.index.build(ds.Files)
+		byName, ok = ds.index.names[name]
+	}
+	if !ok {
+		byName = -1
+	}
+	byChunk, ok := ds.index.chunks[chunkID]
+	if !ok {
+		byChunk = -1
+	}
+	return byName, byChunk
 }
 
 // Contains returns whether the datastore contains the specified file.
 func (ds *DataStore) Contains(file *File) bool {
-	for _, f := range ds.Files {
-		if file.Name == f.Name {
-			return true
-		}
-	}
-	return false
+	return ds.ContainsName(file.Name)
 }
 
 func (ds *DataStore) ContainsName(name string) bool {
-	for _, f := range ds.Files {
-		if name == f.Name {
-			return true
-		}
+	_, found := ds.Get(name)
+	return found
+}
+
+// Get returns the file with the name.
+func (ds *DataStore) Get(name string) (*File, bool) {
+	i, _ := ds.indexed(name, "")
+	if i == -1 {
+		return nil, false
 	}
-	return false
+	return ds.Files[i], true
 }
 
 // Add appends a file to the datastore.
 func (ds *DataStore) Add(file *File) {
+	ds.index.mutex.Lock()
+	defer ds.index.mutex.Unlock()
+	valid := ds.index.valid(ds.Files)
 	ds.Files = append(ds.Files, file)
+	if valid {
+		ds.index.track(ds.Files)
+		ds.index.add(len(ds.Files)-1, file)
+	}
+}
+
+// Replace replaces the file that has the same name as the given file. Returns false if there is no such file.
+func (ds *DataStore) Replace(file *File) bool {
+	i, _ := ds.indexed(file.Name, "")
+	if i == -1 {
+		return false
+	}
+	ds.index.mutex.Lock()
+	defer ds.index.mutex.Unlock()
+	ds.Files[i] = file
+	// Chunks of the old file stay indexed, GetChunkByID verifies the file it finds.
+	if ds.index.valid(ds.Files) {
+		ds.index.add(i, file)
+	}
+	return true
+}
+
+// Remove removes the file with the name and returns it. Returns nil if there is no such file.
+func (ds *DataStore) Remove(name string) *File {
+	i, _ := ds.indexed(name, "")
+	if i == -1 {
+		return nil
+	}
+	ds.index.mutex.Lock()
+	defer ds.index.mutex.Unlock()
+	file := ds.Files[i]
+	ds.Files = append(ds.Files[:i], ds.Files[i+1:]...)
+	ds.index.names = nil
+	return file
 }
 
 func generateFileID(chunks []Chunk) string {
@@ -183,9 +274,17 @@ func generateFileID(chunks []Chunk) string {
 // GetChunkByID searches for the chunk with the given ID and the file the chunk belongs to.
 // Returns nil if the chunk can not be found.
 func (ds *DataStore) GetChunkByID(chunkID ChunkID) (*Chunk, *File) {
+	_, i := ds.indexed("", chunkID)
+	if i == -1 {
+		return nil, nil
+	}
+	file := ds.Files[i]
+	if chunk := file.GetChunkByID(chunkID); chunk != nil {
+		return chunk, file
+	}
+	// The file's chunks were changed in place, look through all of the files.
 	for _, file := range ds.Files {
-		chunk := file.GetChunkByID(chunkID)
-		if chunk != nil {
+		if chunk := file.GetChunkByID(chunkID); chunk != nil {
 			return chunk, file
 		}
 	}
@@ -11,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,37 +21,37 @@ type FileStore interface {
 	SetChunks(chunks []Chunk) (newChunks []Chunk, oldChunks []Chunk)
 	StoreChunk(chunkID ChunkID, content []byte) error
 	ReadChunk(chunkID ChunkID) ([]byte, error)
+	// DeleteChunk removes the locally stored content of a single chunk. The chunk remains part of the file's metadata.
+	DeleteChunk(chunkID ChunkID) error
 	DeleteAllContent() error
 }
 
 type BaseFileStore struct {
 	FileID FileID
 	Chunks []Chunk
+
+	index chunkIndex
 }
 
 func (f *BaseFileStore) HasChunk(chunkID ChunkID) bool {
-	for i := range f.Chunks {
-		if f.Chunks[i].ID == chunkID {
-			return true
-		}
-	}
-	return false
+	_, found := f.Chunk(chunkID)
+	return found
 }
 
 func (f *BaseFileStore) Chunk(chunkID ChunkID) (Chunk, bool) {
-	for i := range f.Chunks {
-		if f.Chunks[i].ID == chunkID {
-			return f.Chunks[i], true
-		}
+	i, ok := f.index.lookup(f.Chunks, chunkID)
+	if !ok {
+		return Chunk{}, false
 	}
-	return Chunk{}, false
+	return f.Chunks[i], true
 }
 
 func (f *BaseFileStore) SetChunks(chunks []Chunk) (newChunks []Chunk, oldChunks []Chunk) {
+	defer f.index.reset()
 	max := len(f.Chunks)
 	// There's less chunks.
 	if len(chunks) < max {
-		oldChunks = append(oldChunks, f.Chunks[max:]...)
+		oldChunks = append(oldChunks, f.Chunks[len(chunks):]...)
 		max = len(chunks)
 		f.Chunks = f.Chunks[:max]
 	}
@@ -73,18 +74,50 @@ func (f *BaseFileStore) SetChunks(chunks []Chunk) (newChunks []Chunk, oldChunks
 	return
 }
 
+// ReplaceChunks replaces the list of chunks of the file store. Unlike SetChunks, it does not compare the lists, so
+// chunks of a partial file store that were stored for the previous list are not deleted.
+func (f *BaseFileStore) ReplaceChunks(chunks []Chunk) {
+	f.Chunks = chunks
+	f.index.reset()
+}
+
+// FullFileStore stores the whole file at a local path. For local copies of synced files, FileID is the version of the
+// file that the local copy was last synced with, local edits are based on that version.
 type FullFileStore struct {
 	BaseFileStore
 	// Path to the file.
 	FilePath string
 
 	mutex sync.RWMutex
+	// writers is the number of downloads writing to the file.
+	writers int32
+}
+
+// BeginWrite marks the file as being written by the cloud. Changes to the file are not local edits until EndWrite is
+// called.
+func (f *FullFileStore) BeginWrite() {
+	atomic.AddInt32(&f.writers, 1)
+}
+
+// EndWrite marks a write started by BeginWrite as completed.
+func (f *FullFileStore) EndWrite() {
+	atomic.AddInt32(&f.writers, -1)
+}
+
+// Writing returns whether the cloud is writing to the file.
+func (f *FullFileStore) Writing() bool {
+	return atomic.LoadInt32(&f.writers) > 0
 }
 
 func (f *FullFileStore) DeleteAllContent() error {
 	return os.Remove(f.FilePath)
 }
 
+// DeleteChunk is not supported by FullFileStore, as the chunk is part of the whole file.
+func (f *FullFileStore) DeleteChunk(chunkID ChunkID) error {
+	return errors.New("cannot delete a single chunk from a full file store")
+}
+
 func (f *FullFileStore) SetChunks(chunks []Chunk) ([]Chunk, []Chunk) {
 	f.FilePath = filepath.FromSlash(f.FilePath)
 	f.mutex.Lock()
@@ -111,6 +144,7 @@ func (f *FullFileStore) SetChunks(chunks []Chunk) ([]Chunk, []Chunk) {
 
 	if newSize < info.Size() {
 		file.Truncate(newSize)
+		file.Sync()
 	}
 
 	return newChunks, oldChunks
@@ -200,12 +234,14 @@ func (f *FullFileStore) StoreChunk(chunkID ChunkID, content []byte) error {
 		}
 		written += n
 	}
-	return nil
+	return file.Sync()
 }
 
 type SyncFileStore struct {
 	FullFileStore
 	CloudPath string
+	// Paused is set while the sync of the file is paused.
+	Paused bool
 
 	LastEdit time.Time
 }
@@ -218,9 +254,14 @@ func (f *SyncFileStore) StoreChunk(chunkID ChunkID, content []byte) error {
 	return f.FullFileStore.StoreChunk(chunkID, content)
 }
 
+// WatcherEvent returns the local edit of the file, based on the version it was last synced with. Returns nil if the
+// file was not edited, or if it is being written by the cloud.
 func (f *SyncFileStore) WatcherEvent(event *fsnotify.Event, fa *File) (*File, error) {
 	if event.Op&fsnotify.Write == fsnotify.Write {
 		utils.GetLogger().Println("[INFO] modified file:", event.Name)
+		if f.Writing() {
+			return nil, nil
+		}
 
 		reader, err := os.Open(f.FilePath)
 		if err != nil {
@@ -228,21 +269,18 @@ func (f *SyncFileStore) WatcherEvent(event *fsnotify.Event, fa *File) (*File, er
 		}
 		info, err := reader.Stat()
 		if err != nil {
+			reader.Close()
 			return nil, err
 		}
-		if !info.ModTime().After(f.LastEdit) {
-			return nil, nil
-		}
-		f.LastEdit = info.ModTime()
 
 		f2, err := NewFile(reader, path.Base(f.CloudPath), fa.Chunks.ChunkSize)
-		if len(f2.Chunks.Chunks) == 0 {
-			return nil, nil
-		}
 		reader.Close()
-		if err == nil {
-			return f2, nil
+		if err != nil || len(f2.Chunks.Chunks) == 0 || f2.ID == f.FileID {
+			return nil, nil
 		}
+		f2.Base = f.FileID
+		f2.SetFileInfo(info)
+		return f2, nil
 	}
 	return nil, nil
 }
@@ -278,16 +316,118 @@ func PartialFileStoreFromFile(file *File, filepath string, folderStore string) (
 	return f, nil
 }
 
+// CopyFileStore copies the chunks that are stored locally in src to a new partial file store in folderPath, stored
+// under fileID. Chunk files of partial file stores are hard linked when possible, so the copy does not take up more
+// space. Returns the amount of bytes that were copied, without the hard linked chunks.
+func CopyFileStore(src FileStore, chunks []Chunk, fileID FileID, folderPath string) (*PartialFileStore, uint64, error) {
+	f := &PartialFileStore{
+		BaseFileStore: BaseFileStore{
+			FileID: fileID,
+			Chunks: append([]Chunk(nil), chunks...),
+		},
+		FolderPath: filepath.FromSlash(folderPath),
+	}
+	partial, isPartial := src.(*PartialFileStore)
+	var copied uint64
+	for _, c := range chunks {
+		if !src.HasChunk(c.ID) {
+			continue
+		}
+		if isPartial && f.LinkChunk(partial, c.ID) {
+			continue
+		}
+		content, err := src.ReadChunk(c.ID)
+		if os.IsNotExist(err) {
+			// Partial file stores only hold some of the chunks.
+			continue
+		}
+		if err != nil {
+			return nil, copied, err
+		}
+		if err := f.StoreChunk(c.ID, content); err != nil {
+			return nil, copied, err
+		}
+		copied += uint64(len(content))
+	}
+	return f, copied, nil
+}
+
+// LinkChunk stores the chunk by hard linking the chunk file of src, which holds the same chunk. Returns false if src
+// does not store the chunk, or it could not be linked.
+func (f *PartialFileStore) LinkChunk(src *PartialFileStore, chunkID ChunkID) bool {
+	c, found := f.Chunk(chunkID)
+	srcChunk, srcFound := src.Chunk(chunkID)
+	if !found || !srcFound {
+		return false
+	}
+	from := filepath.Join(filepath.FromSlash(src.FolderPath), fmt.Sprintf("%s.%d", src.FileID, srcChunk.SequenceNumber))
+	to := filepath.Join(filepath.FromSlash(f.FolderPath), fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber))
+	return os.Link(from, to) == nil
+}
+
 func (f *PartialFileStore) DeleteAllContent() error {
-	var err error
+	f.FolderPath = filepath.FromSlash(f.FolderPath)
+	paths := make([]string, 0, len(f.Chunks))
 	for _, c := range f.Chunks {
-		path := filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber))
-		err2 := os.Remove(path)
-		if err2 != nil {
-			err = err2
-		}
+		paths = append(paths, filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber)))
 	}
-	return err
+	return removeJournaled(f.FolderPath, "DeleteAllContent", f.FileID, nil, paths)
+}
+
+// StoredChunkSize returns the amount of bytes the chunk's contents take up on disk, or 0 if the chunk is not stored.
+func (f *PartialFileStore) StoredChunkSize(chunkID ChunkID) uint64 {
+	c, found := f.Chunk(chunkID)
+	if !found {
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(filepath.FromSlash(f.FolderPath), fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber)))
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
+// StoredSize returns the amount of bytes all of the file's stored chunks take up on disk.
+func (f *PartialFileStore) StoredSize() uint64 {
+	var size uint64
+	for _, c := range f.Chunks {
+		size += f.StoredChunkSize(c.ID)
+	}
+	return size
+}
+
+// UniqueChunkSize returns the amount of bytes that deleting the chunk frees on disk. Chunk files that are hard linked
+// by other file stores are not freed.
+func (f *PartialFileStore) UniqueChunkSize(chunkID ChunkID) uint64 {
+	c, found := f.Chunk(chunkID)
+	if !found {
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(filepath.FromSlash(f.FolderPath), fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber)))
+	if err != nil || utils.LinkCount(info) > 1 {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
+// UniqueSize returns the amount of bytes that deleting all of the file's stored chunks frees on disk.
+func (f *PartialFileStore) UniqueSize() uint64 {
+	var size uint64
+	for _, c := range f.Chunks {
+		size += f.UniqueChunkSize(c.ID)
+	}
+	return size
+}
+
+func (f *PartialFileStore) DeleteChunk(chunkID ChunkID) error {
+	f.FolderPath = filepath.FromSlash(f.FolderPath)
+	c, found := f.Chunk(chunkID)
+	if !found {
+		return errors.New("chunk does not belong to the file")
+	}
+
+	path := filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber))
+	return os.Remove(path)
 }
 
 func (f *PartialFileStore) SetChunks(chunks []Chunk) ([]Chunk, []Chunk) {
@@ -295,12 +435,12 @@ func (f *PartialFileStore) SetChunks(chunks []Chunk) ([]Chunk, []Chunk) {
 	newChunks, oldChunks := f.BaseFileStore.SetChunks(chunks)
 
 	// Delete old chunks.
+	paths := make([]string, 0, len(oldChunks))
 	for _, c := range oldChunks {
-		path := filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber))
-		err := os.Remove(path)
-		if err != nil {
-			utils.GetLogger().Printf("[ERROR] Removing %v: %v", path, err)
-		}
+		paths = append(paths, filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber)))
+	}
+	if err := removeJournaled(f.FolderPath, "SetChunks", f.FileID, f.Chunks, paths); err != nil {
+		utils.GetLogger().Printf("[ERROR] Removing old chunks of %v: %v", f.FileID, err)
 	}
 
 	return newChunks, oldChunks
@@ -326,5 +466,5 @@ func (f *PartialFileStore) StoreChunk(chunkID ChunkID, content []byte) error {
 	}
 
 	path := filepath.Join(f.FolderPath, fmt.Sprintf("%s.%d", f.FileID, c.SequenceNumber))
-	return ioutil.WriteFile(path, content, 0666)
+	return utils.WriteFileAtomic(path, content, 0666)
 }
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// chunkIndex maps chunk IDs to the position of their first occurrence in a list of chunks. Indexes are built lazily
+// on the first lookup, which can happen from concurrent readers of otherwise read-only data. Each lookup reads an
+// immutable snapshot that is replaced as a whole, so lookups of different stores do not contend, and files that are
+// passed by value do not copy a lock. Indexes are not encoded, so decoded values build them again.
+type chunkIndex struct {
+	snapshot atomic.Value // *chunkSnapshot
+}
+
+// chunkSnapshot is a chunk index built for one list of chunks.
+type chunkSnapshot struct {
+	first *Chunk // the first element of the indexed list, to tell it apart from a list of the same length.
+	n     int
+	ids   map[ChunkID]int
+}
+
+// indexes returns whether the snapshot was built for chunks.
+func (s *chunkSnapshot) indexes(chunks []Chunk) bool {
+	if s == nil || s.n != len(chunks) {
+		return false
+	}
+	return len(chunks) == 0 || s.first == &chunks[0]
+}
+
+// lookup returns the position of the chunk in chunks. The index is rebuilt if chunks was replaced without resetting
+// the index.
+func (idx *chunkIndex) lookup(chunks []Chunk, chunkID ChunkID) (int, bool) {
+	s, _ := idx.snapshot.Load().(*chunkSnapshot)
+	if !s.indexes(chunks) {
+		s = &chunkSnapshot{n: len(chunks), ids: make(map[ChunkID]int, len(chunks))}
+		if len(chunks) > 0 {
+			s.first = &chunks[0]
+		}
+		for i := range chunks {
+			if _, ok := s.ids[chunks[i].ID]; !ok {
+				s.ids[chunks[i].ID] = i
+			}
+		}
+		idx.snapshot.Store(s)
+	}
+	i, ok := s.ids[chunkID]
+	if ok && chunks[i].ID != chunkID {
+		// The list was changed in place.
+		idx.reset()
+		return idx.lookup(chunks, chunkID)
+	}
+	return i, ok
+}
+
+func (idx *chunkIndex) reset() {
+	idx.snapshot.Store((*chunkSnapshot)(nil))
+}
+
+// fileIndex maps file names and chunk IDs to the position of the file in a data store. Data stores are not copied, so
+// the index is guarded by its own mutex.
+type fileIndex struct {
+	mutex  sync.Mutex
+	first  **File // the first element of the indexed list, to tell it apart from a list of the same length.
+	n      int
+	names  map[string]int
+	chunks map[ChunkID]int
+}
+
+// valid returns true if the index was built for files and it was not changed since. mutex must be held.
+func (idx *fileIndex) valid(files []*File) bool {
+	if idx.names == nil || idx.n != len(files) {
+		return false
+	}
+	return len(files) == 0 || idx.first == &files[0]
+}
+
+// build indexes the files. mutex must be held.
+func (idx *fileIndex) build(files []*File) {
+	idx.track(files)
+	idx.names = make(map[string]int, len(files))
+	idx.chunks = make(map[ChunkID]int)
+	for i, f := range files {
+		idx.add(i, f)
+	}
+}
+
+// track records files as the indexed list, after files were added to it. mutex must be held.
+func (idx *fileIndex) track(files []*File) {
+	idx.n = len(files)
+	idx.first = nil
+	if len(files) > 0 {
+		idx.first = &files[0]
+	}
+}
+
+func (idx *fileIndex) add(i int, f *File) {
+	if _, ok := idx.names[f.Name]; !ok {
+		idx.names[f.Name] = i
+	}
+	for _, c := range f.Chunks.Chunks {
+		if _, ok := idx.chunks[c.ID]; !ok {
+			idx.chunks[c.ID] = i
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testFile(name string, chunks ...string) *File {
+	f := &File{Name: name}
+	for i, c := range chunks {
+		f.Chunks.Chunks = append(f.Chunks.Chunks, Chunk{ID: ChunkID(c), SequenceNumber: i})
+	}
+	return f
+}
+
+func TestDataStoreIndex(t *testing.T) {
+	ds := DataStore{}
+	ds.Add(testFile("a", "1", "2"))
+	ds.Add(testFile("b", "3"))
+
+	if !ds.ContainsName("a") || !ds.ContainsName("b") || ds.ContainsName("c") {
+		t.Fatal("Unexpected ContainsName results.")
+	}
+	if chunk, file := ds.GetChunkByID("3"); chunk == nil || file.Name != "b" {
+		t.Errorf("Expected chunk 3 to belong to file b, got %v.", file)
+	}
+
+	if !ds.Replace(testFile("a", "4")) {
+		t.Fatal("Expected file a to be replaced.")
+	}
+	if chunk, _ := ds.GetChunkByID("1"); chunk != nil {
+		t.Error("Expected chunk 1 to be gone after replacing file a.")
+	}
+	if chunk, file := ds.GetChunkByID("4"); chunk == nil || file.Name != "a" {
+		t.Error("Expected chunk 4 to belong to file a.")
+	}
+
+	if f := ds.Remove("a"); f == nil {
+		t.Fatal("Expected file a to be removed.")
+	}
+	if ds.ContainsName("a") || !ds.ContainsName("b") {
+		t.Error("Unexpected files after removing file a.")
+	}
+	if _, file := ds.GetChunkByID("3"); file == nil || file.Name != "b" {
+		t.Error("Expected chunk 3 to still belong to file b.")
+	}
+
+	// Files appended directly are indexed as well.
+	ds.Files = append(ds.Files, testFile("c", "5"))
+	if !ds.ContainsName("c") {
+		t.Error("Expected file c to be found.")
+	}
+}
+
+func TestFileStoreChunkIndex(t *testing.T) {
+	f := &BaseFileStore{Chunks: testFile("a", "1", "2", "1").Chunks.Chunks}
+	if c, ok := f.Chunk("1"); !ok || c.SequenceNumber != 0 {
+		t.Errorf("Expected the first occurrence of chunk 1, got %v.", c)
+	}
+	f.SetChunks(testFile("a", "3", "2").Chunks.Chunks)
+	if f.HasChunk("1") || !f.HasChunk("3") || !f.HasChunk("2") {
+		t.Error("Unexpected chunks after SetChunks.")
+	}
+
+	// A list of the same length that replaces the chunks is indexed again.
+	f.Chunks = testFile("a", "4", "5").Chunks.Chunks
+	if !f.HasChunk("4") || !f.HasChunk("5") || f.HasChunk("3") {
+		t.Error("Unexpected chunks after replacing the list.")
+	}
+	f.ReplaceChunks(testFile("a", "6", "7").Chunks.Chunks)
+	if !f.HasChunk("6") || f.HasChunk("4") {
+		t.Error("Unexpected chunks after ReplaceChunks.")
+	}
+
+	// Copies of a file look up their own chunks.
+	file := testFile("b", "1", "2")
+	file.GetChunkByID("1")
+	cp := *file
+	cp.Chunks.Chunks = testFile("b", "3", "4").Chunks.Chunks
+	if cp.GetChunkByID("3") == nil || cp.GetChunkByID("1") != nil || file.GetChunkByID("1") == nil {
+		t.Error("Unexpected chunks of a copied file.")
+	}
+}
+
+func TestDataStoreIndexReplacedFiles(t *testing.T) {
+	ds := DataStore{}
+	ds.Add(testFile("a", "1"))
+	ds.Add(testFile("b", "2"))
+	if !ds.ContainsName("a") {
+		t.Fatal("Expected file a to be found.")
+	}
+	ds.Files = []*File{testFile("c", "3"), testFile("d", "4")}
+	if ds.ContainsName("a") || !ds.ContainsName("c") {
+		t.Error("Unexpected files after replacing the list.")
+	}
+	if _, file := ds.GetChunkByID("4"); file == nil || file.Name != "d" {
+		t.Error("Expected chunk 4 to belong to file d.")
+	}
+}
+
+func benchmarkDataStore(n int) *DataStore {
+	ds := &DataStore{}
+	for i := 0; i < n; i++ {
+		ds.Add(testFile(fmt.Sprintf("file%d", i), fmt.Sprintf("chunk%d", i)))
+	}
+	return ds
+}
+
+func BenchmarkDataStoreContainsName(b *testing.B) {
+	ds := benchmarkDataStore(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ds.ContainsName(fmt.Sprintf("file%d", i%50000))
+	}
+}
+
+// BenchmarkDataStoreContainsNameScan is the linear scan the index replaces, for comparison.
+func BenchmarkDataStoreContainsNameScan(b *testing.B) {
+	ds := benchmarkDataStore(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("file%d", i%50000)
+		for _, f := range ds.Files {
+			if f.Name == name {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkDataStoreGetChunkByID(b *testing.B) {
+	ds := benchmarkDataStore(50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ds.GetChunkByID(ChunkID(fmt.Sprintf("chunk%d", i%50000)))
+	}
+}
+
+func BenchmarkFileStoreHasChunk(b *testing.B) {
+	f := &BaseFileStore{}
+	for i := 0; i < 50000; i++ {
+		f.Chunks = append(f.Chunks, Chunk{ID: ChunkID(fmt.Sprintf("chunk%d", i)), SequenceNumber: i})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.HasChunk(ChunkID(fmt.Sprintf("chunk%d", i%50000)))
+	}
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"cloud/utils"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// journalSuffix is the file extension of journal entries in a partial file store's folder.
+const journalSuffix = ".journal"
+
+// JournalEntry records an operation on a partial file store: the chunks that the store has once it completes, and the
+// chunk files that it is about to remove. The entry is synced to disk before any file is removed, and deleted once the
+// operation completes. An entry left behind after a crash belongs to an operation that was interrupted, and is rolled
+// forward by RecoverJournal.
+type JournalEntry struct {
+	Op     string
+	FileID FileID
+	// Chunks are the chunks of the store after the operation. The saved state of the store could still list the
+	// chunks from before it, RecoverChunks updates them.
+	Chunks []Chunk
+	Paths  []string
+}
+
+// beginJournal durably records the entry in the folder. The returned function completes the entry.
+func beginJournal(folder string, entry JournalEntry) (func(), error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(folder, string(entry.FileID)+".*"+journalSuffix)
+	if err != nil {
+		return nil, err
+	}
+	p := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(p)
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(p)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(p)
+		return nil, err
+	}
+	utils.SyncDir(folder)
+
+	return func() {
+		if err := os.Remove(p); err != nil {
+			utils.GetLogger().Printf("[ERROR] Removing journal entry %v: %v.", p, err)
+		}
+	}, nil
+}
+
+// removeJournaled removes the paths as a single journaled operation on the folder, after which the store of the file
+// has the chunks.
+func removeJournaled(folder string, op string, fileID FileID, chunks []Chunk, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	done, err := beginJournal(folder, JournalEntry{Op: op, FileID: fileID, Chunks: chunks, Paths: paths})
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			utils.GetLogger().Printf("[ERROR] Removing %v: %v", p, err)
+			lastErr = err
+		}
+	}
+	utils.SyncDir(folder)
+	done()
+	return lastErr
+}
+
+// RecoverJournal completes the operations on partial file stores in the folder that were interrupted by a crash.
+// Interrupted removals are rolled forward, the completed entries are returned so that the chunks of their stores can be
+// rolled forward too. Temporary files of chunk writes that never completed are rolled back by removing them, leaving
+// the previous content of the chunk in place. It must not run while chunks are written to the folder.
+func RecoverJournal(folder string) ([]JournalEntry, error) {
+	infos, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	completed := make([]JournalEntry, 0)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		p := filepath.Join(folder, info.Name())
+		if utils.IsTempFile(info.Name()) {
+			utils.GetLogger().Printf("[INFO] Removing incomplete write: %v.", p)
+			os.Remove(p)
+			continue
+		}
+		if !strings.HasSuffix(info.Name(), journalSuffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return completed, err
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			// The entry was not fully written, so the operation never started.
+			utils.GetLogger().Printf("[WARN] Discarding incomplete journal entry %v: %v.", p, err)
+			os.Remove(p)
+			continue
+		}
+		utils.GetLogger().Printf("[INFO] Completing interrupted %v of file %v.", entry.Op, entry.FileID)
+		for _, chunkPath := range entry.Paths {
+			if err := os.Remove(chunkPath); err != nil && !os.IsNotExist(err) {
+				return completed, err
+			}
+		}
+		os.Remove(p)
+		completed = append(completed, entry)
+	}
+	return completed, utils.SyncDir(folder)
+}
+
+// RecoverChunks sets the chunks of the store to the ones after an interrupted operation on it that RecoverJournal
+// completed. Returns false if the entry is of another file.
+func (f *PartialFileStore) RecoverChunks(entry JournalEntry) bool {
+	if entry.FileID != f.FileID {
+		return false
+	}
+	f.BaseFileStore.SetChunks(entry.Chunks)
+	return true
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"cloud/utils"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverJournal(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_journal_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	dir := dirs[0]
+
+	// A SetChunks that crashed after the journal entry was written, but before the chunk was removed.
+	chunk := filepath.Join(dir, "file.0")
+	kept := filepath.Join(dir, "file.1")
+	for _, p := range []string{chunk, kept} {
+		if err := ioutil.WriteFile(p, []byte("chunk"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunks := []Chunk{{ID: "b", SequenceNumber: 1, ContentSize: 5}}
+	data, _ := json.Marshal(JournalEntry{Op: "SetChunks", FileID: "file", Chunks: chunks, Paths: []string{chunk}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.1"+journalSuffix), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// A chunk write that crashed before the rename, and a journal entry that was never fully written.
+	tmp := filepath.Join(dir, ".file.1.123"+utils.TempFileSuffix)
+	if err := ioutil.WriteFile(tmp, []byte("chu"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.2"+journalSuffix), []byte("{\"Op\":"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := RecoverJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(chunk); !os.IsNotExist(err) {
+		t.Error("Journaled removal was not rolled forward.")
+	}
+	if content, err := ioutil.ReadFile(kept); err != nil || string(content) != "chunk" {
+		t.Errorf("Chunk content changed: %v, %v.", string(content), err)
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	if len(infos) != 1 {
+		t.Errorf("Expected only the kept chunk to remain, got %d files.", len(infos))
+	}
+
+	// The saved store still lists the removed chunk, its chunks are rolled forward too.
+	if len(completed) != 1 {
+		t.Fatalf("Expected the completed SetChunks, got %v.", completed)
+	}
+	store := &PartialFileStore{
+		BaseFileStore: BaseFileStore{FileID: "file", Chunks: []Chunk{{ID: "a", SequenceNumber: 0, ContentSize: 5},
+			chunks[0]}},
+		FolderPath: dir,
+	}
+	other := &PartialFileStore{BaseFileStore: BaseFileStore{FileID: "other"}, FolderPath: dir}
+	if other.RecoverChunks(completed[0]) {
+		t.Error("Recovered the chunks of another file.")
+	}
+	if !store.RecoverChunks(completed[0]) || len(store.Chunks) != 1 || store.Chunks[0].ID != "b" {
+		t.Errorf("Chunks were not rolled forward: %v.", store.Chunks)
+	}
+}
+
+func TestPartialFileStoreAtomicWrite(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_store_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+
+	chunks := []Chunk{{ID: "a", SequenceNumber: 0, ContentSize: 5}, {ID: "b", SequenceNumber: 1, ContentSize: 5}}
+	store := &PartialFileStore{BaseFileStore: BaseFileStore{FileID: "file", Chunks: chunks}, FolderPath: dirs[0]}
+	for _, c := range chunks {
+		if err := store.StoreChunk(c.ID, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.SetChunks(chunks[:1])
+	if err := store.DeleteAllContent(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No temporary files or journal entries are left behind.
+	infos, _ := ioutil.ReadDir(dirs[0])
+	if len(infos) != 0 {
+		t.Errorf("Expected an empty folder, got %d files.", len(infos))
+	}
+}
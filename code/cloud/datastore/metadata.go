@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// DetectContentType returns the MIME type of a file. The type is looked up by the extension of the file's name first,
+// the head of the file's contents is sniffed if the extension is unknown.
+func DetectContentType(name string, head []byte) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// SetFileInfo sets the modification time and mode of the file from the info of its local copy.
+func (file *File) SetFileInfo(info os.FileInfo) {
+	file.Modified = info.ModTime()
+	file.Mode = info.Mode().Perm()
+}
+
+// InheritMetadata keeps the metadata of a previous version of the file that the new version does not set. The
+// creation time and owner always stay the same across versions, user metadata is kept unless the new version sets
+// its own. It is changed or cleared separately from the contents, by replacing it on the cloud.
+func (file *File) InheritMetadata(previous *File) {
+	if previous == nil {
+		return
+	}
+	if !previous.Created.IsZero() {
+		file.Created = previous.Created
+	}
+	if previous.Owner != "" {
+		file.Owner = previous.Owner
+	}
+	if file.Metadata == nil && previous.Metadata != nil {
+		file.Metadata = make(map[string]string, len(previous.Metadata))
+		for k, v := range previous.Metadata {
+			file.Metadata[k] = v
+		}
+	}
+	if file.Mode == 0 {
+		file.Mode = previous.Mode
+	}
+	if file.ContentType == "" {
+		file.ContentType = previous.ContentType
+	}
+}
+
+// RestoreFileInfo applies the mode and modification time of the file to its local copy at localPath.
+func (file *File) RestoreFileInfo(localPath string) error {
+	if file.Mode != 0 {
+		if err := os.Chmod(localPath, file.Mode); err != nil {
+			return err
+		}
+	}
+	if !file.Modified.IsZero() {
+		return os.Chtimes(localPath, time.Now(), file.Modified)
+	}
+	return nil
+}
+
+// Copy returns a copy of the file's metadata with a new name. The copy has the same contents, so it shares the
+// file's chunks.
+func (file *File) Copy(name string) *File {
+	cp := &File{
+		ID:          file.ID,
+		Name:        name,
+		Path:        file.Path,
+		Size:        file.Size,
+		Chunks:      file.Chunks,
+		Created:     file.Created,
+		Modified:    file.Modified,
+		Mode:        file.Mode,
+		ContentType: file.ContentType,
+		Owner:       file.Owner,
+	}
+	cp.Chunks.Chunks = append([]Chunk(nil), file.Chunks.Chunks...)
+	if file.Metadata != nil {
+		cp.Metadata = make(map[string]string, len(file.Metadata))
+		for k, v := range file.Metadata {
+			cp.Metadata[k] = v
+		}
+	}
+	return cp
+}
@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"bytes"
+	"cloud/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDetectContentType(t *testing.T) {
+	if typ := DetectContentType("page.html", nil); typ != "text/html; charset=utf-8" {
+		t.Errorf("Expected the type of the extension, got %v.", typ)
+	}
+	if typ := DetectContentType("image", []byte("\x89PNG\x0D\x0A\x1A\x0A")); typ != "image/png" {
+		t.Errorf("Expected the sniffed type, got %v.", typ)
+	}
+
+	file, err := NewFile(bytes.NewReader([]byte("%PDF-1.4")), "doc", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ContentType != "application/pdf" {
+		t.Errorf("Expected NewFile to detect application/pdf, got %v.", file.ContentType)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	tmp, err := utils.GetTestFile("cloud_test_metadata_*", []byte("contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmp)
+
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := &File{Mode: 0600, Modified: modified}
+	if err := file.RestoreFileInfo(tmp.Name()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("Expected modification time %v, got %v.", modified, info.ModTime())
+	}
+
+	restored := &File{}
+	restored.SetFileInfo(info)
+	if !restored.Modified.Equal(modified) || restored.Mode != info.Mode().Perm() {
+		t.Errorf("Unexpected file info: %v, %v.", restored.Modified, restored.Mode)
+	}
+}
+
+func TestInheritMetadata(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	previous := &File{
+		Created:     created,
+		Owner:       "node",
+		Mode:        0644,
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"a": "b"},
+	}
+	file := &File{Owner: "other", ContentType: "text/html"}
+	file.InheritMetadata(previous)
+	if !file.Created.Equal(created) || file.Owner != "node" || file.Mode != 0644 || file.ContentType != "text/html" {
+		t.Errorf("Unexpected metadata: %+v.", file)
+	}
+	file.Metadata["a"] = "c"
+	if previous.Metadata["a"] != "b" {
+		t.Error("Expected the user metadata to be copied.")
+	}
+}
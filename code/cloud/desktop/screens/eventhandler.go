@@ -3,9 +3,10 @@ package screens
 import (
 	"cloud/network"
 	"fmt"
+	"fyne.io/fyne"
 )
 
-func RegisterEvents(c network.Cloud) {
+func RegisterEvents(w fyne.Window, c network.Cloud) {
 	c.Events().NodeAdded = func(n network.Node) {
 		nodesEventNodeAdded(n)
 	}
@@ -21,4 +22,7 @@ func RegisterEvents(c network.Cloud) {
 	c.Events().NodeUpdated = func(n network.Node) {
 		nodesEventNodeUpdated(n)
 	}
+	c.Events().SyncConflict = func(conflict network.SyncConflict) {
+		syncsEventSyncConflict(w, c, conflict)
+	}
 }
@@ -61,12 +61,38 @@ func FileExplorerScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
 					}
 
 					fullpath := folderPath + "/" + p
-					if err := c.SyncFolder(fullpath, filename); err != nil {
+					plan, err := c.PlanSyncFolder(fullpath, filename)
+					if err != nil {
 						fdialog.ShowError(err, w)
+						return
 					}
+					message := fmt.Sprintf("Upload %d, download %d and resolve %d conflicting files?",
+						plan.Count(network.ReconcileUpload), plan.Count(network.ReconcileDownload),
+						plan.Count(network.ReconcileConflict))
+					fdialog.ShowConfirm("Sync folder", message, func(ok bool) {
+						if !ok {
+							return
+						}
+						if err := c.SyncFolder(fullpath, filename); err != nil {
+							fdialog.ShowError(err, w)
+						}
+					}, w)
+				}),
+				widget.NewToolbarAction(theme.ContentCutIcon(), func() {
+					transferDialog(w, c, "Move", folderPath+"/"+p, c.MoveDirectory, redraw)
+				}),
+				widget.NewToolbarAction(theme.ContentCopyIcon(), func() {
+					transferDialog(w, c, "Copy", folderPath+"/"+p, c.CopyDirectory, redraw)
 				}),
 				widget.NewToolbarAction(theme.DeleteIcon(), func() {
-					err := c.DeleteDirectory(folderPath + "/" + p)
+					fullpath := folderPath + "/" + p
+					if !c.LockFile(fullpath) {
+						fdialog.ShowError(errors.New("Could not acquire lock on the folder"), w)
+						return
+					}
+					defer c.UnlockFile(fullpath)
+
+					err := c.DeleteDirectory(fullpath, true)
 					if err != nil {
 						fdialog.ShowError(err, w)
 					}
@@ -120,6 +146,12 @@ func FileExplorerScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
 						}
 					})
 				}),
+				widget.NewToolbarAction(theme.ContentCutIcon(), func() {
+					transferDialog(w, c, "Move", folderPath+"/"+file.Name, c.MoveFile, redraw)
+				}),
+				widget.NewToolbarAction(theme.ContentCopyIcon(), func() {
+					transferDialog(w, c, "Copy", folderPath+"/"+file.Name, c.CopyFile, redraw)
+				}),
 				widget.NewToolbarAction(theme.DeleteIcon(), func() {
 					fullpath := folderPath + "/" + file.Name
 					if !c.LockFile(fullpath) {
@@ -209,6 +241,32 @@ func FileExplorerScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
 	return fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, hbox, nil, nil), hbox, scroll)
 }
 
+// transferDialog asks for a new path and moves or copies the file or folder at fullpath there, holding the locks of
+// both paths.
+func transferDialog(w fyne.Window, c network.Cloud, title string, fullpath string, transfer func(from, to string) error,
+	done func()) {
+	content := widget.NewEntry()
+	content.SetText(network.CleanNetworkPath(fullpath))
+	fdialog.ShowCustomConfirm(title+" to", title, "Cancel", content, func(s bool) {
+		if !s {
+			return
+		}
+		newPath := content.Text
+		if !c.LockFile(fullpath) || !c.LockFile(newPath) {
+			c.UnlockFile(fullpath)
+			fdialog.ShowError(errors.New("Could not acquire locks on the paths"), w)
+			return
+		}
+		defer c.UnlockFile(fullpath)
+		defer c.UnlockFile(newPath)
+
+		if err := transfer(fullpath, newPath); err != nil {
+			fdialog.ShowError(err, w)
+		}
+		done()
+	}, w)
+}
+
 func fileIcon(filename string) *theme.ThemedResource {
 	s := strings.Split(filename, ".")
 	if len(s) <= 1 {
@@ -12,12 +12,13 @@ func EmptyScreen(w fyne.Window, c *network.Cloud) fyne.CanvasObject {
 }
 
 func Navigation(w fyne.Window, c network.Cloud) {
-	RegisterEvents(c)
+	RegisterEvents(w, c)
 	tabs := widget.NewTabContainer(
 		widget.NewTabItemWithIcon("Home", theme.HomeIcon(), HomeScreen(w, c)),
 		widget.NewTabItemWithIcon("Nodes", theme.ContentCopyIcon(), NodesScreen(w, c)),
 		widget.NewTabItemWithIcon("Whitelist", theme.ContentClearIcon(), WhitelistScreen(w, c)),
 		widget.NewTabItemWithIcon("File Explorer", theme.FolderIcon(), FileExplorerScreen(w, c)),
+		widget.NewTabItemWithIcon("Syncs", theme.ViewRefreshIcon(), SyncsScreen(w, c)),
 		widget.NewTabItemWithIcon("Settings", theme.SettingsIcon(), SettingScreen(w, c)),
 	)
 
@@ -3,9 +3,6 @@ package screens
 import (
 	"cloud/network"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/gob"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"fyne.io/fyne"
@@ -13,8 +10,6 @@ import (
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
-	"io/ioutil"
-	"os"
 	"strconv"
 	"time"
 )
@@ -31,6 +26,7 @@ var newCloudForm struct {
 	nodeIP             *widget.Entry
 	nodePort           *widget.Entry
 	nodePrivateKeyPath *widget.Entry
+	nodePassphrase     *widget.Entry
 	nodeFileStorageDir *widget.Entry
 }
 
@@ -67,6 +63,8 @@ func createWidgets() {
 	newCloudForm.nodePrivateKeyPath = &widget.Entry{
 		PlaceHolder: "Path to your private key",
 	}
+	newCloudForm.nodePassphrase = widget.NewPasswordEntry()
+	newCloudForm.nodePassphrase.SetPlaceHolder("Passphrase of your private key - leave empty if not encrypted")
 
 	newCloudForm.nodeFileStorageDir = &widget.Entry{
 		PlaceHolder: "Path to directory to store files",
@@ -104,21 +102,17 @@ func NewCloudScreen(win fyne.Window) fyne.CanvasObject {
 		&widget.Box{},
 		widget.NewButton("Load from file", func() {
 			filename, err := LoadFileDialog()
-			if err == nil {
-				r, err := os.Open(filename)
-				if err != nil {
-					fdialog.ShowError(err, win)
-					return
-				}
-				defer r.Close()
-				decoder := gob.NewDecoder(r)
-				var savedNetwork network.SavedNetworkState
-				err = decoder.Decode(&savedNetwork)
+			if err != nil {
+				return
+			}
+			load := func(passphrase []byte) {
+				savedNetwork, err := network.ReadStateFile(filename, passphrase)
 				if err != nil {
 					fdialog.ShowError(err, win)
 					return
 				}
 				c := network.LoadNetwork(savedNetwork)
+				c.SetStatePassphrase(passphrase)
 				err = c.Listen()
 				if err != nil {
 					fdialog.ShowError(err, win)
@@ -127,6 +121,16 @@ func NewCloudScreen(win fyne.Window) fyne.CanvasObject {
 				fmt.Printf("%v\n", c)
 				win.SetContent(connectedToNetwork(win, c))
 			}
+			if encrypted, _ := network.IsStateFileEncrypted(filename); !encrypted {
+				load(nil)
+				return
+			}
+			passphrase := widget.NewPasswordEntry()
+			fdialog.ShowCustomConfirm("Passphrase", "Load", "Cancel", passphrase, func(ok bool) {
+				if ok {
+					load([]byte(passphrase.Text))
+				}
+			}, win)
 		}),
 		widget.NewButton("Create", func() {
 			newCloudForm.newNetwork = true
@@ -199,11 +203,29 @@ func createNodeScreen(win fyne.Window) fyne.CanvasObject {
 			newCloudForm.nodeFileStorageDir.SetText(filename)
 		}
 	})
+	generateKeyButton := widget.NewButton("Generate", func() {
+		filename, err := SaveFileDialog()
+		if err != nil {
+			return
+		}
+		key, err := network.GeneratePrivateKey()
+		if err != nil {
+			fdialog.ShowError(err, win)
+			return
+		}
+		// The key is encrypted with the passphrase entered, if any.
+		err = network.WritePrivateKey(filename, key, []byte(newCloudForm.nodePassphrase.Text))
+		if err != nil {
+			fdialog.ShowError(err, win)
+			return
+		}
+		newCloudForm.nodePrivateKeyPath.SetText(filename)
+	})
 	keyID := widget.NewEntry()
 	keyID.Disable()
 
-	newCloudForm.nodePrivateKeyPath.OnChanged = func(new string) {
-		key, err := readKey(new)
+	updateKeyID := func() {
+		key, err := readKey(newCloudForm.nodePrivateKeyPath.Text)
 		if err != nil {
 			keyID.SetText("")
 			return
@@ -215,6 +237,8 @@ func createNodeScreen(win fyne.Window) fyne.CanvasObject {
 		}
 		keyID.SetText(id)
 	}
+	newCloudForm.nodePrivateKeyPath.OnChanged = func(string) { updateKeyID() }
+	newCloudForm.nodePassphrase.OnChanged = func(string) { updateKeyID() }
 
 	w := widget.NewVBox(
 		progressBar,
@@ -225,8 +249,10 @@ func createNodeScreen(win fyne.Window) fyne.CanvasObject {
 		newCloudForm.nodeName,
 		newCloudForm.nodeIP,
 		newCloudForm.nodePort,
-		fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, newCloudForm.nodePrivateKeyPath, browseButton),
-			newCloudForm.nodePrivateKeyPath, browseButton),
+		fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, newCloudForm.nodePrivateKeyPath,
+			widget.NewHBox(browseButton, generateKeyButton)),
+			newCloudForm.nodePrivateKeyPath, widget.NewHBox(browseButton, generateKeyButton)),
+		newCloudForm.nodePassphrase,
 		fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, newCloudForm.nodeFileStorageDir, browseFileStorageButton),
 			newCloudForm.nodeFileStorageDir, browseFileStorageButton),
 		widget.NewHBox(keyID, widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {
@@ -302,6 +328,7 @@ func connectingToNetworkScreen(win fyne.Window) fyne.CanvasObject {
 				Whitelist:   true,
 			}, me, key)
 			c.SetConfig(config)
+			c.SetStatePassphrase([]byte(newCloudForm.nodePassphrase.Text))
 			err = c.ListenOnPort(port)
 			if err != nil {
 				fdialog.ShowError(err, win)
@@ -313,6 +340,7 @@ func connectingToNetworkScreen(win fyne.Window) fyne.CanvasObject {
 				displayError(err)
 				return
 			}
+			c.SetStatePassphrase([]byte(newCloudForm.nodePassphrase.Text))
 			err = c.ListenOnPort(port)
 			if err != nil {
 				displayError(err)
@@ -344,20 +372,7 @@ func connectedToNetwork(win fyne.Window, c network.Cloud) fyne.CanvasObject {
 	return w
 }
 
+// readKey reads the private key at the file, decrypting it with the entered passphrase if needed.
 func readKey(file string) (*rsa.PrivateKey, error) {
-	b, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
-	}
-
-	bb, _ := pem.Decode(b)
-	if bb.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("invalid type " + bb.Type + " want: RSA PRIVATE KEY")
-	}
-
-	key, err := x509.ParsePKCS1PrivateKey(bb.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return key, nil
+	return network.ReadPrivateKey(file, []byte(newCloudForm.nodePassphrase.Text))
 }
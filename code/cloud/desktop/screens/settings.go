@@ -2,12 +2,10 @@ package screens
 
 import (
 	"cloud/network"
-	"encoding/gob"
 	"fyne.io/fyne"
 	"fyne.io/fyne/dialog"
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
-	"os"
 )
 
 func SettingScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
@@ -19,15 +17,7 @@ func SettingScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
 				return
 			}
 
-			f, err := os.Create(filename)
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
-
-			defer f.Close()
-			encoder := gob.NewEncoder(f)
-			err = encoder.Encode(c.SavedNetworkState())
+			err = c.SaveState(filename)
 			if err != nil {
 				dialog.ShowError(err, w)
 				return
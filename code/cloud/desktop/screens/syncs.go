@@ -0,0 +1,104 @@
+package screens
+
+import (
+	"cloud/network"
+	"fmt"
+	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/layout"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"time"
+)
+
+// syncsRefreshInterval is how often the status of the syncs is updated.
+const syncsRefreshInterval = 2 * time.Second
+
+// conflictsList lists the sync conflicts that happened while the app is running.
+var conflictsList *widget.Box
+
+// conflictText describes the sync conflict.
+func conflictText(c network.Cloud, conflict network.SyncConflict) string {
+	from := conflict.NodeID
+	if n, ok := c.NodeByID(conflict.NodeID); ok && n.Name != "" {
+		from = n.Name
+	}
+	return fmt.Sprintf("%s: %s was edited on %s at the same time, their edit was kept as %s.",
+		conflict.Time.Format("2006-01-02 15:04:05"), conflict.Path, from, conflict.CopyPath)
+}
+
+func syncsEventSyncConflict(w fyne.Window, c network.Cloud, conflict network.SyncConflict) {
+	text := conflictText(c, conflict)
+	if conflictsList != nil {
+		conflictsList.Append(widget.NewLabel(text))
+	}
+	dialog.ShowInformation("Sync conflict", text, w)
+}
+
+func syncEntry(w fyne.Window, c network.Cloud, status network.SyncStatus, refresh func()) fyne.CanvasObject {
+	kind := "File"
+	if status.Folder {
+		kind = "Folder"
+	}
+	text := fmt.Sprintf("%s %s <-> %s: %v", kind, status.CloudPath, status.LocalPath, status.State)
+	if status.PendingUploads > 0 || status.PendingDownloads > 0 {
+		text += fmt.Sprintf(" (%d uploads, %d downloads)", status.PendingUploads, status.PendingDownloads)
+	}
+	if status.Error != "" {
+		text += " - " + status.Error
+	}
+
+	act := func(action func(localPath string) error) func() {
+		return func() {
+			if err := action(status.LocalPath); err != nil {
+				dialog.ShowError(err, w)
+			}
+			refresh()
+		}
+	}
+	var toggle *widget.Button
+	if status.State == network.SyncPaused {
+		toggle = widget.NewButtonWithIcon("Resume", theme.MediaPlayIcon(), act(c.ResumeSync))
+	} else {
+		toggle = widget.NewButtonWithIcon("Pause", theme.MediaPauseIcon(), act(c.PauseSync))
+	}
+	remove := widget.NewButtonWithIcon("Remove", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Remove sync", "Stop syncing "+status.LocalPath+"? The files are kept.", func(ok bool) {
+			if ok {
+				act(c.RemoveSync)()
+			}
+		}, w)
+	})
+
+	return widget.NewHBox(widget.NewLabel(text), layout.NewSpacer(), toggle, remove)
+}
+
+func SyncsScreen(w fyne.Window, c network.Cloud) fyne.CanvasObject {
+	list := widget.NewVBox()
+	var refresh func()
+	refresh = func() {
+		list.Children = nil
+		for _, status := range c.Syncs() {
+			list.Append(syncEntry(w, c, status, refresh))
+		}
+		if len(list.Children) == 0 {
+			list.Append(widget.NewLabel("No files or folders are synced."))
+		}
+		list.Refresh()
+	}
+	refresh()
+
+	go func() {
+		for range time.Tick(syncsRefreshInterval) {
+			refresh()
+		}
+	}()
+
+	conflictsList = widget.NewVBox()
+	return widget.NewVBox(
+		list,
+		fyne.NewContainerWithLayout(layout.NewCenterLayout(),
+			widget.NewButtonWithIcon("Refresh", theme.ViewRefreshIcon(), refresh)),
+		widget.NewGroup("Conflicts", conflictsList),
+	)
+}
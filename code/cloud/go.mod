@@ -17,4 +17,5 @@ require (
 	github.com/sqweek/dialog v0.0.0-20200304031853-0dcd55bfe06a
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	golang.org/x/sys v0.0.0-20200302150141-5c8b2ff67527 // indirect
+	golang.org/x/text v0.3.0
 )
@@ -6,13 +6,11 @@ import (
 	"cloud/network"
 	"cloud/utils"
 	"cloud/webapp"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	_ "github.com/joho/godotenv/autoload" // automatically load environment variables from .env file
+	"golang.org/x/crypto/ssh/terminal"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -22,25 +20,193 @@ import (
 	"time"
 )
 
-func readKey(file string) (*rsa.PrivateKey, error) {
-	b, err := ioutil.ReadFile(file)
+// readPassphrase reads the passphrase from the file, or prompts for it on the terminal if no file is given.
+func readPassphrase(file string, prompt string) ([]byte, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	fmt.Print(prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return passphrase, err
+}
+
+// genKeyCommand generates a new private key, encrypted with a passphrase unless it is left empty.
+func genKeyCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: cloud genkey <key file>")
+		return
+	}
+	passphrase, err := readPassphrase("", "Passphrase (empty for none): ")
 	if err != nil {
-		return nil, err
+		fmt.Println("Error while reading passphrase:", err)
+		return
 	}
+	if len(passphrase) != 0 {
+		confirm, err := readPassphrase("", "Repeat passphrase: ")
+		if err != nil {
+			fmt.Println("Error while reading passphrase:", err)
+			return
+		}
+		if string(confirm) != string(passphrase) {
+			fmt.Println("Passphrases do not match.")
+			return
+		}
+	}
+	key, err := network.GeneratePrivateKey()
+	if err != nil {
+		fmt.Println("Error while generating key:", err)
+		return
+	}
+	if err := network.WritePrivateKey(args[0], key, passphrase); err != nil {
+		fmt.Println("Error while writing key:", err)
+		return
+	}
+	id, _ := network.PublicKeyToID(&key.PublicKey)
+	fmt.Println("ID:", id)
+}
 
-	bb, _ := pem.Decode(b)
-	if bb.Type != "RSA PRIVATE KEY" {
-		return nil, errors.New("invalid type " + bb.Type + " want: RSA PRIVATE KEY")
+// stateFileCommand runs the inspect and upgrade commands on a state file.
+func stateFileCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: cloud inspect|upgrade <save file>")
+		return
+	}
+	var passphrase []byte
+	if encrypted, err := network.IsStateFileEncrypted(args[1]); err == nil && encrypted {
+		passphrase, err = readPassphrase("", "Save file passphrase: ")
+		if err != nil {
+			fmt.Println("Error while reading passphrase:", err)
+			return
+		}
+	}
+	if args[0] == "upgrade" {
+		version, err := network.UpgradeStateFile(args[1], passphrase)
+		if err != nil {
+			fmt.Println("Error while upgrading save file:", err)
+			return
+		}
+		fmt.Printf("Upgraded save file from version %d to %d.\n", version, network.CurrentStateVersion)
+		return
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(bb.Bytes)
+	info, err := network.InspectStateFile(args[1], passphrase)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error while reading save file:", err)
+		return
+	}
+	s := info.State
+	fmt.Printf("Version: %d (current: %d) | Encrypted: %v\n", info.Version, network.CurrentStateVersion, info.Encrypted)
+	fmt.Printf("Network: %s | Nodes: %d | Chunks: %d\n", s.Network.Name, len(s.Network.Nodes), len(s.Network.ChunkNodes))
+	fmt.Printf("My node: %v (%v)\n", s.MyNode.Name, s.MyNode.ID)
+	fmt.Printf("File storage dir: %v | Capacity: %d\n", s.Config.FileStorageDir, s.Config.FileStorageCapacity)
+	fmt.Println("Nodes:")
+	for _, n := range s.Network.Nodes {
+		fmt.Printf("|%-20v|%-20v|%-20v|\n", n.Name, n.ID, n.IP)
+	}
+	fmt.Println("Stored files:")
+	for cloudPath, store := range s.FileStorage {
+		fmt.Printf("%v: %T\n", cloudPath, store)
+	}
+	for _, f := range s.FolderSyncs {
+		fmt.Printf("Folder sync: %v -> %v\n", f.CloudPath, f.LocalPath)
+	}
+}
+
+// printSyncPlan prints what a sync would do with each file, and how many files each action applies to.
+func printSyncPlan(plan network.SyncPlan) {
+	for _, a := range plan.Actions {
+		fmt.Printf("%-8v %v <-> %v\n", a.Op, a.CloudPath, a.LocalPath)
+	}
+	fmt.Printf("Upload: %d | Download: %d | Conflict: %d | Unchanged: %d\n", plan.Count(network.ReconcileUpload),
+		plan.Count(network.ReconcileDownload), plan.Count(network.ReconcileConflict), plan.Count(network.ReconcileSkip))
+}
+
+// parseFindCommand parses the arguments of the find command into a search query. Dates are either in RFC 3339 format
+// or a day, like 2006-01-02.
+func parseFindCommand(args []string) (network.SearchQuery, error) {
+	query := network.SearchQuery{}
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&query.Name, "name", "", "")
+	fs.StringVar(&query.Glob, "glob", "", "")
+	fs.StringVar(&query.Regex, "regex", "", "")
+	fs.StringVar(&query.Folder, "in", "", "")
+	fs.StringVar(&query.ContentType, "type", "", "")
+	fs.Uint64Var(&query.MinSize, "minsize", 0, "")
+	fs.Uint64Var(&query.MaxSize, "maxsize", 0, "")
+	after := fs.String("after", "", "")
+	before := fs.String("before", "", "")
+	page := fs.Int("page", 1, "")
+	fs.IntVar(&query.Limit, "limit", 50, "")
+	if err := fs.Parse(args); err != nil {
+		return query, err
+	}
+	if fs.NArg() != 0 {
+		return query, errors.New("unexpected arguments: " + strings.Join(fs.Args(), " "))
+	}
+	for _, d := range []struct {
+		value string
+		t     *time.Time
+	}{{*after, &query.ModifiedAfter}, {*before, &query.ModifiedBefore}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, d.value)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", d.value, time.Local); err != nil {
+				return query, err
+			}
+		}
+		*d.t = t
+	}
+	if *page < 1 {
+		return query, errors.New("page must be at least 1")
+	}
+	query.Offset = (*page - 1) * query.Limit
+	return query, nil
+}
+
+// parseMetadata parses user metadata given as key=value pairs.
+func parseMetadata(pairs []string) (map[string]string, error) {
+	metadata := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return nil, errors.New("expected key=value, got " + pair)
+		}
+		metadata[pair[:i]] = pair[i+1:]
 	}
-	return key, nil
+	return metadata, nil
+}
+
+// lockedTransfer moves or copies a file or directory on the cloud, holding the locks of both paths.
+func lockedTransfer(c network.Cloud, from, to string, transfer func(from, to string) error) error {
+	if !c.LockFile(from) {
+		return errors.New("could not acquire lock on " + from)
+	}
+	defer c.UnlockFile(from)
+	if !c.LockFile(to) {
+		return errors.New("could not acquire lock on " + to)
+	}
+	defer c.UnlockFile(to)
+	return transfer(from, to)
 }
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "inspect" || os.Args[1] == "upgrade") {
+		stateFileCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "genkey" {
+		genKeyCommand(os.Args[2:])
+		return
+	}
+
 	networkPtr := flag.String("network", "new", "Bootstrap IP of a node in an existing network or 'new' to create new network.")
 	networkNamePtr := flag.String("network-name", "New Network", "The name of the network, if creating a new one.")
 	networkSecurePtr := flag.Bool("secure", true, "Enable authentication for the network.")
@@ -50,6 +216,7 @@ func main() {
 
 	namePtr := flag.String("name", "", "Name of the node. Use for easy identification.")
 	privateKeyPtr := flag.String("key", "", "Path to private key.")
+	passphraseFilePtr := flag.String("passphrase-file", "", "File containing the passphrase of the private key and the save file. Prompted for if needed and not set.")
 	ipPtr := flag.String("ip", "", "Remote IP to override source IP address when connecting to local nodes.")
 	portPtr := flag.Int("port", 9000, "Port to listen on.")
 
@@ -60,6 +227,8 @@ func main() {
 	fileStorageDirPtr := flag.String("file-storage-dir", "", "Directory where cloud files should be stored on the node.")
 	fileStorageCapacityPtr := flag.Int64("file-storage-capacity", 0, "Storage space in bytes allocated for file storage.")
 	fileChunkSizePtr := flag.Int("file-chunk-size", 10*1e+7, "Chunk size in bytes used for file splitting (default 10 megabytes)")
+	watchPtr := flag.String("watch", "auto", "How synced files are watched. One of: auto, notify, poll. Use poll on network file systems.")
+	pollIntervalPtr := flag.Duration("poll-interval", 2*time.Second, "How often polled synced files are checked for changes.")
 
 	logDirPtr := flag.String("log-dir", "", "The directory where logs should be written to.")
 	logLevelPtr := flag.String("log-level", "WARN", fmt.Sprintf("The level of logging. One of: %v.", utils.LogLevels))
@@ -90,8 +259,21 @@ func main() {
 		fmt.Println("Network Name:", *networkNamePtr)
 	}
 
+	// A passphrase is needed if the key or the save file is encrypted. The save file is then kept encrypted.
+	var passphrase []byte
+	var err error
+	keyEncrypted, _ := network.IsPrivateKeyEncrypted(*privateKeyPtr)
+	stateEncrypted, _ := network.IsStateFileEncrypted(*saveFilePtr)
+	if *passphraseFilePtr != "" || keyEncrypted || stateEncrypted {
+		passphrase, err = readPassphrase(*passphraseFilePtr, "Passphrase: ")
+		if err != nil {
+			fmt.Println("Error while reading passphrase:", err)
+			return
+		}
+	}
+
 	// Read the key.
-	key, err := readKey(*privateKeyPtr)
+	key, err := network.ReadPrivateKey(*privateKeyPtr, passphrase)
 	if err != nil {
 		fmt.Println("Error while parsing key:", err)
 		return
@@ -136,7 +318,18 @@ func main() {
 	utils.GetLogger().Printf("[INFO] My node: %v.", me)
 
 	var c network.Cloud
-	if *networkPtr == "new" {
+	loaded := false
+	if _, err := os.Stat(*saveFilePtr); *saveFilePtr != "" && err == nil {
+		utils.GetLogger().Println("[INFO] Resuming from save file.")
+		s, err := network.ReadStateFile(*saveFilePtr, passphrase)
+		if err != nil {
+			fmt.Println("Error while reading save file:", err)
+			return
+		}
+		s.Config.SaveFile = *saveFilePtr
+		c = network.LoadNetwork(s)
+		loaded = true
+	} else if *networkPtr == "new" {
 		c = network.SetupNetwork(network.Network{
 			Name:        *networkNamePtr,
 			Whitelist:   *networkWhitelistPtr,
@@ -155,11 +348,26 @@ func main() {
 		utils.GetLogger().Printf("[INFO] Bootstrapped cloud: %v.", c)
 	}
 
-	c.SetConfig(network.CloudConfig{
-		FileStorageDir:      *fileStorageDirPtr,
-		FileStorageCapacity: *fileStorageCapacityPtr,
-		FileChunkSize:       *fileChunkSizePtr,
-	})
+	if !loaded {
+		watchMode := network.WatchAuto
+		switch *watchPtr {
+		case "notify":
+			watchMode = network.WatchNotify
+		case "poll":
+			watchMode = network.WatchPoll
+		}
+		c.SetConfig(network.CloudConfig{
+			FileStorageDir:      *fileStorageDirPtr,
+			FileStorageCapacity: *fileStorageCapacityPtr,
+			FileChunkSize:       *fileChunkSizePtr,
+			SaveFile:            *saveFilePtr,
+			WatchMode:           watchMode,
+			PollInterval:        *pollIntervalPtr,
+		})
+	}
+	if len(passphrase) != 0 {
+		c.SetStatePassphrase(passphrase)
+	}
 
 	if *networkWhitelistFilePtr != "" {
 		r, err := os.Open(*networkWhitelistFilePtr)
@@ -263,21 +471,160 @@ func main() {
 		text = strings.TrimSpace(text)
 		cmd := strings.Split(text, " ")
 		if cmd[0] == "syncfolder" {
-			if len(cmd) == 3 {
+			if len(cmd) == 4 && cmd[3] == "-n" {
+				plan, err := c.PlanSyncFolder(cmd[1], cmd[2])
+				if err != nil {
+					fmt.Println("PlanSyncFolder err: ", err)
+					continue
+				}
+				printSyncPlan(plan)
+			} else if len(cmd) == 4 && cmd[3] == "-p" {
+				fmt.Println("Syncing cloud:", cmd[1], "to local folder:", cmd[2], "with placeholders")
+				err := c.SyncFolderWithOptions(cmd[1], cmd[2], network.SyncOptions{Placeholders: true})
+				if err != nil {
+					fmt.Println("SyncFolderWithOptions err: ", err)
+				}
+			} else if len(cmd) == 3 {
 				fmt.Println("Syncing cloud:", cmd[1], "to local folder:", cmd[2])
 				err := c.SyncFolder(cmd[1], cmd[2])
 				if err != nil {
 					fmt.Println("SyncFolder err: ", err)
 				}
 			} else {
-				fmt.Println("Usage: syncfolder <cloud folder> <local folder>")
+				fmt.Println("Usage: syncfolder <cloud folder> <local folder> [-n | -p]")
+			}
+		}
+		if cmd[0] == "syncignore" {
+			if len(cmd) < 2 {
+				fmt.Println("Usage: syncignore <local folder> [pattern...]")
+				continue
+			}
+			if err := c.SetSyncIgnore(cmd[1], cmd[2:]); err != nil {
+				fmt.Println("SetSyncIgnore err: ", err)
+			}
+		}
+		if cmd[0] == "ignored" {
+			if len(cmd) != 2 {
+				fmt.Println("Usage: ignored <local folder>")
+				continue
+			}
+			ignored, err := c.IgnoredPaths(cmd[1])
+			if err != nil {
+				fmt.Println("IgnoredPaths err: ", err)
+				continue
+			}
+			for _, p := range ignored {
+				fmt.Println(p)
+			}
+			fmt.Printf("%d paths ignored.\n", len(ignored))
+		}
+		if cmd[0] == "exclude" || cmd[0] == "include" {
+			if len(cmd) != 3 {
+				fmt.Println("Usage:", cmd[0], "<local folder> <cloud folder>")
+				continue
+			}
+			var err error
+			if cmd[0] == "exclude" {
+				err = c.ExcludeFolder(cmd[1], cmd[2])
+			} else {
+				err = c.IncludeFolder(cmd[1], cmd[2])
+			}
+			if err != nil {
+				fmt.Println(cmd[0], "err: ", err)
+			}
+		}
+		if cmd[0] == "placeholders" {
+			if len(cmd) != 3 || cmd[2] != "on" && cmd[2] != "off" {
+				fmt.Println("Usage: placeholders <local folder> [on, off]")
+				continue
+			}
+			if err := c.SetSyncPlaceholders(cmd[1], cmd[2] == "on"); err != nil {
+				fmt.Println("SetSyncPlaceholders err: ", err)
+			}
+		}
+		if cmd[0] == "hydrate" {
+			if len(cmd) != 2 {
+				fmt.Println("Usage: hydrate <local path>")
+				continue
+			}
+			if err := c.HydrateFile(cmd[1]); err != nil {
+				fmt.Println("HydrateFile err: ", err)
+			}
+		}
+		if cmd[0] == "syncs" {
+			for _, status := range c.Syncs() {
+				kind := "file"
+				if status.Folder {
+					kind = "folder"
+				}
+				fmt.Printf("%v %v <-> %v: %v, %d uploads, %d downloads pending.\n", kind, status.CloudPath,
+					status.LocalPath, status.State, status.PendingUploads, status.PendingDownloads)
+				if status.Error != "" {
+					fmt.Println("  last error:", status.Error)
+				}
+			}
+		}
+		if cmd[0] == "sync" {
+			if len(cmd) != 3 {
+				fmt.Println("Usage: sync [pause, resume, remove] <local path>")
+				continue
+			}
+			var err error
+			switch cmd[1] {
+			case "pause":
+				err = c.PauseSync(cmd[2])
+			case "resume":
+				err = c.ResumeSync(cmd[2])
+			case "remove":
+				err = c.RemoveSync(cmd[2])
+			default:
+				fmt.Println("Usage: sync [pause, resume, remove] <local path>")
+				continue
+			}
+			if err != nil {
+				fmt.Println("sync", cmd[1], "err: ", err)
 			}
 		}
 		if cmd[0] == "dir" {
 			if len(cmd) == 1 {
-				fmt.Println("sub-commands available: [list, create]")
+				fmt.Println("sub-commands available: [list, create, delete, move, copy]")
 				continue
 			}
+			if cmd[1] == "delete" {
+				if len(cmd) != 3 && (len(cmd) != 4 || cmd[3] != "-r") {
+					fmt.Println("Usage: dir delete <cloud dir> [-r]")
+					continue
+				}
+				recursive := len(cmd) == 4
+				if recursive && !c.LockFile(cmd[2]) {
+					fmt.Println("Could not acquire lock on:", cmd[2])
+					continue
+				}
+				err := c.DeleteDirectory(cmd[2], recursive)
+				if recursive {
+					c.UnlockFile(cmd[2])
+				}
+				if err != nil {
+					fmt.Println("Directory Delete error:", err)
+				} else {
+					fmt.Println("Directory Deleted: ", cmd[2])
+				}
+			}
+			if cmd[1] == "move" || cmd[1] == "copy" {
+				if len(cmd) != 4 {
+					fmt.Println("Usage: dir " + cmd[1] + " <cloud dir> <new cloud dir>")
+					continue
+				}
+				transfer := c.MoveDirectory
+				if cmd[1] == "copy" {
+					transfer = c.CopyDirectory
+				}
+				if err := lockedTransfer(c, cmd[2], cmd[3], transfer); err != nil {
+					fmt.Println("Directory "+cmd[1]+" error:", err)
+				} else {
+					fmt.Println("Directory "+cmd[1]+":", cmd[2], "->", cmd[3])
+				}
+			}
 			if cmd[1] == "create" {
 				if len(cmd) != 3 {
 					fmt.Println("Usage: dir create <cloud dir>")
@@ -310,6 +657,202 @@ func main() {
 				}
 			}
 		}
+		if cmd[0] == "file" {
+			if len(cmd) != 4 || (cmd[1] != "move" && cmd[1] != "copy") {
+				fmt.Println("Usage: file move|copy <cloud file> <new cloud file>")
+				continue
+			}
+			transfer := c.MoveFile
+			if cmd[1] == "copy" {
+				transfer = c.CopyFile
+			}
+			if err := lockedTransfer(c, cmd[2], cmd[3], transfer); err != nil {
+				fmt.Println("File "+cmd[1]+" error:", err)
+			} else {
+				fmt.Println("File "+cmd[1]+":", cmd[2], "->", cmd[3])
+			}
+		}
+		if cmd[0] == "meta" {
+			if len(cmd) == 2 {
+				f, err := c.GetFile(cmd[1])
+				if err != nil {
+					fmt.Println("Meta error:", err)
+					continue
+				}
+				for k, v := range f.Metadata {
+					fmt.Println(k + "=" + v)
+				}
+				continue
+			}
+			if len(cmd) < 3 || (cmd[1] != "set" && cmd[1] != "clear") || (cmd[1] == "clear" && len(cmd) != 3) {
+				fmt.Println("Usage: meta <cloud file> | meta set <cloud file> [key=value...] | meta clear <cloud file>")
+				continue
+			}
+			metadata, err := parseMetadata(cmd[3:])
+			if err != nil {
+				fmt.Println("Meta error:", err)
+				continue
+			}
+			if !c.LockFile(cmd[2]) {
+				fmt.Println("Meta error: could not acquire lock on " + cmd[2])
+				continue
+			}
+			err = c.SetFileMetadata(cmd[2], metadata)
+			c.UnlockFile(cmd[2])
+			if err != nil {
+				fmt.Println("Meta error:", err)
+			} else {
+				fmt.Println("Meta "+cmd[1]+":", cmd[2])
+			}
+		}
+		if cmd[0] == "find" {
+			query, err := parseFindCommand(cmd[1:])
+			if err != nil {
+				fmt.Println("Usage: find [-name substring] [-glob pattern] [-regex expression] [-in folder] [-type mime type]")
+				fmt.Println("            [-minsize bytes] [-maxsize bytes] [-after date] [-before date] [-page n] [-limit n]")
+				fmt.Println(err)
+				continue
+			}
+			result, err := c.Search(query)
+			if err != nil {
+				fmt.Println("Search error:", err)
+				continue
+			}
+			for _, f := range result.Files {
+				fmt.Printf("%-60v %12d %-24v %v\n", f.Path, f.File.Size, f.File.ContentType,
+					f.File.Modified.Format(time.RFC3339))
+			}
+			fmt.Printf("Showing %d of %d files.\n", len(result.Files), result.Total)
+		}
+		if cmd[0] == "rebalance" {
+			if len(cmd) == 1 {
+				fmt.Println("sub-commands available: [status, plan, run]")
+				continue
+			}
+			if cmd[1] == "status" {
+				s := c.RebalanceStatus()
+				fmt.Printf("Running: %v | Dry run: %v | Planned: %d | Moved: %d | Failed: %d | Bytes moved: %d\n",
+					s.Running, s.DryRun, s.Planned, s.Moved, s.Failed, s.Bytes)
+				if s.Error != "" {
+					fmt.Println("Last error:", s.Error)
+				}
+			}
+			if cmd[1] == "plan" || cmd[1] == "run" {
+				var budget uint64
+				if len(cmd) == 3 {
+					budget, err = strconv.ParseUint(cmd[2], 10, 64)
+					if err != nil {
+						fmt.Println("Usage: rebalance " + cmd[1] + " [budget in bytes]")
+						continue
+					}
+				}
+				plan, err := c.Rebalance(budget, cmd[1] == "plan")
+				if err != nil {
+					fmt.Println("Rebalance error:", err)
+					continue
+				}
+				for _, n := range plan.Nodes {
+					fmt.Printf("|%-20v|%12d/%-12d|%6.1f%%|\n", n.ID, n.Used, n.Capacity, n.Fill()*100)
+				}
+				for _, m := range plan.Moves {
+					fmt.Printf("%v chunk %d (%d bytes): %v -> %v\n", m.CloudPath, m.Chunk.SequenceNumber,
+						m.Chunk.ContentSize, m.From, m.To)
+				}
+				fmt.Printf("Moves: %d | Bytes: %d\n", len(plan.Moves), plan.Bytes)
+			}
+		}
+		if cmd[0] == "gc" {
+			if len(cmd) == 1 || (cmd[1] != "plan" && cmd[1] != "run") {
+				fmt.Println("Usage: gc plan|run [grace period, e.g. 1h]")
+				continue
+			}
+			grace := network.DefaultGCGracePeriod
+			if len(cmd) == 3 {
+				grace, err = time.ParseDuration(cmd[2])
+				if err != nil {
+					fmt.Println("Usage: gc " + cmd[1] + " [grace period, e.g. 1h]")
+					continue
+				}
+			}
+			report, err := c.CollectGarbage(grace, cmd[1] == "plan")
+			if err != nil {
+				fmt.Println("GC error:", err)
+				continue
+			}
+			for _, p := range report.OrphanedStores {
+				fmt.Println("Orphaned store:", p)
+			}
+			for _, p := range report.OrphanedFiles {
+				fmt.Println("Orphaned chunk file:", p)
+			}
+			for _, chunkID := range report.StaleChunks {
+				fmt.Println("Stale chunk location:", chunkID)
+			}
+			fmt.Printf("Stores: %d | Files: %d | Chunk locations: %d | Bytes: %d\n", len(report.OrphanedStores),
+				len(report.OrphanedFiles), len(report.StaleChunks), report.Bytes)
+		}
+		if cmd[0] == "drain" {
+			if len(cmd) == 1 {
+				fmt.Println("Usage: drain <ID> | drain status <ID> | drain cancel <ID>")
+				continue
+			}
+			if cmd[1] == "status" {
+				if len(cmd) != 3 {
+					fmt.Println("Usage: drain status <ID>")
+					continue
+				}
+				s, ok := c.DrainStatus(cmd[2])
+				if !ok {
+					fmt.Println("No drain started for node:", cmd[2])
+					continue
+				}
+				fmt.Printf("State: %v | Chunks: %d | Migrated: %d | Failed: %d | Safe to remove: %v\n",
+					s.State, s.Chunks, s.Migrated, s.Failed, s.SafeToRemove)
+				if s.Error != "" {
+					fmt.Println("Last error:", s.Error)
+				}
+			} else if cmd[1] == "cancel" {
+				if len(cmd) != 3 {
+					fmt.Println("Usage: drain cancel <ID>")
+					continue
+				}
+				err := c.CancelDrain(cmd[2])
+				if err != nil {
+					fmt.Println("Drain cancel error:", err)
+				}
+			} else {
+				err := c.DrainNode(cmd[1])
+				if err != nil {
+					fmt.Println("Drain error:", err)
+				} else {
+					fmt.Println("Draining node:", cmd[1])
+				}
+			}
+		}
+		if cmd[0] == "rotatekey" {
+			if len(cmd) != 2 {
+				fmt.Println("Usage: rotatekey <new key file>")
+				continue
+			}
+			newKey, err := network.GeneratePrivateKey()
+			if err != nil {
+				fmt.Println("Error while generating key:", err)
+				continue
+			}
+			// Write the key before rotating, so that it can not be lost.
+			if err := network.WritePrivateKey(cmd[1], newKey, passphrase); err != nil {
+				fmt.Println("Error while writing key:", err)
+				continue
+			}
+			if err := c.RotateKey(newKey); err != nil {
+				fmt.Println("Key rotation error:", err)
+				continue
+			}
+			fmt.Println("Rotated key, the new key was written to:", cmd[1])
+			if *saveFilePtr == "" {
+				fmt.Println("Set a save file to keep the node's ID when restarting with the new key.")
+			}
+		}
 		if cmd[0] == "whitelist" {
 			if len(cmd) == 1 {
 				fmt.Println("sub-commands available: [list, add]")
@@ -331,5 +874,77 @@ func main() {
 				fmt.Println("Whitelist:", c.Whitelist())
 			}
 		}
+		if cmd[0] == "backup" {
+			if len(cmd) == 1 {
+				fmt.Println("sub-commands available: [list, add, remove, run, reports]")
+				continue
+			}
+			if cmd[1] == "list" {
+				for _, job := range c.BackupJobs() {
+					fmt.Printf("%v: %v -> %v, schedule %q, keep %d hourly, %d daily, %d weekly\n", job.Name,
+						job.LocalPath, job.CloudPath, job.Schedule, job.Retention.Hourly, job.Retention.Daily,
+						job.Retention.Weekly)
+				}
+			}
+			if cmd[1] == "add" {
+				if len(cmd) < 7 {
+					fmt.Println("Usage: backup add <name> <local dir> <cloud dir> <hourly>,<daily>,<weekly> <schedule>")
+					continue
+				}
+				var retention network.BackupRetention
+				_, err := fmt.Sscanf(cmd[5], "%d,%d,%d", &retention.Hourly, &retention.Daily, &retention.Weekly)
+				if err != nil {
+					fmt.Println("Invalid retention:", cmd[5])
+					continue
+				}
+				err = c.AddBackupJob(network.BackupJob{
+					Name:      cmd[2],
+					LocalPath: cmd[3],
+					CloudPath: cmd[4],
+					Schedule:  strings.Join(cmd[6:], " "),
+					Retention: retention,
+				})
+				if err != nil {
+					fmt.Println("Backup Add error:", err)
+				} else {
+					fmt.Println("Backup job added:", cmd[2])
+				}
+			}
+			if cmd[1] == "remove" {
+				if len(cmd) != 3 {
+					fmt.Println("Usage: backup remove <name>")
+					continue
+				}
+				if err := c.RemoveBackupJob(cmd[2]); err != nil {
+					fmt.Println("Backup Remove error:", err)
+				}
+			}
+			if cmd[1] == "run" || cmd[1] == "reports" {
+				if len(cmd) != 3 {
+					fmt.Println("Usage: backup", cmd[1], "<name>")
+					continue
+				}
+				reports := c.BackupReports(cmd[2])
+				if cmd[1] == "run" {
+					report, err := c.RunBackup(cmd[2])
+					if err != nil && report.Job == "" {
+						fmt.Println("Backup Run error:", err)
+						continue
+					}
+					reports = []network.BackupReport{report}
+				}
+				for _, report := range reports {
+					fmt.Printf("%v %v: %d uploaded (%d bytes), %d reused, %d failed, %d pruned, took %v\n",
+						report.Started.Format(time.RFC3339), report.Snapshot, report.Uploaded, report.UploadedBytes,
+						report.Reused, len(report.Failed), len(report.Pruned), report.Finished.Sub(report.Started))
+					for _, failed := range report.Failed {
+						fmt.Println("  failed:", failed)
+					}
+					if report.Error != "" {
+						fmt.Println("  error:", report.Error)
+					}
+				}
+			}
+		}
 	}
 }
@@ -3,7 +3,6 @@ package network
 import (
 	"cloud/utils"
 	"encoding/gob"
-	"fmt"
 	"strings"
 )
 
@@ -55,14 +54,14 @@ func (r request) OnAuthenticateRequest(ar AuthRequest) bool {
 	utils.GetLogger().Printf("[DEBUG] Updated context request node: %v.", r)
 
 	// Verify the ID belongs to the public key.
-	id, err := PublicKeyToID(r.FromNode.client.PublicKey())
+	r.Cloud.networkMutex.RLock()
+	err := r.Cloud.network.verifyNodeKey(node.ID, r.FromNode.client.PublicKey())
+	r.Cloud.networkMutex.RUnlock()
 	if err != nil {
+		utils.GetLogger().Printf("[WARN] Node %v failed key verification: %v.", node.ID, err)
 		return false
 	}
-	if id != node.ID {
-		fmt.Println("BAD KEY", id, node.ID)
-		return false
-	}
+	id := node.ID
 	r.FromNode.ID = id
 
 	// If whitelist is enabled, verify that the node is allowed to access it.
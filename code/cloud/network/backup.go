@@ -0,0 +1,575 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages used for backups.
+const (
+	ReuseChunksMsg = "ReuseChunks"
+)
+
+func init() {
+	handlers = append(handlers, createBackupRequestHandler)
+}
+
+func createBackupRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case ReuseChunksMsg:
+			return r.OnReuseChunksRequest
+		}
+		return nil
+	}
+}
+
+// backupSnapshotFormat is the name of the snapshot folders of backup jobs, the time the run started.
+const backupSnapshotFormat = "2006-01-02T15-04-05"
+
+// backupReportHistory is how many of the last reports are kept.
+const backupReportHistory = 50
+
+// BackupRetention is how many snapshots of a backup job are kept. The newest snapshot of each of the last Hourly
+// hours, Daily days and Weekly weeks that have snapshots is kept. The newest snapshot is always kept. If all are 0,
+// all snapshots are kept.
+type BackupRetention struct {
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+// BackupJob backs up a local folder to snapshots in a cloud folder on a schedule.
+type BackupJob struct {
+	Name      string
+	LocalPath string
+	// CloudPath is the cloud folder of the snapshots. Each run creates a snapshot folder named after its start time.
+	CloudPath string
+	// Schedule is a cron expression of when the job runs, in local time, like "0 3 * * *" or "@hourly".
+	Schedule  string
+	Retention BackupRetention
+}
+
+// BackupReport is the result of a run of a backup job.
+type BackupReport struct {
+	Job string
+	// Snapshot is the cloud folder of the snapshot.
+	Snapshot string
+	Started  time.Time
+	Finished time.Time
+	// Uploaded are the files that changed since the previous snapshot, or are new. Reused are the unchanged files,
+	// which are copied from the previous snapshot, so their chunks are not sent again.
+	Uploaded int
+	Reused   int
+	// UploadedBytes is the size of the chunks that were sent. Changed files reuse the chunks of their previous version.
+	UploadedBytes uint64
+	// Failed are the local files that could not be backed up, with the error.
+	Failed []string
+	// Pruned are the snapshots that were deleted by the retention.
+	Pruned []string
+	// Error is set if the run failed.
+	Error string
+}
+
+// backupScheduler runs the backup jobs of the config on their schedule.
+type backupScheduler struct {
+	timers  map[string]*time.Timer
+	running map[string]bool
+	reports []BackupReport
+	mutex   sync.Mutex
+}
+
+// validate checks that the job can be run.
+func (job BackupJob) validate() error {
+	if job.Name == "" {
+		return errors.New("backup job needs a name")
+	}
+	if _, err := parseSchedule(job.Schedule); err != nil {
+		return err
+	}
+	if job.Retention.Hourly < 0 || job.Retention.Daily < 0 || job.Retention.Weekly < 0 {
+		return errors.New("retention can not be negative")
+	}
+	info, err := os.Stat(job.LocalPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(job.LocalPath + " is not a directory")
+	}
+	return nil
+}
+
+// BackupJobs returns the backup jobs of the config.
+func (c *cloud) BackupJobs() []BackupJob {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	return append([]BackupJob(nil), c.config.BackupJobs...)
+}
+
+// backupJob returns the backup job with the name.
+func (c *cloud) backupJob(name string) (BackupJob, bool) {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	for _, job := range c.config.BackupJobs {
+		if job.Name == name {
+			return job, true
+		}
+	}
+	return BackupJob{}, false
+}
+
+// AddBackupJob adds the backup job to the config, and schedules it.
+func (c *cloud) AddBackupJob(job BackupJob) error {
+	job.CloudPath = CleanNetworkPath(job.CloudPath)
+	if err := job.validate(); err != nil {
+		return err
+	}
+	if _, ok := c.backupJob(job.Name); ok {
+		return errors.New("backup job " + job.Name + " already exists")
+	}
+	c.Mutex.Lock()
+	c.config.BackupJobs = append(c.config.BackupJobs, job)
+	c.Mutex.Unlock()
+	c.scheduleBackup(job.Name)
+	c.stateChanged()
+	return nil
+}
+
+// RemoveBackupJob removes the backup job from the config. Its snapshots are kept.
+func (c *cloud) RemoveBackupJob(name string) error {
+	c.Mutex.Lock()
+	found := false
+	jobs := make([]BackupJob, 0, len(c.config.BackupJobs))
+	for _, job := range c.config.BackupJobs {
+		if job.Name == name {
+			found = true
+		} else {
+			jobs = append(jobs, job)
+		}
+	}
+	c.config.BackupJobs = jobs
+	c.Mutex.Unlock()
+	if !found {
+		return errors.New("no backup job " + name)
+	}
+	c.backups.mutex.Lock()
+	if timer, ok := c.backups.timers[name]; ok {
+		timer.Stop()
+		delete(c.backups.timers, name)
+	}
+	c.backups.mutex.Unlock()
+	c.stateChanged()
+	return nil
+}
+
+// BackupReports returns the reports of the last runs of the backup job, oldest first.
+func (c *cloud) BackupReports(name string) []BackupReport {
+	c.backups.mutex.Lock()
+	defer c.backups.mutex.Unlock()
+	reports := make([]BackupReport, 0)
+	for _, report := range c.backups.reports {
+		if report.Job == name {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// stopBackups stops the scheduled runs of the backup jobs.
+func (c *cloud) stopBackups() {
+	c.backups.mutex.Lock()
+	defer c.backups.mutex.Unlock()
+	for name, timer := range c.backups.timers {
+		timer.Stop()
+		delete(c.backups.timers, name)
+	}
+}
+
+// scheduleBackups schedules the backup jobs of the config. Jobs that were scheduled before are rescheduled.
+func (c *cloud) scheduleBackups() {
+	c.stopBackups()
+	for _, job := range c.BackupJobs() {
+		c.scheduleBackup(job.Name)
+	}
+}
+
+// scheduleBackup schedules the next run of the backup job, unless the cloud is closed.
+func (c *cloud) scheduleBackup(name string) {
+	job, ok := c.backupJob(name)
+	if !ok {
+		return
+	}
+	s, err := parseSchedule(job.Schedule)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Backup job %v has an invalid schedule: %v.", name, err)
+		return
+	}
+	now := time.Now()
+	next := s.next(now)
+	if next.IsZero() {
+		return
+	}
+
+	c.backups.mutex.Lock()
+	defer c.backups.mutex.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	if c.backups.timers == nil {
+		c.backups.timers = make(map[string]*time.Timer)
+	}
+	if timer, ok := c.backups.timers[name]; ok {
+		timer.Stop()
+	}
+	c.backups.timers[name] = time.AfterFunc(next.Sub(now), func() {
+		if _, err := c.RunBackup(name); err != nil {
+			utils.GetLogger().Printf("[ERROR] Backup job %v: %v.", name, err)
+		}
+		c.scheduleBackup(name)
+	})
+}
+
+// backupSnapshots returns the start times of the snapshots of the backup job, newest first.
+func (c *cloud) backupSnapshots(job BackupJob) []time.Time {
+	c.networkMutex.RLock()
+	folders, _ := c.network.folderTree(job.CloudPath)
+	c.networkMutex.RUnlock()
+	snapshots := make([]time.Time, 0)
+	for _, folder := range folders {
+		if path.Dir(folder) != job.CloudPath {
+			continue
+		}
+		if t, err := time.ParseInLocation(backupSnapshotFormat, path.Base(folder), time.Local); err == nil {
+			snapshots = append(snapshots, t)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].After(snapshots[j])
+	})
+	return snapshots
+}
+
+// snapshotPath returns the cloud folder of the snapshot of the backup job.
+func snapshotPath(job BackupJob, t time.Time) string {
+	return path.Join(job.CloudPath, t.Format(backupSnapshotFormat))
+}
+
+// retainedSnapshots returns which of the snapshots, sorted newest first, the retention keeps.
+func retainedSnapshots(snapshots []time.Time, r BackupRetention) []bool {
+	keep := make([]bool, len(snapshots))
+	if r.Hourly == 0 && r.Daily == 0 && r.Weekly == 0 {
+		for i := range keep {
+			keep[i] = true
+		}
+		return keep
+	}
+	if len(snapshots) > 0 {
+		keep[0] = true
+	}
+	periods := []struct {
+		count  int
+		bucket func(t time.Time) string
+	}{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for i, t := range snapshots {
+			if len(seen) == period.count {
+				break
+			}
+			if b := period.bucket(t); !seen[b] {
+				seen[b] = true
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// RunBackup runs the backup job now, and returns its report. Files that did not change since the previous snapshot
+// reuse its chunks. Snapshots that the retention does not keep are deleted afterwards.
+func (c *cloud) RunBackup(name string) (BackupReport, error) {
+	job, ok := c.backupJob(name)
+	if !ok {
+		return BackupReport{}, errors.New("no backup job " + name)
+	}
+	c.backups.mutex.Lock()
+	if c.backups.running[name] {
+		c.backups.mutex.Unlock()
+		return BackupReport{}, errors.New("backup job " + name + " is already running")
+	}
+	if c.backups.running == nil {
+		c.backups.running = make(map[string]bool)
+	}
+	c.backups.running[name] = true
+	c.backups.mutex.Unlock()
+
+	report := c.runBackup(job)
+	utils.GetLogger().Printf("[INFO] Backup job %v: snapshot %v, %d uploaded (%d bytes), %d reused, %d failed, %d pruned.",
+		name, report.Snapshot, report.Uploaded, report.UploadedBytes, report.Reused, len(report.Failed),
+		len(report.Pruned))
+
+	c.backups.mutex.Lock()
+	delete(c.backups.running, name)
+	c.backups.reports = append(c.backups.reports, report)
+	if len(c.backups.reports) > backupReportHistory {
+		c.backups.reports = c.backups.reports[len(c.backups.reports)-backupReportHistory:]
+	}
+	c.backups.mutex.Unlock()
+	if report.Error != "" {
+		return report, errors.New(report.Error)
+	}
+	return report, nil
+}
+
+func (c *cloud) runBackup(job BackupJob) BackupReport {
+	report := BackupReport{Job: job.Name, Started: time.Now()}
+	defer func() {
+		report.Finished = time.Now()
+	}()
+
+	snapshots := c.backupSnapshots(job)
+	started := report.Started.Truncate(time.Second)
+	if len(snapshots) > 0 && !started.After(snapshots[0]) {
+		report.Error = "a newer snapshot already exists"
+		return report
+	}
+	report.Snapshot = snapshotPath(job, started)
+	previous := ""
+	if len(snapshots) > 0 {
+		previous = snapshotPath(job, snapshots[0])
+	}
+
+	chunkSize := c.config.FileChunkSize
+	if chunkSize <= 0 {
+		chunkSize = syncChunkSize
+	}
+	err := filepath.Walk(job.LocalPath, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.Failed = append(report.Failed, localPath+": "+err.Error())
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(job.LocalPath, localPath)
+		if err != nil {
+			return err
+		}
+		cloudPath := CleanNetworkPath(path.Join(report.Snapshot, filepath.ToSlash(relPath)))
+		if info.IsDir() {
+			return c.CreateDirectory(cloudPath)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		reused, size, err := c.backupFile(cloudPath, localPath, previous, relPath, chunkSize)
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, localPath+": "+err.Error())
+		case reused:
+			report.Reused++
+		default:
+			report.Uploaded++
+			report.UploadedBytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	snapshots = append([]time.Time{started}, snapshots...)
+	keep := retainedSnapshots(snapshots, job.Retention)
+	for i, t := range snapshots {
+		if keep[i] {
+			continue
+		}
+		snapshot := snapshotPath(job, t)
+		if !c.LockFile(snapshot) {
+			c.UnlockFile(snapshot)
+			report.Failed = append(report.Failed, snapshot+": could not lock the snapshot to prune it")
+			continue
+		}
+		if err := c.DeleteDirectory(snapshot, true); err != nil {
+			report.Failed = append(report.Failed, snapshot+": "+err.Error())
+		} else {
+			report.Pruned = append(report.Pruned, snapshot)
+		}
+		c.UnlockFile(snapshot)
+	}
+	return report
+}
+
+// backupFile adds the local file to the snapshot. If the previous snapshot has the same version of the file, it is
+// copied from there. Returns whether it was copied, and the size that was uploaded.
+func (c *cloud) backupFile(cloudPath, localPath, previous, relPath string, chunkSize int) (bool, uint64, error) {
+	var prev *datastore.File
+	prevPath := CleanNetworkPath(path.Join(previous, filepath.ToSlash(relPath)))
+	if previous != "" {
+		c.networkMutex.RLock()
+		if c.network.folderExists(path.Dir(prevPath)) {
+			prev, _ = c.network.GetFile(prevPath)
+		}
+		c.networkMutex.RUnlock()
+	}
+	// Files are chunked like their previous version, so that unchanged files have the same ID.
+	if prev != nil {
+		chunkSize = prev.Chunks.ChunkSize
+	}
+	file, err := readLocalFile(localPath, chunkSize)
+	if err != nil {
+		return false, 0, err
+	}
+	if file == nil {
+		return false, 0, errors.New("file was removed")
+	}
+	if prev == nil {
+		return false, file.Size, c.AddFile(file, cloudPath, localPath)
+	}
+
+	if !c.LockFile(prevPath) || !c.LockFile(cloudPath) {
+		c.UnlockFile(prevPath)
+		c.UnlockFile(cloudPath)
+		return false, 0, errors.New("could not lock " + cloudPath)
+	}
+	defer c.UnlockFile(prevPath)
+	defer c.UnlockFile(cloudPath)
+	if file.ID != prev.ID {
+		size, err := c.addChangedFile(file, cloudPath, localPath, prevPath, prev)
+		return false, size, err
+	}
+	return true, 0, c.CopyFile(prevPath, cloudPath)
+}
+
+// addChangedFile adds the local file, a changed version of the file at prevPath. The nodes reuse the chunks they hold
+// of the previous version, only the chunks it does not have are distributed. Returns the size of the distributed
+// chunks. File lock must be acquired for both paths.
+func (c *cloud) addChangedFile(file *datastore.File, cloudPath, localPath, prevPath string,
+	prev *datastore.File) (uint64, error) {
+	storage := &datastore.PartialFileStore{
+		BaseFileStore: datastore.BaseFileStore{
+			FileID: file.ID,
+			Chunks: file.Chunks.Chunks,
+		},
+		FolderPath: c.config.FileStorageDir,
+	}
+	c.fileStorageMutex.Lock()
+	c.fileStorage[cloudPath] = storage
+	c.fileStorageMutex.Unlock()
+	if err := c.AddFileMetadata(file, cloudPath); err != nil {
+		c.fileStorageMutex.Lock()
+		if c.fileStorage[cloudPath] == storage {
+			delete(c.fileStorage, cloudPath)
+		}
+		c.fileStorageMutex.Unlock()
+		return 0, err
+	}
+	if _, err := c.SendMessageToMe(ReuseChunksMsg, prevPath, cloudPath); err != nil {
+		return 0, err
+	}
+	for _, r := range c.SendMessageAllOthers(ReuseChunksMsg, prevPath, cloudPath) {
+		if r.Error != nil {
+			utils.GetLogger().Printf("[WARN] Node %v could not reuse the chunks of %v: %v.", r.Node.ID, prevPath, r.Error)
+		}
+	}
+
+	// The original copy is always kept, even if it goes over the node's capacity.
+	reused := make(map[datastore.ChunkID]bool)
+	for _, chunk := range prev.Chunks.Chunks {
+		reused[chunk.ID] = true
+	}
+	whole := &datastore.FullFileStore{
+		BaseFileStore: datastore.BaseFileStore{
+			FileID: file.ID,
+			Chunks: file.Chunks.Chunks,
+		},
+		FilePath: localPath,
+	}
+	var uploaded uint64
+	distributed := make(map[datastore.ChunkID]bool)
+	for _, chunk := range file.Chunks.Chunks {
+		if storage.StoredChunkSize(chunk.ID) == 0 {
+			content, err := whole.ReadChunk(chunk.ID)
+			if err != nil {
+				return uploaded, err
+			}
+			if err := storage.StoreChunk(chunk.ID, content); err != nil {
+				return uploaded, err
+			}
+			c.accountStorage(uint64(len(content)))
+			if reused[chunk.ID] {
+				c.updateChunkNodes(chunk.ID, c.MyNode().ID)
+			}
+		}
+		if reused[chunk.ID] || distributed[chunk.ID] {
+			continue
+		}
+		distributed[chunk.ID] = true
+		if err := c.DistributeChunk(cloudPath, storage, chunk.ID); err != nil {
+			return uploaded, err
+		}
+		uploaded += chunk.ContentSize
+	}
+	return uploaded, nil
+}
+
+// OnReuseChunksRequest stores the chunks of the file that this node holds for the file at prevPath, the previous
+// version of the file.
+func (r request) OnReuseChunksRequest(prevPath, cloudPath string) error {
+	defer r.Cloud.stateChanged()
+	c := r.Cloud
+	c.fileStorageMutex.RLock()
+	prev := c.fileStorage[prevPath]
+	storage, isPartial := c.fileStorage[cloudPath].(*datastore.PartialFileStore)
+	c.fileStorageMutex.RUnlock()
+	if prev == nil || !isPartial {
+		return nil
+	}
+
+	// Chunk files are hard linked when possible, so they do not take up more space.
+	prevPartial, prevIsPartial := prev.(*datastore.PartialFileStore)
+	for _, chunk := range storage.Chunks {
+		if !prev.HasChunk(chunk.ID) || storage.StoredChunkSize(chunk.ID) != 0 {
+			continue
+		}
+		if !prevIsPartial || !storage.LinkChunk(prevPartial, chunk.ID) {
+			content, err := prev.ReadChunk(chunk.ID)
+			if os.IsNotExist(err) {
+				// Partial file stores only hold some of the chunks.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := c.storeChunk(storage, chunk.ID, content); err != nil {
+				return err
+			}
+		}
+		c.updateChunkNodes(chunk.ID, c.MyNode().ID)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"cloud/utils"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetainedSnapshots(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	// 2020-01-08 is a Wednesday, 2020-01-01 is in the previous week.
+	snapshots := []time.Time{at(8, 12, 10), at(8, 12, 0), at(8, 11, 0), at(8, 10, 0), at(7, 12, 0), at(1, 12, 0),
+		at(-6, 12, 0)}
+	tests := []struct {
+		retention BackupRetention
+		keep      []bool
+	}{
+		{BackupRetention{}, []bool{true, true, true, true, true, true, true}},
+		{BackupRetention{Hourly: 1}, []bool{true, false, false, false, false, false, false}},
+		{BackupRetention{Hourly: 2, Daily: 2, Weekly: 2}, []bool{true, false, true, false, true, true, false}},
+		{BackupRetention{Weekly: 5}, []bool{true, false, false, false, false, true, true}},
+	}
+	for _, test := range tests {
+		if keep := retainedSnapshots(snapshots, test.retention); !reflect.DeepEqual(keep, test.keep) {
+			t.Errorf("Expected %+v to keep %v, got %v.", test.retention, test.keep, keep)
+		}
+	}
+}
+
+func TestBackupJob(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_backup_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	localDir := dirs[1]
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "unchanged", "s/b.txt": "first version"})
+
+	job := BackupJob{
+		Name:      "docs",
+		LocalPath: localDir,
+		CloudPath: "/backups/docs",
+		Schedule:  "@daily",
+		Retention: BackupRetention{Hourly: 1},
+	}
+	if err := c.AddBackupJob(BackupJob{Name: "bad", LocalPath: localDir, Schedule: "* *"}); err == nil {
+		t.Error("Added a backup job with an invalid schedule.")
+	}
+	if err := c.AddBackupJob(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddBackupJob(job); err == nil {
+		t.Error("Added a backup job twice.")
+	}
+
+	first, err := c.RunBackup("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Uploaded != 2 || first.Reused != 0 || len(first.Failed) != 0 {
+		t.Errorf("Expected 2 uploaded files in the first snapshot, got %+v.", first)
+	}
+
+	// Snapshots are named after the second they started in.
+	time.Sleep(time.Until(first.Started.Truncate(time.Second).Add(time.Second)))
+	writeTestFiles(t, localDir, map[string]string{"s/b.txt": "second version"})
+	second, err := c.RunBackup("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Uploaded != 1 || second.Reused != 1 || second.UploadedBytes != uint64(len("second version")) {
+		t.Errorf("Expected the unchanged file to be reused, got %+v.", second)
+	}
+	for name, size := range map[string]int{"a.txt": len("unchanged"), "s/b.txt": len("second version")} {
+		f, err := c.GetFile(path.Join(second.Snapshot, name))
+		if err != nil || f.Size != uint64(size) {
+			t.Errorf("Snapshot of %v has %+v, %v.", name, f, err)
+		}
+	}
+	if !reflect.DeepEqual(second.Pruned, []string{first.Snapshot}) {
+		t.Errorf("Expected the first snapshot to be pruned, got %v.", second.Pruned)
+	}
+	if snapshots := c.backupSnapshots(job); len(snapshots) != 1 || snapshotPath(job, snapshots[0]) != second.Snapshot {
+		t.Errorf("Expected only the second snapshot, got %v.", snapshots)
+	}
+	if reports := c.BackupReports("docs"); len(reports) != 2 || reports[1].Snapshot != second.Snapshot {
+		t.Errorf("Expected the reports of both runs, got %+v.", reports)
+	}
+
+	if err := c.RemoveBackupJob("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.BackupJobs()) != 0 {
+		t.Error("Backup job was not removed.")
+	}
+	if _, err := c.RunBackup("docs"); err == nil {
+		t.Error("Ran a removed backup job.")
+	}
+}
+
+func TestBackupReusesChunks(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_backup_chunks_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0], FileChunkSize: 10})
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1]})
+	localDir := dirs[2]
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "0123456789abcdefghijKLMNOPQRST"})
+
+	job := BackupJob{Name: "docs", LocalPath: localDir, CloudPath: "/backups/docs", Schedule: "@daily"}
+	if err := c.AddBackupJob(job); err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.RunBackup("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.UploadedBytes != 30 {
+		t.Errorf("Expected all 30 bytes to be uploaded in the first snapshot, got %v.", first.UploadedBytes)
+	}
+
+	// Only the edited chunk is sent again.
+	time.Sleep(time.Until(first.Started.Truncate(time.Second).Add(time.Second)))
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "0123456789ABCDEFGHIJKLMNOPQRST"})
+	second, err := c.RunBackup("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Uploaded != 1 || second.UploadedBytes != 10 {
+		t.Errorf("Expected the changed file to upload 10 bytes, got %+v.", second)
+	}
+
+	// Every node holds all chunks of the new version.
+	cloudPath := path.Join(second.Snapshot, "a.txt")
+	file, err := c.GetFile(cloudPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cl := range clouds {
+		store := cl.(*cloud).FileStore(cloudPath)
+		if store == nil {
+			t.Fatalf("Cloud %d does not store %v.", i, cloudPath)
+		}
+		content := ""
+		for _, chunk := range file.Chunks.Chunks {
+			b, err := store.ReadChunk(chunk.ID)
+			if err != nil {
+				t.Fatalf("Cloud %d could not read chunk %d: %v.", i, chunk.SequenceNumber, err)
+			}
+			content += string(b)
+		}
+		if content != "0123456789ABCDEFGHIJKLMNOPQRST" {
+			t.Errorf("Cloud %d has %q for the new version.", i, content)
+		}
+	}
+}
@@ -62,7 +62,10 @@ func (r request) OnNetworkInfoRequest() Network {
 	utils.GetLogger().Println("[INFO] Handling NetworkInfo request.")
 	r.Cloud.networkMutex.RLock()
 	defer r.Cloud.networkMutex.RUnlock()
-	return r.Cloud.network
+	// Chunk locations are found through the DHT. ChunkNodes only lists the chunks held by this node.
+	network := r.Cloud.network
+	network.ChunkNodes = nil
+	return network
 }
 
 func (n *cloudNode) NodeInfo() (Node, error) {
@@ -86,6 +89,7 @@ func (c *cloud) AddNode(node Node) {
 }
 
 func (r request) OnAddNodeRequest(node Node) {
+	defer r.Cloud.stateChanged()
 	utils.GetLogger().Printf("[INFO] Handling AddNodeRequest with parameter node: %v.", node)
 
 	r.Cloud.networkMutex.Lock()
@@ -127,6 +131,7 @@ func (c *cloud) AddToWhitelist(ID string) error {
 }
 
 func (r request) OnAddToWhitelist(ID string) error {
+	defer r.Cloud.stateChanged()
 	utils.GetLogger().Printf("[DEBUG] Added ID to list of nodes: %v.", ID)
 	if ID == "" {
 		return errors.New("cannot add empty ID")
@@ -159,6 +164,7 @@ func (c *cloud) RemoveFromWhitelist(ID string) error {
 }
 
 func (r request) OnRemoveFromWhitelist(ID string) error {
+	defer r.Cloud.stateChanged()
 	if ID == "" {
 		return errors.New("cannot add empty ID")
 	}
@@ -8,6 +8,7 @@ import (
 // Messages used for benchmark communications.
 const (
 	StorageSpaceRemainingMsg = "StorageSpaceRemaining"
+	StorageSpaceUsedMsg      = "StorageSpaceUsed"
 	NetworkLatencyMsg        = "NetworkLatency"
 )
 
@@ -25,6 +26,8 @@ func createBenchmarkRequestHandler(node *cloudNode, cloud *cloud) func(string) i
 		switch message {
 		case StorageSpaceRemainingMsg:
 			return r.OnStorageSpaceRemaining
+		case StorageSpaceUsedMsg:
+			return r.OnStorageSpaceUsed
 		case NetworkLatencyMsg:
 			return r.OnNetworkLatency
 		}
@@ -47,24 +50,21 @@ func (r request) OnStorageSpaceRemaining() (uint64, error) {
 	utils.GetLogger().Printf("[DEBUG] Storage Path on the node: %s.", storageDir)
 	storageCapacity := r.Cloud.config.FileStorageCapacity
 	utils.GetLogger().Printf("[DEBUG] Storage Capacity on the node: %d.", storageCapacity)
-	if storageCapacity == -1 {
-		return 0, nil
-	} else if storageCapacity == 0 {
-		// StorageCapacity not set, calculate available disk space
-		spaceRemaining := utils.AvailableDisk(storageDir)
-		return spaceRemaining, nil
-	} else {
-		// Get the current usage from benchmark state.
-		spaceUsed := r.Cloud.BenchmarkState().StorageSpaceUsed
-
-		// TODO: An alternative method when no data is available
-		// may be to walk through the entire directory to calculate its usage.
-		// We can use utils.DirSize for that.
+	utils.GetLogger().Printf("[DEBUG] Computed space usage: %d.", r.Cloud.benchmarkState.StorageSpaceUsed)
+	return r.Cloud.storageRemainingLocked(), nil
+}
 
-		utils.GetLogger().Printf("[DEBUG] Computed space usage: %d.", spaceUsed)
-		spaceRemaining := uint64(storageCapacity) - spaceUsed
-		return spaceRemaining, nil
+// StorageSpaceUsed returns the amount of storage space in bytes that is used by user data on the node.
+func (n *cloudNode) StorageSpaceUsed() (uint64, error) {
+	ret, err := n.client.SendMessage(StorageSpaceUsedMsg)
+	if err != nil {
+		return 0, err
 	}
+	return ret[0].(uint64), nil
+}
+
+func (r request) OnStorageSpaceUsed() uint64 {
+	return r.Cloud.BenchmarkState().StorageSpaceUsed
 }
 
 // NetworkLatency calculates the round-trip time of a request.
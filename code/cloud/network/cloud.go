@@ -2,8 +2,8 @@ package network
 
 import (
 	"cloud/datastore"
+	"cloud/utils"
 	"crypto/rsa"
-	"github.com/fsnotify/fsnotify"
 	"net"
 	"os"
 	"sync"
@@ -62,12 +62,21 @@ type Cloud interface {
 	GetFiles() []*NetworkFile
 	// GetFolders retrieves all folders on the cloud.
 	GetFolders() []*NetworkFolder
+	// Search returns a page of the files on the cloud that match the query, sorted by path.
+	Search(query SearchQuery) (SearchResult, error)
 	// DistributeChunk calculates where it should distribute the chunk on the cloud and sends the data over.
 	DistributeChunk(cloudPath string, store datastore.FileStore, chunkID datastore.ChunkID) error
 	// CreateDirectory creates a directory on the cloud.
 	CreateDirectory(folderPath string) error
-	// DeleteDirectory deletes a directory from the cloud. The directory must be empty.
-	DeleteDirectory(folderPath string) error
+	// DeleteDirectory deletes a directory from the cloud. Unless recursive is set, the directory must not contain any
+	// files. File lock is required for the directory to delete it recursively.
+	DeleteDirectory(folderPath string, recursive bool) error
+	// MoveDirectory moves a directory and all of its contents to a new path. File lock is required for the old and new
+	// paths.
+	MoveDirectory(folderPath string, newPath string) error
+	// CopyDirectory copies a directory and all of its contents to a new path. The copied files reuse the chunks of the
+	// originals. File lock is required for the old and new paths.
+	CopyDirectory(folderPath string, newPath string) error
 	// AddFile creates a new file on the cloud, copying the file from localpath.
 	AddFile(file *datastore.File, filepath string, localpath string) error
 	// AddFileInPlace creates a new file on the cloud, using the localpath as it's store file. Instead of making another
@@ -79,10 +88,15 @@ type Cloud interface {
 	// UpdateFile updates the file's metadata. The node calling UpdateFile needs to have the data for any new chunks.
 	// File lock is required.
 	UpdateFile(file *datastore.File, filepath string) error
+	// SetFileMetadata replaces the user metadata of a file. Empty metadata clears it. File lock is required.
+	SetFileMetadata(filepath string, metadata map[string]string) error
 	// DeleteFile deletes a file from the cloud. File lock is required.
 	DeleteFile(filepath string) error
 	// MoveFile moves a file on the cloud to a new path. File lock is required for old and new file paths.
 	MoveFile(filepath string, newFilepath string) error
+	// CopyFile copies a file on the cloud to a new path. The copy reuses the chunks of the original. File lock is
+	// required for old and new file paths.
+	CopyFile(filepath string, newFilepath string) error
 	// LockFile creates a file lock on the specified path. Returns true if one could be acquired.
 	// File lock is required for manipulating files. Prevents from multiple nodes changing the same file at the same
 	// time, which could lose data.
@@ -94,20 +108,93 @@ type Cloud interface {
 	// cloud file. Uses fsnotify to monitor for changes in the local file.
 	// If the cloud file does not exist, one will be created from the local file.
 	// If the local file does not exist, one will be created from the cloud file.
-	// If both exist, they have to be the same.
+	// If both exist and differ, the side that changed since they were last synced is kept. If both changed, or they
+	// were never synced, CloudConfig.SyncConflicts decides.
 	SyncFile(cloudPath string, localPath string) error
 	// SyncFolder creates a sync between a cloud folder and a local folder. This is similar to SyncFile, but instead of
-	// syncing individual files, it will sync the whole folder. The local folder has to be empty, the cloud folder has to
-	// exist.
+	// syncing individual files, it will sync the whole folder. Files that exist on one side only are copied to the
+	// other, and files that exist on both are reconciled like in SyncFile.
 	SyncFolder(cloudPath string, localPath string) error
+	// SyncFolderWithOptions is SyncFolder with selective sync. Excluded sub-folders are not synced to this node, and
+	// with placeholders, cloud files are only downloaded when HydrateFile is called.
+	SyncFolderWithOptions(cloudPath string, localPath string, options SyncOptions) error
+	// PlanSyncFile returns what SyncFile would do with the files, without changing them.
+	PlanSyncFile(cloudPath string, localPath string) (SyncPlan, error)
+	// PlanSyncFolder returns what SyncFolder would do with the files of the folders, without changing them.
+	PlanSyncFolder(cloudPath string, localPath string) (SyncPlan, error)
+	// SetSyncIgnore sets gitignore-style patterns of files that the folder sync of the local folder does not sync, in
+	// addition to the ones of the .cloudignore file in the local folder.
+	SetSyncIgnore(localPath string, patterns []string) error
+	// IgnoredPaths returns the local paths in the synced local folder that are not synced.
+	IgnoredPaths(localPath string) ([]string, error)
+	// Syncs returns the status of the file and folder syncs.
+	Syncs() []SyncStatus
+	// PauseSync pauses the sync of the local file or folder. Changes on either side are synced once it is resumed.
+	PauseSync(localPath string) error
+	// ResumeSync resumes the paused sync of the local file or folder.
+	ResumeSync(localPath string) error
+	// RemoveSync stops syncing the local file or folder. Both the local and the cloud files are kept.
+	RemoveSync(localPath string) error
+	// ExcludeFolder stops syncing the cloud sub-folder to the synced local folder, without deleting it on the cloud.
+	ExcludeFolder(localPath string, cloudFolder string) error
+	// IncludeFolder syncs an excluded cloud sub-folder to the synced local folder again.
+	IncludeFolder(localPath string, cloudFolder string) error
+	// SetSyncPlaceholders sets whether the folder sync shows cloud files that are not stored locally as placeholders.
+	SetSyncPlaceholders(localPath string, enabled bool) error
+	// HydrateFile downloads the cloud file of a placeholder in a synced folder.
+	HydrateFile(localPath string) error
 	// Distribute calculates what nodes to split the data to and replicates the data to those nodes.
 	Distribute(cloudPath string, file datastore.File, numReplicas int, antiAffinity bool) error
 
+	// PlanRebalance computes chunk moves that even out storage usage between the online nodes. At most budget bytes
+	// are moved, or any amount if budget is 0.
+	PlanRebalance(budget uint64) (RebalancePlan, error)
+	// Rebalance computes a rebalance plan and applies it in the background. If dryRun is true, no chunks are moved.
+	Rebalance(budget uint64, dryRun bool) (RebalancePlan, error)
+	// RebalanceStatus returns the progress of the last rebalance.
+	RebalanceStatus() RebalanceStatus
+
+	// DrainNode stops new data from being stored on the node and migrates its chunks to the other nodes in the
+	// background.
+	DrainNode(ID string) error
+	// DrainStatus returns the progress of a drain started by this node.
+	DrainStatus(ID string) (DrainStatus, bool)
+	// CancelDrain stops the node from being drained.
+	CancelDrain(ID string) error
+
+	// RotateKey replaces this node's identity key with a new one. The node keeps its ID and the current key is revoked
+	// on the network.
+	RotateKey(newKey *rsa.PrivateKey) error
+
+	// CollectGarbage removes data on this node that is no longer part of the network. Chunk files modified within the
+	// grace period are kept. If dryRun is true, nothing is removed.
+	CollectGarbage(grace time.Duration, dryRun bool) (GCReport, error)
+
+	// BackupJobs returns the backup jobs of this node.
+	BackupJobs() []BackupJob
+	// AddBackupJob adds a backup job to the config. It runs on its schedule while the node is running.
+	AddBackupJob(job BackupJob) error
+	// RemoveBackupJob removes a backup job from the config. Its snapshots are kept.
+	RemoveBackupJob(name string) error
+	// RunBackup runs a backup job now, and returns its report.
+	RunBackup(name string) (BackupReport, error)
+	// BackupReports returns the reports of the last runs of a backup job.
+	BackupReports(name string) []BackupReport
+
 	// Events returns a cloud event instance, which can be used to set event hooks.
 	Events() *CloudEvents
 
 	// SavedNetworkState returns a saved instance of the cloud.
 	SavedNetworkState() SavedNetworkState
+	// SaveState atomically writes the cloud's state to the file, to be loaded later with ReadStateFile and
+	// LoadNetwork. If CloudConfig.SaveFile is set, the state is also saved there automatically after every change.
+	SaveState(path string) error
+	// SetStatePassphrase sets the passphrase that saved states are encrypted with. If empty, states are not encrypted.
+	SetStatePassphrase(passphrase []byte)
+
+	// Close stops the background work of the cloud, like the DHT maintenance and the scheduled backups, and stops
+	// accepting connections.
+	Close() error
 
 	// BenchmarkState returns benchmark information for this cloud's node.
 	BenchmarkState() CloudBenchmarkState
@@ -127,17 +214,36 @@ type CloudEvents struct {
 	NodeConnected func(ID string)
 	// NodeDisconnected is called when a node disconnects from the network.
 	NodeDisconnected func(ID string)
+	// NodeDrained is called when a drained node has no data left that is not stored elsewhere and is safe to remove.
+	NodeDrained func(ID string)
 
 	// WhitelistAdded is called when a new whitelist ID is added on the network.
 	WhitelistAdded func(ID string)
 	// WhitelistRemoved is called when a whitelist ID is removed from the network.
 	WhitelistRemoved func(ID string)
+
+	// SyncConflict is called when concurrent edits of a synced file conflict, and one of them is kept as a conflict
+	// copy.
+	SyncConflict func(conflict SyncConflict)
 }
 
 type fileSync struct {
-	CloudPath    string
-	LocalPath    string
-	LastEditTime time.Time
+	CloudPath string
+	LocalPath string
+
+	// Renamed maps the cloud paths of files that are synced under another local name, because of case collisions,
+	// to their local paths.
+	Renamed map[string]string
+	// Index maps the cloud paths of the synced files to their state when they were last synced.
+	Index map[string]SyncEntry
+	// Ignore are gitignore-style patterns of files that are not synced, in addition to the ones of the ignore file.
+	Ignore []string
+	// Paused syncs do not sync changes on either side until they are resumed.
+	Paused bool
+	// Exclude are the cloud sub-folders that are not synced to this node.
+	Exclude []string
+	// Placeholders is set if cloud files that are not stored locally appear as placeholders.
+	Placeholders bool
 }
 
 // Cloud is the client's view of the Network. Contains client-specific information.
@@ -163,12 +269,20 @@ type cloud struct {
 	// Local storage. Maps file path to the store.
 	fileStorage      map[string]datastore.FileStore
 	fileStorageMutex sync.RWMutex
+	// recoveredStorageDir is the file storage directory that was recovered after a crash, recoveredOps are the
+	// interrupted operations whose stores are not restored yet.
+	recoveredStorageDir string
+	recoveredOps        []datastore.JournalEntry
 
 	downloadManager *DownloadManager
 
 	fileSyncs   []*datastore.SyncFileStore
 	folderSyncs []fileSync
-	watcher     *fsnotify.Watcher
+	watcher     fileWatcher
+	watchQueue  *watchQueue
+	renames     renameTracker
+	syncTracker syncTracker
+	ignores     ignoreCache
 
 	// Non-authorized connections.
 	PendingNodes []*cloudNode
@@ -182,9 +296,26 @@ type cloud struct {
 	listener net.Listener
 	Port     int
 
+	// closed is closed when the cloud is closed, which stops its background work.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// nodesChangedCh is signalled when nodes connect or disconnect.
+	nodesChangedCh chan struct{}
+
 	config CloudConfig
 
 	benchmarkState CloudBenchmarkState
+
+	rebalancer rebalancer
+	backups    backupScheduler
+	drainer    drainer
+	persister  persister
+
+	// providerRecords are the chunk locations stored on this node as part of the DHT.
+	providerRecords providerRecords
+
+	// statePassphrase encrypts saved states, if set.
+	statePassphrase []byte
 }
 
 func (c *cloud) DownloadManager() *DownloadManager {
@@ -204,6 +335,48 @@ func (c *cloud) Config() CloudConfig {
 func (c *cloud) SetConfig(config CloudConfig) {
 	c.config = config
 	os.MkdirAll(c.config.FileStorageDir, os.ModeDir)
+	c.recoverFileStorage()
+	c.scheduleBackups()
+}
+
+// recoverFileStorage completes operations in the file storage directory that were interrupted by a crash, then
+// recomputes the storage used. It runs once per directory, when the node starts: later config changes would remove
+// the temporary files of chunk writes in flight.
+func (c *cloud) recoverFileStorage() {
+	dir := c.config.FileStorageDir
+	if dir == "" || dir == c.recoveredStorageDir {
+		return
+	}
+	c.recoveredStorageDir = dir
+	ops, err := datastore.RecoverJournal(dir)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Recovering file storage %v: %v.", dir, err)
+	}
+	c.fileStorageMutex.Lock()
+	c.recoveredOps = append(c.recoveredOps, ops...)
+	c.fileStorageMutex.Unlock()
+	c.applyRecoveredOps()
+	c.recomputeStorageUsed()
+}
+
+// applyRecoveredOps rolls the chunks of the stores forward to the interrupted operations that were completed by the
+// recovery. Operations of stores that are not restored yet are kept.
+func (c *cloud) applyRecoveredOps() {
+	c.fileStorageMutex.Lock()
+	defer c.fileStorageMutex.Unlock()
+	pending := make([]datastore.JournalEntry, 0)
+	for _, op := range c.recoveredOps {
+		applied := false
+		for _, store := range c.fileStorage {
+			if partial, ok := store.(*datastore.PartialFileStore); ok && partial.RecoverChunks(op) {
+				applied = true
+			}
+		}
+		if !applied {
+			pending = append(pending, op)
+		}
+	}
+	c.recoveredOps = pending
 }
 
 func (c *cloud) Events() *CloudEvents {
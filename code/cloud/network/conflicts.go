@@ -0,0 +1,272 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Messages for sync conflicts.
+const (
+	SyncConflictMsg = "SyncConflict"
+)
+
+func init() {
+	gob.Register(SyncConflict{})
+
+	handlers = append(handlers, createConflictRequestHandler)
+}
+
+func createConflictRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case SyncConflictMsg:
+			return r.OnSyncConflict
+		}
+		return nil
+	}
+}
+
+// ErrSyncConflict is returned when an edit of a synced file is not based on the current version of the file.
+var ErrSyncConflict = errors.New("file was changed since the version that was edited")
+
+// SyncConflict is an edit of a synced file that conflicted with an edit from another node, as both were based on the
+// same version of the file. The edit of the node that lost is kept as a conflict copy next to the file.
+type SyncConflict struct {
+	// Path is the cloud path of the file.
+	Path string
+	// CopyPath is the cloud path of the conflict copy.
+	CopyPath string
+	// NodeID is the ID of the node whose edit was kept as the conflict copy.
+	NodeID string
+	// Time is when the conflict was detected.
+	Time time.Time
+}
+
+// conflictCopyName returns the name of a conflict copy of the file, like
+// "notes (conflict from laptop 2020-03-01 15-04-05).txt".
+func conflictCopyName(name string, node Node, t time.Time) string {
+	from := node.Name
+	if from == "" || ValidateName(from) != nil {
+		from = node.ID
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	return fmt.Sprintf("%s (conflict from %s %s)%s", base, from, t.Format("2006-01-02 15-04-05"), ext)
+}
+
+// localVersion returns the version of the file that the local copy has, chunked with the chunk size.
+func localVersion(store *datastore.FullFileStore, chunkSize int) (*datastore.File, error) {
+	f, err := os.Open(store.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return datastore.NewFile(f, filepath.Base(store.FilePath), chunkSize)
+}
+
+// pushLocalEdit updates the cloud file with an edit of its local copy. If another node changed the cloud file since the
+// version that the edit is based on, the edit is kept as a conflict copy and the local copy is replaced with the cloud
+// version.
+func (c *cloud) pushLocalEdit(cloudPath string, store *datastore.FullFileStore, edit *datastore.File) {
+	if edit.ID == edit.Base {
+		return
+	}
+	finish := c.trackTransfer(store.FilePath, false)
+	var err error
+	if c.LockFile(cloudPath) {
+		if err = c.updateSyncedFile(cloudPath, store, edit); err != nil {
+			utils.GetLogger().Printf("[ERROR] Updating synced file %v: %v.", cloudPath, err)
+		}
+	} else {
+		err = errors.New("could not lock " + cloudPath)
+	}
+	c.UnlockFile(cloudPath)
+	finish(err)
+}
+
+// updateSyncedFile updates the cloud file with the edit, or resolves the conflict with the cloud version.
+// File lock must be acquired for the path.
+func (c *cloud) updateSyncedFile(cloudPath string, store *datastore.FullFileStore, edit *datastore.File) error {
+	current, err := c.GetFile(cloudPath)
+	if err != nil {
+		return err
+	}
+	if current.ID == edit.ID {
+		c.fileStorageMutex.Lock()
+		store.FileID = current.ID
+		c.fileStorageMutex.Unlock()
+		c.recordSynced(cloudPath, store.FilePath, current)
+		return nil
+	}
+	if edit.Base == current.ID {
+		return c.UpdateFile(edit, cloudPath)
+	}
+
+	utils.GetLogger().Printf("[WARN] Local edit of %v conflicts with the cloud version.", cloudPath)
+	conflict, localPath, err := saveConflictCopy(c.MyNode(), cloudPath, store)
+	if err != nil {
+		return err
+	}
+	if err := c.restoreCloudVersion(cloudPath, store, current); err != nil {
+		return err
+	}
+	return c.addConflictCopy(conflict, localPath, current.Chunks.ChunkSize)
+}
+
+// localEdited returns whether the local copy of a synced file has an edit that was not synced, with other contents than
+// the file f. Local copies that did not change since they were synced, according to the sync index, are not read.
+// None of the cloud's mutexes may be held.
+func (c *cloud) localEdited(cloudPath string, s *datastore.FullFileStore, f *datastore.File) bool {
+	info, err := os.Stat(s.FilePath)
+	// Empty local copies are placeholders for files that were not downloaded yet.
+	if err != nil || info.Size() == 0 || s.Writing() {
+		return false
+	}
+	c.Mutex.RLock()
+	var entry *SyncEntry
+	if sync := c.folderSyncOf(cloudPath); sync != nil {
+		if e, ok := sync.Index[cloudPath]; ok && filepath.Clean(e.LocalPath) == filepath.Clean(s.FilePath) {
+			entry = &e
+		}
+	}
+	c.Mutex.RUnlock()
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return false
+	}
+
+	local, err := localVersion(s, f.Chunks.ChunkSize)
+	c.fileStorageMutex.RLock()
+	synced := s.FileID
+	c.fileStorageMutex.RUnlock()
+	return err == nil && local.ID != synced && local.ID != f.ID
+}
+
+// keepLocalEdit saves a conflict copy of the local copy of a synced file before an update from another node overwrites
+// it, if the local copy has an edit that was not synced. Returns nil if there is no such edit. None of the cloud's
+// mutexes may be held.
+func (c *cloud) keepLocalEdit(cloudPath string, s *datastore.FullFileStore, f *datastore.File) (*SyncConflict, string) {
+	if !c.localEdited(cloudPath, s, f) {
+		return nil, ""
+	}
+	utils.GetLogger().Printf("[WARN] Update of %v from another node conflicts with the local edit.", cloudPath)
+	conflict, localPath, err := saveConflictCopy(c.MyNode(), cloudPath, s)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Saving conflict copy of %v: %v.", cloudPath, err)
+		return nil, ""
+	}
+	return &conflict, localPath
+}
+
+// saveConflictCopy copies the local copy of a synced file next to it, under the name of a conflict copy with the edit
+// of this node. Returns the conflict and the local path of the copy.
+func saveConflictCopy(me Node, cloudPath string, store *datastore.FullFileStore) (SyncConflict, string, error) {
+	now := time.Now()
+	conflict := SyncConflict{
+		Path:     cloudPath,
+		CopyPath: path.Join(path.Dir(cloudPath), conflictCopyName(path.Base(cloudPath), me, now)),
+		NodeID:   me.ID,
+		Time:     now,
+	}
+	localPath := filepath.Join(filepath.Dir(store.FilePath), path.Base(conflict.CopyPath))
+
+	src, err := os.Open(store.FilePath)
+	if err != nil {
+		return conflict, "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return conflict, "", err
+	}
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return conflict, "", err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return conflict, "", err
+	}
+	return conflict, localPath, os.Chtimes(localPath, now, info.ModTime())
+}
+
+// restoreCloudVersion overwrites the local copy of a synced file with the cloud version of the file.
+func (c *cloud) restoreCloudVersion(cloudPath string, store *datastore.FullFileStore, file *datastore.File) error {
+	store.BeginWrite()
+	defer store.EndWrite()
+
+	// The local copy no longer has the chunks it was synced with, so they are downloaded from other nodes.
+	store.SetChunks(nil)
+	w, err := os.OpenFile(store.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	err = c.DownloadFile(cloudPath, w)
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	c.fileStorageMutex.Lock()
+	store.FileID = file.ID
+	c.fileStorageMutex.Unlock()
+	store.SetChunks(file.Chunks.Chunks)
+	if err := file.RestoreFileInfo(store.FilePath); err != nil {
+		return err
+	}
+	c.recordSynced(cloudPath, store.FilePath, file)
+	return nil
+}
+
+// addConflictCopy adds the conflict copy at localPath to the cloud and reports the conflict to all nodes.
+func (c *cloud) addConflictCopy(conflict SyncConflict, localPath string, chunkSize int) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	file, err := datastore.NewFile(f, path.Base(conflict.CopyPath), chunkSize)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			file.SetFileInfo(info)
+		}
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	c.LockFile(conflict.CopyPath)
+	err = c.AddFileSync(file, conflict.CopyPath, localPath)
+	c.UnlockFile(conflict.CopyPath)
+	if err != nil {
+		return err
+	}
+	return c.sendAll(SyncConflictMsg, conflict)
+}
+
+func (r request) OnSyncConflict(conflict SyncConflict) error {
+	utils.GetLogger().Printf("[WARN] Sync conflict on %v, the edit of node %v was kept as %v.", conflict.Path,
+		conflict.NodeID, conflict.CopyPath)
+	if r.Cloud.events.SyncConflict != nil {
+		go r.Cloud.events.SyncConflict(conflict)
+	}
+	return nil
+}
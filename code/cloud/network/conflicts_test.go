@@ -0,0 +1,190 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConflictCopyName(t *testing.T) {
+	at := time.Date(2020, 3, 1, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		node     Node
+		expected string
+	}{
+		{"notes.txt", Node{ID: "id", Name: "laptop"}, "notes (conflict from laptop 2020-03-01 15-04-05).txt"},
+		{"Makefile", Node{ID: "id", Name: "laptop"}, "Makefile (conflict from laptop 2020-03-01 15-04-05)"},
+		{"notes.txt", Node{ID: "id", Name: "a:b"}, "notes (conflict from id 2020-03-01 15-04-05).txt"},
+	}
+	for _, test := range tests {
+		if name := conflictCopyName(test.name, test.node, at); name != test.expected {
+			t.Errorf("Expected %q, got %q.", test.expected, name)
+		}
+	}
+}
+
+// waitForConflict returns the next reported conflict, or fails the test if none is reported in time.
+func waitForConflict(t *testing.T, conflicts chan SyncConflict) SyncConflict {
+	select {
+	case conflict := <-conflicts:
+		return conflict
+	case <-time.After(5 * time.Second):
+		t.Fatal("Conflict was not reported.")
+	}
+	return SyncConflict{}
+}
+
+func TestSyncConflict(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageDirs, err := utils.GetTestDirs("cloud_test_conflict_data_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(storageDirs)
+	localDirs, err := utils.GetTestDirs("cloud_test_conflict_local_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(localDirs)
+
+	conflicts := make(chan SyncConflict, 4)
+	for i, c := range clouds {
+		c.SetConfig(CloudConfig{FileStorageDir: storageDirs[i]})
+	}
+	clouds[0].Events().SyncConflict = func(conflict SyncConflict) {
+		conflicts <- conflict
+	}
+
+	// Both nodes have a local copy of the same version.
+	chunkSize := 4
+	localPaths := []string{filepath.Join(localDirs[0], "doc.txt"), filepath.Join(localDirs[1], "doc.txt")}
+	stores := make([]*datastore.FullFileStore, 2)
+	var base *datastore.File
+	for i, localPath := range localPaths {
+		if err := ioutil.WriteFile(localPath, []byte("base content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = &datastore.FullFileStore{FilePath: localPath}
+		if base, err = localVersion(stores[i], chunkSize); err != nil {
+			t.Fatal(err)
+		}
+		stores[i].FileID, stores[i].Chunks = base.ID, base.Chunks.Chunks
+	}
+	if err := clouds[0].AddFileInPlace(base, "/doc.txt", localPaths[0]); err != nil {
+		t.Fatal(err)
+	}
+	c1 := clouds[1].(*cloud)
+	c1.fileStorageMutex.Lock()
+	c1.fileStorage["/doc.txt"] = stores[1]
+	c1.fileStorageMutex.Unlock()
+
+	// Both nodes edit the file, node 1 pushes its edit first.
+	if err := ioutil.WriteFile(localPaths[1], []byte("edited on node 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(localPaths[0], []byte("edited on node 1!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	edit, err := localVersion(stores[0], chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit.Base = base.ID
+	clouds[0].(*cloud).pushLocalEdit("/doc.txt", stores[0], edit)
+
+	conflict := waitForConflict(t, conflicts)
+	if conflict.Path != "/doc.txt" || conflict.NodeID != clouds[1].MyNode().ID {
+		t.Errorf("Unexpected conflict: %+v.", conflict)
+	}
+	if f, err := clouds[0].GetFile(conflict.CopyPath); err != nil || f.Size != uint64(len("edited on node 2")) {
+		t.Errorf("Conflict copy %v is not on the cloud: %v.", conflict.CopyPath, err)
+	}
+	copyPath := filepath.Join(localDirs[1], path.Base(conflict.CopyPath))
+	if content, err := ioutil.ReadFile(copyPath); err != nil || string(content) != "edited on node 2" {
+		t.Errorf("Conflict copy has %q, %v.", content, err)
+	}
+	if content, err := ioutil.ReadFile(localPaths[1]); err != nil || string(content) != "edited on node 1!" {
+		t.Errorf("Local copy of node 2 has %q, %v.", content, err)
+	}
+
+	// Node 2 pushes an edit of the version that was replaced.
+	time.Sleep(time.Second)
+	if err := ioutil.WriteFile(localPaths[1], []byte("late edit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	late, err := localVersion(stores[1], chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late.Base = base.ID
+	if !c1.LockFile("/doc.txt") {
+		t.Fatal("Could not lock the file.")
+	}
+	if err := c1.UpdateFile(late, "/doc.txt"); err == nil {
+		t.Error("Expected an edit of an old version to be rejected.")
+	}
+	c1.UnlockFile("/doc.txt")
+
+	c1.pushLocalEdit("/doc.txt", stores[1], late)
+	lateConflict := waitForConflict(t, conflicts)
+	if lateConflict.CopyPath == conflict.CopyPath {
+		t.Errorf("Expected a new conflict copy, got %v.", lateConflict.CopyPath)
+	}
+	if f, err := clouds[0].GetFile("/doc.txt"); err != nil || f.ID != edit.ID {
+		t.Error("Expected the cloud file to keep the edit of node 1.")
+	}
+	if content, err := ioutil.ReadFile(localPaths[1]); err != nil || string(content) != "edited on node 1!" {
+		t.Errorf("Local copy of node 2 has %q, %v.", content, err)
+	}
+}
+
+func TestLocalEdited(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_local_edited_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	localPath := filepath.Join(dirs[0], "doc.txt")
+	if err := ioutil.WriteFile(localPath, []byte("base content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := &datastore.FullFileStore{FilePath: localPath}
+	base, err := localVersion(store, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.FileID = base.ID
+	update := &datastore.File{ID: "update", Chunks: base.Chunks}
+
+	c := &cloud{folderSyncs: []fileSync{{CloudPath: "/p", LocalPath: dirs[0]}}}
+	if c.localEdited("/p/doc.txt", store, update) {
+		t.Error("Expected the synced version not to be an edit.")
+	}
+	if err := ioutil.WriteFile(localPath, []byte("edited content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !c.localEdited("/p/doc.txt", store, update) {
+		t.Error("Expected the changed local copy to be an edit.")
+	}
+
+	// Local copies with the size and modification time of the sync index are not read.
+	info, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.folderSyncs[0].Index = map[string]SyncEntry{
+		"/p/doc.txt": {LocalPath: localPath, Size: info.Size(), ModTime: info.ModTime()},
+	}
+	if c.localEdited("/p/doc.txt", store, update) {
+		t.Error("Expected the indexed local copy not to be an edit.")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type CloudConfig struct {
@@ -22,10 +23,28 @@ type CloudConfig struct {
 	// If -1, no storage will be allowed on the node.
 	FileStorageCapacity int64
 
+	// SaveFile is a file path where the cloud's state is saved automatically whenever it changes.
+	// If empty, the state is not saved.
+	SaveFile string
+
 	// FileChunkSize controls into how many bytes a file should be chunked in.
 	// TODO: Default value? Check for 0 value everywhere.
 	// FIXME: use int64 (or uint64) type
 	FileChunkSize int
+
+	// CaseCollisions is how folder syncs handle cloud files whose names only differ in case.
+	CaseCollisions CaseCollisionPolicy
+
+	// SyncConflicts is how syncs resolve files that were edited both locally and on the cloud when they are attached.
+	SyncConflicts ConflictPolicy
+
+	// WatchMode is how syncs watch the local files for changes.
+	WatchMode WatchMode
+	// PollInterval is how often polled local files are checked for changes. If 0, they are checked every 2 seconds.
+	PollInterval time.Duration
+
+	// BackupJobs are backed up by this node on their schedule.
+	BackupJobs []BackupJob
 }
 
 // ConnectToNode establishes a connection to a node with that ID. Will return error if a connection could not be
@@ -87,7 +106,10 @@ func BootstrapToNetwork(bootstrapIP string, myNode Node, privateKey *rsa.Private
 	utils.GetLogger().Printf("[INFO] Bootstrapping with ip: %v, and node: %v.", bootstrapIP, myNode)
 
 	myNode.PublicKey = privateKey.PublicKey
-	myNode.ID, _ = PublicKeyToID(&privateKey.PublicKey)
+	// A node that rotated its key keeps the ID derived from its first key.
+	if myNode.ID == "" {
+		myNode.ID, _ = PublicKeyToID(&privateKey.PublicKey)
+	}
 
 	// Create the cloud object.
 	cloud := &cloud{
@@ -99,8 +121,12 @@ func BootstrapToNetwork(bootstrapIP string, myNode Node, privateKey *rsa.Private
 		privateKey:  privateKey,
 		Port:        0,
 		config:      config,
+
+		closed:         make(chan struct{}),
+		nodesChangedCh: make(chan struct{}, 1),
 	}
 	cloud.downloadManager = &DownloadManager{Cloud: cloud}
+	cloud.recoverFileStorage()
 	ips := strings.Split(myNode.IP, ":")
 	if len(ips) > 0 {
 		cloud.Port, _ = strconv.Atoi(ips[len(ips)-1])
@@ -157,6 +183,10 @@ func BootstrapToNetwork(bootstrapIP string, myNode Node, privateKey *rsa.Private
 	}
 
 	cloud.network = network
+	cloud.network.indexMutex()
+	if cloud.network.ChunkNodes == nil {
+		cloud.network.ChunkNodes = make(map[datastore.ChunkID][]string)
+	}
 	// Create stores for any files.
 	var createStorage func(folderpath string, nw *NetworkFolder)
 	createStorage = func(folderpath string, nw *NetworkFolder) {
@@ -190,6 +220,7 @@ func BootstrapToNetwork(bootstrapIP string, myNode Node, privateKey *rsa.Private
 			go cloud.ConnectToNode(network.Nodes[i].ID)
 		}
 	}()
+	go cloud.maintainDHT()
 
 	return cloud, nil
 }
@@ -198,11 +229,15 @@ func SetupNetwork(network Network, myNode Node, privateKey *rsa.PrivateKey) Clou
 	utils.GetLogger().Printf("[INFO] Setting up network with name: %v, and initial name: %v.", network.Name, myNode.Name)
 
 	myNode.PublicKey = privateKey.PublicKey
-	myNode.ID, _ = PublicKeyToID(&privateKey.PublicKey)
+	// A node that rotated its key keeps the ID derived from its first key.
+	if myNode.ID == "" {
+		myNode.ID, _ = PublicKeyToID(&privateKey.PublicKey)
+	}
 
 	if network.ChunkNodes == nil {
 		network.ChunkNodes = make(map[datastore.ChunkID][]string)
 	}
+	network.indexMutex()
 
 	cloud := &cloud{
 		network:     network,
@@ -213,6 +248,9 @@ func SetupNetwork(network Network, myNode Node, privateKey *rsa.PrivateKey) Clou
 		myNode:      myNode,
 		privateKey:  privateKey,
 		Port:        0,
+
+		closed:         make(chan struct{}),
+		nodesChangedCh: make(chan struct{}, 1),
 	}
 	cloud.downloadManager = &DownloadManager{Cloud: cloud}
 	ips := strings.Split(myNode.IP, ":")
@@ -228,6 +266,7 @@ func SetupNetwork(network Network, myNode Node, privateKey *rsa.PrivateKey) Clou
 		client: comm.NewLocalClient(),
 	}
 	cloud.addRequestHandlers(cloud.Nodes[myNode.ID])
+	go cloud.maintainDHT()
 	return cloud
 }
 func SetupNetworkWithConfig(network Network, myNode Node, privateKey *rsa.PrivateKey, config CloudConfig) Cloud {
@@ -282,6 +321,12 @@ func (c *cloud) Accept() {
 	for {
 		conn, err := c.listener.Accept()
 		if err != nil {
+			select {
+			case <-c.closed:
+				utils.GetLogger().Println("[INFO] Cloud is closed, no longer accepting clients.")
+				return
+			default:
+			}
 			fmt.Println(err)
 			continue
 		}
@@ -313,6 +358,19 @@ func (c *cloud) AcceptUsingListener(listener net.Listener) {
 	c.Accept()
 }
 
+func (c *cloud) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		utils.GetLogger().Printf("[INFO] Closing the cloud of node %v.", c.MyNode().ID)
+		close(c.closed)
+		c.stopBackups()
+		if c.listener != nil {
+			err = c.listener.Close()
+		}
+	})
+	return err
+}
+
 func (c *cloud) handleCloudNodeConnection(n *cloudNode) {
 	n.client.HandleConnection()
 
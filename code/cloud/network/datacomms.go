@@ -7,7 +7,7 @@ import (
 	"errors"
 	"os"
 	"path"
-	"strings"
+	"time"
 )
 
 // Messages for data communications.
@@ -20,9 +20,13 @@ const (
 	DeleteFileMsg = "DeleteFile"
 	MoveFileMsg   = "MoveFile"
 
+	SetFileMetadataMsg = "SetFileMetadata"
+
 	SaveChunkMsg        = "SaveChunk"
 	GetChunkMsg         = "GetChunk"
+	DeleteChunkMsg      = "DeleteChunk"
 	updateChunkNodesMsg = "updateChunkNodes"
+	removeChunkNodesMsg = "removeChunkNodes"
 
 	LockFileMsg   = "LockFile"
 	UnlockFileMsg = "UnlockFile"
@@ -32,6 +36,7 @@ func init() {
 	gob.Register(&datastore.File{})
 	gob.Register(SaveChunkRequest{})
 	gob.Register(datastore.ChunkID(""))
+	gob.Register(map[string]string{})
 
 	handlers = append(handlers, createDataStoreRequestHandler)
 }
@@ -47,16 +52,18 @@ func (c *cloud) CreateDirectory(folderPath string) error {
 }
 
 func (r request) OnCreateDirectory(folderPath string) error {
-	r.Cloud.networkMutex.RLock()
-	defer r.Cloud.networkMutex.RUnlock()
+	defer r.Cloud.stateChanged()
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
 	// GetFolder will create the folder if one doesn't exist.
 	_, err := r.Cloud.network.GetFolder(folderPath)
 	return err
 }
 
-// DeleteDirectory deletes the provided folder. The directory must be empty for the delete to be done.
-func (c *cloud) DeleteDirectory(folderPath string) error {
-	res := c.SendMessageAll(DeleteDirectoryMsg, folderPath)
+// DeleteDirectory deletes the provided folder. Unless recursive is set, the directory must not contain any files.
+// File lock must be acquired for the directory's path to delete it recursively.
+func (c *cloud) DeleteDirectory(folderPath string, recursive bool) error {
+	res := c.SendMessageAll(DeleteDirectoryMsg, CleanNetworkPath(folderPath), recursive)
 	for _, r := range res {
 		if r.Error != nil {
 			return r.Error
@@ -65,55 +72,62 @@ func (c *cloud) DeleteDirectory(folderPath string) error {
 	return nil
 }
 
-func (r request) OnDeleteDirectory(folderPath string) error {
-	r.Cloud.networkMutex.RLock()
-	defer r.Cloud.networkMutex.RUnlock()
-	// GetFolder will create the folder if one doesn't exist.
-	folder, err := r.Cloud.network.GetFolder(folderPath)
-	if err != nil {
-		return err
+func (r request) OnDeleteDirectory(folderPath string, recursive bool) error {
+	defer r.Cloud.stateChanged()
+	folderPath = CleanNetworkPath(folderPath)
+	if recursive && !r.holdsLock(folderPath) {
+		return errors.New("node does not have the lock for the directory acquired")
 	}
-	if len(folder.Files.Files) != 0 {
+
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
+	_, files := r.Cloud.network.folderTree(folderPath)
+	if len(files) != 0 && !recursive {
 		return errors.New("directory is not empty")
 	}
-
-	splitFolders := strings.Split(folderPath, "/")
-	baseFolder := strings.Join(splitFolders[:len(splitFolders)-1], "/")
-	targetFolder := splitFolders[len(splitFolders)-1]
-	utils.GetLogger().Printf("[DEBUG] Split: %v, base folder: '%s', target folder: '%s'", splitFolders, baseFolder, targetFolder)
-	var networkFolder *NetworkFolder
-
-	if len(splitFolders) == 1 {
-		networkFolder = r.Cloud.network.RootFolder
-	} else {
-		networkFolder, err = r.Cloud.network.GetFolder(baseFolder)
-		if err != nil {
-			return err
-		}
+	utils.GetLogger().Printf("[DEBUG] Removing folder: '%s'", folderPath)
+	if err := r.Cloud.network.removeFolder(folderPath); err != nil {
+		return err
 	}
-
-	for i := range networkFolder.SubFolders {
-		if networkFolder.SubFolders[i].Name == targetFolder {
-			networkFolder.SubFolders = append(networkFolder.SubFolders[:i], networkFolder.SubFolders[i+1:]...)
-			return nil
-		}
+	for filePath := range files {
+		r.Cloud.deleteFileStorage(filePath)
 	}
+	return nil
+}
 
-	return errors.New("directory not found")
+// setFileMetadata fills in the metadata of a file added to the cloud that was not set. Files are owned by the node
+// that adds them.
+func (c *cloud) setFileMetadata(file *datastore.File) {
+	now := time.Now()
+	if file.Created.IsZero() {
+		file.Created = now
+	}
+	if file.Modified.IsZero() {
+		file.Modified = now
+	}
+	if file.Owner == "" {
+		file.Owner = c.MyNode().ID
+	}
 }
 
 // AddFile adds a file to the Network. It distributes the file automatically.
 // TODO: Use reader instead of LocalPath.
 func (c *cloud) AddFile(file *datastore.File, cloudPath string, localPath string) error {
 	cloudPath = CleanNetworkPath(cloudPath)
+	c.setFileMetadata(file)
 	var err error
 	fs := c.FileStore(cloudPath)
 	if fs == nil {
-		fs, err = datastore.PartialFileStoreFromFile(file, localPath, c.config.FileStorageDir)
+		partial, err := datastore.PartialFileStoreFromFile(file, localPath, c.config.FileStorageDir)
 		if err != nil {
 			return err
 		}
+		// The original copy is always kept, even if it goes over the node's capacity.
+		c.accountStorage(partial.StoredSize())
+		fs = partial
+		c.fileStorageMutex.Lock()
 		c.fileStorage[cloudPath] = fs
+		c.fileStorageMutex.Unlock()
 	}
 	utils.GetLogger().Printf("[INFO] Sending AddFile request for file: %v, on node: %v.", file, c.MyNode().ID)
 	_, err = c.SendMessageToMe(AddFileMsg, file, cloudPath)
@@ -132,6 +146,7 @@ func (c *cloud) AddFile(file *datastore.File, cloudPath string, localPath string
 }
 
 func (c *cloud) AddFileMetadata(file *datastore.File, cloudPath string) error {
+	c.setFileMetadata(file)
 	utils.GetLogger().Printf("[INFO] Sending AddFile request for file: %v, on node: %v.", file, c.MyNode().ID)
 	_, err := c.SendMessageToMe(AddFileMsg, file, cloudPath)
 	if err != nil {
@@ -151,6 +166,7 @@ func (c *cloud) AddFileMetadata(file *datastore.File, cloudPath string) error {
 }
 
 func (c *cloud) AddFileSync(file *datastore.File, cloudPath string, localPath string) error {
+	c.setFileMetadata(file)
 	var err error
 	fs := c.FileStore(cloudPath)
 	if fs == nil {
@@ -161,7 +177,9 @@ func (c *cloud) AddFileSync(file *datastore.File, cloudPath string, localPath st
 			},
 			FilePath: localPath,
 		}
+		c.fileStorageMutex.Lock()
 		c.fileStorage[cloudPath] = fs
+		c.fileStorageMutex.Unlock()
 	}
 	utils.GetLogger().Printf("[INFO] Sending AddFile request for file: %v, on node: %v.", file, c.MyNode().ID)
 	_, err = c.SendMessageToMe(AddFileMsg, file, cloudPath)
@@ -180,6 +198,7 @@ func (c *cloud) AddFileSync(file *datastore.File, cloudPath string, localPath st
 }
 
 func (c *cloud) AddFileInPlace(file *datastore.File, cloudPath string, localPath string) error {
+	c.setFileMetadata(file)
 	var err error
 	fs := c.FileStore(cloudPath)
 	if fs == nil {
@@ -190,7 +209,9 @@ func (c *cloud) AddFileInPlace(file *datastore.File, cloudPath string, localPath
 			},
 			FilePath: localPath,
 		}
+		c.fileStorageMutex.Lock()
 		c.fileStorage[cloudPath] = fs
+		c.fileStorageMutex.Unlock()
 	}
 	utils.GetLogger().Printf("[INFO] Sending AddFile request for file: %v, on node: %v.", file, c.MyNode().ID)
 	_, err = c.SendMessageToMe(AddFileMsg, file, cloudPath)
@@ -200,30 +221,36 @@ func (c *cloud) AddFileInPlace(file *datastore.File, cloudPath string, localPath
 }
 
 func (r request) OnAddFileRequest(file *datastore.File, filepath string) error {
+	defer r.Cloud.stateChanged()
 	filepath = CleanNetworkPath(filepath)
 	utils.GetLogger().Printf("[INFO] Node: %v, received AddFile request for file: %v.", r.Cloud.MyNode().ID, file)
 
 	c := r.Cloud
-	c.networkMutex.RLock()
-	folder, err := c.network.GetFolder(path.Dir(filepath))
-	if err != nil {
-		c.networkMutex.RUnlock()
-		return err
-	}
-	ok := folder.Files.Contains(file)
-	c.networkMutex.RUnlock()
-	if ok {
-		return nil
-	}
-
 	c.networkMutex.Lock()
-	folder.Files.Add(file)
+	added, err := c.network.addFile(filepath, file)
 	c.networkMutex.Unlock()
+	if err != nil || !added {
+		return err
+	}
 
+	// The local path is found before locking the file storage, it reads the cloud folder.
+	inSync, fpath := c.isInFolderSync(filepath)
+	placeholders := inSync && c.syncsPlaceholders(filepath)
 	c.fileStorageMutex.Lock()
 	storage := c.fileStorage[filepath]
 	if storage == nil {
-		if ok, fpath := c.isInFolderSync(filepath); ok {
+		if placeholders {
+			c.fileStorage[filepath] = &datastore.PartialFileStore{
+				BaseFileStore: datastore.BaseFileStore{
+					FileID: file.ID,
+					Chunks: file.Chunks.Chunks,
+				},
+				FolderPath: c.config.FileStorageDir,
+			}
+			if err := writePlaceholder(fpath, filepath, file); err != nil {
+				utils.GetLogger().Printf("[ERROR] Writing placeholder of %v: %v.", filepath, err)
+			}
+		} else if inSync {
 			c.fileStorage[filepath] = &datastore.FullFileStore{
 				BaseFileStore: datastore.BaseFileStore{
 					FileID: file.ID,
@@ -252,7 +279,12 @@ func (r request) OnAddFileRequest(file *datastore.File, filepath string) error {
 
 // UpdateFile updates a file on the network's data store.
 // Does not update the actual chunks. File lock must be acquired for given path before.
+// The creation time, owner and user metadata of the file are kept from its previous version.
 func (c *cloud) UpdateFile(file *datastore.File, cloudPath string) error {
+	if previous, err := c.GetFile(cloudPath); err == nil {
+		file.InheritMetadata(previous)
+	}
+	c.setFileMetadata(file)
 	_, err := c.SendMessageToMe(UpdateFileMsg, file, cloudPath)
 	if err != nil {
 		return err
@@ -267,6 +299,7 @@ func (c *cloud) UpdateFile(file *datastore.File, cloudPath string) error {
 }
 
 func (r request) OnUpdateFileRequest(file *datastore.File, cloudpath string) error {
+	defer r.Cloud.stateChanged()
 	cloudpath = CleanNetworkPath(cloudpath)
 	utils.GetLogger().Printf("[INFO] received UpdateFile request for file: %v from: %v.", cloudpath, r.FromNode.ID)
 
@@ -279,55 +312,147 @@ func (r request) OnUpdateFileRequest(file *datastore.File, cloudpath string) err
 		return errors.New("node does not have the lock for the file acquired")
 	}
 
-	foldername, filename := path.Split(cloudpath)
-	c.networkMutex.Lock()
-	defer c.networkMutex.Unlock()
-	folder, err := c.network.GetFolder(foldername)
-	if err != nil {
-		return err
+	// Edits of synced files must be based on the current version, or they would overwrite another node's edit.
+	isConflict := func() bool {
+		current, err := c.network.GetFile(cloudpath)
+		return err == nil && file.Base != "" && file.Base != current.ID && file.ID != current.ID
+	}
+	c.networkMutex.RLock()
+	conflicting := isConflict()
+	c.networkMutex.RUnlock()
+	if conflicting {
+		return ErrSyncConflict
 	}
 
-	// Check that there is a file with existing name.
-	found := -1
-	for i := range folder.Files.Files {
-		if folder.Files.Files[i].Name == filename {
-			found = i
+	me := c.MyNode()
+	fromOther := r.FromNode.ID != me.ID
+	// The local copy is looked at before locking, it reads the local file and the sync. The requesting node holds the
+	// file lock, so the file does not change in the meantime.
+	var syncKey string
+	var conflict *SyncConflict
+	var conflictPath string
+	c.fileStorageMutex.RLock()
+	edited, isLocal := localCopy(c.fileStorage[cloudpath])
+	c.fileStorageMutex.RUnlock()
+	if isLocal {
+		syncKey = c.syncKey(edited.FilePath)
+		if fromOther && !c.syncTracker.get(syncKey).paused {
+			conflict, conflictPath = c.keepLocalEdit(cloudpath, edited, file)
+		}
+	}
+	keepConflict := false
+	defer func() {
+		if conflictPath != "" && !keepConflict {
+			os.Remove(conflictPath)
 		}
+	}()
+
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	if isConflict() {
+		return ErrSyncConflict
 	}
-	if found == -1 {
-		return errors.New("file " + filename + " was not found")
+	if err := c.network.replaceFile(cloudpath, file); err != nil {
+		return err
 	}
-	folder.Files.Files[found] = file
 
 	c.fileStorageMutex.Lock()
 	defer c.fileStorageMutex.Unlock()
 
 	if fileStore := c.fileStorage[cloudpath]; fileStore != nil {
+		local, isLocal := localCopy(fileStore)
+		if isLocal && syncKey != "" && c.syncTracker.get(syncKey).paused {
+			// The local copy is reconciled with the cloud version when the sync is resumed.
+			return nil
+		}
+		if isLocal && fromOther {
+			local.BeginWrite()
+			if conflict != nil && local.FilePath == edited.FilePath {
+				// The local copy has other contents than its chunks, so the whole file is downloaded.
+				keepConflict = true
+				fileStore.SetChunks(nil)
+			}
+		}
+		if !keepConflict {
+			conflict = nil
+		}
+		if isLocal {
+			local.FileID = file.ID
+		}
+		partial, isPartial := fileStore.(*datastore.PartialFileStore)
+		var sizeBefore uint64
+		if isPartial {
+			sizeBefore = partial.UniqueSize()
+		}
 		newChunks, _ := fileStore.SetChunks(file.Chunks.Chunks)
+		if isPartial {
+			if sizeAfter := partial.UniqueSize(); sizeAfter < sizeBefore {
+				c.releaseStorage(sizeBefore - sizeAfter)
+			}
+		}
+		var finish func(err error)
+		if isLocal && fromOther {
+			if syncKey == "" {
+				// The local copy was stored in the meantime.
+				syncKey = local.FilePath
+			}
+			finish = c.syncTracker.transfer(syncKey, true)
+		}
 		go func() {
+			complete := true
 			for _, chunk := range newChunks {
-				if r.FromNode.ID != c.MyNode().ID {
+				if fromOther {
 					res, err := r.FromNode.client.SendMessage(GetChunkMsg, cloudpath, chunk.ID)
-					if err == nil {
+					if err != nil {
+						complete = false
+					} else {
 						content := res[0].([]byte)
-						fileStore.StoreChunk(chunk.ID, content)
+						if err := c.storeChunk(fileStore, chunk.ID, content); err != nil {
+							utils.GetLogger().Printf("[ERROR] Storing chunk %v: %v.", chunk.ID, err)
+							complete = false
+							continue
+						}
 					}
 				}
 				go c.updateChunkNodes(chunk.ID, r.Cloud.MyNode().ID)
 			}
+			if isLocal {
+				if err := file.RestoreFileInfo(local.FilePath); err != nil {
+					utils.GetLogger().Printf("[WARN] Restoring file info of %v: %v.", local.FilePath, err)
+				}
+				if complete {
+					c.recordSynced(cloudpath, local.FilePath, file)
+				}
+				if fromOther {
+					local.EndWrite()
+					if complete {
+						finish(nil)
+					} else {
+						finish(errors.New("download of " + cloudpath + " did not complete"))
+					}
+				}
+			}
+			if conflict != nil {
+				if err := c.addConflictCopy(*conflict, conflictPath, file.Chunks.ChunkSize); err != nil {
+					utils.GetLogger().Printf("[ERROR] Adding conflict copy of %v: %v.", cloudpath, err)
+				}
+			}
 		}()
 	}
 	return nil
 }
 
-// DeleteFile deletes a file on the network's data store.
-// Will delete stored chunks as well. File lock must be acquired for given path before.
-func (c *cloud) DeleteFile(path string) error {
-	_, err := c.SendMessageToMe(DeleteFileMsg, path)
+// SetFileMetadata replaces the user metadata of a file on the network's data store. Empty metadata clears it.
+// File lock must be acquired for given path before.
+func (c *cloud) SetFileMetadata(cloudPath string, metadata map[string]string) error {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	_, err := c.SendMessageToMe(SetFileMetadataMsg, cloudPath, metadata)
 	if err != nil {
 		return err
 	}
-	res := c.SendMessageAllOthers(DeleteFileMsg, path)
+	res := c.SendMessageAllOthers(SetFileMetadataMsg, cloudPath, metadata)
 	for _, r := range res {
 		if r.Error != nil {
 			return r.Error
@@ -336,47 +461,73 @@ func (c *cloud) DeleteFile(path string) error {
 	return nil
 }
 
-func (r request) OnDeleteFileRequest(filepath string) error {
-	filepath = CleanNetworkPath(filepath)
-	utils.GetLogger().Printf("[INFO] received DeleteFile request for file: %v from: %v.", filepath, r.FromNode.ID)
+func (r request) OnSetFileMetadataRequest(cloudPath string, metadata map[string]string) error {
+	defer r.Cloud.stateChanged()
+	cloudPath = CleanNetworkPath(cloudPath)
+	utils.GetLogger().Printf("[INFO] received SetFileMetadata request for file: %v from: %v.", cloudPath, r.FromNode.ID)
 
 	c := r.Cloud
 
 	r.Cloud.fileLockMutex.Lock()
-	lockedBy, isLocked := r.Cloud.fileLocks[filepath]
+	lockedBy, isLocked := r.Cloud.fileLocks[cloudPath]
 	r.Cloud.fileLockMutex.Unlock()
 	if !isLocked || lockedBy != r.FromNode.ID {
 		return errors.New("node does not have the lock for the file acquired")
 	}
 
-	foldername, filename := path.Split(filepath)
 	c.networkMutex.Lock()
 	defer c.networkMutex.Unlock()
-	folder, err := c.network.GetFolder(foldername)
+	current, err := c.network.GetFile(cloudPath)
 	if err != nil {
 		return err
 	}
+	// The file is replaced by a copy, callers of GetFile may still read the current one.
+	file := current.Copy(current.Name)
+	file.Metadata = nil
+	if len(metadata) > 0 {
+		file.Metadata = metadata
+	}
+	return c.network.replaceFile(cloudPath, file)
+}
 
-	// Check that there is a file with existing name.
-	found := -1
-	for i := range folder.Files.Files {
-		if folder.Files.Files[i].Name == filename {
-			found = i
-		}
+// DeleteFile deletes a file on the network's data store.
+// Will delete stored chunks as well. File lock must be acquired for given path before.
+func (c *cloud) DeleteFile(path string) error {
+	_, err := c.SendMessageToMe(DeleteFileMsg, path)
+	if err != nil {
+		return err
 	}
-	if found == -1 {
-		return errors.New("file " + filename + " was not found")
+	res := c.SendMessageAllOthers(DeleteFileMsg, path)
+	for _, r := range res {
+		if r.Error != nil {
+			return r.Error
+		}
 	}
+	return nil
+}
 
-	folder.Files.Files = append(folder.Files.Files[:found], folder.Files.Files[found+1:]...)
+func (r request) OnDeleteFileRequest(filepath string) error {
+	defer r.Cloud.stateChanged()
+	filepath = CleanNetworkPath(filepath)
+	utils.GetLogger().Printf("[INFO] received DeleteFile request for file: %v from: %v.", filepath, r.FromNode.ID)
 
-	r.Cloud.fileStorageMutex.RLock()
-	storage := r.Cloud.fileStorage[filepath]
-	r.Cloud.fileStorageMutex.RUnlock()
+	c := r.Cloud
 
-	storage.DeleteAllContent()
-	//storage.SetChunks([]datastore.Chunk{})
+	r.Cloud.fileLockMutex.Lock()
+	lockedBy, isLocked := r.Cloud.fileLocks[filepath]
+	r.Cloud.fileLockMutex.Unlock()
+	if !isLocked || lockedBy != r.FromNode.ID {
+		return errors.New("node does not have the lock for the file acquired")
+	}
 
+	c.networkMutex.Lock()
+	if _, err := c.network.removeFile(filepath); err != nil {
+		c.networkMutex.Unlock()
+		return err
+	}
+	c.deleteFileStorage(filepath)
+	c.networkMutex.Unlock()
+	c.removeSyncedPlaceholder(filepath)
 	return nil
 }
 
@@ -397,6 +548,7 @@ func (c *cloud) MoveFile(path string, newpath string) error {
 }
 
 func (r request) OnMoveFileRequest(filepath string, newfilepath string) error {
+	defer r.Cloud.stateChanged()
 	filepath = CleanNetworkPath(filepath)
 	newfilepath = CleanNetworkPath(newfilepath)
 	utils.GetLogger().Printf("[INFO] received MoveFile request for file: %v from: %v.", filepath, r.FromNode.ID)
@@ -414,42 +566,33 @@ func (r request) OnMoveFileRequest(filepath string, newfilepath string) error {
 		return errors.New("node does not have the lock for the move-to file acquired")
 	}
 
-	folderName, filename := path.Split(filepath)
-	utils.GetLogger().Printf("[DEBUG] Split into folderName: '%s', filename: '%s'", folderName, filename)
-	c.networkMutex.Lock()
-	defer c.networkMutex.Unlock()
-	folder, err := c.network.GetFolder(folderName)
-
-	if err != nil {
+	if err := c.moveFile(filepath, newfilepath); err != nil {
 		return err
 	}
-	newFolderName, newFilename := path.Split(newfilepath)
-	newFolder, err := c.network.GetFolder(newFolderName)
-	if err != nil {
-		return err
-	}
-	if newFolder.Files.ContainsName(newFilename) {
+	c.syncMovedFile(filepath, newfilepath)
+	return nil
+}
+
+// moveFile moves the file and its file store to the new path.
+func (c *cloud) moveFile(filepath string, newfilepath string) error {
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	if _, err := c.network.GetFile(newfilepath); err == nil {
 		return errors.New("file with that name already exists")
 	}
 
 	// Get current file and remove it.
-	found := -1
-	for i := range folder.Files.Files {
-		if folder.Files.Files[i].Name == filename {
-			found = i
-		}
+	file, err := c.network.removeFile(filepath)
+	if err != nil {
+		return err
 	}
-	if found == -1 {
-		return errors.New("file " + filename + " was not found")
+	file.Name = path.Base(newfilepath)
+	if _, err := c.network.addFile(newfilepath, file); err != nil {
+		return err
 	}
-	file := folder.Files.Files[found]
-	folder.Files.Files = append(folder.Files.Files[:found], folder.Files.Files[found+1:]...)
-	file.Name = newFilename
-	newFolder.Files.Add(file)
 
 	c.fileStorageMutex.Lock()
-	c.fileStorage[newfilepath] = c.fileStorage[filepath]
-	delete(c.fileStorage, filepath)
+	c.moveFileStorage(filepath, newfilepath)
 	c.fileStorageMutex.Unlock()
 	return nil
 }
@@ -475,6 +618,7 @@ func (n *cloudNode) SaveChunk(filePath string, chunk datastore.Chunk, contents [
 
 // OnSaveChunkRequest persistently stores a chunk given by its contents, as the given cloud path.
 func (r request) OnSaveChunkRequest(sr SaveChunkRequest) error {
+	defer r.Cloud.stateChanged()
 	utils.GetLogger().Printf("[INFO] Node: %v, received SaveChunk request.", r.Cloud.MyNode().ID)
 	utils.GetLogger().Printf("[DEBUG] Got SaveChunkRequest chunk: %v.", sr.Chunk)
 
@@ -487,15 +631,11 @@ func (r request) OnSaveChunkRequest(sr SaveChunkRequest) error {
 	if storage == nil {
 		return errors.New("no storage found for file")
 	}
-	if err := storage.StoreChunk(sr.Chunk.ID, sr.Contents); err != nil {
+	if err := r.Cloud.storeChunk(storage, sr.Chunk.ID, sr.Contents); err != nil {
 		return err
 	}
 	utils.GetLogger().Printf("[DEBUG] Finished saving chunk.")
 
-	benchmarkState := r.Cloud.BenchmarkState()
-	benchmarkState.StorageSpaceUsed += uint64(len(sr.Contents))
-	r.Cloud.SetBenchmarkState(benchmarkState)
-
 	err := r.Cloud.updateChunkNodes(sr.Chunk.ID, r.Cloud.MyNode().ID)
 	return err
 }
@@ -503,9 +643,7 @@ func (r request) OnSaveChunkRequest(sr SaveChunkRequest) error {
 func (c *cloud) GetChunk(filePath string, chunkID datastore.ChunkID) (content []byte, err error) {
 	utils.GetLogger().Printf("[INFO] Downloading file: %v chunk: %v", filePath, chunkID)
 	filePath = CleanNetworkPath(filePath)
-	c.networkMutex.RLock()
-	nodes := c.network.ChunkNodes[chunkID]
-	c.networkMutex.RUnlock()
+	nodes := c.chunkHolders(chunkID)
 
 	var lastErr error
 	for _, n := range nodes {
@@ -540,7 +678,7 @@ func (r request) OnGetChunkRequest(filePath string, chunkID datastore.ChunkID) (
 
 // updateChunkNodes updates the node's ChunkNodes data structure.
 // It maps the chunkID key and appends the nodeID value.
-// updateChunkNodes recursively sends out the update to other nodes.
+// If the node is this node, it is published as a provider of the chunk in the DHT.
 func (c *cloud) updateChunkNodes(chunkID datastore.ChunkID, nodeID string) error {
 	utils.GetLogger().Printf("[INFO] Sending updateChunkNodes request.")
 	_, err := c.SendMessageToMe(updateChunkNodesMsg, chunkID, nodeID)
@@ -548,11 +686,14 @@ func (c *cloud) updateChunkNodes(chunkID datastore.ChunkID, nodeID string) error
 		// FIXME: a way to propagate errors returned from requests, i.e. take the place of communication.go errors
 		utils.GetLogger().Printf("[ERROR] %v.", err)
 	}
-	c.SendMessageAllOthers(updateChunkNodesMsg, chunkID, nodeID)
+	if nodeID == c.MyNode().ID {
+		c.provide(chunkID)
+	}
 	return err
 }
 
 func (r request) onUpdateChunkNodes(chunkID datastore.ChunkID, nodeID string) {
+	defer r.Cloud.stateChanged()
 	utils.GetLogger().Printf("[INFO] Node: %v, received onUpdateChunkNodes request.", r.FromNode.ID)
 	utils.GetLogger().Printf("[DEBUG] Received request at client: %v.", &r.FromNode.client)
 	utils.GetLogger().Printf("[DEBUG] Updating ChunkNodes with ChunkID: %v, NodeID: %v.",
@@ -589,6 +730,94 @@ func (r request) onUpdateChunkNodes(chunkID datastore.ChunkID, nodeID string) {
 	utils.GetLogger().Printf("[DEBUG] Finished updating ChunkNodes: %v.", c.network.ChunkNodes)
 }
 
+// DeleteChunk removes the node's local copy of a file's chunk. The node stops being listed as a holder of the chunk.
+func (n *cloudNode) DeleteChunk(filePath string, chunkID datastore.ChunkID) error {
+	utils.GetLogger().Printf("[INFO] Sending DeleteChunk request for file: %v, chunk: %v, on node: %v.",
+		filePath, chunkID, n.ID)
+	_, err := n.client.SendMessage(DeleteChunkMsg, filePath, chunkID)
+	return err
+}
+
+// OnDeleteChunkRequest deletes the locally stored content of a chunk belonging to the file at the given cloud path.
+func (r request) OnDeleteChunkRequest(filePath string, chunkID datastore.ChunkID) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] Node: %v, received DeleteChunk request for chunk: %v.", r.Cloud.MyNode().ID, chunkID)
+	c := r.Cloud
+
+	c.fileStorageMutex.RLock()
+	storage := c.fileStorage[filePath]
+	c.fileStorageMutex.RUnlock()
+	if storage == nil {
+		return errors.New("file is not stored")
+	}
+	chunk, ok := storage.Chunk(chunkID)
+	if !ok {
+		return errors.New("chunk does not belong to the file")
+	}
+	var size uint64
+	if partial, ok := storage.(*datastore.PartialFileStore); ok {
+		size = partial.UniqueChunkSize(chunk.ID)
+	}
+	if err := storage.DeleteChunk(chunkID); err != nil {
+		return err
+	}
+	c.releaseStorage(size)
+	return c.releaseChunkNode(filePath, chunkID)
+}
+
+// releaseChunkNode stops listing this node as a holder of the chunk, after the file store of the cloud path stopped
+// holding it. Files with the same content share chunk IDs, the chunk is still advertised if another file holds it.
+func (c *cloud) releaseChunkNode(filePath string, chunkID datastore.ChunkID) error {
+	shared := false
+	c.fileStorageMutex.RLock()
+	for p, s := range c.fileStorage {
+		if p != filePath && s.HasChunk(chunkID) {
+			shared = true
+			break
+		}
+	}
+	c.fileStorageMutex.RUnlock()
+	if shared {
+		return nil
+	}
+	return c.removeChunkNodes(chunkID, c.MyNode().ID)
+}
+
+// removeChunkNodes removes the nodeID value from the chunkID key in ChunkNodes. If the node is this node, its provider
+// records of the chunk are withdrawn from the DHT.
+func (c *cloud) removeChunkNodes(chunkID datastore.ChunkID, nodeID string) error {
+	utils.GetLogger().Printf("[INFO] Sending removeChunkNodes request.")
+	_, err := c.SendMessageToMe(removeChunkNodesMsg, chunkID, nodeID)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v.", err)
+	}
+	if nodeID == c.MyNode().ID {
+		c.unprovide(chunkID)
+	}
+	return err
+}
+
+func (r request) onRemoveChunkNodes(chunkID datastore.ChunkID, nodeID string) {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[DEBUG] Removing from ChunkNodes ChunkID: %v, NodeID: %v.", chunkID, nodeID)
+
+	c := r.Cloud
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	chunkNodes := c.network.ChunkNodes[chunkID]
+	remaining := make([]string, 0, len(chunkNodes))
+	for _, nID := range chunkNodes {
+		if nID != nodeID {
+			remaining = append(remaining, nID)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(c.network.ChunkNodes, chunkID)
+		return
+	}
+	c.network.ChunkNodes[chunkID] = remaining
+}
+
 func (c *cloud) LockFile(path string) bool {
 	path = CleanNetworkPath(path)
 	// Check that we can lock the file on our client first.
@@ -625,6 +854,12 @@ func (r request) OnLockFileRequest(path string) error {
 	if isLocked {
 		return errors.New("file locked by: " + lockedBy)
 	}
+	// Locking a directory locks its whole subtree, so locks of other nodes may not be above or below the path.
+	for lockedPath, lockedBy := range r.Cloud.fileLocks {
+		if lockedBy != r.FromNode.ID && (isSubPath(lockedPath, path) || isSubPath(path, lockedPath)) {
+			return errors.New(lockedPath + " locked by: " + lockedBy)
+		}
+	}
 	r.Cloud.fileLocks[path] = r.FromNode.ID
 	return nil
 }
@@ -667,8 +902,12 @@ func createDataStoreRequestHandler(node *cloudNode, cloud *cloud) func(string) i
 			return r.OnSaveChunkRequest
 		case GetChunkMsg:
 			return r.OnGetChunkRequest
+		case DeleteChunkMsg:
+			return r.OnDeleteChunkRequest
 		case updateChunkNodesMsg:
 			return r.onUpdateChunkNodes
+		case removeChunkNodesMsg:
+			return r.onRemoveChunkNodes
 		case LockFileMsg:
 			return r.OnLockFileRequest
 		case UnlockFileMsg:
@@ -677,6 +916,8 @@ func createDataStoreRequestHandler(node *cloudNode, cloud *cloud) func(string) i
 			return r.OnUpdateFileRequest
 		case MoveFileMsg:
 			return r.OnMoveFileRequest
+		case SetFileMetadataMsg:
+			return r.OnSetFileMetadataRequest
 		case DeleteFileMsg:
 			return r.OnDeleteFileRequest
 		case CreateDirectoryMsg:
@@ -9,6 +9,15 @@ import (
 	"time"
 )
 
+// lookupChunkNodes looks up the holders of the chunks through the DHT.
+func lookupChunkNodes(c Cloud, chunks []datastore.Chunk) ChunkNodes {
+	IDs := make([]datastore.ChunkID, 0, len(chunks))
+	for _, chunk := range chunks {
+		IDs = append(IDs, chunk.ID)
+	}
+	return c.(*cloud).findProviders(IDs...)
+}
+
 // TODO: fix this test after!
 func TestNode_AddFileSaveChunk(t *testing.T) {
 	numNodes := 4
@@ -77,7 +86,7 @@ func TestNode_AddFileSaveChunk(t *testing.T) {
 	// Check that we have a required ChunkNodes.
 	t.Logf("Updated chunk-node locations: %v.", cloud.Network().ChunkNodes)
 	chunks := file.Chunks.Chunks
-	actualChunkNodes := cloud.Network().ChunkNodes
+	actualChunkNodes := lookupChunkNodes(cloud, chunks)
 	allNodes := []string{cloud.Network().Nodes[0].ID, cloud.Network().Nodes[1].ID, cloud.Network().Nodes[2].ID, cloud.Network().Nodes[3].ID}
 	expectedChunkNodes := ChunkNodes{
 		chunks[0].ID: allNodes,
@@ -121,11 +130,11 @@ func TestNode_AddFileSaveChunk(t *testing.T) {
 		}
 	}
 
-	// Check that all clouds have same ChunkNodes
-	chunkLocations := cloud.Network().ChunkNodes
+	// Check that all clouds find the same chunk locations.
+	chunkLocations := lookupChunkNodes(cloud, chunks)
 	t.Logf("ChunkNodes in main cloud representation: %v", chunkLocations)
 	for _, c := range clouds {
-		chunkLocationsOther := c.Network().ChunkNodes
+		chunkLocationsOther := lookupChunkNodes(c, chunks)
 		t.Logf("ChunkNodes in another cloud representation: %v.", chunkLocationsOther)
 		for k := range chunkLocations {
 			v := chunkLocations[k]
@@ -242,7 +251,7 @@ func TestNodeFileOperations(t *testing.T) {
 	if err := cloud.CreateDirectory("/folder2"); err != nil {
 		t.Errorf("CreateDirectory(): %v", err)
 	}
-	if err := cloud.DeleteDirectory("/folder2"); err != nil {
+	if err := cloud.DeleteDirectory("/folder2", false); err != nil {
 		t.Errorf("CreateDirectory(): %v", err)
 	}
 
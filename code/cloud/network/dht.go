@@ -0,0 +1,324 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"cloud/utils"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages used for the chunk location DHT.
+const (
+	ProvideMsg       = "Provide"
+	UnprovideMsg     = "Unprovide"
+	FindProvidersMsg = "FindProviders"
+)
+
+// dhtReplication is the number of nodes closest to a chunk that store the chunk's provider records, Kademlia's k.
+const dhtReplication = 4
+
+// Provider records expire after providerRecordTTL, unless the provider publishes them again. Providers republish their
+// records every providerRepublishInterval, which also moves them to nodes that became responsible for the chunks.
+// Records are also republished nodesChangedDelay after nodes connect or disconnect, which changes the nodes that are
+// responsible for the chunks.
+var (
+	providerRecordTTL         = 24 * time.Hour
+	providerRepublishInterval = time.Hour
+	nodesChangedDelay         = time.Second
+)
+
+func init() {
+	gob.Register(ChunkNodes{})
+	gob.Register([]datastore.ChunkID{})
+
+	handlers = append(handlers, createDHTRequestHandler)
+}
+
+func createDHTRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case ProvideMsg:
+			return r.OnProvideRequest
+		case UnprovideMsg:
+			return r.OnUnprovideRequest
+		case FindProvidersMsg:
+			return r.OnFindProvidersRequest
+		}
+		return nil
+	}
+}
+
+// providerRecords are the provider records a node stores for the chunks it is responsible for. Each chunk maps the
+// IDs of the nodes that hold it to the time their record expires.
+type providerRecords struct {
+	records map[datastore.ChunkID]map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func (p *providerRecords) add(chunkID datastore.ChunkID, nodeID string, expires time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.records == nil {
+		p.records = make(map[datastore.ChunkID]map[string]time.Time)
+	}
+	if p.records[chunkID] == nil {
+		p.records[chunkID] = make(map[string]time.Time)
+	}
+	p.records[chunkID][nodeID] = expires
+}
+
+func (p *providerRecords) remove(chunkID datastore.ChunkID, nodeID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.records[chunkID], nodeID)
+	if len(p.records[chunkID]) == 0 {
+		delete(p.records, chunkID)
+	}
+}
+
+// providers returns the nodes with a record for the chunk that has not expired.
+func (p *providerRecords) providers(chunkID datastore.ChunkID, now time.Time) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	providers := make([]string, 0, len(p.records[chunkID]))
+	for nodeID, expires := range p.records[chunkID] {
+		if now.Before(expires) {
+			providers = append(providers, nodeID)
+		}
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// expire removes the records that expired, and returns how many were removed.
+func (p *providerRecords) expire(now time.Time) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	removed := 0
+	for chunkID, nodes := range p.records {
+		for nodeID, expires := range nodes {
+			if !now.Before(expires) {
+				delete(nodes, nodeID)
+				removed++
+			}
+		}
+		if len(nodes) == 0 {
+			delete(p.records, chunkID)
+		}
+	}
+	return removed
+}
+
+// dhtKey maps node and chunk IDs to the DHT's key space. Both are hex encoded SHA-256 hashes.
+func dhtKey(ID string) []byte {
+	if key, err := hex.DecodeString(ID); err == nil && len(key) == sha256.Size {
+		return key
+	}
+	sum := sha256.Sum256([]byte(ID))
+	return sum[:]
+}
+
+// xorDistance returns the Kademlia distance between two keys.
+func xorDistance(a, b []byte) []byte {
+	d := make([]byte, len(a))
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closestNodes returns the k node IDs closest to the key, closest first.
+func closestNodes(key []byte, IDs []string, k int) []string {
+	sorted := append([]string(nil), IDs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(xorDistance(key, dhtKey(sorted[i])), xorDistance(key, dhtKey(sorted[j]))) < 0
+	})
+	if len(sorted) > k {
+		sorted = sorted[:k]
+	}
+	return sorted
+}
+
+// responsibleNodes groups the chunks by the online nodes that should store their provider records.
+func (c *cloud) responsibleNodes(chunkIDs []datastore.ChunkID) map[string][]datastore.ChunkID {
+	c.NodesMutex.RLock()
+	online := make([]string, 0, len(c.Nodes))
+	for ID := range c.Nodes {
+		online = append(online, ID)
+	}
+	c.NodesMutex.RUnlock()
+
+	groups := make(map[string][]datastore.ChunkID)
+	for _, chunkID := range chunkIDs {
+		for _, ID := range closestNodes(dhtKey(string(chunkID)), online, dhtReplication) {
+			groups[ID] = append(groups[ID], chunkID)
+		}
+	}
+	return groups
+}
+
+// sendDHT sends the message to the nodes responsible for the chunks, each with the chunks it is responsible for.
+func (c *cloud) sendDHT(msg string, chunkIDs []datastore.ChunkID) []Response {
+	groups := c.responsibleNodes(chunkIDs)
+	responses := make(chan Response, len(groups))
+	for ID, group := range groups {
+		go func(ID string, group []datastore.ChunkID) {
+			res := Response{Node: c.GetCloudNode(ID)}
+			if res.Node == nil {
+				res.Node = &cloudNode{ID: ID}
+				res.Error = errors.New("node is not online")
+			} else {
+				res.Returns, res.Error = res.Node.client.SendMessage(msg, group)
+			}
+			responses <- res
+		}(ID, group)
+	}
+	ret := make([]Response, 0, len(groups))
+	for range groups {
+		ret = append(ret, <-responses)
+	}
+	return ret
+}
+
+// provide publishes this node as a provider of the chunks.
+func (c *cloud) provide(chunkIDs ...datastore.ChunkID) {
+	for _, res := range c.sendDHT(ProvideMsg, chunkIDs) {
+		if res.Error != nil {
+			utils.GetLogger().Printf("[WARN] Publishing provider records on %v: %v.", res.Node.ID, res.Error)
+		}
+	}
+}
+
+// unprovide withdraws this node as a provider of the chunks.
+func (c *cloud) unprovide(chunkIDs ...datastore.ChunkID) {
+	for _, res := range c.sendDHT(UnprovideMsg, chunkIDs) {
+		if res.Error != nil {
+			utils.GetLogger().Printf("[WARN] Withdrawing provider records on %v: %v.", res.Node.ID, res.Error)
+		}
+	}
+}
+
+// findProviders looks up the nodes holding each of the chunks in the DHT.
+func (c *cloud) findProviders(chunkIDs ...datastore.ChunkID) ChunkNodes {
+	found := make(ChunkNodes)
+	for _, res := range c.sendDHT(FindProvidersMsg, chunkIDs) {
+		if res.Error != nil {
+			utils.GetLogger().Printf("[WARN] Finding providers on %v: %v.", res.Node.ID, res.Error)
+			continue
+		}
+		for chunkID, providers := range res.Returns[0].(ChunkNodes) {
+			for _, p := range providers {
+				if !containsString(found[chunkID], p) {
+					found[chunkID] = append(found[chunkID], p)
+				}
+			}
+		}
+	}
+
+	// This node always knows about its own chunks, even before its records are published.
+	myID := c.MyNode().ID
+	c.networkMutex.RLock()
+	for _, chunkID := range chunkIDs {
+		if containsString(c.network.ChunkNodes[chunkID], myID) && !containsString(found[chunkID], myID) {
+			found[chunkID] = append(found[chunkID], myID)
+		}
+	}
+	c.networkMutex.RUnlock()
+	return found
+}
+
+// chunkHolders returns the IDs of the nodes that hold the chunk.
+func (c *cloud) chunkHolders(chunkID datastore.ChunkID) []string {
+	return c.findProviders(chunkID)[chunkID]
+}
+
+// republish publishes the provider records of all of the chunks this node holds again, and drops expired records.
+func (c *cloud) republish() {
+	myID := c.MyNode().ID
+	c.networkMutex.RLock()
+	held := make([]datastore.ChunkID, 0)
+	for chunkID, nodes := range c.network.ChunkNodes {
+		if containsString(nodes, myID) {
+			held = append(held, chunkID)
+		}
+	}
+	c.networkMutex.RUnlock()
+
+	if len(held) != 0 {
+		c.provide(held...)
+	}
+	if removed := c.providerRecords.expire(time.Now()); removed != 0 {
+		utils.GetLogger().Printf("[DEBUG] Expired %d provider records.", removed)
+	}
+}
+
+// nodesChanged signals the DHT maintenance that nodes connected or disconnected.
+func (c *cloud) nodesChanged() {
+	select {
+	case c.nodesChangedCh <- struct{}{}:
+	default:
+	}
+}
+
+// maintainDHT republishes this node's provider records periodically, and after nodes connect or disconnect. It returns
+// once the cloud is closed.
+func (c *cloud) maintainDHT() {
+	ticker := time.NewTicker(providerRepublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		case <-c.nodesChangedCh:
+			// Nodes often connect together, the records are published once they did.
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(nodesChangedDelay):
+			}
+			select {
+			case <-c.nodesChangedCh:
+			default:
+			}
+		}
+		c.republish()
+	}
+}
+
+func (r request) OnProvideRequest(chunkIDs []datastore.ChunkID) error {
+	expires := time.Now().Add(providerRecordTTL)
+	for _, chunkID := range chunkIDs {
+		r.Cloud.providerRecords.add(chunkID, r.FromNode.ID, expires)
+	}
+	return nil
+}
+
+func (r request) OnUnprovideRequest(chunkIDs []datastore.ChunkID) error {
+	for _, chunkID := range chunkIDs {
+		r.Cloud.providerRecords.remove(chunkID, r.FromNode.ID)
+	}
+	return nil
+}
+
+func (r request) OnFindProvidersRequest(chunkIDs []datastore.ChunkID) ChunkNodes {
+	now := time.Now()
+	found := make(ChunkNodes)
+	for _, chunkID := range chunkIDs {
+		if providers := r.Cloud.providerRecords.providers(chunkID, now); len(providers) != 0 {
+			found[chunkID] = providers
+		}
+	}
+	return found
+}
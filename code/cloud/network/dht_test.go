@@ -0,0 +1,120 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"testing"
+	"time"
+)
+
+func TestClosestNodes(t *testing.T) {
+	key := dhtKey("00000000000000000000000000000000000000000000000000000000000000ff")
+	IDs := []string{
+		"ff000000000000000000000000000000000000000000000000000000000000ff",
+		"00000000000000000000000000000000000000000000000000000000000000fe",
+		"0f000000000000000000000000000000000000000000000000000000000000ff",
+	}
+	closest := closestNodes(key, IDs, 2)
+	if len(closest) != 2 || closest[0] != IDs[1] || closest[1] != IDs[2] {
+		t.Errorf("Unexpected closest nodes: %v.", closest)
+	}
+	if d := xorDistance(key, key); !bytes.Equal(d, make([]byte, len(key))) {
+		t.Errorf("Expected zero distance to itself, got %x.", d)
+	}
+}
+
+func TestProviderRecordsExpire(t *testing.T) {
+	p := providerRecords{}
+	now := time.Now()
+	p.add("chunk", "a", now.Add(time.Hour))
+	p.add("chunk", "b", now.Add(-time.Second))
+	if providers := p.providers("chunk", now); len(providers) != 1 || providers[0] != "a" {
+		t.Errorf("Expected only provider a, got %v.", providers)
+	}
+	if removed := p.expire(now); removed != 1 {
+		t.Errorf("Expected 1 expired record, got %d.", removed)
+	}
+	p.remove("chunk", "a")
+	if len(p.records) != 0 {
+		t.Errorf("Expected no records left, got %v.", p.records)
+	}
+}
+
+func TestFindProviders(t *testing.T) {
+	clouds, err := CreateTestClouds(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkID := datastore.ChunkID("chunk")
+	holder := clouds[1].(*cloud)
+	if err := holder.updateChunkNodes(chunkID, holder.MyNode().ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range clouds {
+		holders := c.(*cloud).chunkHolders(chunkID)
+		if len(holders) != 1 || holders[0] != holder.MyNode().ID {
+			t.Errorf("Cloud %d found holders %v, expected %v.", i, holders, holder.MyNode().ID)
+		}
+		// Chunk locations are not replicated to every node.
+		if _, ok := c.Network().ChunkNodes[chunkID]; ok && c != clouds[1] {
+			t.Errorf("Cloud %d has the chunk in its ChunkNodes.", i)
+		}
+	}
+
+	if err := holder.removeChunkNodes(chunkID, holder.MyNode().ID); err != nil {
+		t.Fatal(err)
+	}
+	if holders := clouds[0].(*cloud).chunkHolders(chunkID); len(holders) != 0 {
+		t.Errorf("Expected no holders after withdrawing, got %v.", holders)
+	}
+}
+
+func TestRepublishOnNodeConnect(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := clouds[0].(*cloud)
+	defer holder.Close()
+	chunkID := datastore.ChunkID("chunk")
+	holder.networkMutex.Lock()
+	holder.network.ChunkNodes[chunkID] = []string{holder.MyNode().ID}
+	holder.networkMutex.Unlock()
+
+	// The new node becomes responsible for the chunk's records, which the holder publishes to it once it connects.
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID, err := PublicKeyToID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := BootstrapToNetwork(holder.MyNode().IP, Node{ID: ID, Name: "Node 2"}, key, CloudConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Close()
+	waitFor(t, "Provider records were not published to the connected node.", func() bool {
+		providers := joined.(*cloud).providerRecords.providers(chunkID, time.Now())
+		return len(providers) == 1 && providers[0] == holder.MyNode().ID
+	})
+}
+
+func TestCloseStopsDHTMaintenance(t *testing.T) {
+	c := &cloud{closed: make(chan struct{}), nodesChangedCh: make(chan struct{}, 1)}
+	stopped := make(chan struct{})
+	go func() {
+		c.maintainDHT()
+		close(stopped)
+	}()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DHT maintenance did not stop when the cloud was closed.")
+	}
+}
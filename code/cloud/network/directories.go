@@ -0,0 +1,264 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"encoding/gob"
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// Messages for operations on whole directories and copies.
+const (
+	MoveDirectoryMsg = "MoveDirectory"
+	CopyFileMsg      = "CopyFile"
+	CopyDirectoryMsg = "CopyDirectory"
+)
+
+func init() {
+	gob.Register(CopyRequest{})
+
+	handlers = append(handlers, createDirectoryRequestHandler)
+}
+
+func createDirectoryRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case MoveDirectoryMsg:
+			return r.OnMoveDirectoryRequest
+		case CopyFileMsg:
+			return r.OnCopyFileRequest
+		case CopyDirectoryMsg:
+			return r.OnCopyDirectoryRequest
+		}
+		return nil
+	}
+}
+
+// CopyRequest asks the nodes to copy a file or directory. Time is when the copy was made, it becomes the creation
+// time of the copied files.
+type CopyRequest struct {
+	Path    string
+	NewPath string
+	Time    time.Time
+}
+
+// holdsLock returns whether the node sending the request holds the lock for the path.
+func (r request) holdsLock(path string) bool {
+	r.Cloud.fileLockMutex.Lock()
+	defer r.Cloud.fileLockMutex.Unlock()
+	lockedBy, isLocked := r.Cloud.fileLocks[path]
+	return isLocked && lockedBy == r.FromNode.ID
+}
+
+// sendAll sends the message to this node first, then to all others. Returns the first error.
+func (c *cloud) sendAll(msg string, args ...interface{}) error {
+	if _, err := c.SendMessageToMe(msg, args...); err != nil {
+		return err
+	}
+	for _, r := range c.SendMessageAllOthers(msg, args...) {
+		if r.Error != nil {
+			return r.Error
+		}
+	}
+	return nil
+}
+
+// deleteFileStorage deletes the locally stored contents of the file and forgets its file store.
+func (c *cloud) deleteFileStorage(cloudPath string) {
+	c.forgetSynced(cloudPath)
+	c.fileStorageMutex.Lock()
+	storage := c.fileStorage[cloudPath]
+	delete(c.fileStorage, cloudPath)
+	c.fileStorageMutex.Unlock()
+
+	if storage != nil {
+		var size uint64
+		if partial, ok := storage.(*datastore.PartialFileStore); ok {
+			size = partial.UniqueSize()
+		}
+		storage.DeleteAllContent()
+		c.releaseStorage(size)
+	}
+}
+
+// moveFileStorage moves the file store of a file to its new path. fileStorageMutex must be held.
+func (c *cloud) moveFileStorage(cloudPath, newPath string) {
+	storage, ok := c.fileStorage[cloudPath]
+	if !ok {
+		return
+	}
+	if sync, ok := storage.(*datastore.SyncFileStore); ok {
+		sync.CloudPath = newPath
+	}
+	c.fileStorage[newPath] = storage
+	delete(c.fileStorage, cloudPath)
+}
+
+// copyFileStorage copies the locally stored chunks of a file to a file store for the copy at newPath. Chunks are not
+// sent over the network, every node copies the chunks it already holds.
+func (c *cloud) copyFileStorage(cloudPath, newPath string, file *datastore.File) error {
+	c.fileStorageMutex.RLock()
+	storage := c.fileStorage[cloudPath]
+	c.fileStorageMutex.RUnlock()
+	if storage == nil {
+		return nil
+	}
+
+	// The copy's chunk files are named after the store's file ID, which has to differ from the original's.
+	storeID := datastore.FileID(utils.HashFile([]byte(string(file.ID) + newPath)))
+	cp, copied, err := datastore.CopyFileStore(storage, file.Chunks.Chunks, storeID, c.config.FileStorageDir)
+	if err != nil {
+		return err
+	}
+	// Hard linked chunks do not take up more space.
+	c.accountStorage(copied)
+	c.fileStorageMutex.Lock()
+	c.fileStorage[newPath] = cp
+	c.fileStorageMutex.Unlock()
+	return nil
+}
+
+// MoveDirectory moves a directory, with all of its contents, to a new path.
+// File lock must be acquired for the directory's path and the new path.
+func (c *cloud) MoveDirectory(folderPath string, newPath string) error {
+	return c.sendAll(MoveDirectoryMsg, CleanNetworkPath(folderPath), CleanNetworkPath(newPath))
+}
+
+func (r request) OnMoveDirectoryRequest(folderPath string, newPath string) error {
+	defer r.Cloud.stateChanged()
+	folderPath = CleanNetworkPath(folderPath)
+	newPath = CleanNetworkPath(newPath)
+	utils.GetLogger().Printf("[INFO] received MoveDirectory request for: %v from: %v.", folderPath, r.FromNode.ID)
+
+	if !r.holdsLock(folderPath) || !r.holdsLock(newPath) {
+		return errors.New("node does not have the lock for the directories acquired")
+	}
+
+	files, err := r.Cloud.moveDirectory(folderPath, newPath)
+	if err != nil {
+		return err
+	}
+	r.Cloud.syncMovedDirectory(folderPath, newPath, files)
+	return nil
+}
+
+// moveDirectory moves the directory and the file stores of its files to the new path. Returns the old paths of the
+// moved files.
+func (c *cloud) moveDirectory(folderPath string, newPath string) ([]string, error) {
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	if !c.network.folderExists(folderPath) {
+		return nil, errors.New("directory not found")
+	}
+	if _, err := c.network.GetFile(newPath); err == nil || c.network.folderExists(newPath) {
+		return nil, errors.New("file or directory with that name already exists")
+	}
+
+	_, files := c.network.folderTree(folderPath)
+	if err := c.network.moveFolder(folderPath, newPath); err != nil {
+		return nil, err
+	}
+
+	moved := make([]string, 0, len(files))
+	c.fileStorageMutex.Lock()
+	for filePath := range files {
+		c.moveFileStorage(filePath, newPath+strings.TrimPrefix(filePath, folderPath))
+		moved = append(moved, filePath)
+	}
+	c.fileStorageMutex.Unlock()
+	return moved, nil
+}
+
+// CopyFile copies a file to a new path. The copy reuses the chunks of the file.
+// File lock must be acquired for the path and the new path.
+func (c *cloud) CopyFile(filePath string, newPath string) error {
+	return c.sendAll(CopyFileMsg, CopyRequest{
+		Path:    CleanNetworkPath(filePath),
+		NewPath: CleanNetworkPath(newPath),
+		Time:    time.Now(),
+	})
+}
+
+func (r request) OnCopyFileRequest(req CopyRequest) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] received CopyFile request for file: %v from: %v.", req.Path, r.FromNode.ID)
+
+	if !r.holdsLock(req.Path) || !r.holdsLock(req.NewPath) {
+		return errors.New("node does not have the lock for the files acquired")
+	}
+
+	c := r.Cloud
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	file, err := c.network.GetFile(req.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := c.network.GetFile(req.NewPath); err == nil || c.network.folderExists(req.NewPath) {
+		return errors.New("file or directory with that name already exists")
+	}
+	return r.copyFile(req.Path, req.NewPath, file, req.Time)
+}
+
+// copyFile adds a copy of the file at newPath, owned by the requesting node. networkMutex must be held.
+func (r request) copyFile(filePath, newPath string, file *datastore.File, created time.Time) error {
+	cp := file.Copy(path.Base(newPath))
+	cp.Created = created
+	cp.Owner = r.FromNode.ID
+	if _, err := r.Cloud.network.addFile(newPath, cp); err != nil {
+		return err
+	}
+	return r.Cloud.copyFileStorage(filePath, newPath, cp)
+}
+
+// CopyDirectory copies a directory, with all of its contents, to a new path. The copies reuse the chunks of the
+// files.
+// File lock must be acquired for the directory's path and the new path.
+func (c *cloud) CopyDirectory(folderPath string, newPath string) error {
+	return c.sendAll(CopyDirectoryMsg, CopyRequest{
+		Path:    CleanNetworkPath(folderPath),
+		NewPath: CleanNetworkPath(newPath),
+		Time:    time.Now(),
+	})
+}
+
+func (r request) OnCopyDirectoryRequest(req CopyRequest) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] received CopyDirectory request for: %v from: %v.", req.Path, r.FromNode.ID)
+
+	if !r.holdsLock(req.Path) || !r.holdsLock(req.NewPath) {
+		return errors.New("node does not have the lock for the directories acquired")
+	}
+	if req.Path == req.NewPath || isSubPath(req.Path, req.NewPath) {
+		return errors.New("can not copy a directory into itself")
+	}
+
+	c := r.Cloud
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	if !c.network.folderExists(req.Path) {
+		return errors.New("directory not found")
+	}
+	if _, err := c.network.GetFile(req.NewPath); err == nil || c.network.folderExists(req.NewPath) {
+		return errors.New("file or directory with that name already exists")
+	}
+
+	folders, files := c.network.folderTree(req.Path)
+	for _, folderPath := range folders {
+		c.network.GetFolder(req.NewPath + strings.TrimPrefix(folderPath, req.Path))
+	}
+	for filePath, file := range files {
+		if err := r.copyFile(filePath, req.NewPath+strings.TrimPrefix(filePath, req.Path), file, req.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"testing"
+)
+
+func TestDirectoryOperations(t *testing.T) {
+	clouds, err := CreateTestClouds(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_directories_", len(clouds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	for i, c := range clouds {
+		c.SetConfig(CloudConfig{FileStorageDir: dirs[i]})
+	}
+
+	contents := []byte("contents of a file that is copied around")
+	tmp, err := utils.GetTestFile("cloud_test_directories_file_*", contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmp)
+	file, err := datastore.NewFile(tmp, "f", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0]
+	if err := c.AddFile(file, "/a/f", tmp.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy reuses the chunks of the original, and stays readable once the original is deleted.
+	if err := lockedTransfer(c, "/a/f", "/b/f", c.CopyFile); err != nil {
+		t.Fatal(err)
+	}
+	if !c.LockFile("/a") {
+		t.Fatal("Could not lock /a.")
+	}
+	if err := c.DeleteDirectory("/a", true); err != nil {
+		t.Fatal(err)
+	}
+	c.UnlockFile("/a")
+	for i, cl := range clouds {
+		if _, err := cl.GetFile("/a/f"); err == nil {
+			t.Errorf("Cloud %d still has /a/f.", i)
+		}
+		cp, err := cl.GetFile("/b/f")
+		if err != nil {
+			t.Fatalf("Cloud %d: %v", i, err)
+		}
+		if cp.ID != file.ID || cp.Owner != c.MyNode().ID {
+			t.Errorf("Cloud %d has an unexpected copy: %+v.", i, cp)
+		}
+	}
+	read := func(cloudPath string) []byte {
+		buffer := &bytes.Buffer{}
+		if err := clouds[1].(*cloud).DownloadFile(cloudPath, buffer); err != nil {
+			t.Fatalf("Downloading %v: %v", cloudPath, err)
+		}
+		return buffer.Bytes()
+	}
+	if got := read("/b/f"); !bytes.Equal(got, contents) {
+		t.Errorf("Copy has contents %q, expected %q.", got, contents)
+	}
+
+	if err := lockedTransfer(c, "/b", "/c/d", c.MoveDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockedTransfer(c, "/c", "/e", c.CopyDirectory); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockedTransfer(c, "/c", "/c/x", c.CopyDirectory); err == nil {
+		t.Error("Expected copying a directory into itself to fail.")
+	}
+	for _, p := range []string{"/c/d/f", "/e/d/f"} {
+		if got := read(p); !bytes.Equal(got, contents) {
+			t.Errorf("%v has contents %q, expected %q.", p, got, contents)
+		}
+	}
+	if n := c.Network(); n.folderExists("/b") {
+		t.Error("Expected /b to be moved.")
+	}
+
+	// Locking a directory locks its subtree.
+	if !c.LockFile("/c") {
+		t.Fatal("Could not lock /c.")
+	}
+	if clouds[1].LockFile("/c/d/f") || clouds[1].LockFile("/") {
+		t.Error("Expected paths above and below a locked directory to be locked.")
+	}
+	if err := c.DeleteDirectory("/c", false); err == nil {
+		t.Error("Expected deleting a non-empty directory to fail.")
+	}
+	if err := c.DeleteDirectory("/c", true); err != nil {
+		t.Fatal(err)
+	}
+	c.UnlockFile("/c")
+	for i, cl := range clouds {
+		if n := cl.Network(); n.folderExists("/c") {
+			t.Errorf("Cloud %d still has /c.", i)
+		}
+		if cl.(*cloud).FileStore("/c/d/f") != nil {
+			t.Errorf("Cloud %d still stores /c/d/f.", i)
+		}
+	}
+	if got := read("/e/d/f"); !bytes.Equal(got, contents) {
+		t.Errorf("Copy has contents %q after deleting the original, expected %q.", got, contents)
+	}
+}
+
+// lockedTransfer moves or copies a path holding the locks of both paths.
+func lockedTransfer(c Cloud, from, to string, transfer func(from, to string) error) error {
+	if !c.LockFile(from) || !c.LockFile(to) {
+		return errors.New("could not acquire the locks")
+	}
+	defer c.UnlockFile(from)
+	defer c.UnlockFile(to)
+	return transfer(from, to)
+}
+
+func TestCopyFileStorageUsage(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_copy_usage_", len(clouds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	for i, c := range clouds {
+		c.SetConfig(CloudConfig{FileStorageDir: dirs[i]})
+	}
+
+	tmp, err := utils.GetTestFile("cloud_test_copy_usage_file_*", []byte("contents of a file that is copied"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmp)
+	file, err := datastore.NewFile(tmp, "f", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0]
+	if err := c.AddFile(file, "/f", tmp.Name()); err != nil {
+		t.Fatal(err)
+	}
+	remote := clouds[1].(*cloud)
+	if _, ok := remote.FileStore("/f").(*datastore.PartialFileStore); !ok {
+		t.Fatal("Expected cloud 1 to store chunks of /f.")
+	}
+	used := remote.BenchmarkState().StorageSpaceUsed
+
+	// Hard linked chunks of the copy take up no more space, and deleting the copy frees none.
+	if err := lockedTransfer(c, "/f", "/g", c.CopyFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := remote.BenchmarkState().StorageSpaceUsed; got != used {
+		t.Errorf("Copying changed the usage from %d to %d bytes.", used, got)
+	}
+	if !c.LockFile("/g") {
+		t.Fatal("Could not lock /g.")
+	}
+	err = c.DeleteFile("/g")
+	c.UnlockFile("/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remote.BenchmarkState().StorageSpaceUsed; got != used {
+		t.Errorf("Deleting the copy changed the usage from %d to %d bytes.", used, got)
+	}
+}
@@ -15,14 +15,35 @@ func (c *cloud) DistributeChunk(cloudPath string, store datastore.FileStore, chu
 	if err != nil {
 		return err
 	}
+	draining := c.drainingNodes()
 	c.NodesMutex.RLock()
 	defer c.NodesMutex.RUnlock()
+	// The chunk must be saved on at least one other node, this node already stores it.
+	myID := c.MyNode().ID
+	tried, saved := 0, 0
 	for _, n := range c.Nodes {
+		if _, ok := draining[n.ID]; ok {
+			continue
+		}
+		if n.ID != myID {
+			tried++
+		}
 		utils.GetLogger().Printf("[INFO] Saving chunk: %v on node %v.", chunkID, n.ID)
 		chunk, _ := store.Chunk(chunkID)
 		if err := n.SaveChunk(cloudPath, chunk, content); err != nil {
+			if IsStorageFullError(err) {
+				// The other nodes still get a copy.
+				utils.GetLogger().Printf("[WARN] Node %v is full, not saving chunk %v: %v.", n.ID, chunkID, err)
+				continue
+			}
 			return err
 		}
+		if n.ID != myID {
+			saved++
+		}
+	}
+	if tried > 0 && saved == 0 {
+		return errors.New("no node has enough storage for chunk")
 	}
 	return nil
 }
@@ -30,6 +51,16 @@ func (c *cloud) DistributeChunk(cloudPath string, store datastore.FileStore, chu
 // Mapping from Node ID's to a slice of Chunk SequenceNumber's.
 type distributionScheme map[string][]int
 
+// assigned returns whether the scheme assigns the chunk to the node.
+func (scheme distributionScheme) assigned(nodeID string, chunk datastore.Chunk) bool {
+	for _, sequenceNumber := range scheme[nodeID] {
+		if sequenceNumber == chunk.SequenceNumber {
+			return true
+		}
+	}
+	return false
+}
+
 // Distribute computes how to distribute a file and saves the file chunks on the cloud.
 // numReplicas specifies how many copies of all file's chunks should be stored on the cloud.
 // Note that a replica does not include the original file itself.
@@ -48,7 +79,9 @@ func (c *cloud) Distribute(cloudPath string, file datastore.File, numReplicas in
 	}
 	utils.GetLogger().Printf("[DEBUG] Distribution scheme retrieved: %v.", distributionScheme)
 
-	// Apply the scheme.
+	// Apply the scheme. Chunks that are saved elsewhere are recorded apart from the scheme, so that the nodes they are
+	// saved on are not visited again.
+	fallback := make(map[string][]int)
 	for nodeID, sequenceNumbers := range distributionScheme {
 		for _, sequenceNumber := range sequenceNumbers {
 			cnode := c.GetCloudNode(nodeID)
@@ -64,6 +97,10 @@ func (c *cloud) Distribute(cloudPath string, file datastore.File, numReplicas in
 					return err
 				}
 				err = cnode.SaveChunk(cloudPath, file.Chunks.Chunks[sequenceNumber], content)
+				if IsStorageFullError(err) {
+					utils.GetLogger().Printf("[WARN] Node %v is full: %v. Retrying on another node.", nodeID, err)
+					err = c.saveChunkElsewhere(cloudPath, file.Chunks.Chunks[sequenceNumber], content, distributionScheme, fallback)
+				}
 				if err != nil {
 					return err
 				}
@@ -74,6 +111,37 @@ func (c *cloud) Distribute(cloudPath string, file datastore.File, numReplicas in
 	return nil
 }
 
+// saveChunkElsewhere saves the chunk on a node that neither the scheme nor an earlier fallback assigned the chunk to.
+// Nodes are tried in turn until one of them has enough storage, which is recorded in fallback.
+func (c *cloud) saveChunkElsewhere(cloudPath string, chunk datastore.Chunk, content []byte,
+	scheme, fallback distributionScheme) error {
+	draining := c.drainingNodes()
+	c.NodesMutex.RLock()
+	candidates := make([]*cloudNode, 0)
+	for _, n := range c.Nodes {
+		if _, ok := draining[n.ID]; ok {
+			continue
+		}
+		if !scheme.assigned(n.ID, chunk) && !fallback.assigned(n.ID, chunk) {
+			candidates = append(candidates, n)
+		}
+	}
+	c.NodesMutex.RUnlock()
+
+	for _, n := range candidates {
+		err := n.SaveChunk(cloudPath, chunk, content)
+		if err == nil {
+			fallback[n.ID] = append(fallback[n.ID], chunk.SequenceNumber)
+			return nil
+		}
+		if !IsStorageFullError(err) {
+			return err
+		}
+		utils.GetLogger().Printf("[WARN] Node %v is full: %v.", n.ID, err)
+	}
+	return errors.New("no node has enough storage for chunk")
+}
+
 // distributionAlgorithm returns a suitable distributionScheme for the file and the given cloud.
 func (c *cloud) distributionAlgorithm(file datastore.File, numReplicas int, antiAffinity bool) (distributionScheme, error) {
 	scheme := make(distributionScheme)
@@ -109,7 +177,7 @@ func (c *cloud) distributionAlgorithm(file datastore.File, numReplicas int, anti
 	}
 
 	// Apply hard constraints (must be met) on nodes.
-	availableNodes, nodeBenchmarks = filterNodes(availableNodes, nodeBenchmarks)
+	availableNodes, nodeBenchmarks = filterNodes(availableNodes, nodeBenchmarks, c.drainingNodes())
 	if len(availableNodes) == 0 {
 		return nil, errors.New("No nodes available")
 	}
@@ -159,12 +227,18 @@ func (c *cloud) distributionAlgorithm(file datastore.File, numReplicas int, anti
 	// Implementation detail: Would probably need a "distributionAlgoChunk(chunk, numReplicas)" function.
 }
 
-func filterNodes(availableNodes []*cloudNode, benchmarks []NodeBenchmark) ([]*cloudNode, []NodeBenchmark) {
+func filterNodes(availableNodes []*cloudNode, benchmarks []NodeBenchmark,
+	draining map[string]bool) ([]*cloudNode, []NodeBenchmark) {
 	var newAvailableNodes []*cloudNode
 	var newBenchmarks []NodeBenchmark
 	for i, n := range availableNodes {
 		benchmark := benchmarks[i]
 
+		if _, ok := draining[n.ID]; ok {
+			// node is being decommissioned
+			continue
+		}
+
 		if benchmark.StorageSpaceRemaining == 0 {
 			// node not allowed to store data
 			continue
@@ -150,10 +150,17 @@ func (m *DownloadQueue) downloadFile(c *cloud) error {
 			return err
 		}
 		m.ChunkDownloaded[dl[i]] = true
-		_, err = w.Write(content)
+		_, err = w.WriteAt(content, chunk.ChunkOffset)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	// The local file could have been larger than the cloud file.
+	if err := w.Truncate(int64(file.Size)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return file.RestoreFileInfo(localPath)
 }
@@ -0,0 +1,493 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages used for draining nodes.
+const (
+	DrainNodeMsg   = "DrainNode"
+	NodeDrainedMsg = "NodeDrained"
+	CancelDrainMsg = "CancelDrain"
+	WholeFilesMsg  = "WholeFiles"
+)
+
+// Drain states.
+const (
+	DrainStateDraining = "draining"
+	DrainStateDrained  = "drained"
+	DrainStateFailed   = "failed"
+)
+
+// DrainStatus reports the progress of draining a node.
+type DrainStatus struct {
+	NodeID string
+	State  string
+
+	// Chunks is the number of chunks the node held when the drain started.
+	Chunks   int
+	Migrated int
+	Failed   int
+
+	// SafeToRemove is true once every chunk of the node has enough copies on other nodes.
+	SafeToRemove bool
+	Error        string
+	Started      time.Time
+	Finished     time.Time
+}
+
+type drainer struct {
+	statuses map[string]*DrainStatus
+	mutex    sync.RWMutex
+}
+
+func (d *drainer) update(ID string, f func(s *DrainStatus)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.statuses == nil {
+		d.statuses = make(map[string]*DrainStatus)
+	}
+	if _, ok := d.statuses[ID]; !ok {
+		d.statuses[ID] = &DrainStatus{NodeID: ID}
+	}
+	f(d.statuses[ID])
+}
+
+// start marks the node as being drained, unless it already is. It returns the node's previous status, to restore it
+// if the drain can not be started.
+func (d *drainer) start(ID string) (*DrainStatus, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.statuses == nil {
+		d.statuses = make(map[string]*DrainStatus)
+	}
+	previous := d.statuses[ID]
+	if previous != nil && previous.State == DrainStateDraining {
+		return nil, false
+	}
+	d.statuses[ID] = &DrainStatus{NodeID: ID, State: DrainStateDraining, Started: time.Now()}
+	return previous, true
+}
+
+// restore sets the node's status back to the one it had before a drain that could not be started.
+func (d *drainer) restore(ID string, previous *DrainStatus) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if previous == nil {
+		delete(d.statuses, ID)
+	} else {
+		d.statuses[ID] = previous
+	}
+}
+
+func init() {
+	handlers = append(handlers, createDrainRequestHandler)
+}
+
+func createDrainRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case DrainNodeMsg:
+			return r.OnDrainNodeRequest
+		case NodeDrainedMsg:
+			return r.OnNodeDrainedRequest
+		case CancelDrainMsg:
+			return r.OnCancelDrainRequest
+		case WholeFilesMsg:
+			return r.OnWholeFilesRequest
+		}
+		return nil
+	}
+}
+
+// drainingNodes returns a copy of the network's draining nodes.
+func (c *cloud) drainingNodes() map[string]bool {
+	c.networkMutex.RLock()
+	defer c.networkMutex.RUnlock()
+	draining := make(map[string]bool)
+	for ID, safe := range c.network.DrainingNodes {
+		draining[ID] = safe
+	}
+	return draining
+}
+
+// DrainStatus returns the progress of draining the node, if a drain was started by this node.
+func (c *cloud) DrainStatus(ID string) (DrainStatus, bool) {
+	c.drainer.mutex.RLock()
+	defer c.drainer.mutex.RUnlock()
+	s, ok := c.drainer.statuses[ID]
+	if !ok {
+		return DrainStatus{}, false
+	}
+	return *s, true
+}
+
+// DrainNode marks the node as draining on the network and migrates all of its chunks to other nodes in the
+// background. The node will no longer be chosen to store data. Each chunk keeps as many copies as it had before the
+// drain, as long as there are enough other nodes. Once every chunk has enough copies elsewhere, the node is marked as
+// safe to remove. Progress can be followed with DrainStatus.
+func (c *cloud) DrainNode(ID string) error {
+	if _, found := c.NodeByID(ID); !found {
+		return errors.New("node not found")
+	}
+	previous, ok := c.drainer.start(ID)
+	if !ok {
+		return errors.New("node is already being drained")
+	}
+	_, marked := c.drainingNodes()[ID]
+
+	_, err := c.SendMessageToMe(DrainNodeMsg, ID)
+	if err == nil {
+		for _, r := range c.SendMessageAllOthers(DrainNodeMsg, ID) {
+			if r.Error != nil {
+				err = r.Error
+				break
+			}
+		}
+	}
+	if err != nil {
+		// The nodes that marked the node as draining are told to unmark it.
+		if !marked {
+			c.CancelDrain(ID)
+		}
+		c.drainer.restore(ID, previous)
+		return err
+	}
+	go c.drain(ID)
+	return nil
+}
+
+// CancelDrain stops the node from being drained. Chunks that were already migrated are kept on their new nodes.
+func (c *cloud) CancelDrain(ID string) error {
+	_, err := c.SendMessageToMe(CancelDrainMsg, ID)
+	if err != nil {
+		return err
+	}
+	c.SendMessageAllOthers(CancelDrainMsg, ID)
+	return nil
+}
+
+func (r request) OnDrainNodeRequest(ID string) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] Marking node %v as draining.", ID)
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
+	if r.Cloud.network.DrainingNodes == nil {
+		r.Cloud.network.DrainingNodes = make(map[string]bool)
+	}
+	r.Cloud.network.DrainingNodes[ID] = false
+	return nil
+}
+
+func (r request) OnNodeDrainedRequest(ID string) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] Node %v is drained and safe to remove.", ID)
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
+	if _, ok := r.Cloud.network.DrainingNodes[ID]; !ok {
+		return errors.New("node is not being drained")
+	}
+	r.Cloud.network.DrainingNodes[ID] = true
+
+	// The drain replicated the node's whole files, it no longer holds them for the network.
+	for fileID, nodes := range r.Cloud.network.FileNodes {
+		remaining := make([]string, 0, len(nodes))
+		for _, nID := range nodes {
+			if nID != ID {
+				remaining = append(remaining, nID)
+			}
+		}
+		r.Cloud.network.FileNodes[fileID] = remaining
+	}
+	if r.Cloud.events.NodeDrained != nil {
+		go r.Cloud.events.NodeDrained(ID)
+	}
+	return nil
+}
+
+func (r request) OnCancelDrainRequest(ID string) error {
+	defer r.Cloud.stateChanged()
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
+	delete(r.Cloud.network.DrainingNodes, ID)
+	return nil
+}
+
+// OnWholeFilesRequest returns the cloud paths of the files this node stores whole, like the files it syncs locally.
+func (r request) OnWholeFilesRequest() []string {
+	c := r.Cloud
+	c.fileStorageMutex.RLock()
+	defer c.fileStorageMutex.RUnlock()
+	paths := make([]string, 0)
+	for cloudPath, storage := range c.fileStorage {
+		switch storage.(type) {
+		case *datastore.FullFileStore, *datastore.SyncFileStore:
+			paths = append(paths, cloudPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// wholeFiles asks the node for the cloud paths of the files it stores whole.
+func (c *cloud) wholeFiles(ID string) ([]string, error) {
+	cnode := c.GetCloudNode(ID)
+	if cnode == nil {
+		return nil, errors.New("node is not online")
+	}
+	res, err := cnode.client.SendMessage(WholeFilesMsg)
+	if err != nil {
+		return nil, err
+	}
+	paths, _ := res[0].([]string)
+	return paths, nil
+}
+
+// drainChunk is a chunk held by a draining node, with one of the files it belongs to.
+type drainChunk struct {
+	cloudPath string
+	chunk     datastore.Chunk
+	// required is the number of copies the chunk should have on nodes that are not draining.
+	required int
+	// whole is set for chunks of files the node stores whole. The node keeps its copy of those.
+	whole bool
+}
+
+// requiredCopies returns the number of copies a chunk should keep on the nodes that are not draining. It is the same
+// amount as before the drain, but at least one.
+func requiredCopies(holders []string, eligible int) int {
+	required := len(holders)
+	if required > eligible {
+		required = eligible
+	}
+	if required < 1 {
+		required = 1
+	}
+	return required
+}
+
+// drain migrates the chunks of a draining node to the other nodes.
+func (c *cloud) drain(ID string) {
+	draining := c.drainingNodes()
+
+	c.networkMutex.RLock()
+	eligible := 0
+	for _, n := range c.network.Nodes {
+		if _, ok := draining[n.ID]; !ok {
+			eligible++
+		}
+	}
+	// Chunks that no file refers to any more are left for the garbage collector.
+	chunkIDs := c.network.chunkIDs()
+	c.networkMutex.RUnlock()
+
+	chunkNodes := c.findProviders(chunkIDs...)
+
+	// The node's whole files, like the files it syncs locally, are replicated as well, even if the node never published
+	// their chunks. Nothing can be copied from a node that is offline.
+	whole, wholeErr := c.wholeFiles(ID)
+	if wholeErr != nil && c.GetCloudNode(ID) == nil {
+		utils.GetLogger().Printf("[WARN] Node %v is offline, its whole files are not replicated.", ID)
+		wholeErr = nil
+	}
+
+	chunks := make([]drainChunk, 0)
+	listed := make(map[datastore.ChunkID]bool)
+	c.networkMutex.RLock()
+	for _, cloudPath := range whole {
+		file, err := c.network.GetFile(cloudPath)
+		if err != nil {
+			continue
+		}
+		for _, chunk := range file.Chunks.Chunks {
+			if listed[chunk.ID] {
+				continue
+			}
+			listed[chunk.ID] = true
+			holders := chunkNodes[chunk.ID]
+			if !containsString(holders, ID) {
+				holders = append(holders, ID)
+			}
+			chunks = append(chunks, drainChunk{
+				cloudPath: cloudPath,
+				chunk:     chunk,
+				required:  requiredCopies(holders, eligible),
+				whole:     true,
+			})
+		}
+	}
+	for chunkID, holders := range chunkNodes {
+		if listed[chunkID] || !containsString(holders, ID) {
+			continue
+		}
+		paths := c.network.chunkFiles(chunkID)
+		if len(paths) == 0 {
+			continue
+		}
+		file, err := c.network.GetFile(paths[0])
+		if err != nil {
+			continue
+		}
+		chunk := file.GetChunkByID(chunkID)
+		if chunk == nil {
+			continue
+		}
+		chunks = append(chunks, drainChunk{cloudPath: paths[0], chunk: *chunk, required: requiredCopies(holders, eligible)})
+	}
+	c.networkMutex.RUnlock()
+
+	c.drainer.update(ID, func(s *DrainStatus) {
+		s.Chunks = len(chunks)
+		if wholeErr != nil {
+			s.Error = "listing whole files: " + wholeErr.Error()
+		}
+	})
+	if wholeErr != nil {
+		utils.GetLogger().Printf("[ERROR] Listing whole files of node %v: %v.", ID, wholeErr)
+	}
+	utils.GetLogger().Printf("[INFO] Draining %d chunks from node %v.", len(chunks), ID)
+
+	for _, dc := range chunks {
+		if _, ok := c.drainingNodes()[ID]; !ok {
+			utils.GetLogger().Printf("[INFO] Drain of node %v was cancelled.", ID)
+			c.drainer.update(ID, func(s *DrainStatus) {
+				s.State = DrainStateFailed
+				s.Error = "drain cancelled"
+				s.Finished = time.Now()
+			})
+			return
+		}
+		err := c.migrateChunk(dc, ID, draining)
+		c.drainer.update(ID, func(s *DrainStatus) {
+			if err != nil {
+				s.Failed++
+				s.Error = err.Error()
+				return
+			}
+			s.Migrated++
+		})
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] Migrating chunk %v from node %v: %v.", dc.chunk.ID, ID, err)
+		}
+	}
+
+	// Only mark the node as safe once every chunk has enough copies on other nodes.
+	safe := wholeErr == nil
+	for _, dc := range chunks {
+		if len(c.otherHolders(dc.chunk.ID, draining)) < dc.required {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		c.SendMessageToMe(NodeDrainedMsg, ID)
+		c.SendMessageAllOthers(NodeDrainedMsg, ID)
+	}
+
+	c.drainer.update(ID, func(s *DrainStatus) {
+		s.SafeToRemove = safe
+		s.State = DrainStateDrained
+		if !safe {
+			s.State = DrainStateFailed
+		}
+		s.Finished = time.Now()
+	})
+}
+
+// otherHolders returns the holders of the chunk that are not draining.
+func (c *cloud) otherHolders(chunkID datastore.ChunkID, draining map[string]bool) []string {
+	others := make([]string, 0)
+	for _, nID := range c.chunkHolders(chunkID) {
+		if _, ok := draining[nID]; !ok {
+			others = append(others, nID)
+		}
+	}
+	return others
+}
+
+// migrateChunk copies the chunk to nodes that are not draining until it has the required amount of copies, then
+// deletes the copy on the draining node.
+func (c *cloud) migrateChunk(dc drainChunk, ID string, draining map[string]bool) error {
+	others := c.otherHolders(dc.chunk.ID, draining)
+	for len(others) < dc.required {
+		target, err := c.drainTarget(dc.chunk, others, draining)
+		if err != nil {
+			return err
+		}
+		// Prefer copying from the draining node, so that other nodes are not loaded.
+		source := ID
+		if c.GetCloudNode(ID) == nil {
+			if len(others) == 0 {
+				return errors.New("no online copy of the chunk")
+			}
+			source = others[0]
+		}
+		if err := c.copyChunk(dc.cloudPath, dc.chunk, source, target); err != nil {
+			return err
+		}
+		others = append(others, target)
+	}
+
+	// The data is safe elsewhere. Free up the space on the draining node. Whole files stay in place, they are the
+	// node's local copies.
+	if dc.whole {
+		return nil
+	}
+	if cnode := c.GetCloudNode(ID); cnode != nil {
+		if err := cnode.DeleteChunk(dc.cloudPath, dc.chunk.ID); err != nil {
+			utils.GetLogger().Printf("[WARN] Could not delete chunk %v on drained node %v: %v.", dc.chunk.ID, ID, err)
+		}
+	}
+	return nil
+}
+
+// drainTarget picks the online, non-draining node with the most storage remaining that does not hold the chunk yet.
+func (c *cloud) drainTarget(chunk datastore.Chunk, holders []string, draining map[string]bool) (string, error) {
+	c.NodesMutex.RLock()
+	candidates := make([]*cloudNode, 0)
+	for _, n := range c.Nodes {
+		if _, ok := draining[n.ID]; ok || containsString(holders, n.ID) {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	c.NodesMutex.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	best := ""
+	var bestRemaining uint64
+	for _, n := range candidates {
+		remaining, err := n.StorageSpaceRemaining()
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] %v", err)
+			continue
+		}
+		if remaining >= chunk.ContentSize && remaining > bestRemaining {
+			best = n.ID
+			bestRemaining = remaining
+		}
+	}
+	if best == "" {
+		return "", errors.New("no node available to take the chunk")
+	}
+	return best, nil
+}
+
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
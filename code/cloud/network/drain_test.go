@@ -0,0 +1,130 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFilterNodesSkipsDraining(t *testing.T) {
+	nodes := []*cloudNode{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	benchmarks := []NodeBenchmark{{StorageSpaceRemaining: 10}, {StorageSpaceRemaining: 10}, {StorageSpaceRemaining: 0}}
+
+	filtered, filteredBenchmarks := filterNodes(nodes, benchmarks, map[string]bool{"a": false})
+	if len(filtered) != 1 || filtered[0].ID != "b" {
+		t.Fatalf("Expected only node b to be available, got %v nodes.", len(filtered))
+	}
+	if len(filteredBenchmarks) != 1 {
+		t.Errorf("Expected 1 benchmark, got %v.", len(filteredBenchmarks))
+	}
+}
+
+func TestDrainNodeMarksNetwork(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID := clouds[1].MyNode().ID
+	if err := clouds[0].DrainNode(ID); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clouds {
+		if _, ok := c.(*cloud).drainingNodes()[ID]; !ok {
+			t.Errorf("Cloud %d does not see node %v as draining.", i, ID)
+		}
+	}
+	if err := clouds[0].DrainNode("unknown"); err == nil {
+		t.Error("Expected error when draining an unknown node.")
+	}
+}
+
+func TestDrainerStart(t *testing.T) {
+	var d drainer
+	previous, ok := d.start("a")
+	if !ok || previous != nil {
+		t.Fatalf("Expected the drain to start, got %v, %v.", previous, ok)
+	}
+	if _, ok := d.start("a"); ok {
+		t.Error("Started a drain of a node that is already being drained.")
+	}
+	d.restore("a", previous)
+	if _, ok := d.statuses["a"]; ok {
+		t.Error("Expected the status of the node to be removed.")
+	}
+
+	d.update("a", func(s *DrainStatus) {
+		s.State = DrainStateDrained
+	})
+	previous, ok = d.start("a")
+	if !ok || previous == nil || previous.State != DrainStateDrained {
+		t.Fatalf("Expected a drained node to be drained again, got %v, %v.", previous, ok)
+	}
+	d.restore("a", previous)
+	if d.statuses["a"].State != DrainStateDrained {
+		t.Errorf("Expected the previous status to be restored, got %v.", d.statuses["a"].State)
+	}
+}
+
+func TestDrainNodeReplicatesWholeFiles(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_drain_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	clouds[0].SetConfig(CloudConfig{FileStorageDir: dirs[0], FileStorageCapacity: 1000})
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 1000})
+
+	// The file is only stored whole on the second node, its chunks are not published.
+	content := []byte("hellothere i see you are a fan of bytes?")
+	tmpfile, err := utils.GetTestFile("cloud_test_file_*", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmpfile)
+	file, err := datastore.NewFile(tmpfile, tmpfile.Name(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[1].AddFileInPlace(file, "/test", tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := clouds[0].(*cloud)
+	ID := clouds[1].MyNode().ID
+	if err := c.DrainNode(ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the drain to finish", func() bool {
+		s, _ := c.DrainStatus(ID)
+		return s.State != DrainStateDraining
+	})
+	if s, _ := c.DrainStatus(ID); !s.SafeToRemove || s.Migrated != len(file.Chunks.Chunks) {
+		t.Fatalf("Expected all %d chunks to be migrated and the node to be safe to remove, got %+v.",
+			len(file.Chunks.Chunks), s)
+	}
+
+	// The data is still reachable from the other node, and the node keeps its own copy.
+	store := c.FileStore("/test")
+	if store == nil {
+		t.Fatal("File is not stored on the remaining node.")
+	}
+	read := make([]byte, 0)
+	for _, chunk := range file.Chunks.Chunks {
+		chunkContent, err := store.ReadChunk(chunk.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, chunkContent...)
+	}
+	if string(read) != string(content) {
+		t.Errorf("Expected content %q on the remaining node, got %q.", content, read)
+	}
+	if _, err := ioutil.ReadFile(tmpfile.Name()); err != nil {
+		t.Errorf("Expected the drained node to keep its local file: %v.", err)
+	}
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// DefaultGCGracePeriod is how old an unreferenced chunk file has to be before the garbage collector removes it.
+// Chunks of uploads that are still in progress are younger than this and are left alone.
+const DefaultGCGracePeriod = time.Hour
+
+// chunkFileName matches the names of chunk files in the file storage directory: <FileID>.<SequenceNumber>.
+var chunkFileName = regexp.MustCompile(`^[0-9a-f]{64}\.[0-9]+$`)
+
+// GCReport describes what a garbage collection removed, or would remove on a dry run.
+type GCReport struct {
+	DryRun bool
+	// OrphanedFiles are chunk files in the file storage directory that no file store references.
+	OrphanedFiles []string
+	// OrphanedStores are the cloud paths of file stores whose file no longer exists in the network.
+	OrphanedStores []string
+	// StaleChunks are chunks that this node is listed as holding in ChunkNodes, but no longer holds.
+	StaleChunks []datastore.ChunkID
+	// Bytes is the amount of storage freed.
+	Bytes uint64
+}
+
+// CollectGarbage removes data on this node that is no longer part of the network.
+// It marks the file stores of files in the network's file tree as live, then sweeps file stores of deleted files,
+// chunk files in the file storage directory that no live file store references, and ChunkNodes entries for chunks
+// that this node does not hold. Chunk files modified within the grace period are never removed, so that uploads in
+// progress are not affected. If dryRun is true, nothing is removed and the report lists what would be.
+func (c *cloud) CollectGarbage(grace time.Duration, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+	dir := c.config.FileStorageDir
+	if dir == "" {
+		return report, errors.New("no file storage directory configured")
+	}
+	cutoff := time.Now().Add(-grace)
+	myID := c.MyNode().ID
+
+	// Mark.
+	c.networkMutex.RLock()
+	paths := make(map[string]bool)
+	referenced := make(map[datastore.ChunkID]bool)
+	c.network.walkFiles(func(cloudPath string, file *datastore.File) {
+		paths[cloudPath] = true
+		for _, chunk := range file.Chunks.Chunks {
+			referenced[chunk.ID] = true
+		}
+	})
+	listed := make([]datastore.ChunkID, 0)
+	for chunkID, nodes := range c.network.ChunkNodes {
+		if containsString(nodes, myID) {
+			listed = append(listed, chunkID)
+		}
+	}
+	c.networkMutex.RUnlock()
+
+	live := make(map[string]bool)
+	orphaned := make(map[string]*datastore.PartialFileStore)
+	c.fileStorageMutex.RLock()
+	for cloudPath, store := range c.fileStorage {
+		partial, isPartial := store.(*datastore.PartialFileStore)
+		if paths[cloudPath] {
+			if isPartial {
+				for _, chunk := range partial.Chunks {
+					live[chunkFilePath(partial, chunk)] = true
+				}
+			}
+			continue
+		}
+		report.OrphanedStores = append(report.OrphanedStores, cloudPath)
+		if isPartial {
+			orphaned[cloudPath] = partial
+		}
+	}
+	c.fileStorageMutex.RUnlock()
+
+	// Sweep file stores of files that were deleted while this node was offline.
+	// A store whose chunks were written recently may belong to a file that is still being added.
+	stores := report.OrphanedStores[:0]
+	for _, cloudPath := range report.OrphanedStores {
+		if partial, ok := orphaned[cloudPath]; ok && modifiedAfter(partial, cutoff) {
+			for _, chunk := range partial.Chunks {
+				live[chunkFilePath(partial, chunk)] = true
+			}
+			continue
+		}
+		stores = append(stores, cloudPath)
+	}
+	report.OrphanedStores = stores
+	if !dryRun {
+		c.fileStorageMutex.Lock()
+		for _, cloudPath := range report.OrphanedStores {
+			delete(c.fileStorage, cloudPath)
+		}
+		c.fileStorageMutex.Unlock()
+		c.stateChanged()
+	}
+
+	// Sweep chunk files. This includes the content of the stores dropped above.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !chunkFileName.MatchString(info.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, info.Name())
+		if live[p] || info.ModTime().After(cutoff) {
+			continue
+		}
+		report.OrphanedFiles = append(report.OrphanedFiles, p)
+		report.Bytes += uint64(info.Size())
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			utils.GetLogger().Printf("[ERROR] Removing orphaned chunk file %v: %v.", p, err)
+			continue
+		}
+		c.releaseStorage(uint64(info.Size()))
+	}
+
+	// Sweep ChunkNodes entries of chunks this node no longer holds.
+	c.fileStorageMutex.RLock()
+	for _, chunkID := range listed {
+		held := false
+		if referenced[chunkID] {
+			for cloudPath, store := range c.fileStorage {
+				if paths[cloudPath] && store.HasChunk(chunkID) {
+					held = true
+					break
+				}
+			}
+		}
+		if !held {
+			report.StaleChunks = append(report.StaleChunks, chunkID)
+		}
+	}
+	c.fileStorageMutex.RUnlock()
+	if !dryRun {
+		for _, chunkID := range report.StaleChunks {
+			if err := c.removeChunkNodes(chunkID, myID); err != nil {
+				utils.GetLogger().Printf("[ERROR] Removing stale chunk location %v: %v.", chunkID, err)
+			}
+		}
+	}
+
+	utils.GetLogger().Printf("[INFO] Garbage collection (dry run: %v): %d files, %d stores, %d chunk locations, %d bytes.",
+		dryRun, len(report.OrphanedFiles), len(report.OrphanedStores), len(report.StaleChunks), report.Bytes)
+	return report, nil
+}
+
+// chunkFilePath returns the path of the file holding the chunk's contents in a partial file store.
+func chunkFilePath(store *datastore.PartialFileStore, chunk datastore.Chunk) string {
+	return filepath.Join(filepath.FromSlash(store.FolderPath), fmt.Sprintf("%s.%d", store.FileID, chunk.SequenceNumber))
+}
+
+// modifiedAfter returns true if any of the store's chunk files was modified after the given time.
+func modifiedAfter(store *datastore.PartialFileStore, t time.Time) bool {
+	for _, chunk := range store.Chunks {
+		info, err := os.Stat(chunkFilePath(store, chunk))
+		if err == nil && info.ModTime().After(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_gc_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c := clouds[0].(*cloud)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+
+	content := []byte("hellothere i see you are a fan of bytes?") // 40 bytes
+	tmpfile, err := utils.GetTestFile("cloud_test_file_*", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmpfile)
+	file, err := datastore.NewFile(tmpfile, tmpfile.Name(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddFile(file, "/test", tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A chunk file left behind by a failed upload, and one that is still being uploaded.
+	old := filepath.Join(dirs[0], strings.Repeat("a", 64)+".0")
+	recent := filepath.Join(dirs[0], strings.Repeat("b", 64)+".0")
+	for _, p := range []string{old, recent} {
+		if err := ioutil.WriteFile(p, []byte("orphan"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.CollectGarbage(time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanedFiles) != 1 || report.OrphanedFiles[0] != old {
+		t.Errorf("Expected orphaned files [%v], got %v.", old, report.OrphanedFiles)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Error("Dry run removed a file.")
+	}
+
+	if _, err := c.CollectGarbage(time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("Orphaned chunk file was not removed.")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("Chunk file within the grace period was removed.")
+	}
+	for _, chunk := range file.Chunks.Chunks {
+		if _, err := c.FileStore("/test").ReadChunk(chunk.ID); err != nil {
+			t.Errorf("Live chunk %v was removed: %v.", chunk.SequenceNumber, err)
+		}
+	}
+}
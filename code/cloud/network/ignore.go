@@ -0,0 +1,302 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IgnoreFileName is the name of the file in the root of a synced local folder that lists the files that are not
+// synced, with gitignore-style patterns.
+const IgnoreFileName = ".cloudignore"
+
+// ignoreRule is a gitignore-style pattern.
+type ignoreRule struct {
+	re *regexp.Regexp
+	// negate re-includes the paths that an earlier rule ignored.
+	negate bool
+	// dirOnly only matches folders.
+	dirOnly bool
+}
+
+// ignoreRules decide which paths of a folder sync are not synced. Later rules take precedence over earlier ones.
+type ignoreRules []ignoreRule
+
+// parseIgnoreRules parses gitignore-style patterns. Empty lines and lines starting with # are skipped.
+func parseIgnoreRules(patterns []string) (ignoreRules, error) {
+	rules := make(ignoreRules, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimRight(pattern, " \t\r")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, `\`) {
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		// Patterns without a slash match names at any depth, others are relative to the root of the sync.
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		pattern = strings.TrimPrefix(pattern, "/")
+		if pattern == "" {
+			return nil, errors.New("empty ignore pattern")
+		}
+		re, err := regexp.Compile(ignorePatternRegexp(pattern))
+		if err != nil {
+			return nil, err
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ignorePatternRegexp converts a gitignore-style pattern to a regular expression that matches slash separated paths.
+func ignorePatternRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case ch == '*':
+			b.WriteString("[^/]*")
+		case ch == '?':
+			b.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// ignores returns whether the path, relative to the root of the sync and slash separated, is ignored. Paths in ignored
+// folders are ignored, even if a later rule re-includes them.
+func (rules ignoreRules) ignores(relPath string, isDir bool) bool {
+	relPath = strings.Trim(relPath, "/")
+	if relPath == "" || len(rules) == 0 {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if rules.matches(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return rules.matches(relPath, isDir)
+}
+
+// matches returns whether the last rule that matches the path ignores it.
+func (rules ignoreRules) matches(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// readIgnoreFile returns the lines of the ignore file of the local folder, or nothing if it has none.
+func readIgnoreFile(localPath string) ([]string, error) {
+	f, err := os.Open(filepath.Join(localPath, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// ignoreCache keeps the parsed ignore rules of the folder syncs by local folder, so that they are not parsed for every
+// path.
+type ignoreCache struct {
+	entries map[string]*cachedIgnoreRules
+	mutex   sync.Mutex
+}
+
+// cachedIgnoreRules are the parsed ignore rules of a folder sync, with the patterns and the state of the ignore file
+// they were parsed from.
+type cachedIgnoreRules struct {
+	patterns []string
+	// size and modTime are the ignore file's. size is -1 if there is none.
+	size    int64
+	modTime time.Time
+	rules   ignoreRules
+}
+
+// sameStrings returns whether both lists have the same strings in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncRules returns the ignore rules of the folder sync. They are only parsed again if the patterns of the sync, or
+// the size or modification time of its ignore file changed.
+func (c *cloud) syncRules(s *fileSync) ignoreRules {
+	size, modTime, _ := fileState(filepath.Join(s.LocalPath, IgnoreFileName))
+	key := filepath.Clean(s.LocalPath)
+	c.ignores.mutex.Lock()
+	cached, ok := c.ignores.entries[key]
+	c.ignores.mutex.Unlock()
+	if ok && cached.size == size && cached.modTime.Equal(modTime) && sameStrings(cached.patterns, s.Ignore) {
+		return cached.rules
+	}
+
+	cached = &cachedIgnoreRules{
+		patterns: append([]string(nil), s.Ignore...),
+		size:     size,
+		modTime:  modTime,
+		rules:    s.rules(),
+	}
+	c.ignores.mutex.Lock()
+	if c.ignores.entries == nil {
+		c.ignores.entries = make(map[string]*cachedIgnoreRules)
+	}
+	c.ignores.entries[key] = cached
+	c.ignores.mutex.Unlock()
+	return cached.rules
+}
+
+// rules returns the ignore rules of the folder sync, from its configuration followed by its ignore file. Invalid
+// patterns are skipped.
+func (sync *fileSync) rules() ignoreRules {
+	patterns, _ := readIgnoreFile(sync.LocalPath)
+	patterns = append(append([]string(nil), sync.Ignore...), patterns...)
+	rules := make(ignoreRules, 0, len(patterns))
+	for _, pattern := range patterns {
+		if parsed, err := parseIgnoreRules([]string{pattern}); err == nil {
+			rules = append(rules, parsed...)
+		}
+	}
+	return rules
+}
+
+// ignoresLocal returns whether the local path of the folder sync is ignored. Placeholders and the local files of
+// excluded folders are not synced either.
+func (sync *fileSync) ignoresLocal(rules ignoreRules, localPath string, isDir bool) bool {
+	if !isDir && isPlaceholder(localPath) || len(sync.Exclude) > 0 && sync.excludes(syncCloudPath(sync, localPath)) {
+		return true
+	}
+	relPath, err := filepath.Rel(sync.LocalPath, localPath)
+	if err != nil {
+		return false
+	}
+	return rules.ignores(filepath.ToSlash(relPath), isDir)
+}
+
+// ignoresCloud returns whether the cloud path of the folder sync is ignored, or in an excluded folder.
+func (sync *fileSync) ignoresCloud(rules ignoreRules, cloudPath string, isDir bool) bool {
+	return sync.excludes(cloudPath) || rules.ignores(strings.TrimPrefix(cloudPath, sync.CloudPath), isDir)
+}
+
+// syncByLocalPath returns the folder sync of the local folder. Mutex must be held.
+func (c *cloud) syncByLocalPath(localPath string) (*fileSync, error) {
+	for i := range c.folderSyncs {
+		if filepath.Clean(c.folderSyncs[i].LocalPath) == filepath.Clean(localPath) {
+			return &c.folderSyncs[i], nil
+		}
+	}
+	return nil, errors.New("local folder is not synced")
+}
+
+// SetSyncIgnore sets the ignore patterns of the folder sync of the local folder. Files that are already synced and
+// become ignored are kept, but no longer synced.
+func (c *cloud) SetSyncIgnore(localPath string, patterns []string) error {
+	if _, err := parseIgnoreRules(patterns); err != nil {
+		return err
+	}
+	c.Mutex.Lock()
+	sync, err := c.syncByLocalPath(localPath)
+	if err == nil {
+		sync.Ignore = patterns
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	c.stateChanged()
+	return nil
+}
+
+// IgnoredPaths returns the local paths in the synced local folder that are not synced. Contents of ignored folders are
+// not listed.
+func (c *cloud) IgnoredPaths(localPath string) ([]string, error) {
+	c.Mutex.RLock()
+	sync, err := c.syncByLocalPath(localPath)
+	var s fileSync
+	if err == nil {
+		s = *sync
+	}
+	c.Mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := c.syncRules(&s)
+	ignored := make([]string, 0)
+	err = filepath.Walk(s.LocalPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !s.ignoresLocal(rules, p, info.IsDir()) {
+			return nil
+		}
+		ignored = append(ignored, p)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return ignored, err
+}
@@ -0,0 +1,189 @@
+package network
+
+import (
+	"cloud/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := parseIgnoreRules([]string{
+		"# editor files",
+		"*.swp",
+		"node_modules/",
+		"/build",
+		"docs/**/*.tmp",
+		"*.log",
+		"!keep.log",
+		`\#notes`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"a.txt", false, false},
+		{".a.txt.swp", false, true},
+		{"sub/.a.txt.swp", false, true},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"web/node_modules/pkg/index.js", false, true},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"src/build", true, false},
+		{"docs/a.tmp", false, true},
+		{"docs/x/y/a.tmp", false, true},
+		{"a.tmp", false, false},
+		{"debug.log", false, true},
+		{"keep.log", false, false},
+		{"build/keep.log", false, true},
+		{"#notes", false, true},
+	}
+	for _, test := range tests {
+		if ignored := rules.ignores(test.path, test.isDir); ignored != test.expected {
+			t.Errorf("Expected %v to be ignored: %v, got %v.", test.path, test.expected, ignored)
+		}
+	}
+}
+
+func TestSyncFolderIgnore(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_ignore_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	uploadDir, localDir := dirs[1], dirs[2]
+
+	// Ignored cloud files are not downloaded.
+	writeTestFiles(t, uploadDir, map[string]string{"remote.tmp": "temporary"})
+	file, err := readLocalFile(filepath.Join(uploadDir, "remote.tmp"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddFile(file, "/p/remote.tmp", filepath.Join(uploadDir, "remote.tmp")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, localDir, map[string]string{
+		IgnoreFileName:           "*.swp\nnode_modules/\n*.tmp\n",
+		"a.txt":                  "synced",
+		".a.txt.swp":             "swap",
+		"node_modules/pkg/x.js":  "dependency",
+		"src/node_modules/y.js":  "dependency",
+		"src/main.go":            "package main",
+		"src/remote.tmp.keep.md": "synced",
+	})
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSyncIgnore(localDir, []string{"*.bak"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(localDir, "remote.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected the ignored cloud file not to be downloaded: %v.", err)
+	}
+
+	for _, p := range []string{"/p/" + IgnoreFileName, "/p/a.txt", "/p/src/main.go", "/p/src/remote.tmp.keep.md"} {
+		if _, err := c.GetFile(p); err != nil {
+			t.Errorf("Expected %v to be synced: %v.", p, err)
+		}
+	}
+	for _, p := range []string{"/p/.a.txt.swp", "/p/node_modules/pkg/x.js", "/p/src/node_modules/y.js"} {
+		if c.FileStore(p) != nil {
+			t.Errorf("Expected %v to be ignored.", p)
+		}
+	}
+
+	plan, err := c.planSyncFolder(&c.folderSyncs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range plan.Actions {
+		if a.CloudPath == "/p/remote.tmp" {
+			t.Error("Expected the ignored cloud file not to be planned.")
+		}
+	}
+	if ok, _ := c.isInFolderSync("/p/remote.tmp"); ok {
+		t.Error("Expected ignored cloud files not to be synced.")
+	}
+
+	ignored, err := c.IgnoredPaths(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		filepath.Join(localDir, ".a.txt.swp"):          true,
+		filepath.Join(localDir, "node_modules"):        true,
+		filepath.Join(localDir, "src", "node_modules"): true,
+	}
+	if len(ignored) != len(expected) {
+		t.Errorf("Expected %d ignored paths, got %v.", len(expected), ignored)
+	}
+	for _, p := range ignored {
+		if !expected[p] {
+			t.Errorf("Unexpected ignored path %v.", p)
+		}
+	}
+
+	// The watcher skips ignored files.
+	writeTestFiles(t, localDir, map[string]string{
+		"b.txt.swp": "swap",
+		"b.txt.bak": "backup",
+		"b.txt":     "synced",
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for c.FileStore("/p/b.txt") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Created file was not synced.")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c.FileStore("/p/b.txt.swp") != nil || c.FileStore("/p/b.txt.bak") != nil {
+		t.Error("Expected the created swap and backup files to be ignored.")
+	}
+}
+
+func TestSyncRulesCache(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_ignore_cache_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c := &cloud{}
+	sync := &fileSync{CloudPath: "/p", LocalPath: dirs[0], Ignore: []string{"*.tmp"}}
+	writeTestFiles(t, dirs[0], map[string]string{IgnoreFileName: "build/\n"})
+
+	rules := c.syncRules(sync)
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d.", len(rules))
+	}
+	if again := c.syncRules(sync); &again[0] != &rules[0] {
+		t.Error("Expected the rules to be cached.")
+	}
+
+	// Changes of the ignore file or of the patterns of the sync are picked up.
+	writeTestFiles(t, dirs[0], map[string]string{IgnoreFileName: "build/\n*.log\n"})
+	if rules := c.syncRules(sync); len(rules) != 3 || !rules.ignores("a.log", false) {
+		t.Errorf("Expected the changed ignore file to be parsed again, got %d rules.", len(rules))
+	}
+	sync.Ignore = nil
+	if rules := c.syncRules(sync); len(rules) != 2 || rules.ignores("a.tmp", false) {
+		t.Errorf("Expected the changed patterns to be parsed again, got %d rules.", len(rules))
+	}
+	if err := os.Remove(filepath.Join(dirs[0], IgnoreFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if rules := c.syncRules(sync); len(rules) != 0 {
+		t.Errorf("Expected no rules without the ignore file, got %d.", len(rules))
+	}
+}
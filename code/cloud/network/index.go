@@ -0,0 +1,315 @@
+package network
+
+import (
+	"cloud/datastore"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// networkIndex indexes the network's folder tree, so that lookups do not walk it. Files are looked up in the data
+// store of their folder, which is indexed by name.
+type networkIndex struct {
+	// root is the root folder the index was built for.
+	root *NetworkFolder
+
+	// folders maps clean folder paths to the folders.
+	folders map[string]*NetworkFolder
+
+	// chunks maps chunk IDs to the cloud paths of the files that contain them.
+	chunks map[datastore.ChunkID][]string
+
+	// files maps the clean cloud paths of all files to the files, for searches.
+	files map[string]*datastore.File
+}
+
+// indexMutex returns the mutex that guards the network's index. Folders are created and the index is built lazily by
+// lookups, which are done while holding the network mutex for reading. The network of a cloud gets its mutex when the
+// cloud is set up, other networks when they are first looked up.
+func (n *Network) indexMutex() *sync.Mutex {
+	if n.indexLock == nil {
+		n.indexLock = new(sync.Mutex)
+	}
+	return n.indexLock
+}
+
+// networkIndex returns the index of the network, building it if needed. The index mutex must be held.
+func (n *Network) networkIndex() *networkIndex {
+	if n.RootFolder == nil {
+		n.RootFolder = &NetworkFolder{
+			Name: "/",
+		}
+	}
+	if n.index != nil && n.index.root == n.RootFolder {
+		return n.index
+	}
+
+	idx := &networkIndex{
+		root:    n.RootFolder,
+		folders: make(map[string]*NetworkFolder),
+		chunks:  make(map[datastore.ChunkID][]string),
+		files:   make(map[string]*datastore.File),
+	}
+	var walk func(folderPath string, folder *NetworkFolder)
+	walk = func(folderPath string, folder *NetworkFolder) {
+		idx.folders[folderPath] = folder
+		for _, f := range folder.Files.Files {
+			idx.addFile(CleanNetworkPath(path.Join(folderPath, f.Name)), f)
+		}
+		for _, sub := range folder.SubFolders {
+			walk(CleanNetworkPath(path.Join(folderPath, sub.Name)), sub)
+		}
+	}
+	walk("/", n.RootFolder)
+	n.index = idx
+	return idx
+}
+
+func (idx *networkIndex) addFile(cloudPath string, file *datastore.File) {
+	idx.files[cloudPath] = file
+	for _, c := range file.Chunks.Chunks {
+		if !containsString(idx.chunks[c.ID], cloudPath) {
+			idx.chunks[c.ID] = append(idx.chunks[c.ID], cloudPath)
+		}
+	}
+}
+
+func (idx *networkIndex) removeFile(cloudPath string, file *datastore.File) {
+	if idx.files[cloudPath] == file {
+		delete(idx.files, cloudPath)
+	}
+	for _, c := range file.Chunks.Chunks {
+		paths := idx.chunks[c.ID]
+		remaining := make([]string, 0, len(paths))
+		for _, p := range paths {
+			if p != cloudPath {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(idx.chunks, c.ID)
+		} else {
+			idx.chunks[c.ID] = remaining
+		}
+	}
+}
+
+// chunkFiles returns the cloud paths of the files that contain the chunk.
+func (n *Network) chunkFiles(chunkID datastore.ChunkID) []string {
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	paths := n.networkIndex().chunks[chunkID]
+	return append([]string(nil), paths...)
+}
+
+// chunkIDs returns the IDs of all of the chunks of the network's files.
+func (n *Network) chunkIDs() []datastore.ChunkID {
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	idx := n.networkIndex()
+	IDs := make([]datastore.ChunkID, 0, len(idx.chunks))
+	for chunkID := range idx.chunks {
+		IDs = append(IDs, chunkID)
+	}
+	return IDs
+}
+
+// addFile adds the file to its folder, creating the folder if needed. Returns false if the folder already contains a
+// file with the same name.
+func (n *Network) addFile(cloudPath string, file *datastore.File) (bool, error) {
+	cloudPath = CleanNetworkPath(cloudPath)
+	if err := ValidatePath(cloudPath); err != nil {
+		return false, err
+	}
+	folder, err := n.GetFolder(path.Dir(cloudPath))
+	if err != nil {
+		return false, err
+	}
+	file.Name = path.Base(cloudPath)
+	if folder.Files.Contains(file) {
+		return false, nil
+	}
+	folder.Files.Add(file)
+
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	n.networkIndex().addFile(CleanNetworkPath(cloudPath), file)
+	return true, nil
+}
+
+// replaceFile replaces the metadata of an existing file.
+func (n *Network) replaceFile(cloudPath string, file *datastore.File) error {
+	folderName, filename := path.Split(cloudPath)
+	folder, err := n.GetFolder(folderName)
+	if err != nil {
+		return err
+	}
+	old, found := folder.Files.Get(filename)
+	if !found {
+		return errors.New("file " + filename + " was not found")
+	}
+	file.Name = filename
+	folder.Files.Replace(file)
+
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	idx := n.networkIndex()
+	idx.removeFile(CleanNetworkPath(cloudPath), old)
+	idx.addFile(CleanNetworkPath(cloudPath), file)
+	return nil
+}
+
+// removeFile removes the file from its folder and returns it.
+func (n *Network) removeFile(cloudPath string) (*datastore.File, error) {
+	folderName, filename := path.Split(cloudPath)
+	folder, err := n.GetFolder(folderName)
+	if err != nil {
+		return nil, err
+	}
+	file := folder.Files.Remove(filename)
+	if file == nil {
+		return nil, errors.New("file " + filename + " was not found")
+	}
+
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	n.networkIndex().removeFile(CleanNetworkPath(cloudPath), file)
+	return file, nil
+}
+
+// removeFolder removes the folder from its parent folder.
+func (n *Network) removeFolder(folderPath string) error {
+	folderPath = CleanNetworkPath(folderPath)
+	if folderPath == "/" {
+		return errors.New("can not remove the root folder")
+	}
+	parentPath, name := path.Split(folderPath)
+	parent, err := n.GetFolder(parentPath)
+	if err != nil {
+		return err
+	}
+
+	for i := range parent.SubFolders {
+		if parent.SubFolders[i].Name == name {
+			parent.SubFolders = append(parent.SubFolders[:i], parent.SubFolders[i+1:]...)
+
+			// The folder could contain any number of sub-folders and files, so the index is built again.
+			n.indexMutex().Lock()
+			n.index = nil
+			n.indexMutex().Unlock()
+			return nil
+		}
+	}
+	return errors.New("directory not found")
+}
+
+// getFolder returns the folder with the path, creating it and any missing parent folders. Returns an error if a
+// missing folder's name is not valid. The index mutex must be held.
+func (n *Network) getFolder(folderPath string) (*NetworkFolder, error) {
+	idx := n.networkIndex()
+	folderPath = CleanNetworkPath(folderPath)
+	if f, ok := idx.folders[folderPath]; ok {
+		return f, nil
+	}
+	if len(folderPath) > MaxPathLength {
+		return nil, fmt.Errorf("path is longer than %d bytes", MaxPathLength)
+	}
+
+	f := idx.root
+	current := "/"
+	for _, p := range strings.Split(folderPath, "/") {
+		if p == "" {
+			continue
+		}
+
+		current = CleanNetworkPath(path.Join(current, p))
+		if sub, ok := idx.folders[current]; ok {
+			f = sub
+			continue
+		}
+		if err := ValidateName(p); err != nil {
+			return nil, err
+		}
+		newFolder := &NetworkFolder{Name: p, Files: datastore.DataStore{}}
+		f.SubFolders = append(f.SubFolders, newFolder)
+		idx.folders[current] = newFolder
+		f = newFolder
+	}
+	return f, nil
+}
+
+// isSubPath returns whether the clean path p is inside the clean folder path parent.
+func isSubPath(parent, p string) bool {
+	return parent == "/" && p != "/" || strings.HasPrefix(p, parent+"/")
+}
+
+// folderExists returns whether the folder exists, without creating it.
+func (n *Network) folderExists(folderPath string) bool {
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	_, ok := n.networkIndex().folders[CleanNetworkPath(folderPath)]
+	return ok
+}
+
+// folderTree returns the cloud paths of the folder and all of its sub-folders, parents first, and of all of the files
+// in them. Returns nothing if the folder does not exist.
+func (n *Network) folderTree(folderPath string) ([]string, map[string]*datastore.File) {
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	folderPath = CleanNetworkPath(folderPath)
+	folders := make([]string, 0)
+	files := make(map[string]*datastore.File)
+	root, ok := n.networkIndex().folders[folderPath]
+	if !ok {
+		return folders, files
+	}
+
+	var walk func(p string, folder *NetworkFolder)
+	walk = func(p string, folder *NetworkFolder) {
+		folders = append(folders, p)
+		for _, f := range folder.Files.Files {
+			files[CleanNetworkPath(path.Join(p, f.Name))] = f
+		}
+		for _, sub := range folder.SubFolders {
+			walk(CleanNetworkPath(path.Join(p, sub.Name)), sub)
+		}
+	}
+	walk(folderPath, root)
+	return folders, files
+}
+
+// moveFolder moves the folder, with all of its contents, to a new path. Missing parent folders of the new path are
+// created.
+func (n *Network) moveFolder(folderPath, newPath string) error {
+	folderPath = CleanNetworkPath(folderPath)
+	newPath = CleanNetworkPath(newPath)
+	if folderPath == newPath || isSubPath(folderPath, newPath) {
+		return errors.New("can not move a directory into itself")
+	}
+	if err := ValidatePath(newPath); err != nil {
+		return err
+	}
+
+	n.indexMutex().Lock()
+	folder, ok := n.networkIndex().folders[folderPath]
+	n.indexMutex().Unlock()
+	if !ok {
+		return errors.New("directory not found")
+	}
+	if err := n.removeFolder(folderPath); err != nil {
+		return err
+	}
+
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	parent, err := n.getFolder(path.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	folder.Name = path.Base(newPath)
+	parent.SubFolders = append(parent.SubFolders, folder)
+	n.index = nil
+	return nil
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"cloud/datastore"
+	"fmt"
+	"path"
+	"testing"
+)
+
+func indexTestFile(name string, chunks ...string) *datastore.File {
+	f := &datastore.File{Name: name}
+	for i, c := range chunks {
+		f.Chunks.Chunks = append(f.Chunks.Chunks, datastore.Chunk{ID: datastore.ChunkID(c), SequenceNumber: i})
+	}
+	return f
+}
+
+func TestNetworkIndex(t *testing.T) {
+	n := &Network{}
+	if _, err := n.addFile("/a/b/file", indexTestFile("file", "1", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.addFile("/a/other", indexTestFile("other", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := n.addFile("/a/other", indexTestFile("other", "3")); added {
+		t.Error("Expected a file with an existing name not to be added.")
+	}
+
+	if f, err := n.GetFile("/a/b/file"); err != nil || f.Name != "file" {
+		t.Fatalf("Expected to find /a/b/file, got %v, %v.", f, err)
+	}
+	if paths := n.chunkFiles("2"); len(paths) != 2 {
+		t.Errorf("Expected chunk 2 to be in 2 files, got %v.", paths)
+	}
+
+	if err := n.replaceFile("/a/b/file", indexTestFile("file", "4")); err != nil {
+		t.Fatal(err)
+	}
+	if paths := n.chunkFiles("1"); len(paths) != 0 {
+		t.Errorf("Expected chunk 1 to be gone, got %v.", paths)
+	}
+	if paths := n.chunkFiles("4"); len(paths) != 1 || paths[0] != "/a/b/file" {
+		t.Errorf("Expected chunk 4 to be in /a/b/file, got %v.", paths)
+	}
+
+	if _, err := n.removeFile("/a/other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.GetFile("/a/other"); err == nil {
+		t.Error("Expected /a/other to be removed.")
+	}
+	if paths := n.chunkFiles("2"); len(paths) != 0 {
+		t.Errorf("Expected chunk 2 to be gone, got %v.", paths)
+	}
+
+	if err := n.removeFolder("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if paths := n.chunkFiles("4"); len(paths) != 0 {
+		t.Errorf("Expected chunk 4 to be gone with its folder, got %v.", paths)
+	}
+	if folder, _ := n.GetFolder("/a/b"); len(folder.Files.Files) != 0 {
+		t.Error("Expected /a/b to be created again empty.")
+	}
+}
+
+func benchmarkNetwork(folders, files int) (*Network, []string) {
+	n := &Network{}
+	paths := make([]string, 0, folders*files)
+	for i := 0; i < folders; i++ {
+		for j := 0; j < files; j++ {
+			p := fmt.Sprintf("/folder%d/sub/file%d", i, j)
+			n.addFile(p, indexTestFile(path.Base(p), fmt.Sprintf("chunk%d-%d", i, j)))
+			paths = append(paths, p)
+		}
+	}
+	return n, paths
+}
+
+func BenchmarkNetworkGetFile(b *testing.B) {
+	n, paths := benchmarkNetwork(100, 500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := n.GetFile(paths[i%len(paths)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkNetworkGetFileScan walks the folder tree for every lookup, as the network did before it was indexed.
+func BenchmarkNetworkGetFileScan(b *testing.B) {
+	n, paths := benchmarkNetwork(100, 500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := paths[i%len(paths)]
+		found := false
+		n.walkFiles(func(cloudPath string, file *datastore.File) {
+			if !found && cloudPath == target {
+				found = true
+			}
+		})
+	}
+}
+
+func BenchmarkNetworkChunkFiles(b *testing.B) {
+	n, _ := benchmarkNetwork(100, 500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.chunkFiles(datastore.ChunkID(fmt.Sprintf("chunk%d-%d", i%100, i%500)))
+	}
+}
+
+func TestNetworkIndexMutex(t *testing.T) {
+	n := &Network{}
+	if _, err := n.GetFolder("/a"); err != nil {
+		t.Fatal(err)
+	}
+	// Copies share the index, so they share its mutex.
+	copied := *n
+	if copied.indexMutex() != n.indexMutex() {
+		t.Error("Expected a copy of the network to share the index mutex.")
+	}
+	if other := (&Network{}); other.indexMutex() == n.indexMutex() {
+		t.Error("Expected networks to have their own index mutexes.")
+	}
+}
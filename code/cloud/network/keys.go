@@ -0,0 +1,90 @@
+package network
+
+import (
+	"cloud/utils"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// PEM block types of node private keys.
+const (
+	privateKeyBlockType          = "RSA PRIVATE KEY"
+	encryptedPrivateKeyBlockType = "ENCRYPTED CLOUD PRIVATE KEY"
+)
+
+// ErrPassphraseRequired is returned when reading encrypted data without a passphrase.
+var ErrPassphraseRequired = errors.New("passphrase required")
+
+// GeneratePrivateKey generates a new node identity key.
+func GeneratePrivateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// EncodePrivateKey encodes the key as PEM. If passphrase is not empty, the key is encrypted with it.
+func EncodePrivateKey(key *rsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	der := x509.MarshalPKCS1PrivateKey(key)
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: privateKeyBlockType, Bytes: der}), nil
+	}
+	encrypted, err := utils.EncryptWithPassphrase(der, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedPrivateKeyBlockType, Bytes: encrypted}), nil
+}
+
+// DecodePrivateKey decodes a PEM key written by EncodePrivateKey, or an unencrypted PKCS#1 key.
+func DecodePrivateKey(data []byte, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	der := block.Bytes
+	switch block.Type {
+	case privateKeyBlockType:
+	case encryptedPrivateKeyBlockType:
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		var err error
+		der, err = utils.DecryptWithPassphrase(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid type " + block.Type + " want: " + privateKeyBlockType)
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// ReadPrivateKey reads a private key file. The passphrase is only needed if the key is encrypted.
+func ReadPrivateKey(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePrivateKey(data, passphrase)
+}
+
+// WritePrivateKey writes the key to the file, encrypted with the passphrase if it is not empty.
+func WritePrivateKey(path string, key *rsa.PrivateKey, passphrase []byte) error {
+	data, err := EncodePrivateKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0600)
+}
+
+// IsPrivateKeyEncrypted returns true if the private key file is encrypted with a passphrase.
+func IsPrivateKeyEncrypted(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedPrivateKeyBlockType, nil
+}
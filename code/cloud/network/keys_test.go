@@ -0,0 +1,74 @@
+package network
+
+import (
+	"cloud/utils"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedPrivateKey(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_keys_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	path := filepath.Join(dirs[0], "key.pem")
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("correct horse battery staple")
+	if err := WritePrivateKey(path, key, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := IsPrivateKeyEncrypted(path); err != nil || !encrypted {
+		t.Errorf("Expected key to be encrypted, got %v, %v.", encrypted, err)
+	}
+
+	if _, err := ReadPrivateKey(path, nil); err != ErrPassphraseRequired {
+		t.Errorf("Got error %v; want %v.", err, ErrPassphraseRequired)
+	}
+	if _, err := ReadPrivateKey(path, []byte("wrong")); err != utils.ErrWrongPassphrase {
+		t.Errorf("Got error %v; want %v.", err, utils.ErrWrongPassphrase)
+	}
+	read, err := ReadPrivateKey(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.N.Cmp(key.N) != 0 {
+		t.Error("Decrypted key does not match.")
+	}
+
+	// Keys without a passphrase are plain PKCS#1.
+	if err := WritePrivateKey(path, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPrivateKey(path, nil); err != nil {
+		t.Errorf("Reading unencrypted key: %v.", err)
+	}
+}
+
+func TestEncryptedStateFile(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_keys_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	path := filepath.Join(dirs[0], "state")
+
+	passphrase := []byte("passphrase")
+	if err := WriteStateFile(path, SavedNetworkState{Network: Network{Name: "secret"}}, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadStateFile(path, nil); err != ErrPassphraseRequired {
+		t.Errorf("Got error %v; want %v.", err, ErrPassphraseRequired)
+	}
+	info, err := InspectStateFile(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Encrypted || info.State.Network.Name != "secret" {
+		t.Errorf("Got encrypted %v, network %v.", info.Encrypted, info.State.Network.Name)
+	}
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"cloud/datastore"
+	"testing"
+	"time"
+)
+
+func TestFileMetadataPropagation(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := clouds[0].AddFileMetadata(&datastore.File{
+		ID:          "v1",
+		Name:        "file.txt",
+		Modified:    modified,
+		Mode:        0640,
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"tag": "report"},
+	}, "/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := clouds[0].MyNode().ID
+	f, err := clouds[1].GetFile("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Owner != owner || f.Created.IsZero() || !f.Modified.Equal(modified) || f.Mode != 0640 ||
+		f.ContentType != "text/plain" || f.Metadata["tag"] != "report" {
+		t.Errorf("Unexpected metadata after AddFile: %+v.", f)
+	}
+	created := f.Created
+
+	if !clouds[1].LockFile("/file.txt") {
+		t.Fatal("Could not lock /file.txt.")
+	}
+	defer clouds[1].UnlockFile("/file.txt")
+	if err := clouds[1].UpdateFile(&datastore.File{ID: "v2", Name: "file.txt"}, "/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clouds {
+		f, err := c.GetFile("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ID != "v2" || f.Owner != owner || !f.Created.Equal(created) || f.Metadata["tag"] != "report" ||
+			f.Mode != 0640 || !f.Modified.After(modified) {
+			t.Errorf("Cloud %d has unexpected metadata after UpdateFile: %+v.", i, f)
+		}
+	}
+}
+
+func TestSetFileMetadata(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[0].AddFileMetadata(&datastore.File{
+		ID:       "v1",
+		Name:     "file.txt",
+		Metadata: map[string]string{"tag": "report"},
+	}, "/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := clouds[1].GetFile("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clouds[1].SetFileMetadata("/file.txt", map[string]string{"a": "b"}); err == nil {
+		t.Error("Expected setting metadata without the file lock to fail.")
+	}
+	if !clouds[1].LockFile("/file.txt") {
+		t.Fatal("Could not lock /file.txt.")
+	}
+	defer clouds[1].UnlockFile("/file.txt")
+	if err := clouds[1].SetFileMetadata("/file.txt", map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clouds {
+		f, err := c.GetFile("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Metadata) != 1 || f.Metadata["a"] != "b" || f.ID != "v1" || !f.Created.Equal(before.Created) {
+			t.Errorf("Cloud %d has unexpected metadata after SetFileMetadata: %+v.", i, f)
+		}
+	}
+	if before.Metadata["tag"] != "report" {
+		t.Error("Expected files returned before to keep their metadata.")
+	}
+
+	// Cleared metadata is not inherited from the previous version by updates.
+	if err := clouds[1].SetFileMetadata("/file.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[1].UpdateFile(&datastore.File{ID: "v2", Name: "file.txt"}, "/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clouds {
+		f, err := c.GetFile("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ID != "v2" || len(f.Metadata) != 0 {
+			t.Errorf("Cloud %d has unexpected metadata after clearing it: %+v.", i, f)
+		}
+	}
+}
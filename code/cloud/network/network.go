@@ -8,9 +8,10 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"golang.org/x/text/unicode/norm"
 	"path"
 	"path/filepath"
-	"strings"
+	"sync"
 )
 
 type ChunkNodes map[datastore.ChunkID][]string
@@ -57,20 +58,32 @@ type Network struct {
 
 	RootFolder *NetworkFolder
 
-	// ChunkNodes maps chunk ID's to the Nodes (Node ID's) that contain that chunk.
-	// This way we can keep track of which nodes contain which chunks.
-	// And make decisions about the chunk requests to perform.
-	// In the future this scheme might change, for example, with each node knowing only about its own chunks.
+	// ChunkNodes maps chunk ID's to the Nodes (Node ID's) that contain that chunk. Each node only lists the chunks it
+	// holds itself, and publishes them as provider records in the DHT. Holders of any chunk are looked up in the DHT.
 	ChunkNodes ChunkNodes
 
 	// FileNodes maps file ID's to the Nodes that contain the whole file. Those nodes are syncing the whole file all the
 	// time.
 	FileNodes FileNodes
+
+	// DrainingNodes contains the IDs of nodes that are being drained. Draining nodes are not chosen to store new data.
+	// The value is true once all of the node's chunks have enough copies on other nodes and it is safe to remove it.
+	DrainingNodes map[string]bool
+
+	// RevokedKeys contains the key IDs (see PublicKeyToID) of keys that were replaced by a key rotation. Revoked keys
+	// can not be used to authenticate.
+	RevokedKeys []string
+
+	index *networkIndex
+	// indexLock guards index. It is a pointer, so that copies of the network share it along with the index.
+	indexLock *sync.Mutex
 }
 
 // CleanNetworkPath cleans the provided path and returns a network-friendly path. Always starting with a / and only
-// containing forward slashes.
+// containing forward slashes. Names are normalized to Unicode NFC, so that paths typed on different platforms match.
+// Paths are not validated, see ValidatePath.
 func CleanNetworkPath(networkPath string) string {
+	networkPath = norm.NFC.String(networkPath)
 	networkPath = filepath.ToSlash(networkPath)
 	networkPath = path.Clean(networkPath)
 	if len(networkPath) == 0 {
@@ -120,47 +133,17 @@ func (n *Network) GetFile(file string) (*datastore.File, error) {
 		return nil, err
 	}
 
-	for _, f := range folder.Files.Files {
-		if f.Name == base {
-			return f, nil
-		}
+	if f, found := folder.Files.Get(base); found {
+		return f, nil
 	}
 	return nil, errors.New("file not found")
 }
 
-// GetFolder retrieves the folder for the given path.
+// GetFolder retrieves the folder for the given path. Missing folders are created, if their names are valid.
 func (n *Network) GetFolder(folder string) (*NetworkFolder, error) {
-	paths := strings.Split(folder, "/")
-
-	if n.RootFolder == nil {
-		n.RootFolder = &NetworkFolder{
-			Name: "/",
-		}
-	}
-	f := n.RootFolder
-
-	for _, p := range paths {
-		if p == "" {
-			continue
-		}
-
-		// TODO: Check validity of path.
-
-		foundFolder := false
-		for _, sub := range f.SubFolders {
-			if sub.Name == p {
-				foundFolder = true
-				f = sub
-				break
-			}
-		}
-		if !foundFolder {
-			newFolder := &NetworkFolder{Name: p, Files: datastore.DataStore{}}
-			f.SubFolders = append(f.SubFolders, newFolder)
-			f = newFolder
-		}
-	}
-	return f, nil
+	n.indexMutex().Lock()
+	defer n.indexMutex().Unlock()
+	return n.getFolder(folder)
 }
 
 // GetFolders retrieve the folders in the network.
@@ -211,6 +194,23 @@ func (n *Network) rGetFiles(folder *NetworkFolder) []*NetworkFile {
 	return netFiles
 }
 
+// walkFiles calls fn for every file in the network, together with the file's full cloud path.
+func (n *Network) walkFiles(fn func(cloudPath string, file *datastore.File)) {
+	var walk func(folderPath string, folder *NetworkFolder)
+	walk = func(folderPath string, folder *NetworkFolder) {
+		if folder == nil {
+			return
+		}
+		for _, f := range folder.Files.Files {
+			fn(CleanNetworkPath(path.Join(folderPath, f.Name)), f)
+		}
+		for _, sub := range folder.SubFolders {
+			walk(path.Join(folderPath, sub.Name), sub)
+		}
+	}
+	walk("/", n.RootFolder)
+}
+
 func (c *cloud) NodeByID(ID string) (node Node, found bool) {
 	c.networkMutex.RLock()
 	defer c.networkMutex.RUnlock()
@@ -38,6 +38,7 @@ func (c *cloud) addCloudNode(ID string, node *cloudNode) bool {
 	defer c.NodesMutex.Unlock()
 	if _, ok := c.Nodes[ID]; !ok {
 		c.Nodes[ID] = node
+		c.nodesChanged()
 
 		if c.events.NodeConnected != nil {
 			go c.events.NodeConnected(ID)
@@ -52,6 +53,7 @@ func (c *cloud) removeCloudNode(ID string) bool {
 	defer c.NodesMutex.Unlock()
 	if _, ok := c.Nodes[ID]; ok {
 		delete(c.Nodes, ID)
+		c.nodesChanged()
 
 		if c.events.NodeDisconnected != nil {
 			go c.events.NodeDisconnected(ID)
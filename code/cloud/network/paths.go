@@ -0,0 +1,222 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of cloud paths. They are the lowest limits of the file systems that cloud folders are synced to.
+const (
+	// MaxNameLength is the maximum length of a file or folder name, in bytes.
+	MaxNameLength = 255
+	// MaxPathLength is the maximum length of a cloud path, in bytes.
+	MaxPathLength = 4096
+)
+
+// forbiddenChars can not be used in names on Windows. '/' separates names, so it is never part of one.
+const forbiddenChars = `<>:"\|?*`
+
+// reservedNames are device names on Windows. They are reserved with any extension, like "con.txt".
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true,
+	"COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true,
+	"LPT9": true,
+}
+
+// ValidateName returns an error if the file or folder name can not be used on every platform that nodes run on.
+func ValidateName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("name %q is longer than %d bytes", name, MaxNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("name %q is not valid UTF-8", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r == '/' || strings.ContainsRune(forbiddenChars, r) {
+			return fmt.Errorf("name %q contains the forbidden character %q", name, r)
+		}
+	}
+	if strings.HasSuffix(name, " ") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("name %q ends with a space or a period", name)
+	}
+	base := strings.ToUpper(strings.TrimRight(strings.SplitN(name, ".", 2)[0], " "))
+	if reservedNames[base] {
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	return nil
+}
+
+// ValidatePath returns an error if any name of the cloud path is invalid, or if the path is too long. The path is
+// cleaned first.
+func ValidatePath(networkPath string) error {
+	networkPath = CleanNetworkPath(networkPath)
+	if len(networkPath) > MaxPathLength {
+		return fmt.Errorf("path is longer than %d bytes", MaxPathLength)
+	}
+	for _, name := range strings.Split(networkPath, "/") {
+		if name == "" {
+			continue
+		}
+		if err := ValidateName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CaseCollisionPolicy decides how folder syncs handle cloud files whose names differ only in case. Such files can not
+// be stored next to each other on case-insensitive file systems.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionRename syncs colliding files under a name with a numbered suffix, like "Name (1).txt". The name
+	// that comes first when sorted, or that is already synced, keeps its name.
+	CaseCollisionRename CaseCollisionPolicy = iota
+	// CaseCollisionIgnore syncs every file under its own name. Only safe on case-sensitive file systems.
+	CaseCollisionIgnore
+)
+
+// syncLocalPath returns the local path that the cloud file is synced to by the folder sync. It reads the cloud folder
+// under networkMutex and the renamed files under Mutex, so none of the cloud's mutexes may be held.
+func (c *cloud) syncLocalPath(sync *fileSync, cloudPath string) string {
+	cloudPath = CleanNetworkPath(cloudPath)
+	c.Mutex.RLock()
+	renamed, ok := sync.Renamed[cloudPath]
+	c.Mutex.RUnlock()
+	if ok {
+		return renamed
+	}
+	relPath := strings.TrimPrefix(cloudPath, sync.CloudPath)
+	localPath := filepath.Join(sync.LocalPath, filepath.FromSlash(relPath))
+	if c.config.CaseCollisions == CaseCollisionIgnore {
+		return localPath
+	}
+
+	cloudDir, name := path.Split(cloudPath)
+	localDir := filepath.Dir(localPath)
+	names := folderNames{local: localNames(localDir), cloud: c.cloudNames(cloudDir)}
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	// Another event could have renamed it in the meantime.
+	if renamed, ok := sync.Renamed[cloudPath]; ok {
+		return renamed
+	}
+	if !caseCollides(sync, names, cloudDir, localDir, name, false) {
+		return localPath
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !caseCollides(sync, names, cloudDir, localDir, candidate, true) {
+			renamed := filepath.Join(localDir, candidate)
+			c.setRenamed(sync, cloudPath, renamed)
+			return renamed
+		}
+	}
+}
+
+// setRenamed records that the cloud file is synced under another local name. If the sync is a snapshot, the folder
+// sync it was taken of records it too. Mutex must be held.
+func (c *cloud) setRenamed(sync *fileSync, cloudPath, localPath string) {
+	syncs := []*fileSync{sync}
+	if registered, err := c.syncByLocalPath(sync.LocalPath); err == nil && registered != sync {
+		syncs = append(syncs, registered)
+	}
+	for _, s := range syncs {
+		if s.Renamed == nil {
+			s.Renamed = make(map[string]string)
+		}
+		s.Renamed[cloudPath] = localPath
+	}
+}
+
+// folderNames are the names in a local folder and in the cloud folder that is synced to it.
+type folderNames struct {
+	local []string
+	cloud []string
+}
+
+// localNames returns the names in the local folder, or nothing if it can not be read.
+func localNames(localDir string) []string {
+	infos, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// cloudNames returns the names of the files in the cloud folder, or nothing if it does not exist.
+func (c *cloud) cloudNames(cloudDir string) []string {
+	c.networkMutex.RLock()
+	defer c.networkMutex.RUnlock()
+	if !c.network.folderExists(cloudDir) {
+		return nil
+	}
+	folder, err := c.network.GetFolder(cloudDir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(folder.Files.Files))
+	for _, f := range folder.Files.Files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// caseCollides returns whether the name collides with a name that only differs in case, in the cloud folder or in the
+// local folder it is synced to. Unless exact is set, another name collides only if it is already synced or comes
+// first. Mutex must be held.
+func caseCollides(sync *fileSync, names folderNames, cloudDir, localDir, name string, exact bool) bool {
+	collides := func(other string) bool {
+		if exact {
+			return strings.EqualFold(name, other)
+		}
+		return other != name && strings.EqualFold(name, other)
+	}
+
+	for _, other := range names.local {
+		if collides(other) {
+			return true
+		}
+	}
+	for _, localPath := range sync.Renamed {
+		if filepath.Dir(localPath) == localDir && collides(filepath.Base(localPath)) {
+			return true
+		}
+	}
+	for _, other := range names.cloud {
+		if _, renamed := sync.Renamed[CleanNetworkPath(path.Join(cloudDir, other))]; renamed && !exact {
+			continue
+		}
+		if collides(other) && (exact || other < name) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncCloudPath returns the cloud path of a local file in the folder sync. Mutex must be held, unless the sync is a
+// snapshot.
+func syncCloudPath(sync *fileSync, localPath string) string {
+	for cloudPath, renamed := range sync.Renamed {
+		if renamed == localPath {
+			return cloudPath
+		}
+	}
+	relPath := filepath.ToSlash(strings.TrimPrefix(localPath, sync.LocalPath))
+	return CleanNetworkPath(path.Join(sync.CloudPath, relPath))
+}
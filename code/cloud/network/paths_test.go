@@ -0,0 +1,87 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"file.txt", "console", "Contents", "ünïcode", ".hidden", "a b"}
+	for _, name := range valid {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("Expected %q to be valid: %v.", name, err)
+		}
+	}
+	invalid := []string{"", "..", "a:b", "a\\b", "what?", "tab\t", "CON", "nul.txt", "Com1.tar.gz", "dot.", "space ",
+		strings.Repeat("a", MaxNameLength+1), "\xff"}
+	for _, name := range invalid {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("Expected %q to be invalid.", name)
+		}
+	}
+	if err := ValidatePath(strings.Repeat("/abc", MaxPathLength/4+1)); err == nil {
+		t.Error("Expected a long path to be invalid.")
+	}
+}
+
+func TestCleanNetworkPathNormalization(t *testing.T) {
+	// "é" as a single code point and as "e" followed by a combining accent.
+	if nfc, nfd := CleanNetworkPath("/caf\u00e9"), CleanNetworkPath("/cafe\u0301"); nfc != nfd {
+		t.Errorf("Expected %q and %q to be the same path.", nfc, nfd)
+	}
+}
+
+func TestNetworkRejectsInvalidPaths(t *testing.T) {
+	n := &Network{}
+	if _, err := n.GetFolder("/ok/bad|name"); err == nil {
+		t.Error("Expected an invalid folder name to be rejected.")
+	}
+	if _, err := n.addFile("/ok/aux.txt", indexTestFile("aux.txt")); err == nil {
+		t.Error("Expected a reserved file name to be rejected.")
+	}
+	if _, err := n.addFile("/ok/cafe\u0301", indexTestFile("cafe\u0301")); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := n.GetFile("/ok/caf\u00e9"); err != nil || f.Name != "caf\u00e9" {
+		t.Errorf("Expected the file name to be normalized, got %v, %v.", f, err)
+	}
+}
+
+func TestSyncCaseCollisions(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_case_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+
+	for _, name := range []string{"a.txt", "A.txt", "b.txt"} {
+		if err := c.AddFileMetadata(&datastore.File{ID: datastore.FileID(name)}, "/s/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := &fileSync{CloudPath: "/s", LocalPath: dirs[0]}
+	if p := c.syncLocalPath(sync, "/s/a.txt"); p != filepath.Join(dirs[0], "a (1).txt") {
+		t.Errorf("Expected a.txt to be renamed, got %v.", p)
+	}
+	for _, name := range []string{"A.txt", "b.txt"} {
+		if p := c.syncLocalPath(sync, "/s/"+name); p != filepath.Join(dirs[0], name) {
+			t.Errorf("Expected %v to keep its name, got %v.", name, p)
+		}
+	}
+	if p := syncCloudPath(sync, filepath.Join(dirs[0], "a (1).txt")); p != "/s/a.txt" {
+		t.Errorf("Expected the renamed file to map to /s/a.txt, got %v.", p)
+	}
+
+	c.config.CaseCollisions = CaseCollisionIgnore
+	if p := c.syncLocalPath(&fileSync{CloudPath: "/s", LocalPath: dirs[0]}, "/s/a.txt"); p != filepath.Join(dirs[0], "a.txt") {
+		t.Errorf("Expected a.txt to keep its name when collisions are ignored, got %v.", p)
+	}
+}
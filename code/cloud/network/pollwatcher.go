@@ -0,0 +1,274 @@
+package network
+
+import (
+	"cloud/utils"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WatchMode is how syncs watch the local files for changes.
+type WatchMode int
+
+const (
+	// WatchAuto uses the file system's notifications, and polls the folders that can not be watched because the
+	// notification limits of the system are reached.
+	WatchAuto WatchMode = iota
+	// WatchNotify only uses the file system's notifications.
+	WatchNotify
+	// WatchPoll polls all of the watched files. Network file systems like NFS and SMB do not notify of changes.
+	WatchPoll
+)
+
+// defaultPollInterval is how often watched files are polled if the config does not set it.
+const defaultPollInterval = 2 * time.Second
+
+// fileWatcher watches local files and folders for changes. Watching a folder watches its direct children.
+type fileWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+}
+
+// polledFile is the state of a polled file at the last poll.
+type polledFile struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// pollWatcher watches files by comparing snapshots of them. It produces the same events as the file system's
+// notifications, except that removed and renamed files are both reported as renamed, the sync pairs them with the
+// created new names.
+type pollWatcher struct {
+	handle   func(event fsnotify.Event)
+	interval time.Duration
+	// watched maps the watched paths to the snapshot of the path and its children.
+	watched map[string]map[string]polledFile
+	mutex   sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPollWatcher creates a watcher that polls the watched paths every interval, and handles their events with handle.
+func newPollWatcher(handle func(event fsnotify.Event), interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		handle:   handle,
+		interval: interval,
+		watched:  make(map[string]map[string]polledFile),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.poll()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// pollSnapshot returns the state of the path, and of its children if it is a folder.
+func pollSnapshot(name string) (map[string]polledFile, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := map[string]polledFile{
+		name: {size: info.Size(), modTime: info.ModTime(), isDir: info.IsDir()},
+	}
+	if !info.IsDir() {
+		return snapshot, nil
+	}
+	children, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		snapshot[filepath.Join(name, child.Name())] = polledFile{
+			size:    child.Size(),
+			modTime: child.ModTime(),
+			isDir:   child.IsDir(),
+		}
+	}
+	return snapshot, nil
+}
+
+func (w *pollWatcher) Add(name string) error {
+	name = filepath.Clean(name)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.watched[name]; ok {
+		return nil
+	}
+	snapshot, err := pollSnapshot(name)
+	if err != nil {
+		return err
+	}
+	w.watched[name] = snapshot
+	return nil
+}
+
+func (w *pollWatcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.watched[name]; !ok {
+		return errors.New("can't remove non-existent watch for: " + name)
+	}
+	delete(w.watched, name)
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+// poll compares the watched paths with their last snapshots, and handles the changes. Removed and renamed files are
+// handled first, so that renames can be paired with the new names.
+func (w *pollWatcher) poll() {
+	renamed := make(map[string]bool)
+	created := make(map[string]bool)
+	written := make(map[string]bool)
+	w.mutex.Lock()
+	for name, before := range w.watched {
+		after, err := pollSnapshot(name)
+		if err != nil {
+			// The watched path itself is gone, like the file system's notifications the watch is removed.
+			after = map[string]polledFile{}
+			delete(w.watched, name)
+		} else {
+			w.watched[name] = after
+		}
+		for p, old := range before {
+			current, ok := after[p]
+			switch {
+			case !ok:
+				renamed[p] = true
+			case old.isDir != current.isDir:
+				renamed[p] = true
+				created[p] = true
+			case !current.isDir && (old.size != current.size || !old.modTime.Equal(current.modTime)):
+				written[p] = true
+			}
+		}
+		for p := range after {
+			if _, ok := before[p]; !ok {
+				created[p] = true
+			}
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, set := range []struct {
+		names map[string]bool
+		op    fsnotify.Op
+	}{{renamed, fsnotify.Rename}, {created, fsnotify.Create}, {written, fsnotify.Write}} {
+		names := make([]string, 0, len(set.names))
+		for name := range set.names {
+			names = append(names, name)
+		}
+		// Parents are created before their children.
+		sort.Strings(names)
+		for _, name := range names {
+			w.handle(fsnotify.Event{Name: name, Op: set.op})
+		}
+	}
+}
+
+// isWatchLimit returns whether the error is because the system does not allow more notification watches.
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// fallbackWatcher watches files with the file system's notifications, and polls the ones that can not be watched
+// because the notification limits of the system are reached.
+type fallbackWatcher struct {
+	notify *fsnotify.Watcher
+	poll   *pollWatcher
+}
+
+func (w *fallbackWatcher) Add(name string) error {
+	err := w.notify.Add(name)
+	if isWatchLimit(err) {
+		utils.GetLogger().Printf("[WARN] Can not watch %v: %v, polling it instead.", name, err)
+		return w.poll.Add(name)
+	}
+	return err
+}
+
+func (w *fallbackWatcher) Remove(name string) error {
+	notifyErr := w.notify.Remove(name)
+	if pollErr := w.poll.Remove(name); pollErr == nil {
+		return nil
+	}
+	return notifyErr
+}
+
+func (w *fallbackWatcher) Close() error {
+	w.poll.Close()
+	return w.notify.Close()
+}
+
+// newNotifyWatcher creates a watcher that uses the file system's notifications, and handles their events with handle.
+func newNotifyWatcher(handle func(event fsnotify.Event)) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				handle(event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				utils.GetLogger().Println("[INFO] error:", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// newFileWatcher creates the watcher of the config's watch mode, which handles its events with handle.
+func (c *cloud) newFileWatcher(handle func(event fsnotify.Event)) (fileWatcher, error) {
+	interval := c.config.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	if c.config.WatchMode == WatchPoll {
+		return newPollWatcher(handle, interval), nil
+	}
+	notify, err := newNotifyWatcher(handle)
+	if err != nil {
+		if c.config.WatchMode == WatchAuto {
+			utils.GetLogger().Printf("[WARN] File system notifications are not available: %v, polling instead.", err)
+			return newPollWatcher(handle, interval), nil
+		}
+		return nil, err
+	}
+	if c.config.WatchMode == WatchNotify {
+		return notify, nil
+	}
+	return &fallbackWatcher{notify: notify, poll: newPollWatcher(handle, interval)}, nil
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"cloud/utils"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_poll_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	dir := dirs[0]
+	writeTestFiles(t, dir, map[string]string{"a.txt": "a"})
+
+	events := make(chan fsnotify.Event, 16)
+	w := newPollWatcher(func(event fsnotify.Event) {
+		events <- event
+	}, time.Hour)
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Watched a path that does not exist.")
+	}
+
+	expect := func(expected ...fsnotify.Event) {
+		w.poll()
+		for _, e := range expected {
+			select {
+			case event := <-events:
+				if event != e {
+					t.Errorf("Expected %v, got %v.", e, event)
+				}
+			default:
+				t.Errorf("Expected %v, got nothing.", e)
+			}
+		}
+		select {
+		case event := <-events:
+			t.Errorf("Unexpected %v.", event)
+		default:
+		}
+	}
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+
+	expect()
+	writeTestFiles(t, dir, map[string]string{"a.txt": "edited"})
+	expect(fsnotify.Event{Name: a, Op: fsnotify.Write})
+	if err := os.Rename(a, b); err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Event{Name: a, Op: fsnotify.Rename}, fsnotify.Event{Name: b, Op: fsnotify.Create})
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Event{Name: b, Op: fsnotify.Rename})
+
+	if err := w.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, dir, map[string]string{"c.txt": "c"})
+	expect()
+}
+
+func TestIsWatchLimit(t *testing.T) {
+	if !isWatchLimit(syscall.ENOSPC) || !isWatchLimit(syscall.EMFILE) {
+		t.Error("Expected the inotify limits to be detected.")
+	}
+	if isWatchLimit(nil) || isWatchLimit(syscall.ENOENT) {
+		t.Error("Expected other errors not to be watch limits.")
+	}
+}
+
+func TestSyncFolderPolling(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_polling_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0], WatchMode: WatchPoll, PollInterval: 50 * time.Millisecond})
+	localDir := dirs[1]
+
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.watcher.(*pollWatcher); !ok {
+		t.Fatalf("Expected a polling watcher, got %T.", c.watcher)
+	}
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "polled"})
+	waitFor(t, "Created file was not uploaded.", func() bool {
+		return c.FileStore("/p/a.txt") != nil
+	})
+	waitForIndex(t, c, "/p/a.txt")
+
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "polled edit"})
+	waitFor(t, "Edited file was not uploaded.", func() bool {
+		f, err := c.GetFile("/p/a.txt")
+		return err == nil && f.Size == uint64(len("polled edit"))
+	})
+}
+
+func TestSyncFolderPollingCreatedFolder(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_polling_folder_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0], WatchMode: WatchPoll, PollInterval: 50 * time.Millisecond})
+	localDir := dirs[1]
+
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	// The folder and its contents show up in the same poll.
+	staging := filepath.Join(dirs[2], "new")
+	writeTestFiles(t, staging, map[string]string{"x.txt": "x", "sub/y.txt": "y"})
+	if err := os.Rename(staging, filepath.Join(localDir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Files of the created folder were not uploaded.", func() bool {
+		return c.FileStore("/p/new/x.txt") != nil && c.FileStore("/p/new/sub/y.txt") != nil
+	})
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const storageFullMessage = "storage full"
+
+// StorageFullError is returned when a node refuses to store data because its storage capacity would be exceeded.
+type StorageFullError struct {
+	Requested uint64 // in bytes, the amount of storage the write needed.
+	Remaining uint64 // in bytes, the amount of storage that was left on the node.
+}
+
+func (e *StorageFullError) Error() string {
+	return fmt.Sprintf("%s: %d bytes requested, %d bytes remaining", storageFullMessage, e.Requested, e.Remaining)
+}
+
+// IsStorageFullError returns true if the error was caused by a node running out of storage.
+// Errors returned by remote nodes only keep their message, so the message is checked as well.
+func IsStorageFullError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var fullErr *StorageFullError
+	if errors.As(err, &fullErr) {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), storageFullMessage)
+}
+
+// storageRemainingLocked returns the storage left for user data on the node. c.Mutex must be held.
+func (c *cloud) storageRemainingLocked() uint64 {
+	capacity := c.config.FileStorageCapacity
+	if capacity == -1 {
+		return 0
+	} else if capacity == 0 {
+		// Capacity not set, the disk itself is the limit.
+		return utils.AvailableDisk(c.config.FileStorageDir)
+	}
+	used := c.benchmarkState.StorageSpaceUsed
+	if used >= uint64(capacity) {
+		return 0
+	}
+	return uint64(capacity) - used
+}
+
+// reserveStorage accounts for size bytes of new user data on the node. If the node does not have enough storage left,
+// nothing is reserved and a StorageFullError is returned.
+func (c *cloud) reserveStorage(size uint64) error {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if size == 0 {
+		return nil
+	}
+	remaining := c.storageRemainingLocked()
+	if size > remaining {
+		return &StorageFullError{Requested: size, Remaining: remaining}
+	}
+	c.benchmarkState.StorageSpaceUsed += size
+	return nil
+}
+
+// accountStorage accounts for size bytes of user data on the node, without checking the capacity.
+func (c *cloud) accountStorage(size uint64) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.benchmarkState.StorageSpaceUsed += size
+}
+
+// releaseStorage frees size bytes of user data on the node.
+func (c *cloud) releaseStorage(size uint64) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if c.benchmarkState.StorageSpaceUsed < size {
+		c.benchmarkState.StorageSpaceUsed = 0
+	} else {
+		c.benchmarkState.StorageSpaceUsed -= size
+	}
+}
+
+// recomputeStorageUsed sets the storage used by the node to the size of the node's file storage directory.
+func (c *cloud) recomputeStorageUsed() {
+	dir := c.config.FileStorageDir
+	if dir == "" {
+		return
+	}
+	used, err := utils.DirSize(dir)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Computing storage used in %v: %v.", dir, err)
+		return
+	}
+	utils.GetLogger().Printf("[INFO] Storage used in %v: %d bytes.", dir, used)
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.benchmarkState.StorageSpaceUsed = used
+}
+
+// storeChunk stores the chunk's contents in the file store, reserving the storage it needs beforehand.
+// Only chunks kept in the node's file storage directory count towards its capacity.
+func (c *cloud) storeChunk(storage datastore.FileStore, chunkID datastore.ChunkID, content []byte) error {
+	partial, ok := storage.(*datastore.PartialFileStore)
+	if !ok {
+		return storage.StoreChunk(chunkID, content)
+	}
+
+	// The chunk may already be stored, only the difference in size needs to be reserved.
+	existing := partial.StoredChunkSize(chunkID)
+	size := uint64(len(content))
+	if size > existing {
+		if err := c.reserveStorage(size - existing); err != nil {
+			return err
+		}
+	}
+	if err := storage.StoreChunk(chunkID, content); err != nil {
+		if size > existing {
+			c.releaseStorage(size - existing)
+		}
+		return err
+	}
+	if size < existing {
+		c.releaseStorage(existing - size)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"testing"
+)
+
+func TestReserveStorage(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	c.SetConfig(CloudConfig{FileStorageCapacity: 100})
+
+	if err := c.reserveStorage(60); err != nil {
+		t.Fatal(err)
+	}
+	err = c.reserveStorage(50)
+	if !IsStorageFullError(err) {
+		t.Fatalf("Expected storage full error, got: %v.", err)
+	}
+	if used := c.BenchmarkState().StorageSpaceUsed; used != 60 {
+		t.Errorf("Refused reservation changed usage. Expected 60, got %v.", used)
+	}
+	c.releaseStorage(60)
+	if err := c.reserveStorage(100); err != nil {
+		t.Errorf("Expected reservation to fit after release, got: %v.", err)
+	}
+
+	// Errors returned by remote nodes only keep their message.
+	if !IsStorageFullError(errors.New(err.Error())) {
+		t.Error("Expected storage full error to be recognised from its message.")
+	}
+}
+
+func TestSaveChunkQuota(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_quota_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	clouds[0].SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 15})
+
+	content := []byte("hellothere i see you are a fan of bytes?") // 40 bytes
+	tmpfile, err := utils.GetTestFile("cloud_test_file_*", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmpfile)
+	file, err := datastore.NewFile(tmpfile, tmpfile.Name(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[0].AddFile(file, "/test", tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one 10 byte chunk fits on the second node.
+	if used := clouds[1].BenchmarkState().StorageSpaceUsed; used != 10 {
+		t.Errorf("Expected StorageSpaceUsed 10 on the full node, got %v.", used)
+	}
+	if used := clouds[0].BenchmarkState().StorageSpaceUsed; used != 40 {
+		t.Errorf("Expected StorageSpaceUsed 40 on the origin node, got %v.", used)
+	}
+
+	// Usage is recomputed from the storage directory, as on startup.
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 15})
+	if used := clouds[1].BenchmarkState().StorageSpaceUsed; used != 10 {
+		t.Errorf("Expected recomputed StorageSpaceUsed 10, got %v.", used)
+	}
+}
+
+func TestDistributeChunkAllNodesFull(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_quota_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	clouds[0].SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 5})
+
+	tmpfile, err := utils.GetTestFile("cloud_test_file_*", []byte("hellothere i see you"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmpfile)
+	file, err := datastore.NewFile(tmpfile, tmpfile.Name(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[0].AddFile(file, "/test", tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := clouds[0].(*cloud)
+	err = c.DistributeChunk("/test", c.FileStore("/test"), file.Chunks.Chunks[0].ID)
+	if err == nil {
+		t.Error("Expected an error when no node has enough storage for the chunk.")
+	}
+}
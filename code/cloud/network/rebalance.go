@@ -0,0 +1,313 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rebalanceTolerance is how far (as a fraction of capacity) a node's fill may be from the network average before the
+// node takes part in rebalancing.
+const rebalanceTolerance = 0.05
+
+// NodeStorage is a snapshot of a node's storage usage.
+type NodeStorage struct {
+	ID       string
+	Used     uint64 // in bytes, how much storage is used already.
+	Capacity uint64 // in bytes, used storage plus remaining storage.
+}
+
+// Fill returns the share of the node's capacity that is used, between 0 and 1.
+func (s NodeStorage) Fill() float64 {
+	if s.Capacity == 0 {
+		return 1
+	}
+	return float64(s.Used) / float64(s.Capacity)
+}
+
+// ChunkMove describes moving a chunk replica of a file from one node to another.
+type ChunkMove struct {
+	CloudPath string
+	Chunk     datastore.Chunk
+	From      string
+	To        string
+}
+
+// RebalancePlan is a list of chunk moves that evens out storage usage between nodes.
+type RebalancePlan struct {
+	Moves []ChunkMove
+	// Bytes is the amount of data that the moves will transfer.
+	Bytes uint64
+	// Nodes is the storage usage of the online nodes at the time the plan was made.
+	Nodes []NodeStorage
+}
+
+// RebalanceStatus reports the progress of the last rebalance.
+type RebalanceStatus struct {
+	Running  bool
+	DryRun   bool
+	Planned  int
+	Moved    int
+	Failed   int
+	Bytes    uint64 // bytes moved so far.
+	Error    string // last error encountered, if any.
+	Started  time.Time
+	Finished time.Time
+}
+
+type rebalancer struct {
+	status RebalanceStatus
+	mutex  sync.RWMutex
+}
+
+func (r *rebalancer) update(f func(s *RebalanceStatus)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f(&r.status)
+}
+
+// start marks a new rebalance as running, unless one already is. The check and the update happen under one lock, so
+// concurrent calls cannot both start a rebalance.
+func (r *rebalancer) start(dryRun bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.status.Running {
+		return false
+	}
+	r.status = RebalanceStatus{Running: true, DryRun: dryRun, Started: time.Now()}
+	return true
+}
+
+func (c *cloud) RebalanceStatus() RebalanceStatus {
+	c.rebalancer.mutex.RLock()
+	defer c.rebalancer.mutex.RUnlock()
+	return c.rebalancer.status
+}
+
+// nodeStorage retrieves the storage usage of a node.
+func (n *cloudNode) nodeStorage() (NodeStorage, error) {
+	used, err := n.StorageSpaceUsed()
+	if err != nil {
+		return NodeStorage{}, err
+	}
+	remaining, err := n.StorageSpaceRemaining()
+	if err != nil {
+		return NodeStorage{}, err
+	}
+	return NodeStorage{ID: n.ID, Used: used, Capacity: used + remaining}, nil
+}
+
+// PlanRebalance computes which chunks should be moved so that each online node uses a similar share of its capacity.
+// Chunks are moved from nodes filled above the network average to nodes filled below it.
+// budget is the maximum amount of bytes that the plan may move. If budget is 0, the plan is not limited.
+func (c *cloud) PlanRebalance(budget uint64) (RebalancePlan, error) {
+	plan := RebalancePlan{}
+
+	c.NodesMutex.RLock()
+	cnodes := make([]*cloudNode, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		cnodes = append(cnodes, n)
+	}
+	c.NodesMutex.RUnlock()
+
+	var totalUsed, totalCapacity uint64
+	for _, n := range cnodes {
+		s, err := n.nodeStorage()
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] Retrieving storage of node %v: %v.", n.ID, err)
+			continue
+		}
+		plan.Nodes = append(plan.Nodes, s)
+		totalUsed += s.Used
+		totalCapacity += s.Capacity
+	}
+	if len(plan.Nodes) < 2 {
+		return plan, errors.New("at least two online nodes are needed to rebalance")
+	}
+	if totalCapacity == 0 {
+		return plan, errors.New("no storage capacity available")
+	}
+	average := float64(totalUsed) / float64(totalCapacity)
+	utils.GetLogger().Printf("[DEBUG] Rebalancing towards average fill: %v.", average)
+
+	// Projected usage of each node, as moves are planned.
+	projected := make(map[string]NodeStorage)
+	for _, s := range plan.Nodes {
+		projected[s.ID] = s
+	}
+
+	c.networkMutex.RLock()
+	chunkIDs := c.network.chunkIDs()
+	c.networkMutex.RUnlock()
+	chunkNodes := c.findProviders(chunkIDs...)
+
+	c.networkMutex.RLock()
+	defer c.networkMutex.RUnlock()
+
+	seen := make(map[datastore.ChunkID]bool)
+	c.network.walkFiles(func(cloudPath string, file *datastore.File) {
+		for _, chunk := range file.Chunks.Chunks {
+			if seen[chunk.ID] {
+				continue
+			}
+			seen[chunk.ID] = true
+			if budget != 0 && plan.Bytes+chunk.ContentSize > budget {
+				return
+			}
+
+			holders := chunkNodes[chunk.ID]
+			from := mostFilled(holders, projected, average+rebalanceTolerance)
+			if from == "" {
+				continue
+			}
+			to := leastFilled(holders, projected, average-rebalanceTolerance, chunk.ContentSize)
+			if to == "" {
+				continue
+			}
+
+			plan.Moves = append(plan.Moves, ChunkMove{CloudPath: cloudPath, Chunk: chunk, From: from, To: to})
+			plan.Bytes += chunk.ContentSize
+
+			f := projected[from]
+			f.Used -= chunk.ContentSize
+			projected[from] = f
+			t := projected[to]
+			t.Used += chunk.ContentSize
+			projected[to] = t
+		}
+	})
+	return plan, nil
+}
+
+// mostFilled returns the holder with the highest fill above the threshold, or an empty string if there is none.
+func mostFilled(holders []string, projected map[string]NodeStorage, threshold float64) string {
+	best := ""
+	bestFill := threshold
+	for _, id := range holders {
+		s, ok := projected[id]
+		if !ok {
+			continue
+		}
+		if s.Fill() > bestFill {
+			best = id
+			bestFill = s.Fill()
+		}
+	}
+	return best
+}
+
+// leastFilled returns the node that does not hold the chunk and has the lowest fill below the threshold, or an empty
+// string if there is none.
+func leastFilled(holders []string, projected map[string]NodeStorage, threshold float64, size uint64) string {
+	isHolder := make(map[string]bool)
+	for _, id := range holders {
+		isHolder[id] = true
+	}
+
+	ids := make([]string, 0, len(projected))
+	for id := range projected {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	best := ""
+	bestFill := threshold
+	for _, id := range ids {
+		s := projected[id]
+		if isHolder[id] || s.Capacity-s.Used < size {
+			continue
+		}
+		if s.Fill() < bestFill {
+			best = id
+			bestFill = s.Fill()
+		}
+	}
+	return best
+}
+
+// ErrRebalanceRunning is returned when a rebalance is started while another one is running.
+var ErrRebalanceRunning = errors.New("a rebalance is already running")
+
+// Rebalance plans a rebalance and applies it in the background. Progress can be followed with RebalanceStatus.
+// If dryRun is true, the plan is returned and recorded in the status but no chunks are moved.
+func (c *cloud) Rebalance(budget uint64, dryRun bool) (RebalancePlan, error) {
+	if !c.rebalancer.start(dryRun) {
+		return RebalancePlan{}, ErrRebalanceRunning
+	}
+	plan, err := c.PlanRebalance(budget)
+	if err != nil {
+		c.rebalancer.update(func(s *RebalanceStatus) {
+			s.Running = false
+			s.Error = err.Error()
+			s.Finished = time.Now()
+		})
+		return plan, err
+	}
+
+	c.rebalancer.update(func(s *RebalanceStatus) {
+		s.Planned = len(plan.Moves)
+		if dryRun {
+			s.Running = false
+			s.Finished = time.Now()
+		}
+	})
+	if dryRun {
+		return plan, nil
+	}
+
+	go func() {
+		for _, m := range plan.Moves {
+			err := c.moveChunk(m)
+			c.rebalancer.update(func(s *RebalanceStatus) {
+				if err != nil {
+					s.Failed++
+					s.Error = err.Error()
+					return
+				}
+				s.Moved++
+				s.Bytes += m.Chunk.ContentSize
+			})
+			if err != nil {
+				utils.GetLogger().Printf("[ERROR] Moving chunk %v from %v to %v: %v.", m.Chunk.ID, m.From, m.To, err)
+			}
+		}
+		c.rebalancer.update(func(s *RebalanceStatus) {
+			s.Running = false
+			s.Finished = time.Now()
+		})
+	}()
+	return plan, nil
+}
+
+// copyChunk copies a chunk of a file from one node to another. The receiving node is added to ChunkNodes.
+func (c *cloud) copyChunk(cloudPath string, chunk datastore.Chunk, from string, to string) error {
+	src := c.GetCloudNode(from)
+	if src == nil {
+		return errors.New("source node " + from + " is not online")
+	}
+	dst := c.GetCloudNode(to)
+	if dst == nil {
+		return errors.New("target node " + to + " is not online")
+	}
+
+	res, err := src.client.SendMessage(GetChunkMsg, cloudPath, chunk.ID)
+	if err != nil {
+		return err
+	}
+	return dst.SaveChunk(cloudPath, chunk, res[0].([]byte))
+}
+
+// moveChunk copies the chunk to the target node, then deletes the copy from the source node.
+func (c *cloud) moveChunk(m ChunkMove) error {
+	if err := c.copyChunk(m.CloudPath, m.Chunk, m.From, m.To); err != nil {
+		return err
+	}
+	src := c.GetCloudNode(m.From)
+	if src == nil {
+		return errors.New("source node " + m.From + " is not online")
+	}
+	return src.DeleteChunk(m.CloudPath, m.Chunk.ID)
+}
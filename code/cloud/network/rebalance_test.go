@@ -0,0 +1,123 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"cloud/utils"
+	"testing"
+)
+
+func TestRebalanceNodeSelection(t *testing.T) {
+	projected := map[string]NodeStorage{
+		"full":  {ID: "full", Used: 90, Capacity: 100},
+		"half":  {ID: "half", Used: 50, Capacity: 100},
+		"empty": {ID: "empty", Used: 0, Capacity: 100},
+	}
+
+	if from := mostFilled([]string{"full", "half"}, projected, 0.5); from != "full" {
+		t.Errorf("mostFilled got %v; want full", from)
+	}
+	if from := mostFilled([]string{"half", "empty"}, projected, 0.5); from != "" {
+		t.Errorf("mostFilled got %v; want no node", from)
+	}
+	if to := leastFilled([]string{"full"}, projected, 0.5, 10); to != "empty" {
+		t.Errorf("leastFilled got %v; want empty", to)
+	}
+	// A holder of the chunk is never chosen as the target.
+	if to := leastFilled([]string{"full", "empty"}, projected, 0.5, 10); to != "" {
+		t.Errorf("leastFilled got %v; want no node", to)
+	}
+	// The target must have enough space remaining.
+	if to := leastFilled([]string{"full"}, projected, 0.5, 200); to != "" {
+		t.Errorf("leastFilled got %v; want no node", to)
+	}
+}
+
+func TestPlanRebalanceSingleNode(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clouds[0].SetConfig(CloudConfig{FileStorageCapacity: 100})
+	if _, err := clouds[0].PlanRebalance(0); err == nil {
+		t.Error("Expected error when rebalancing a single node.")
+	}
+}
+
+func TestRebalanceMovesChunks(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_rebalance_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	clouds[0].SetConfig(CloudConfig{FileStorageDir: dirs[0], FileStorageCapacity: 50})
+	// The second node is full while the file is added, so only the first node holds its chunks.
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 1})
+
+	content := []byte("hellothere i see you are a fan of bytes?") // 40 bytes
+	tmpfile, err := utils.GetTestFile("cloud_test_file_*", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestFileCleanup(tmpfile)
+	file, err := datastore.NewFile(tmpfile, tmpfile.Name(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[0].AddFile(file, "/test", tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	clouds[1].SetConfig(CloudConfig{FileStorageDir: dirs[1], FileStorageCapacity: 150})
+
+	// The first node is 80% full and the network 20%. Chunks move until the first node is within the tolerance.
+	c := clouds[0].(*cloud)
+	plan, err := c.PlanRebalance(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Moves) != 3 || plan.Bytes != 30 {
+		t.Fatalf("Expected 3 moves of 30 bytes, got %d moves of %d bytes.", len(plan.Moves), plan.Bytes)
+	}
+	for _, m := range plan.Moves {
+		if m.From != clouds[0].MyNode().ID || m.To != clouds[1].MyNode().ID {
+			t.Errorf("Unexpected move from %v to %v.", m.From, m.To)
+		}
+	}
+
+	if _, err := c.Rebalance(0, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the rebalance to finish", func() bool {
+		return !c.RebalanceStatus().Running
+	})
+	if s := c.RebalanceStatus(); s.Moved != 3 || s.Failed != 0 || s.Bytes != 30 {
+		t.Fatalf("Unexpected rebalance status: %+v.", s)
+	}
+	src, srcOk := c.FileStore("/test").(*datastore.PartialFileStore)
+	dst, dstOk := clouds[1].(*cloud).FileStore("/test").(*datastore.PartialFileStore)
+	if !srcOk || !dstOk {
+		t.Fatal("Expected both nodes to store chunks of the file.")
+	}
+	for _, m := range plan.Moves {
+		if src.StoredChunkSize(m.Chunk.ID) != 0 || dst.StoredChunkSize(m.Chunk.ID) == 0 {
+			t.Errorf("Chunk %v was not moved.", m.Chunk.ID)
+		}
+	}
+	buffer := &bytes.Buffer{}
+	if err := clouds[1].(*cloud).DownloadFile("/test", buffer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), content) {
+		t.Errorf("Downloaded %q after rebalancing, expected %q.", buffer.Bytes(), content)
+	}
+
+	// A rebalance is not started while another one is running.
+	c.rebalancer.update(func(s *RebalanceStatus) { s.Running = true })
+	if _, err := c.Rebalance(0, true); err != ErrRebalanceRunning {
+		t.Errorf("Expected an error when a rebalance is already running, got %v.", err)
+	}
+}
@@ -0,0 +1,449 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// syncChunkSize is the chunk size of local files that syncs add to the cloud.
+const syncChunkSize = 4 * 1024 * 1024
+
+// ReconcileOp is what the initial scan of a sync does with a file.
+type ReconcileOp int
+
+const (
+	// ReconcileSkip leaves a file that is the same locally and on the cloud.
+	ReconcileSkip ReconcileOp = iota
+	// ReconcileUpload adds a local file to the cloud, or updates the cloud file with the local edit.
+	ReconcileUpload
+	// ReconcileDownload downloads a cloud file, or replaces the local file with the cloud edit.
+	ReconcileDownload
+	// ReconcileConflict resolves a file that was edited both locally and on the cloud by the conflict policy.
+	ReconcileConflict
+	// ReconcileDeleteLocal deletes a local file that was deleted on the cloud since it was last synced.
+	ReconcileDeleteLocal
+	// ReconcileDeleteCloud deletes a cloud file that was deleted locally since it was last synced.
+	ReconcileDeleteCloud
+	// ReconcilePlaceholder writes a placeholder for a cloud file instead of downloading it.
+	ReconcilePlaceholder
+)
+
+func (op ReconcileOp) String() string {
+	switch op {
+	case ReconcileSkip:
+		return "skip"
+	case ReconcileUpload:
+		return "upload"
+	case ReconcileDownload:
+		return "download"
+	case ReconcileConflict:
+		return "conflict"
+	case ReconcileDeleteLocal:
+		return "delete local"
+	case ReconcileDeleteCloud:
+		return "delete cloud"
+	case ReconcilePlaceholder:
+		return "placeholder"
+	}
+	return "unknown"
+}
+
+// ConflictPolicy decides how syncs resolve files that were edited both locally and on the cloud when they are
+// attached. It is also used when a file differs on both sides and it is not known which side changed.
+type ConflictPolicy int
+
+const (
+	// ConflictKeepBoth keeps the local file as a conflict copy and downloads the cloud file.
+	ConflictKeepBoth ConflictPolicy = iota
+	// ConflictPreferLocal replaces the cloud file with the local file.
+	ConflictPreferLocal
+	// ConflictPreferCloud replaces the local file with the cloud file.
+	ConflictPreferCloud
+)
+
+// ReconcileAction is what the initial scan of a sync does with a file.
+type ReconcileAction struct {
+	CloudPath string
+	LocalPath string
+	Op        ReconcileOp
+	// Local and Cloud are the versions of the file on each side, nil if the file does not exist there.
+	Local *datastore.File
+	Cloud *datastore.File
+}
+
+// SyncPlan is the result of the initial scan of a sync. Actions are sorted by cloud path.
+type SyncPlan struct {
+	Actions []ReconcileAction
+}
+
+// Count returns the number of files that the operation is applied to.
+func (p SyncPlan) Count(op ReconcileOp) int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// reconcileOp compares the local and cloud versions of a file with the version they were last synced at. base is
+// empty if the file was not synced before. A file that was synced and is missing on one side was deleted there, unless
+// the other side changed it since. A file missing on both sides was deleted on both, and is only forgotten.
+func reconcileOp(local, cloud *datastore.File, base datastore.FileID) ReconcileOp {
+	switch {
+	case local == nil && cloud == nil:
+		return ReconcileDeleteLocal
+	case cloud == nil && base != "" && local.ID == base:
+		return ReconcileDeleteLocal
+	case local == nil && base != "" && cloud.ID == base:
+		return ReconcileDeleteCloud
+	case cloud == nil:
+		return ReconcileUpload
+	case local == nil:
+		return ReconcileDownload
+	case local.ID == cloud.ID:
+		return ReconcileSkip
+	case base != "" && local.ID == base:
+		return ReconcileDownload
+	case base != "" && cloud.ID == base:
+		return ReconcileUpload
+	}
+	return ReconcileConflict
+}
+
+// syncBase returns the version that the local file was last synced at, if this node stores it as the local copy of
+// the cloud file.
+func (c *cloud) syncBase(cloudPath, localPath string) datastore.FileID {
+	c.fileStorageMutex.RLock()
+	defer c.fileStorageMutex.RUnlock()
+	local, ok := localCopy(c.fileStorage[cloudPath])
+	if ok && filepath.Clean(local.FilePath) == filepath.Clean(localPath) {
+		return local.FileID
+	}
+	return ""
+}
+
+// readLocalFile returns the version of the local file, chunked with the chunk size. Returns nil if the file does not
+// exist.
+func readLocalFile(localPath string, chunkSize int) (*datastore.File, error) {
+	f, err := os.Open(localPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errors.New(localPath + " is a directory")
+	}
+	file, err := datastore.NewFile(f, filepath.Base(localPath), chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	file.SetFileInfo(info)
+	return file, nil
+}
+
+// reconcileAction compares the local and cloud versions of a file. Local files are chunked like the cloud file. entry is
+// the file's state when it was last synced, or nil if it is not known. Files missing on one side are only deleted on
+// the other if it is known, and the local file is not read again if it did not change since.
+func (c *cloud) reconcileAction(cloudPath, localPath string, cloudFile *datastore.File,
+	entry *SyncEntry) (ReconcileAction, error) {
+	var local *datastore.File
+	info, err := os.Stat(localPath)
+	if entry != nil && err == nil && entry.unchanged(info) {
+		local = entry.file()
+		local.SetFileInfo(info)
+	} else {
+		chunkSize := syncChunkSize
+		if cloudFile != nil {
+			chunkSize = cloudFile.Chunks.ChunkSize
+		}
+		if local, err = readLocalFile(localPath, chunkSize); err != nil {
+			return ReconcileAction{}, err
+		}
+	}
+
+	var base datastore.FileID
+	if entry != nil {
+		base = entry.FileID
+	} else if local != nil && cloudFile != nil {
+		base = c.syncBase(cloudPath, localPath)
+	}
+	return ReconcileAction{
+		CloudPath: cloudPath,
+		LocalPath: localPath,
+		Op:        reconcileOp(local, cloudFile, base),
+		Local:     local,
+		Cloud:     cloudFile,
+	}, nil
+}
+
+// PlanSyncFile returns what syncing the cloud file with the local file would do, without changing either.
+func (c *cloud) PlanSyncFile(cloudPath string, localPath string) (SyncPlan, error) {
+	return c.planSyncFile(CleanNetworkPath(cloudPath), localPath, nil)
+}
+
+func (c *cloud) planSyncFile(cloudPath string, localPath string, entry *SyncEntry) (SyncPlan, error) {
+	cloudFile, _ := c.GetFile(cloudPath)
+	a, err := c.reconcileAction(cloudPath, localPath, cloudFile, entry)
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	// A synced file may have been deleted on both sides, it is only an error for a new sync.
+	if a.Local == nil && a.Cloud == nil && entry == nil {
+		return SyncPlan{}, errors.New("file does not exist on the cloud nor locally")
+	}
+	return SyncPlan{Actions: []ReconcileAction{a}}, nil
+}
+
+// PlanSyncFolder returns what syncing the cloud folder with the local folder would do, without changing either.
+func (c *cloud) PlanSyncFolder(cloudPath string, localPath string) (SyncPlan, error) {
+	return c.planSyncFolder(&fileSync{CloudPath: CleanNetworkPath(cloudPath), LocalPath: localPath})
+}
+
+func (c *cloud) planSyncFolder(sync *fileSync) (SyncPlan, error) {
+	c.networkMutex.RLock()
+	_, cloudFiles := c.network.folderTree(sync.CloudPath)
+	c.networkMutex.RUnlock()
+
+	rules := c.syncRules(sync)
+	plan := SyncPlan{}
+	planned := make(map[string]bool)
+	for cloudPath, cloudFile := range cloudFiles {
+		if sync.ignoresCloud(rules, cloudPath, false) {
+			continue
+		}
+		localPath := c.syncLocalPath(sync, cloudPath)
+		a, err := c.reconcileAction(cloudPath, localPath, cloudFile, c.syncEntry(sync, cloudPath, localPath))
+		if err != nil {
+			return plan, err
+		}
+		// Cloud files that are not stored locally are only downloaded on request.
+		if sync.Placeholders && a.Op == ReconcileDownload && a.Local == nil {
+			a.Op = ReconcilePlaceholder
+		}
+		plan.Actions = append(plan.Actions, a)
+		planned[localPath] = true
+	}
+
+	err := filepath.Walk(sync.LocalPath, func(localPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && localPath == sync.LocalPath {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if sync.ignoresLocal(rules, localPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || planned[localPath] {
+			return nil
+		}
+		cloudPath := syncCloudPath(sync, localPath)
+		a, err := c.reconcileAction(cloudPath, localPath, nil, c.syncEntry(sync, cloudPath, localPath))
+		if err != nil {
+			return err
+		}
+		plan.Actions = append(plan.Actions, a)
+		return nil
+	})
+	sort.Slice(plan.Actions, func(i, j int) bool {
+		return plan.Actions[i].CloudPath < plan.Actions[j].CloudPath
+	})
+	return plan, err
+}
+
+// setSyncStore makes the sync store the file store of the file. Chunks stored by a previous partial store are
+// deleted, the local file has all of them.
+func (c *cloud) setSyncStore(store *datastore.SyncFileStore) {
+	c.fileStorageMutex.Lock()
+	previous := c.fileStorage[store.CloudPath]
+	c.fileStorage[store.CloudPath] = store
+	c.fileStorageMutex.Unlock()
+
+	if partial, ok := previous.(*datastore.PartialFileStore); ok {
+		size := partial.UniqueSize()
+		partial.DeleteAllContent()
+		c.releaseStorage(size)
+	}
+}
+
+// reconcile applies an action of the initial scan of a sync, and returns the sync store of the file. The store is
+// used once the local and cloud files are the same, done is called then. Downloads complete in the background.
+func (c *cloud) reconcile(a ReconcileAction, done func()) (store *datastore.SyncFileStore, err error) {
+	store = &datastore.SyncFileStore{
+		FullFileStore: datastore.FullFileStore{FilePath: a.LocalPath},
+		CloudPath:     a.CloudPath,
+	}
+
+	op := a.Op
+	var conflict *SyncConflict
+	var copyPath string
+	if op == ReconcileConflict {
+		switch c.config.SyncConflicts {
+		case ConflictPreferLocal:
+			op = ReconcileUpload
+		case ConflictPreferCloud:
+			op = ReconcileDownload
+		default:
+			saved, localPath, err := saveConflictCopy(c.MyNode(), a.CloudPath, &store.FullFileStore)
+			if err != nil {
+				done()
+				return store, err
+			}
+			conflict, copyPath = &saved, localPath
+			op = ReconcileDownload
+		}
+	}
+
+	if op == ReconcileUpload || op == ReconcileDeleteCloud {
+		finish := c.trackTransfer(a.LocalPath, false)
+		defer func() {
+			finish(err)
+		}()
+	}
+	switch op {
+	case ReconcileSkip:
+		store.FileID = a.Cloud.ID
+		store.ReplaceChunks(a.Cloud.Chunks.Chunks)
+		c.setSyncStore(store)
+		c.recordSynced(a.CloudPath, a.LocalPath, a.Cloud)
+		removePlaceholder(a.LocalPath)
+		done()
+	case ReconcilePlaceholder:
+		defer done()
+		return store, writePlaceholder(a.LocalPath, a.CloudPath, a.Cloud)
+	case ReconcileUpload:
+		defer done()
+		store.FileID = a.Local.ID
+		store.ReplaceChunks(a.Local.Chunks.Chunks)
+		if a.Cloud == nil {
+			c.setSyncStore(store)
+			if err := c.AddFile(a.Local, a.CloudPath, a.LocalPath); err != nil {
+				return store, err
+			}
+			c.recordSynced(a.CloudPath, a.LocalPath, a.Local)
+			return store, nil
+		}
+		// The local file is an edit of the cloud version.
+		store.FileID = a.Cloud.ID
+		c.setSyncStore(store)
+		a.Local.Base = a.Cloud.ID
+		if !c.LockFile(a.CloudPath) {
+			c.UnlockFile(a.CloudPath)
+			return store, errors.New("could not lock " + a.CloudPath)
+		}
+		defer c.UnlockFile(a.CloudPath)
+		return store, c.UpdateFile(a.Local, a.CloudPath)
+	case ReconcileDeleteLocal:
+		defer done()
+		c.deleteFileStorage(a.CloudPath)
+		if err := os.Remove(a.LocalPath); err != nil && !os.IsNotExist(err) {
+			return store, err
+		}
+	case ReconcileDeleteCloud:
+		defer done()
+		if !c.LockFile(a.CloudPath) {
+			c.UnlockFile(a.CloudPath)
+			return store, errors.New("could not lock " + a.CloudPath)
+		}
+		defer c.UnlockFile(a.CloudPath)
+		return store, c.DeleteFile(a.CloudPath)
+	case ReconcileDownload:
+		store.FileID = a.Cloud.ID
+		store.ReplaceChunks(a.Cloud.Chunks.Chunks)
+		os.MkdirAll(filepath.Dir(a.LocalPath), 0755)
+		finish := c.trackTransfer(a.LocalPath, true)
+		// Chunks are read from the previous store until the download completes.
+		c.downloadManager.QueueDownload(a.CloudPath, a.LocalPath, func(event DownloadEvent) {
+			if event != DownloadCompleted {
+				return
+			}
+			defer done()
+			if local, err := localVersion(&store.FullFileStore, a.Cloud.Chunks.ChunkSize); err != nil ||
+				local.ID != a.Cloud.ID {
+				utils.GetLogger().Printf("[ERROR] Downloading %v to %v did not complete.", a.CloudPath, a.LocalPath)
+				finish(errors.New("download of " + a.CloudPath + " did not complete"))
+			} else {
+				finish(nil)
+				c.setSyncStore(store)
+				c.recordSynced(a.CloudPath, a.LocalPath, a.Cloud)
+				removePlaceholder(a.LocalPath)
+			}
+			if conflict != nil {
+				if err := c.addConflictCopy(*conflict, copyPath, a.Cloud.Chunks.ChunkSize); err != nil {
+					utils.GetLogger().Printf("[ERROR] Adding conflict copy of %v: %v.", a.CloudPath, err)
+				}
+			}
+		})
+	}
+	return store, nil
+}
+
+// reconcileFolders creates the sub-folders of the sync that only exist on one side on the other. Returns the local
+// folders of the sync.
+func (c *cloud) reconcileFolders(sync *fileSync) []string {
+	c.networkMutex.RLock()
+	cloudFolders, _ := c.network.folderTree(sync.CloudPath)
+	c.networkMutex.RUnlock()
+
+	rules := c.syncRules(sync)
+	localFolders := make([]string, 0)
+	for _, cloudFolder := range cloudFolders {
+		if sync.ignoresCloud(rules, cloudFolder, true) {
+			continue
+		}
+		relPath := strings.TrimPrefix(cloudFolder, sync.CloudPath)
+		os.MkdirAll(filepath.Join(sync.LocalPath, filepath.FromSlash(relPath)), 0755)
+	}
+	filepath.Walk(sync.LocalPath, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		// Ignored folders are not watched.
+		if sync.ignoresLocal(rules, localPath, true) {
+			return filepath.SkipDir
+		}
+		localFolders = append(localFolders, localPath)
+		if err := c.CreateDirectory(syncCloudPath(sync, localPath)); err != nil {
+			utils.GetLogger().Printf("[ERROR] Creating directory for %v: %v.", localPath, err)
+		}
+		return nil
+	})
+	return localFolders
+}
+
+// reconcileAll applies the plan of a sync. Once all of the downloads complete, the local folders are watched.
+func (c *cloud) reconcileAll(plan SyncPlan, localFolders []string) {
+	pending := int32(1)
+	done := func() {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			for _, folder := range localFolders {
+				c.watcher.Add(folder)
+			}
+		}
+	}
+	for _, a := range plan.Actions {
+		atomic.AddInt32(&pending, 1)
+		if _, err := c.reconcile(a, done); err != nil {
+			utils.GetLogger().Printf("[ERROR] Syncing %v with %v: %v.", a.CloudPath, a.LocalPath, err)
+		}
+	}
+	done()
+}
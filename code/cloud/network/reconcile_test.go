@@ -0,0 +1,181 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileOp(t *testing.T) {
+	a := &datastore.File{ID: "a"}
+	b := &datastore.File{ID: "b"}
+	tests := []struct {
+		local, cloud *datastore.File
+		base         datastore.FileID
+		expected     ReconcileOp
+	}{
+		{a, nil, "", ReconcileUpload},
+		{nil, a, "", ReconcileDownload},
+		{a, a, "", ReconcileSkip},
+		{a, b, "", ReconcileConflict},
+		{a, b, "a", ReconcileDownload},
+		{a, b, "b", ReconcileUpload},
+		{a, b, "c", ReconcileConflict},
+		{a, nil, "a", ReconcileDeleteLocal},
+		{nil, a, "a", ReconcileDeleteCloud},
+		{b, nil, "a", ReconcileUpload},
+		{nil, b, "a", ReconcileDownload},
+		{nil, nil, "a", ReconcileDeleteLocal},
+		{nil, nil, "", ReconcileDeleteLocal},
+	}
+	for i, test := range tests {
+		if op := reconcileOp(test.local, test.cloud, test.base); op != test.expected {
+			t.Errorf("Test %d: expected %v, got %v.", i, test.expected, op)
+		}
+	}
+}
+
+// writeTestFiles writes the files, mapped by their path relative to the directory.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncFolderReconcile(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_reconcile_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	uploadDir, localDir := dirs[1], dirs[2]
+
+	writeTestFiles(t, uploadDir, map[string]string{
+		"same.txt":      "same content",
+		"cloudonly.txt": "only on the cloud",
+		"diff.txt":      "cloud version",
+	})
+	for _, name := range []string{"same.txt", "cloudonly.txt", "diff.txt"} {
+		file, err := readLocalFile(filepath.Join(uploadDir, name), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddFile(file, "/p/"+name, filepath.Join(uploadDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFiles(t, localDir, map[string]string{
+		"same.txt":       "same content",
+		"localonly.txt":  "only local",
+		"diff.txt":       "local version",
+		"sub/nested.txt": "nested",
+	})
+
+	expected := map[string]ReconcileOp{
+		"/p/cloudonly.txt":  ReconcileDownload,
+		"/p/diff.txt":       ReconcileConflict,
+		"/p/localonly.txt":  ReconcileUpload,
+		"/p/same.txt":       ReconcileSkip,
+		"/p/sub/nested.txt": ReconcileUpload,
+	}
+	plan, err := c.PlanSyncFolder("/p", localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != len(expected) {
+		t.Errorf("Expected %d actions, got %d.", len(expected), len(plan.Actions))
+	}
+	for _, a := range plan.Actions {
+		if op, ok := expected[a.CloudPath]; !ok || op != a.Op {
+			t.Errorf("Unexpected action %v for %v.", a.Op, a.CloudPath)
+		}
+	}
+	// Planning does not change anything.
+	if _, err := c.GetFile("/p/localonly.txt"); err == nil {
+		t.Error("Planning uploaded a file.")
+	}
+	if _, err := os.Stat(filepath.Join(localDir, "cloudonly.txt")); err == nil {
+		t.Error("Planning downloaded a file.")
+	}
+
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/p/localonly.txt", "/p/sub/nested.txt"} {
+		if _, err := c.GetFile(p); err != nil {
+			t.Errorf("Local file %v was not uploaded: %v.", p, err)
+		}
+	}
+	want := map[string]string{
+		"cloudonly.txt": "only on the cloud",
+		"diff.txt":      "cloud version",
+		"same.txt":      "same content",
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for name, content := range want {
+		for {
+			b, err := ioutil.ReadFile(filepath.Join(localDir, name))
+			if err == nil && string(b) == content {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Local %v has %q, expected %q.", name, b, content)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// The local edit of the conflicting file is kept as a conflict copy.
+	var copyName string
+	for time.Now().Before(deadline) && copyName == "" {
+		infos, _ := ioutil.ReadDir(localDir)
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), "diff (conflict from ") {
+				copyName = info.Name()
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(localDir, copyName)); err != nil || string(b) != "local version" {
+		t.Fatalf("Conflict copy %q has %q, %v.", copyName, b, err)
+	}
+	for time.Now().Before(deadline) {
+		if _, err := c.GetFile("/p/" + copyName); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Once synced, only the side that changed is synced again.
+	writeTestFiles(t, localDir, map[string]string{"same.txt": "edited locally"})
+	plan, err = c.PlanSyncFolder("/p", localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range plan.Actions {
+		op := ReconcileSkip
+		if a.CloudPath == "/p/same.txt" {
+			op = ReconcileUpload
+		}
+		if a.Op != op {
+			t.Errorf("Expected %v for %v after syncing, got %v.", op, a.CloudPath, a.Op)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renameWindow is how long the watcher waits for the new name of a file or folder that was renamed in a synced folder.
+// If none shows up, it was moved out of the sync and it is deleted from the cloud. Created files are only handled after
+// the watcher's quiet period, so it is included.
+const renameWindow = watchQuietPeriod + 500*time.Millisecond
+
+// pendingRename is a file or folder of a folder sync that was renamed locally, and whose new name is not known yet.
+type pendingRename struct {
+	cloudPath string
+	localPath string
+	dir       bool
+	// file is the cloud version of the file, nil for folders.
+	file *datastore.File
+	// size and modTime are the synced local file's, if it is in the sync index. Renames keep them.
+	size    int64
+	modTime time.Time
+	timer   *time.Timer
+	// held counts the created files being compared with the rename. It does not expire while they are.
+	held int
+}
+
+// renameTracker pairs the rename events of the watcher with the create events of the new names.
+type renameTracker struct {
+	pending map[string]*pendingRename
+	mutex   sync.Mutex
+}
+
+// take removes the pending rename of the cloud path, and returns whether it was pending.
+func (t *renameTracker) take(cloudPath string) (*pendingRename, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r, ok := t.pending[cloudPath]
+	if ok {
+		r.timer.Stop()
+		delete(t.pending, cloudPath)
+	}
+	return r, ok
+}
+
+// expire removes the pending rename once its window is over, unless it was taken or is being compared with a created
+// file. Returns whether it was removed.
+func (t *renameTracker) expire(r *pendingRename) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending[r.cloudPath] != r || r.held > 0 {
+		return false
+	}
+	delete(t.pending, r.cloudPath)
+	return true
+}
+
+// hold keeps the pending rename from expiring while a created file is compared with it. Returns false if it is no
+// longer pending.
+func (t *renameTracker) hold(r *pendingRename) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending[r.cloudPath] != r {
+		return false
+	}
+	r.held++
+	r.timer.Stop()
+	return true
+}
+
+// release ends a hold of the pending rename. The rename gets a new window once it is no longer held.
+func (t *renameTracker) release(r *pendingRename) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r.held--
+	if r.held == 0 && t.pending[r.cloudPath] == r {
+		r.timer.Reset(renameWindow)
+	}
+}
+
+// candidates returns the pending renames of files or folders.
+func (t *renameTracker) candidates(dir bool) []*pendingRename {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	candidates := make([]*pendingRename, 0)
+	for _, r := range t.pending {
+		if r.dir == dir {
+			candidates = append(candidates, r)
+		}
+	}
+	return candidates
+}
+
+// localRenamed records that the local file or folder of the cloud path was renamed. If its new name is not seen in a
+// folder sync in time, it is deleted from the cloud.
+func (c *cloud) localRenamed(cloudPath, localPath string) {
+	r := &pendingRename{cloudPath: cloudPath, localPath: localPath}
+	c.networkMutex.RLock()
+	file, err := c.network.GetFile(cloudPath)
+	dir := c.network.folderExists(cloudPath)
+	c.networkMutex.RUnlock()
+	if err == nil {
+		r.file = file
+	} else if dir {
+		r.dir = true
+	} else {
+		// The cloud file was already moved, this is the rename of a remote move.
+		return
+	}
+	if r.file != nil {
+		c.Mutex.RLock()
+		if sync := c.folderSyncOf(cloudPath); sync != nil {
+			if entry, ok := sync.Index[cloudPath]; ok && filepath.Clean(entry.LocalPath) == filepath.Clean(localPath) {
+				r.size, r.modTime = entry.Size, entry.ModTime
+			}
+		}
+		c.Mutex.RUnlock()
+	}
+
+	c.renames.mutex.Lock()
+	defer c.renames.mutex.Unlock()
+	if c.renames.pending == nil {
+		c.renames.pending = make(map[string]*pendingRename)
+	}
+	if previous, ok := c.renames.pending[cloudPath]; ok {
+		previous.timer.Stop()
+	}
+	c.renames.pending[cloudPath] = r
+	r.timer = time.AfterFunc(renameWindow, func() {
+		if !c.renames.expire(r) {
+			return
+		}
+		utils.GetLogger().Printf("[INFO] %v was moved out of the sync, deleting %v.", localPath, cloudPath)
+		if !c.LockFile(cloudPath) {
+			c.UnlockFile(cloudPath)
+			return
+		}
+		defer c.UnlockFile(cloudPath)
+		var err error
+		if r.dir {
+			c.watcher.Remove(localPath)
+			err = c.DeleteDirectory(cloudPath, true)
+		} else {
+			err = c.DeleteFile(cloudPath)
+		}
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] Deleting %v: %v.", cloudPath, err)
+		}
+	})
+}
+
+// matchRename returns the pending rename whose new name is the created local file or folder, if there is one. Folders
+// are matched by name or by the names of their contents, files by their contents.
+func (c *cloud) matchRename(localPath string, info os.FileInfo) *pendingRename {
+	candidates := c.renames.candidates(info.IsDir())
+	if info.IsDir() {
+		for _, r := range candidates {
+			if filepath.Base(r.localPath) == info.Name() {
+				return r
+			}
+		}
+		// A folder renamed to another name is matched if it has the same contents, and only one pending rename does.
+		var match *pendingRename
+		for _, r := range candidates {
+			if c.sameFolderContents(localPath, r.cloudPath) {
+				if match != nil {
+					return nil
+				}
+				match = r
+			}
+		}
+		return match
+	}
+
+	// A renamed file keeps its size and modification time. Files are only read if none matches them, and a renamed
+	// file has the same size.
+	sameSize := make([]*pendingRename, 0)
+	for _, r := range candidates {
+		if r.file.Size != uint64(info.Size()) {
+			continue
+		}
+		if r.size == info.Size() && !r.modTime.IsZero() && r.modTime.Equal(info.ModTime()) {
+			return r
+		}
+		sameSize = append(sameSize, r)
+	}
+	for _, r := range sameSize {
+		if !c.renames.hold(r) {
+			continue
+		}
+		file, err := readLocalFile(localPath, r.file.Chunks.ChunkSize)
+		c.renames.release(r)
+		if err == nil && file != nil && file.ID == r.file.ID {
+			return r
+		}
+	}
+	return nil
+}
+
+// sameFolderContents returns whether the local folder has the same files and sub-folders as the cloud folder. Empty
+// folders are not compared, a new empty folder is not told apart from a renamed one.
+func (c *cloud) sameFolderContents(localPath, cloudPath string) bool {
+	children, err := ioutil.ReadDir(localPath)
+	if err != nil || len(children) == 0 {
+		return false
+	}
+	cloudPath = CleanNetworkPath(cloudPath)
+	c.networkMutex.RLock()
+	folders, files := c.network.folderTree(cloudPath)
+	c.networkMutex.RUnlock()
+	cloudChildren := make(map[string]bool)
+	for _, p := range folders {
+		if path.Dir(p) == cloudPath {
+			cloudChildren[p] = true
+		}
+	}
+	for p := range files {
+		if path.Dir(p) == cloudPath {
+			cloudChildren[p] = true
+		}
+	}
+	if len(children) != len(cloudChildren) {
+		return false
+	}
+	for _, child := range children {
+		if !cloudChildren[CleanNetworkPath(path.Join(cloudPath, child.Name()))] {
+			return false
+		}
+	}
+	return true
+}
+
+// moveRenamed moves the cloud file or folder of a local rename to the cloud path of its new local name. Returns false
+// if the created local file or folder is not the new name of a local rename.
+func (c *cloud) moveRenamed(cloudPath, localPath string, info os.FileInfo) bool {
+	r := c.matchRename(localPath, info)
+	if r == nil {
+		return false
+	}
+	if _, ok := c.renames.take(r.cloudPath); !ok {
+		// The rename was just handled as a deletion.
+		return false
+	}
+	utils.GetLogger().Printf("[INFO] renamed: %v to %v, moving %v to %v.", r.localPath, localPath, r.cloudPath,
+		cloudPath)
+
+	if !c.LockFile(r.cloudPath) || !c.LockFile(cloudPath) {
+		c.UnlockFile(r.cloudPath)
+		c.UnlockFile(cloudPath)
+		utils.GetLogger().Printf("[ERROR] Could not lock %v and %v to move them.", r.cloudPath, cloudPath)
+		return true
+	}
+	var err error
+	if r.dir {
+		err = c.MoveDirectory(r.cloudPath, cloudPath)
+	} else {
+		err = c.MoveFile(r.cloudPath, cloudPath)
+	}
+	c.UnlockFile(r.cloudPath)
+	c.UnlockFile(cloudPath)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Moving %v to %v: %v.", r.cloudPath, cloudPath, err)
+	}
+	return true
+}
+
+// moveLocal renames the local file or folder of a folder sync after its cloud path was moved, so that it does not have
+// to be downloaded again. Nothing is renamed if it was already moved locally.
+func (c *cloud) moveLocal(oldLocalPath, newLocalPath string) {
+	if oldLocalPath == newLocalPath {
+		return
+	}
+	if _, err := os.Stat(newLocalPath); err == nil {
+		// Moved locally, or there is another file at the new path already.
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(newLocalPath), 0755); err != nil {
+		utils.GetLogger().Printf("[ERROR] Moving %v to %v: %v.", oldLocalPath, newLocalPath, err)
+		return
+	}
+	if err := os.Rename(oldLocalPath, newLocalPath); err != nil {
+		utils.GetLogger().Printf("[ERROR] Moving %v to %v: %v.", oldLocalPath, newLocalPath, err)
+	}
+}
+
+// rewatch watches the folders of a local folder that was moved at their new paths.
+func (c *cloud) rewatch(oldLocalPath, newLocalPath string) {
+	if c.watcher == nil {
+		return
+	}
+	filepath.Walk(newLocalPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		c.watcher.Remove(oldLocalPath + strings.TrimPrefix(p, newLocalPath))
+		c.watcher.Add(p)
+		return nil
+	})
+}
+
+// syncMovedFile moves the local copy of a file that was moved on the cloud, if it is part of a folder sync.
+func (c *cloud) syncMovedFile(cloudPath, newPath string) {
+	oldLocalPath, ok := c.syncedLocalPath(newPath)
+	if !ok {
+		return
+	}
+	inSync, newLocalPath := c.isInFolderSync(newPath)
+	if !inSync {
+		c.moveLocalCopy(cloudPath, newPath, "")
+		return
+	}
+	c.moveLocal(oldLocalPath, newLocalPath)
+	c.moveLocalCopy(cloudPath, newPath, newLocalPath)
+}
+
+// syncMovedDirectory moves the local folder of a directory that was moved on the cloud, if it is part of a folder
+// sync. files are the old cloud paths of the moved files.
+func (c *cloud) syncMovedDirectory(folderPath, newPath string, files []string) {
+	inOld, oldLocalPath := c.isInFolderSync(folderPath)
+	inNew, newLocalPath := c.isInFolderSync(newPath)
+	if inOld && inNew {
+		c.moveLocal(oldLocalPath, newLocalPath)
+		c.rewatch(oldLocalPath, newLocalPath)
+	}
+	for _, filePath := range files {
+		newFilePath := newPath + strings.TrimPrefix(filePath, folderPath)
+		localPath, ok := c.syncedLocalPath(newFilePath)
+		if !ok {
+			continue
+		}
+		if inOld && inNew && strings.HasPrefix(localPath, oldLocalPath+string(filepath.Separator)) {
+			c.moveLocalCopy(filePath, newFilePath, newLocalPath+strings.TrimPrefix(localPath, oldLocalPath))
+		} else {
+			c.moveLocalCopy(filePath, newFilePath, "")
+		}
+	}
+}
+
+// syncedLocalPath returns the local path of the file, if it is stored as a local copy in a folder sync.
+func (c *cloud) syncedLocalPath(cloudPath string) (string, bool) {
+	c.fileStorageMutex.RLock()
+	local, ok := localCopy(c.fileStorage[cloudPath])
+	var localPath string
+	if ok {
+		localPath = local.FilePath
+	}
+	c.fileStorageMutex.RUnlock()
+	if !ok {
+		return "", false
+	}
+	// File syncs keep the local path that the user chose.
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	for i := range c.folderSyncs {
+		if strings.HasPrefix(localPath, filepath.Clean(c.folderSyncs[i].LocalPath)+string(filepath.Separator)) {
+			return localPath, true
+		}
+	}
+	return "", false
+}
+
+// moveLocalCopy points the local copy of a moved file, and its sync index entry, to the new local path. If the new
+// local path is empty, the file was moved out of the folder syncs and it is no longer indexed.
+func (c *cloud) moveLocalCopy(cloudPath, newPath, newLocalPath string) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if newLocalPath != "" {
+		c.fileStorageMutex.Lock()
+		if local, ok := localCopy(c.fileStorage[newPath]); ok {
+			local.FilePath = newLocalPath
+		}
+		c.fileStorageMutex.Unlock()
+	}
+
+	sync := c.folderSyncOf(cloudPath)
+	if sync == nil {
+		return
+	}
+	entry, ok := sync.Index[cloudPath]
+	if !ok {
+		return
+	}
+	delete(sync.Index, cloudPath)
+	if newSync := c.folderSyncOf(newPath); newSync != nil && newLocalPath != "" {
+		if newSync.Index == nil {
+			newSync.Index = make(map[string]SyncEntry)
+		}
+		entry.LocalPath = newLocalPath
+		newSync.Index[newPath] = entry
+	}
+}
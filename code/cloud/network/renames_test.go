@@ -0,0 +1,237 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it holds, or fails the test with the message.
+func waitFor(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSyncRenames(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_renames_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	localDir, outsideDir := dirs[1], dirs[2]
+
+	if err := c.CreateDirectory("/p"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, localDir, map[string]string{
+		"a.txt":     "renamed file",
+		"sub/x.txt": "in a moved folder",
+	})
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/a.txt", "/p/sub/x.txt")
+	file, err := c.GetFile("/p/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local renames move the cloud file.
+	if err := os.Rename(filepath.Join(localDir, "a.txt"), filepath.Join(localDir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Renamed file was not moved on the cloud.", func() bool {
+		_, err := c.GetFile("/p/a.txt")
+		return err != nil && c.FileStore("/p/b.txt") != nil
+	})
+	if moved, err := c.GetFile("/p/b.txt"); err != nil || moved.ID != file.ID {
+		t.Errorf("Expected the moved file to keep its version: %v.", err)
+	}
+	if local, ok := localCopy(c.FileStore("/p/b.txt")); !ok || local.FilePath != filepath.Join(localDir, "b.txt") {
+		t.Error("Expected the local copy to be at the new name.")
+	}
+	if entry := c.syncEntry(&c.folderSyncs[0], "/p/b.txt", filepath.Join(localDir, "b.txt")); entry == nil {
+		t.Error("Expected the sync index entry to be moved.")
+	}
+
+	if err := os.Rename(filepath.Join(localDir, "sub"), filepath.Join(localDir, "sub2")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "Renamed folder was not moved on the cloud.", func() bool {
+		return c.FileStore("/p/sub2/x.txt") != nil
+	})
+	c.networkMutex.RLock()
+	if c.network.folderExists("/p/sub") || !c.network.folderExists("/p/sub2") {
+		t.Error("Expected the folder to be moved.")
+	}
+	c.networkMutex.RUnlock()
+	if local, ok := localCopy(c.FileStore("/p/sub2/x.txt")); !ok ||
+		local.FilePath != filepath.Join(localDir, "sub2", "x.txt") {
+		t.Error("Expected the local copy to be in the renamed folder.")
+	}
+
+	// Remote moves rename the local file.
+	if !c.LockFile("/p/b.txt") || !c.LockFile("/p/c.txt") {
+		t.Fatal("Could not lock the files.")
+	}
+	err = c.MoveFile("/p/b.txt", "/p/c.txt")
+	c.UnlockFile("/p/b.txt")
+	c.UnlockFile("/p/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(localDir, "c.txt")); err != nil || string(content) != "renamed file" {
+		t.Errorf("Local c.txt has %q, %v.", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(localDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected b.txt to be renamed: %v.", err)
+	}
+	time.Sleep(2 * renameWindow)
+	if f, err := c.GetFile("/p/c.txt"); err != nil || f.ID != file.ID {
+		t.Errorf("Expected the watcher to leave the moved file: %v.", err)
+	}
+
+	// Files moved out of the sync are deleted from the cloud.
+	if err := os.Rename(filepath.Join(localDir, "c.txt"), filepath.Join(outsideDir, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "File moved out of the sync was not deleted.", func() bool {
+		_, err := c.GetFile("/p/c.txt")
+		return err != nil
+	})
+}
+
+func TestMatchRename(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_match_rename_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	localPath := filepath.Join(dirs[0], "b.txt")
+	if err := ioutil.WriteFile(localPath, []byte("renamed file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rename with the same size and modification time is matched without reading the file, which has other contents
+	// than the cloud version here.
+	c := &cloud{}
+	r := &pendingRename{
+		cloudPath: "/p/a.txt",
+		file:      &datastore.File{ID: "other", Size: uint64(info.Size())},
+		size:      info.Size(),
+		modTime:   info.ModTime(),
+		timer:     time.NewTimer(time.Hour),
+	}
+	c.renames.pending = map[string]*pendingRename{r.cloudPath: r}
+	if match := c.matchRename(localPath, info); match != r {
+		t.Fatal("Expected the rename to be matched on its size and modification time.")
+	}
+	r.modTime = info.ModTime().Add(-time.Second)
+	if match := c.matchRename(localPath, info); match != nil {
+		t.Error("Expected a rename with another modification time to be compared by contents.")
+	}
+
+	// A rename does not expire while a created file is compared with it.
+	if !c.renames.hold(r) {
+		t.Fatal("Expected the rename to be pending.")
+	}
+	if c.renames.expire(r) {
+		t.Error("Expected a held rename not to expire.")
+	}
+	c.renames.release(r)
+	if !c.renames.expire(r) {
+		t.Error("Expected the released rename to expire.")
+	}
+	if c.renames.hold(r) {
+		t.Error("Expected an expired rename not to be held.")
+	}
+}
+
+func TestMatchFolderRename(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_match_folder_rename_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	writeTestFiles(t, dirs[0], map[string]string{
+		"sub2/x.txt":   "x",
+		"sub2/in/y":    "y",
+		"other/x.txt":  "x",
+		"other/z.txt":  "z",
+		"sub/new.txt":  "new",
+		"copy/x.txt":   "x",
+		"copy/in/y":    "y",
+		"unrelated/a":  "a",
+		"unrelated/in": "in",
+	})
+	if err := os.Mkdir(filepath.Join(dirs[0], "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &cloud{}
+	for _, p := range []string{"/p/sub/x.txt", "/p/sub/in/y"} {
+		if _, err := c.network.addFile(p, indexTestFile(path.Base(p))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.network.GetFolder("/p/gone"); err != nil {
+		t.Fatal(err)
+	}
+	r := &pendingRename{cloudPath: "/p/sub", localPath: filepath.Join(dirs[0], "sub"), dir: true}
+	c.renames.pending = map[string]*pendingRename{r.cloudPath: r}
+	match := func(name string) *pendingRename {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dirs[0], name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.matchRename(filepath.Join(dirs[0], name), info)
+	}
+
+	if match("sub") != r {
+		t.Error("Expected a folder with the same name to be matched.")
+	}
+	if match("sub2") != r {
+		t.Error("Expected a folder with the same contents to be matched.")
+	}
+	for _, name := range []string{"other", "unrelated", "empty"} {
+		if match(name) != nil {
+			t.Errorf("Expected %v to be a new folder.", name)
+		}
+	}
+
+	// Folders with the same contents as several renamed folders are new folders.
+	other := &pendingRename{cloudPath: "/p/gone", localPath: filepath.Join(dirs[0], "gone"), dir: true}
+	c.renames.pending[other.cloudPath] = other
+	if match("copy") != r {
+		t.Error("Expected the folder to be matched with the rename of the same contents.")
+	}
+	for _, p := range []string{"/p/gone/x.txt", "/p/gone/in/y"} {
+		if _, err := c.network.addFile(p, indexTestFile(path.Base(p))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if match("copy") != nil {
+		t.Error("Expected a folder matching several renames to be a new folder.")
+	}
+}
@@ -0,0 +1,231 @@
+package network
+
+import (
+	"bytes"
+	"cloud/utils"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"time"
+)
+
+// Messages used for key rotation.
+const (
+	RotateKeyMsg = "RotateKey"
+)
+
+// keyRotationContext is prepended to signed key rotation statements, so that the signatures can not be reused for
+// anything else.
+const keyRotationContext = "cloud key rotation\x00"
+
+// KeyRotation binds a new public key to the stable ID of a node. It is signed by the node's current key, which is
+// revoked once the rotation is applied. The node also signs it with the new key, to prove that it owns it.
+type KeyRotation struct {
+	NodeID string
+	// NewPublicKey is PKIX DER encoded.
+	NewPublicKey []byte
+	Time         time.Time
+
+	Signature       []byte
+	NewKeySignature []byte
+}
+
+func init() {
+	gob.Register(KeyRotation{})
+
+	handlers = append(handlers, createRotationRequestHandler)
+}
+
+func createRotationRequestHandler(node *cloudNode, cloud *cloud) func(string) interface{} {
+	r := request{
+		Cloud:    cloud,
+		FromNode: node,
+	}
+
+	return func(message string) interface{} {
+		switch message {
+		case RotateKeyMsg:
+			return r.OnRotateKeyRequest
+		}
+		return nil
+	}
+}
+
+// statement returns the digest of the key rotation that is signed by both keys.
+func (kr KeyRotation) statement() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(keyRotationContext)
+	buf.WriteString(kr.NodeID)
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.BigEndian, uint32(len(kr.NewPublicKey)))
+	buf.Write(kr.NewPublicKey)
+	binary.Write(&buf, binary.BigEndian, kr.Time.UnixNano())
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+// NewKeyRotation creates a key rotation statement for the node, signed by its current and its new key.
+func NewKeyRotation(nodeID string, oldKey *rsa.PrivateKey, newKey *rsa.PrivateKey) (KeyRotation, error) {
+	der, err := x509.MarshalPKIXPublicKey(&newKey.PublicKey)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	kr := KeyRotation{
+		NodeID:       nodeID,
+		NewPublicKey: der,
+		Time:         time.Now(),
+	}
+	digest := kr.statement()
+	if kr.Signature, err = rsa.SignPSS(rand.Reader, oldKey, crypto.SHA256, digest, nil); err != nil {
+		return kr, err
+	}
+	if kr.NewKeySignature, err = rsa.SignPSS(rand.Reader, newKey, crypto.SHA256, digest, nil); err != nil {
+		return kr, err
+	}
+	return kr, nil
+}
+
+// Verify checks that the rotation is signed by the old key and by the new key it contains. It returns the new key.
+func (kr KeyRotation) Verify(oldKey *rsa.PublicKey) (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(kr.NewPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	newKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("new key is not an RSA key")
+	}
+	digest := kr.statement()
+	if err := rsa.VerifyPSS(oldKey, crypto.SHA256, digest, kr.Signature, nil); err != nil {
+		return nil, errors.New("key rotation is not signed by the current key")
+	}
+	if err := rsa.VerifyPSS(newKey, crypto.SHA256, digest, kr.NewKeySignature, nil); err != nil {
+		return nil, errors.New("key rotation is not signed by the new key")
+	}
+	return newKey, nil
+}
+
+// nodePublicKey returns the RSA public key of the node, if it is known.
+func nodePublicKey(node Node) *rsa.PublicKey {
+	switch key := node.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key
+	case rsa.PublicKey:
+		return &key
+	}
+	return nil
+}
+
+// IsKeyRevoked returns true if the key with the key ID (see PublicKeyToID) was replaced by a key rotation.
+func (n *Network) IsKeyRevoked(keyID string) bool {
+	return containsString(n.RevokedKeys, keyID)
+}
+
+// verifyNodeKey checks that the node with the ID may authenticate with the public key. The ID of a node is derived
+// from its first key. Once a node rotates its key, it keeps its ID and authenticates with the key stored in the
+// network, while the old key is revoked.
+func (n *Network) verifyNodeKey(ID string, key *rsa.PublicKey) error {
+	keyID, err := PublicKeyToID(key)
+	if err != nil {
+		return err
+	}
+	if n.IsKeyRevoked(keyID) {
+		return errors.New("key is revoked")
+	}
+	if node, found := n.NodeByID(ID); found {
+		if current := nodePublicKey(node); current != nil {
+			if currentID, err := PublicKeyToID(current); err == nil && currentID == keyID {
+				return nil
+			}
+			return errors.New("key does not match the node's key")
+		}
+	}
+	if keyID != ID {
+		return errors.New("ID does not belong to the key")
+	}
+	return nil
+}
+
+// RotateKey replaces the identity key of this node. The node keeps its ID, so its data, whitelist entries and chunk
+// locations stay valid. The rotation is signed with the current key, which is revoked on the network. Existing
+// connections are kept, new connections use the new key.
+func (c *cloud) RotateKey(newKey *rsa.PrivateKey) error {
+	me := c.MyNode()
+	kr, err := NewKeyRotation(me.ID, c.PrivateKey(), newKey)
+	if err != nil {
+		return err
+	}
+	if _, err := c.SendMessageToMe(RotateKeyMsg, kr); err != nil {
+		return err
+	}
+
+	c.Mutex.Lock()
+	c.privateKey = newKey
+	c.myNode.PublicKey = newKey.PublicKey
+	c.Mutex.Unlock()
+	c.stateChanged()
+
+	res := c.SendMessageAllOthers(RotateKeyMsg, kr)
+	for _, r := range res {
+		if r.Error != nil {
+			utils.GetLogger().Printf("[WARN] Node %v did not apply the key rotation: %v.", r.Node.ID, r.Error)
+		}
+	}
+	return nil
+}
+
+func (r request) OnRotateKeyRequest(kr KeyRotation) error {
+	defer r.Cloud.stateChanged()
+	utils.GetLogger().Printf("[INFO] Handling key rotation of node %v.", kr.NodeID)
+
+	r.Cloud.networkMutex.Lock()
+	defer r.Cloud.networkMutex.Unlock()
+
+	var node *Node
+	for i := range r.Cloud.network.Nodes {
+		if r.Cloud.network.Nodes[i].ID == kr.NodeID {
+			node = &r.Cloud.network.Nodes[i]
+			break
+		}
+	}
+	if node == nil {
+		return errors.New("node not found")
+	}
+	oldKey := nodePublicKey(*node)
+	if oldKey == nil {
+		return errors.New("node has no public key")
+	}
+	newKey, err := kr.Verify(oldKey)
+	if err != nil {
+		return err
+	}
+
+	oldID, err := PublicKeyToID(oldKey)
+	if err != nil {
+		return err
+	}
+	newID, err := PublicKeyToID(newKey)
+	if err != nil {
+		return err
+	}
+	if newID == oldID {
+		return nil
+	}
+	if r.Cloud.network.IsKeyRevoked(newID) {
+		return errors.New("new key is revoked")
+	}
+
+	// Whitelist entries and chunk locations refer to the stable node ID, so they stay valid.
+	node.PublicKey = *newKey
+	r.Cloud.network.RevokedKeys = append(r.Cloud.network.RevokedKeys, oldID)
+
+	if r.Cloud.events.NodeUpdated != nil {
+		go r.Cloud.events.NodeUpdated(*node)
+	}
+	return nil
+}
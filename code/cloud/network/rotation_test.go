@@ -0,0 +1,69 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestKeyRotationVerify(t *testing.T) {
+	oldKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyRotation("node", oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Verify(&oldKey.PublicKey); err != nil {
+		t.Errorf("Expected rotation to verify, got: %v.", err)
+	}
+	if _, err := kr.Verify(&newKey.PublicKey); err == nil {
+		t.Error("Expected rotation to not verify with the new key as the current key.")
+	}
+	kr.NodeID = "other"
+	if _, err := kr.Verify(&oldKey.PublicKey); err == nil {
+		t.Error("Expected tampered rotation to not verify.")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	clouds, err := CreateTestClouds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID := clouds[1].MyNode().ID
+	oldKey := clouds[1].(*cloud).PrivateKey()
+	newKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clouds[1].RotateKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if clouds[1].MyNode().ID != ID {
+		t.Errorf("Expected the node ID to stay %v, got %v.", ID, clouds[1].MyNode().ID)
+	}
+	if clouds[1].(*cloud).PrivateKey() != newKey {
+		t.Error("Expected the node to use the new key.")
+	}
+
+	for i, c := range clouds {
+		n := c.Network()
+		node, found := n.NodeByID(ID)
+		if !found {
+			t.Fatalf("Cloud %d lost node %v.", i, ID)
+		}
+		if key := nodePublicKey(node); key == nil || key.N.Cmp(newKey.N) != 0 {
+			t.Errorf("Cloud %d does not have the new key of node %v.", i, ID)
+		}
+		if err := n.verifyNodeKey(ID, &newKey.PublicKey); err != nil {
+			t.Errorf("Cloud %d does not accept the new key: %v.", i, err)
+		}
+		if err := n.verifyNodeKey(ID, &oldKey.PublicKey); err == nil {
+			t.Errorf("Cloud %d accepts the revoked key.", i)
+		}
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"cloud/utils"
 	"crypto/rsa"
 	"encoding/gob"
-	"os"
-	"path/filepath"
+	"sync"
+	"time"
 )
 
+// stateSaveDelay is how long the state is left unchanged before it is saved. Bursts of changes are saved together.
+const stateSaveDelay = 2 * time.Second
+
 func init() {
 	gob.Register(SavedNetworkState{})
 }
@@ -32,10 +35,18 @@ func (c *cloud) SavedNetworkState() SavedNetworkState {
 	defer c.networkMutex.RUnlock()
 	c.Mutex.RLock()
 	defer c.Mutex.RUnlock()
+	c.fileStorageMutex.RLock()
+	defer c.fileStorageMutex.RUnlock()
+	return c.savedNetworkStateLocked()
+}
+
+// savedNetworkStateLocked returns the cloud's state. The network, cloud and file storage mutexes must be held.
+// The returned state shares data with the cloud, so it must be used before the mutexes are released.
+func (c *cloud) savedNetworkStateLocked() SavedNetworkState {
 	//fmt.Println(c.folderSyncs)
 	return SavedNetworkState{
 		Network:     c.network,
-		Config:      c.Config(),
+		Config:      c.config,
 		MyNode:      c.myNode,
 		PrivateKey:  c.privateKey,
 		FileStorage: c.fileStorage,
@@ -44,40 +55,113 @@ func (c *cloud) SavedNetworkState() SavedNetworkState {
 	}
 }
 
+// SaveState writes the cloud's state to the file. The file is replaced atomically, so it always contains either the
+// previous state or the new one.
+func (c *cloud) SaveState(path string) error {
+	c.networkMutex.RLock()
+	c.Mutex.RLock()
+	c.fileStorageMutex.RLock()
+	data, err := encodeState(c.savedNetworkStateLocked(), nil)
+	passphrase := c.statePassphrase
+	c.fileStorageMutex.RUnlock()
+	c.Mutex.RUnlock()
+	c.networkMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	// Deriving the key is slow, so the state is encrypted once the locks are released.
+	if len(passphrase) != 0 {
+		if data, err = utils.EncryptWithPassphrase(data, passphrase); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileAtomic(path, data, 0600)
+}
+
+// SetStatePassphrase sets the passphrase that saved states are encrypted with. If empty, states are saved unencrypted.
+func (c *cloud) SetStatePassphrase(passphrase []byte) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.statePassphrase = passphrase
+}
+
+// persister saves the cloud's state to the configured save file, a short while after it last changed.
+type persister struct {
+	timer *time.Timer
+	mutex sync.Mutex
+}
+
+// stateChanged schedules the cloud's state to be saved. It should be called after every change to the network,
+// the file storage or the syncs.
+func (c *cloud) stateChanged() {
+	if c.config.SaveFile == "" {
+		return
+	}
+	c.persister.mutex.Lock()
+	defer c.persister.mutex.Unlock()
+	if c.persister.timer != nil {
+		c.persister.timer.Stop()
+	}
+	c.persister.timer = time.AfterFunc(stateSaveDelay, func() {
+		saveFile := c.config.SaveFile
+		if saveFile == "" {
+			return
+		}
+		utils.GetLogger().Printf("[DEBUG] Saving state to %v.", saveFile)
+		if err := c.SaveState(saveFile); err != nil {
+			utils.GetLogger().Printf("[ERROR] Saving state to %v: %v.", saveFile, err)
+		}
+	})
+}
+
 // LoadNetwork uses a SavedNetworkState to connect to the network, if it's up. If the network is offline, it will bring
 // it back online.
 func LoadNetwork(s SavedNetworkState) Cloud {
 	utils.GetLogger().Println("[INFO] Loading cloud network.")
 
 	for _, n := range s.Network.Nodes {
+		if n.ID == s.MyNode.ID {
+			continue
+		}
 		c, err := BootstrapToNetwork(n.IP, s.MyNode, s.PrivateKey, s.Config)
 		if err != nil {
 			continue
 		}
+		restoreStorage(c.(*cloud), s)
 		return c
 	}
 	utils.GetLogger().Println("[INFO] Could not reconnect to the network. Starting our own.")
 	c := SetupNetwork(s.Network, s.MyNode, s.PrivateKey)
 	c.SetConfig(s.Config)
-	cc := c.(*cloud)
+	restoreStorage(c.(*cloud), s)
+	return c
+}
+
+// restoreStorage restores the file storage and syncs of a saved state on the cloud.
+func restoreStorage(cc *cloud, s SavedNetworkState) {
 	if s.FileStorage != nil {
-		cc.fileStorage = s.FileStorage
+		cc.fileStorageMutex.Lock()
+		for cloudPath, store := range s.FileStorage {
+			cc.fileStorage[cloudPath] = store
+		}
+		cc.fileStorageMutex.Unlock()
+		// The saved stores could predate operations that were interrupted by a crash.
+		cc.applyRecoveredOps()
+	}
+	// The network of a bootstrap node does not list the chunks held by this node.
+	myID := cc.MyNode().ID
+	cc.networkMutex.Lock()
+	for chunkID, nodes := range s.Network.ChunkNodes {
+		if containsString(nodes, myID) && !containsString(cc.network.ChunkNodes[chunkID], myID) {
+			cc.network.ChunkNodes[chunkID] = append(cc.network.ChunkNodes[chunkID], myID)
+		}
 	}
+	cc.networkMutex.Unlock()
+	go cc.republish()
+
 	cc.fileSyncs = s.FileSyncs
 	cc.folderSyncs = s.FolderSyncs
-	//fmt.Println(cc.folderSyncs, s.FolderSyncs)
 	cc.createWatcher()
-	for _, f := range cc.fileSyncs {
-		cc.watcher.Add(f.FilePath)
-	}
-	for _, f := range cc.folderSyncs {
-		cc.watcher.Add(f.LocalPath)
-		filepath.Walk(f.LocalPath, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				cc.watcher.Add(path)
-			}
-			return nil
-		})
-	}
-	return c
+	// Files could have changed while the node was offline.
+	cc.rescan()
 }
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutomaticStateSave(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := utils.GetTestDirs("cloud_test_state_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	saveFile := filepath.Join(dirs[0], "state")
+	c := clouds[0]
+	c.SetConfig(CloudConfig{SaveFile: saveFile})
+
+	if err := c.CreateDirectory("/saved"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(stateSaveDelay + time.Second)
+
+	s, err := ReadStateFile(saveFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Network.GetFolder("/saved"); err != nil {
+		t.Errorf("Saved state is missing the created directory: %v.", err)
+	}
+	if s.Config.SaveFile != saveFile {
+		t.Errorf("Saved config has save file %v; want %v.", s.Config.SaveFile, saveFile)
+	}
+	if s.MyNode.ID != c.MyNode().ID {
+		t.Errorf("Saved state has node %v; want %v.", s.MyNode.ID, c.MyNode().ID)
+	}
+}
+
+func TestRecoverFileStorage(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_recover_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	dir := dirs[0]
+
+	// The node crashed while removing a chunk of a SetChunks, and while writing a chunk.
+	removed := filepath.Join(dir, "file.0")
+	tmp := filepath.Join(dir, ".file.1.1"+utils.TempFileSuffix)
+	for _, p := range []string{removed, tmp} {
+		if err := ioutil.WriteFile(p, []byte("chunk"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := datastore.Chunk{ID: "b", SequenceNumber: 1, ContentSize: 5}
+	data, err := json.Marshal(datastore.JournalEntry{
+		Op:     "SetChunks",
+		FileID: "file",
+		Chunks: []datastore.Chunk{kept},
+		Paths:  []string{removed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.1.journal"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetConfig(CloudConfig{FileStorageDir: dir})
+	for _, p := range []string{removed, tmp} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%v was not recovered: %v.", p, err)
+		}
+	}
+
+	// The saved store predates the SetChunks, it is rolled forward once restored.
+	store := &datastore.PartialFileStore{
+		BaseFileStore: datastore.BaseFileStore{
+			FileID: "file",
+			Chunks: []datastore.Chunk{{ID: "a", SequenceNumber: 0, ContentSize: 5}, kept},
+		},
+		FolderPath: dir,
+	}
+	restoreStorage(c, SavedNetworkState{FileStorage: map[string]datastore.FileStore{"/file": store}})
+	if len(store.Chunks) != 1 || store.Chunks[0].ID != "b" {
+		t.Errorf("Chunks of the restored store were not rolled forward: %v.", store.Chunks)
+	}
+
+	// Changing the config of a running node does not remove the writes in flight.
+	if err := ioutil.WriteFile(tmp, []byte("chunk"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c.SetConfig(CloudConfig{FileStorageDir: dir, FileStorageCapacity: 1 << 20})
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("Write in flight was removed: %v.", err)
+	}
+}
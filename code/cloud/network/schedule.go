@@ -0,0 +1,142 @@
+package network
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleMacros are the cron shorthands for common schedules.
+var scheduleMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// scheduleField is the range of values of a cron field.
+type scheduleField struct {
+	name     string
+	min, max int
+}
+
+var scheduleFields = []scheduleField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// schedule is a cron schedule. Each field is a set of the values that match, as bits.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the day of month or the day of week is *. If both are restricted, days that match
+	// either are in the schedule, like in cron.
+	domAny, dowAny bool
+}
+
+// parseSchedule parses a cron expression with the minute, hour, day of month, month and day of week fields, or one of
+// the @hourly, @daily, @weekly and @monthly shorthands. Fields are lists of values, ranges and steps, like 0,30 or 1-5
+// or */15. Sunday is 0 or 7.
+func parseSchedule(expr string) (*schedule, error) {
+	if macro, ok := scheduleMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(scheduleFields) {
+		return nil, errors.New("schedule must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseScheduleField(field, scheduleFields[i]); err != nil {
+			return nil, err
+		}
+	}
+	s := &schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseScheduleField parses a comma separated list of values, ranges and steps.
+func parseScheduleField(field string, f scheduleField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, errors.New("invalid step in " + f.name + ": " + item)
+			}
+			item = item[:i]
+		}
+		from, to := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("invalid " + f.name + ": " + item)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("invalid " + f.name + ": " + item)
+				}
+			} else if step > 1 {
+				// 5/15 is every 15 from 5.
+				to = f.max
+			}
+		}
+		if from < f.min || to > f.max || from > to {
+			return 0, errors.New(f.name + " out of range: " + item)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time in the schedule after t, or the zero time if there is none in the next 5 years.
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "@yearly"} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("Parsed invalid schedule %q.", expr)
+		}
+	}
+	for _, expr := range []string{"* * * * *", "0,30 1-5 */2 * 7", "5/15 * 1 1 0-6", "@hourly", "@daily", "@weekly",
+		"@monthly"} {
+		if _, err := parseSchedule(expr); err != nil {
+			t.Errorf("Could not parse %q: %v.", expr, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2020-01-01 is a Wednesday.
+	from := time.Date(2020, 1, 1, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2020, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2020, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		// Both days restricted: either the 15th or a Friday.
+		{"0 0 15 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := s.next(from); !next.Equal(test.next) {
+			t.Errorf("Expected %q to run next at %v, got %v.", test.expr, test.next, next)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"cloud/datastore"
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SearchQuery filters the files on the cloud. Empty fields do not filter.
+type SearchQuery struct {
+	// Name matches files whose name contains it, ignoring case.
+	Name string
+	// Glob matches files whose name matches the shell pattern, as in path.Match.
+	Glob string
+	// Regex matches files whose full cloud path matches the regular expression.
+	Regex string
+	// Folder only matches files in the folder or its sub-folders.
+	Folder string
+
+	// MinSize and MaxSize match files with sizes in the range, in bytes. A MaxSize of 0 does not limit the size.
+	MinSize uint64
+	MaxSize uint64
+
+	// ModifiedAfter and ModifiedBefore match files that were last modified in the range.
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	// ContentType matches files whose MIME type starts with it, like "image/" or "text/plain".
+	ContentType string
+
+	// Offset is the number of matches to skip, and Limit the maximum number of matches to return. A Limit of 0 returns
+	// all matches.
+	Offset int
+	Limit  int
+}
+
+// SearchResult is a page of the files that matched a search, sorted by their cloud path.
+type SearchResult struct {
+	Files []*NetworkFile
+	// Total is the number of files that matched, on all pages.
+	Total int
+}
+
+// matcher returns a function that checks a file against the query.
+func (q SearchQuery) matcher() (func(cloudPath string, f *datastore.File) bool, error) {
+	if q.Glob != "" {
+		if _, err := path.Match(q.Glob, ""); err != nil {
+			return nil, err
+		}
+	}
+	var re *regexp.Regexp
+	if q.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(q.Regex); err != nil {
+			return nil, err
+		}
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, errors.New("offset and limit must not be negative")
+	}
+	name := strings.ToLower(q.Name)
+	folder := ""
+	if q.Folder != "" {
+		folder = CleanNetworkPath(q.Folder)
+	}
+
+	return func(cloudPath string, f *datastore.File) bool {
+		if folder != "" && !isSubPath(folder, cloudPath) {
+			return false
+		}
+		if name != "" && !strings.Contains(strings.ToLower(f.Name), name) {
+			return false
+		}
+		if q.Glob != "" {
+			if ok, _ := path.Match(q.Glob, f.Name); !ok {
+				return false
+			}
+		}
+		if re != nil && !re.MatchString(cloudPath) {
+			return false
+		}
+		if f.Size < q.MinSize || q.MaxSize != 0 && f.Size > q.MaxSize {
+			return false
+		}
+		if !q.ModifiedAfter.IsZero() && f.Modified.Before(q.ModifiedAfter) {
+			return false
+		}
+		if !q.ModifiedBefore.IsZero() && !f.Modified.Before(q.ModifiedBefore) {
+			return false
+		}
+		return q.ContentType == "" || strings.HasPrefix(f.ContentType, q.ContentType)
+	}, nil
+}
+
+// Search returns the files in the network that match the query. The network's index of files is searched, so the
+// folder tree is not walked.
+func (n *Network) Search(query SearchQuery) (SearchResult, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	n.indexMutex().Lock()
+	matches := make([]*NetworkFile, 0)
+	for cloudPath, file := range n.networkIndex().files {
+		if match(cloudPath, file) {
+			matches = append(matches, &NetworkFile{File: file, Path: cloudPath})
+		}
+	}
+	n.indexMutex().Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Path < matches[j].Path
+	})
+	result := SearchResult{Total: len(matches)}
+	if query.Offset >= len(matches) {
+		result.Files = []*NetworkFile{}
+		return result, nil
+	}
+	matches = matches[query.Offset:]
+	if query.Limit != 0 && len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+	}
+	result.Files = matches
+	return result, nil
+}
+
+func (c *cloud) Search(query SearchQuery) (SearchResult, error) {
+	c.networkMutex.RLock()
+	defer c.networkMutex.RUnlock()
+	return c.network.Search(query)
+}
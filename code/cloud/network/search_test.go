@@ -0,0 +1,91 @@
+package network
+
+import (
+	"cloud/datastore"
+	"testing"
+	"time"
+)
+
+func searchPaths(t *testing.T, n *Network, query SearchQuery) []string {
+	result, err := n.Search(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(result.Files))
+	for _, f := range result.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearch(t *testing.T) {
+	day := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		path string
+		file *datastore.File
+	}{
+		{"/docs/Report.pdf", &datastore.File{Size: 2000, Modified: day, ContentType: "application/pdf"}},
+		{"/docs/notes.txt", &datastore.File{Size: 10, Modified: day.Add(24 * time.Hour), ContentType: "text/plain"}},
+		{"/photos/cat.png", &datastore.File{Size: 5000, Modified: day.Add(48 * time.Hour), ContentType: "image/png"}},
+		{"/photos/2020/dog.png", &datastore.File{Size: 7000, Modified: day, ContentType: "image/png"}},
+	}
+	n := &Network{}
+	for _, f := range files {
+		if _, err := n.addFile(f.path, f.file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query SearchQuery
+		paths []string
+	}{
+		{SearchQuery{Name: "REPORT"}, []string{"/docs/Report.pdf"}},
+		{SearchQuery{Glob: "*.png"}, []string{"/photos/2020/dog.png", "/photos/cat.png"}},
+		{SearchQuery{Regex: "^/photos/[0-9]+/"}, []string{"/photos/2020/dog.png"}},
+		{SearchQuery{Folder: "/docs"}, []string{"/docs/Report.pdf", "/docs/notes.txt"}},
+		{SearchQuery{MinSize: 2000, MaxSize: 5000}, []string{"/docs/Report.pdf", "/photos/cat.png"}},
+		{SearchQuery{ModifiedAfter: day.Add(time.Hour)}, []string{"/docs/notes.txt", "/photos/cat.png"}},
+		{SearchQuery{ModifiedBefore: day.Add(time.Hour), ContentType: "image/"}, []string{"/photos/2020/dog.png"}},
+		{SearchQuery{Offset: 1, Limit: 2}, []string{"/docs/notes.txt", "/photos/2020/dog.png"}},
+		{SearchQuery{Offset: 10}, []string{}},
+	}
+	for i, test := range tests {
+		if paths := searchPaths(t, n, test.query); !equalPaths(paths, test.paths) {
+			t.Errorf("Query %d returned %v, expected %v.", i, paths, test.paths)
+		}
+	}
+	if result, _ := n.Search(SearchQuery{Limit: 1}); result.Total != len(files) || len(result.Files) != 1 {
+		t.Errorf("Expected 1 of %d files, got %d of %d.", len(files), len(result.Files), result.Total)
+	}
+	if _, err := n.Search(SearchQuery{Regex: "("}); err == nil {
+		t.Error("Expected an invalid regular expression to fail.")
+	}
+
+	// The index is updated by changes to the network.
+	if err := n.replaceFile("/docs/notes.txt", &datastore.File{Size: 99999}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.removeFile("/docs/Report.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.moveFolder("/photos", "/pictures"); err != nil {
+		t.Fatal(err)
+	}
+	if paths := searchPaths(t, n, SearchQuery{MinSize: 5000}); !equalPaths(paths,
+		[]string{"/docs/notes.txt", "/pictures/2020/dog.png", "/pictures/cat.png"}) {
+		t.Errorf("Unexpected files after changes: %v.", paths)
+	}
+}
@@ -0,0 +1,275 @@
+package network
+
+import (
+	"bufio"
+	"cloud/datastore"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PlaceholderSuffix is appended to the local name of a cloud file to name its placeholder.
+const PlaceholderSuffix = ".cloud"
+
+// placeholderHeader is the first line of placeholders. Local files that end with the suffix but do not start with it
+// are synced like any other file.
+const placeholderHeader = "cloud placeholder"
+
+// SyncOptions are the per-node options of a folder sync.
+type SyncOptions struct {
+	// Exclude are cloud sub-folders of the sync that are not synced to this node.
+	Exclude []string
+	// Placeholders makes cloud files that are not stored locally appear as small placeholder files instead of being
+	// downloaded. HydrateFile downloads them.
+	Placeholders bool
+}
+
+// placeholderPath returns the path of the placeholder of the local file.
+func placeholderPath(localPath string) string {
+	return localPath + PlaceholderSuffix
+}
+
+// isPlaceholder returns whether the local file is a placeholder.
+func isPlaceholder(localPath string) bool {
+	if !strings.HasSuffix(localPath, PlaceholderSuffix) {
+		return false
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	return strings.TrimSpace(line) == placeholderHeader
+}
+
+// writePlaceholder writes the placeholder of a cloud file that is not stored at the local path.
+func writePlaceholder(localPath, cloudPath string, file *datastore.File) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%s\n%s\n%d bytes\n", placeholderHeader, cloudPath, file.Size)
+	return ioutil.WriteFile(placeholderPath(localPath), []byte(content), 0644)
+}
+
+// removePlaceholder removes the placeholder of the local file, if it has one.
+func removePlaceholder(localPath string) {
+	if p := placeholderPath(localPath); isPlaceholder(p) {
+		os.Remove(p)
+	}
+}
+
+// excludes returns whether the cloud path is in an excluded sub-folder of the folder sync.
+func (sync *fileSync) excludes(cloudPath string) bool {
+	for _, folder := range sync.Exclude {
+		if cloudPath == folder || isSubPath(folder, cloudPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncsPlaceholders returns whether the cloud file is part of a folder sync that uses placeholders.
+func (c *cloud) syncsPlaceholders(cloudPath string) bool {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	for i := range c.folderSyncs {
+		if isSubPath(c.folderSyncs[i].CloudPath, cloudPath) {
+			return c.folderSyncs[i].Placeholders
+		}
+	}
+	return false
+}
+
+// removeSyncedPlaceholder removes the placeholder of a cloud file that was deleted, if it is part of a folder sync.
+// None of the cloud's mutexes may be held.
+func (c *cloud) removeSyncedPlaceholder(cloudPath string) {
+	var sync fileSync
+	found := false
+	c.Mutex.RLock()
+	for i := range c.folderSyncs {
+		if c.folderSyncs[i].Placeholders && isSubPath(c.folderSyncs[i].CloudPath, cloudPath) {
+			sync, found = c.folderSyncs[i].snapshot(), true
+			break
+		}
+	}
+	c.Mutex.RUnlock()
+	if found {
+		removePlaceholder(c.syncLocalPath(&sync, cloudPath))
+	}
+}
+
+// excludedFolder returns the folder sync of the local folder, and checks that the cloud folder is part of it. Mutex
+// must be held.
+func (c *cloud) excludedFolder(localPath, cloudFolder string) (*fileSync, error) {
+	sync, err := c.syncByLocalPath(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isSubPath(sync.CloudPath, cloudFolder) {
+		return nil, errors.New(cloudFolder + " is not a sub-folder of " + sync.CloudPath)
+	}
+	return sync, nil
+}
+
+// ExcludeFolder stops syncing the cloud sub-folder to the synced local folder. The cloud files are kept. Local files
+// that did not change since they were synced are deleted, others are kept but no longer synced.
+func (c *cloud) ExcludeFolder(localPath, cloudFolder string) error {
+	cloudFolder = CleanNetworkPath(cloudFolder)
+	c.Mutex.Lock()
+	sync, err := c.excludedFolder(localPath, cloudFolder)
+	var s fileSync
+	excluded := err == nil && sync.excludes(cloudFolder)
+	if err == nil && !excluded {
+		sync.Exclude = append(sync.Exclude, cloudFolder)
+		s = sync.snapshot()
+	}
+	c.Mutex.Unlock()
+	if err != nil || excluded {
+		return err
+	}
+
+	localFolder := c.syncLocalPath(&s, cloudFolder)
+	if c.watcher != nil {
+		filepath.Walk(localFolder, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				c.watcher.Remove(p)
+			}
+			return nil
+		})
+	}
+	c.fileStorageMutex.RLock()
+	files := make([]string, 0)
+	for cloudPath := range c.fileStorage {
+		if isSubPath(cloudFolder, cloudPath) {
+			files = append(files, cloudPath)
+		}
+	}
+	c.fileStorageMutex.RUnlock()
+	for _, cloudPath := range files {
+		local, ok := localCopy(c.FileStore(cloudPath))
+		if !ok {
+			continue
+		}
+		filePath := local.FilePath
+		c.Mutex.RLock()
+		entry, indexed := c.indexOf(&s).Index[cloudPath]
+		c.Mutex.RUnlock()
+		c.releaseLocalCopy(cloudPath)
+		c.forgetSynced(cloudPath)
+		if info, err := os.Stat(filePath); err == nil && indexed && entry.unchanged(info) {
+			os.Remove(filePath)
+		}
+	}
+	removeEmptyFolders(localFolder)
+	c.stateChanged()
+	return nil
+}
+
+// removeEmptyFolders removes the local folder and its sub-folders, if they are empty.
+func removeEmptyFolders(localFolder string) {
+	folders := make([]string, 0)
+	filepath.Walk(localFolder, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			folders = append(folders, p)
+		}
+		return nil
+	})
+	// Sub-folders are removed before their parents.
+	sort.Sort(sort.Reverse(sort.StringSlice(folders)))
+	for _, folder := range folders {
+		os.Remove(folder)
+	}
+}
+
+// IncludeFolder syncs an excluded cloud sub-folder to the synced local folder again.
+func (c *cloud) IncludeFolder(localPath, cloudFolder string) error {
+	cloudFolder = CleanNetworkPath(cloudFolder)
+	c.Mutex.Lock()
+	sync, err := c.excludedFolder(localPath, cloudFolder)
+	var s fileSync
+	if err == nil {
+		exclude := make([]string, 0, len(sync.Exclude))
+		for _, folder := range sync.Exclude {
+			if folder != cloudFolder && !isSubPath(cloudFolder, folder) {
+				exclude = append(exclude, folder)
+			}
+		}
+		sync.Exclude = exclude
+		s = sync.snapshot()
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.createWatcher(); err != nil {
+		return err
+	}
+	c.rescanFolderSync(&s)
+	c.stateChanged()
+	return nil
+}
+
+// SetSyncPlaceholders sets whether the folder sync of the local folder shows cloud files that are not stored locally
+// as placeholders. Disabling them downloads the files.
+func (c *cloud) SetSyncPlaceholders(localPath string, enabled bool) error {
+	c.Mutex.Lock()
+	sync, err := c.syncByLocalPath(localPath)
+	var s fileSync
+	if err == nil {
+		sync.Placeholders = enabled
+		s = sync.snapshot()
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.createWatcher(); err != nil {
+		return err
+	}
+	c.rescanFolderSync(&s)
+	c.stateChanged()
+	return nil
+}
+
+// HydrateFile downloads the cloud file of a placeholder. localPath is the path of the placeholder, or of the file it
+// stands for. The placeholder is replaced by the file once the download completes, and the file is synced from then on.
+func (c *cloud) HydrateFile(localPath string) error {
+	localPath = strings.TrimSuffix(localPath, PlaceholderSuffix)
+	c.Mutex.RLock()
+	var cloudPath string
+	for i := range c.folderSyncs {
+		sync := &c.folderSyncs[i]
+		if strings.HasPrefix(localPath, filepath.Clean(sync.LocalPath)+string(filepath.Separator)) {
+			cloudPath = syncCloudPath(sync, localPath)
+			break
+		}
+	}
+	c.Mutex.RUnlock()
+	if cloudPath == "" {
+		return errors.New(localPath + " is not in a synced folder")
+	}
+
+	c.networkMutex.RLock()
+	var file *datastore.File
+	err := errors.New(cloudPath + " does not exist")
+	if c.network.folderExists(path.Dir(cloudPath)) {
+		file, err = c.network.GetFile(cloudPath)
+	}
+	c.networkMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = c.reconcile(ReconcileAction{
+		CloudPath: cloudPath,
+		LocalPath: localPath,
+		Op:        ReconcileDownload,
+		Cloud:     file,
+	}, func() {})
+	return err
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelectiveSync(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_selective_", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	uploadDir, localDir := dirs[1], dirs[2]
+
+	files := map[string]string{
+		"docs/a.txt":    "document",
+		"media/b.bin":   "large media",
+		"media/s/c.bin": "more media",
+	}
+	writeTestFiles(t, uploadDir, files)
+	for name := range files {
+		file, err := readLocalFile(filepath.Join(uploadDir, name), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddFile(file, "/p/"+name, filepath.Join(uploadDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.SyncFolderWithOptions("/p", localDir, SyncOptions{Exclude: []string{"/q"}}); err == nil {
+		t.Error("Excluded a folder that is not part of the sync.")
+	}
+	err = c.SyncFolderWithOptions("/p", localDir, SyncOptions{Exclude: []string{"/p/media"}, Placeholders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := func(name string) string {
+		return filepath.Join(localDir, filepath.FromSlash(name))
+	}
+	if !isPlaceholder(local("docs/a.txt" + PlaceholderSuffix)) {
+		t.Error("Cloud file has no placeholder.")
+	}
+	if _, err := os.Stat(local("docs/a.txt")); !os.IsNotExist(err) {
+		t.Errorf("Cloud file was downloaded: %v.", err)
+	}
+	if _, err := os.Stat(local("media")); !os.IsNotExist(err) {
+		t.Errorf("Excluded folder was synced: %v.", err)
+	}
+	plan, err := c.planSyncFolder(&c.folderSyncs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 1 || plan.Actions[0].Op != ReconcilePlaceholder {
+		t.Errorf("Expected a placeholder for the cloud file only, got %+v.", plan.Actions)
+	}
+
+	// Placeholders are replaced by the file on request.
+	if err := c.HydrateFile(local("docs/a.txt" + PlaceholderSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/docs/a.txt")
+	if b, err := ioutil.ReadFile(local("docs/a.txt")); err != nil || string(b) != "document" {
+		t.Errorf("Hydrated file has %q, %v.", b, err)
+	}
+	if _, err := os.Stat(local("docs/a.txt" + PlaceholderSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Placeholder of the hydrated file was not removed: %v.", err)
+	}
+
+	// Included folders get placeholders, which are downloaded once placeholders are disabled.
+	if err := c.IncludeFolder(localDir, "/p/media"); err != nil {
+		t.Fatal(err)
+	}
+	if !isPlaceholder(local("media/s/c.bin" + PlaceholderSuffix)) {
+		t.Error("Included folder has no placeholders.")
+	}
+	if err := c.SetSyncPlaceholders(localDir, false); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/media/b.bin", "/p/media/s/c.bin")
+	if _, err := os.Stat(local("media/b.bin" + PlaceholderSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Placeholder of the downloaded file was not removed: %v.", err)
+	}
+
+	// Excluded folders are removed locally, but kept on the cloud.
+	if err := c.ExcludeFolder(localDir, "/p/media"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(local("media")); !os.IsNotExist(err) {
+		t.Errorf("Excluded folder was not removed locally: %v.", err)
+	}
+	for _, p := range []string{"/p/media/b.bin", "/p/media/s/c.bin"} {
+		if _, err := c.GetFile(p); err != nil {
+			t.Errorf("Excluded file %v was deleted on the cloud: %v.", p, err)
+		}
+		if _, ok := localCopy(c.FileStore(p)); ok {
+			t.Errorf("Excluded file %v is still stored locally.", p)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"cloud/utils"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// State files start with a header: the magic bytes followed by the schema version as a big endian uint32.
+// Version 1 files have no header, they are a raw gob encoding of SavedNetworkState.
+var stateMagic = []byte("CLOUDSTATE")
+
+// CurrentStateVersion is the schema version that state files are written with. The schema is made of the record types
+// of the state file, any change to them needs a new version and a migration.
+const CurrentStateVersion = 3
+
+// stateMigrations maps a schema version to the function that converts a payload of that version to the next one.
+var stateMigrations = map[int]func(payload []byte) ([]byte, error){
+	1: migrateStateV1,
+	2: migrateStateV2,
+}
+
+// Kinds of file stores in a state file.
+const (
+	storeKindFull    = "full"
+	storeKindSync    = "sync"
+	storeKindPartial = "partial"
+)
+
+// storeRecord is the schema of a file store in a state file.
+type storeRecord struct {
+	CloudPath string
+	Kind      string
+	FileID    datastore.FileID
+	Chunks    []datastore.Chunk
+
+	// FilePath is set for full and sync stores.
+	FilePath string
+	// LastEdit is set for sync stores.
+	LastEdit time.Time
+	// Paused is set for sync stores of paused file syncs.
+	Paused bool
+	// FolderPath is set for partial stores.
+	FolderPath string
+}
+
+// stateV3 is the schema of a version 3 state file.
+type stateV3 struct {
+	Network networkRecord
+	Config  configRecord
+	MyNode  nodeRecord
+	// PrivateKey is PKCS#1 DER encoded.
+	PrivateKey []byte
+
+	Stores []storeRecord
+	// FileSyncs are the cloud paths of sync stores that are synced as single files.
+	FileSyncs   []string
+	FolderSyncs []folderSyncRecord
+}
+
+// StateFileInfo describes a state file.
+type StateFileInfo struct {
+	Version int
+	// Encrypted is true if the state file is encrypted with a passphrase.
+	Encrypted bool
+	State     SavedNetworkState
+}
+
+// splitStateHeader returns the schema version and the payload of an encoded state.
+func splitStateHeader(data []byte) (int, []byte, error) {
+	if !bytes.HasPrefix(data, stateMagic) {
+		return 1, data, nil
+	}
+	data = data[len(stateMagic):]
+	if len(data) < 4 {
+		return 0, nil, errors.New("state file header is truncated")
+	}
+	return int(binary.BigEndian.Uint32(data[:4])), data[4:], nil
+}
+
+// decodeState decodes an encoded state of any supported version, migrating it to the current version.
+// The passphrase is only needed if the state is encrypted.
+func decodeState(data []byte, passphrase []byte) (StateFileInfo, error) {
+	info := StateFileInfo{Encrypted: utils.IsEncrypted(data)}
+	if info.Encrypted {
+		if len(passphrase) == 0 {
+			return info, ErrPassphraseRequired
+		}
+		var err error
+		if data, err = utils.DecryptWithPassphrase(data, passphrase); err != nil {
+			return info, err
+		}
+	}
+	version, payload, err := splitStateHeader(data)
+	if err != nil {
+		return info, err
+	}
+	info.Version = version
+	if version > CurrentStateVersion {
+		return info, fmt.Errorf("state file version %d is newer than the supported version %d", version,
+			CurrentStateVersion)
+	}
+	for v := version; v < CurrentStateVersion; v++ {
+		migrate, ok := stateMigrations[v]
+		if !ok {
+			return info, fmt.Errorf("no migration from state file version %d", v)
+		}
+		utils.GetLogger().Printf("[INFO] Migrating state from version %d to %d.", v, v+1)
+		if payload, err = migrate(payload); err != nil {
+			return info, fmt.Errorf("migrating state from version %d: %v", v, err)
+		}
+	}
+
+	var s stateV3
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&s); err != nil {
+		return info, err
+	}
+	info.State, err = s.savedNetworkState()
+	return info, err
+}
+
+// encodeState encodes the state with the current schema version. If passphrase is not empty, the state is encrypted
+// with it.
+func encodeState(s SavedNetworkState, passphrase []byte) ([]byte, error) {
+	v3, err := newStateV3(s)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(stateMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(CurrentStateVersion))
+	if err := gob.NewEncoder(&buf).Encode(v3); err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return buf.Bytes(), nil
+	}
+	return utils.EncryptWithPassphrase(buf.Bytes(), passphrase)
+}
+
+// ReadStateFile reads a state file of any supported version. The passphrase is only needed if the file is encrypted.
+func ReadStateFile(path string, passphrase []byte) (SavedNetworkState, error) {
+	info, err := InspectStateFile(path, passphrase)
+	return info.State, err
+}
+
+// InspectStateFile reads a state file, together with the schema version it was written with.
+// The passphrase is only needed if the file is encrypted.
+func InspectStateFile(path string, passphrase []byte) (StateFileInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return StateFileInfo{}, err
+	}
+	return decodeState(data, passphrase)
+}
+
+// IsStateFileEncrypted returns true if the state file is encrypted with a passphrase.
+func IsStateFileEncrypted(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return utils.IsEncrypted(data), nil
+}
+
+// WriteStateFile atomically writes the state to the file, with the current schema version.
+// If passphrase is not empty, the file is encrypted with it.
+func WriteStateFile(path string, s SavedNetworkState, passphrase []byte) error {
+	data, err := encodeState(s, passphrase)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, data, 0600)
+}
+
+// UpgradeStateFile rewrites a state file with the current schema version. It returns the version the file had.
+// An encrypted file stays encrypted with the same passphrase.
+func UpgradeStateFile(path string, passphrase []byte) (int, error) {
+	info, err := InspectStateFile(path, passphrase)
+	if err != nil {
+		return info.Version, err
+	}
+	if info.Version == CurrentStateVersion {
+		return info.Version, nil
+	}
+	if !info.Encrypted {
+		passphrase = nil
+	}
+	return info.Version, WriteStateFile(path, info.State, passphrase)
+}
+
+// migrateStateV1 converts the raw gob encoding of SavedNetworkState to the version 2 schema. Version 2 payloads have
+// the field names of the version 3 records, so they are written with those.
+func migrateStateV1(payload []byte) ([]byte, error) {
+	var s SavedNetworkState
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&s); err != nil {
+		return nil, err
+	}
+	// Version 1 encoded synced files twice, in the file storage and in the file syncs.
+	for _, sync := range s.FileSyncs {
+		if _, ok := s.FileStorage[sync.CloudPath]; !ok {
+			if s.FileStorage == nil {
+				s.FileStorage = make(map[string]datastore.FileStore)
+			}
+			s.FileStorage[sync.CloudPath] = sync
+		}
+	}
+	v3, err := newStateV3(s)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v3); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// migrateStateV2 converts a version 2 payload to the version 3 schema. Version 2 encoded the network, config and
+// folder syncs with the cloud's own types, which gained fields without a new version: the case collision and conflict
+// policies, watch mode, poll interval and backup jobs of the config, the store of paused file syncs, and the renamed
+// files, index, ignore patterns, pause state, excluded folders and placeholders of folder syncs. Files written before
+// a field was added do not have it, and it is decoded as its zero value, which is its default.
+func migrateStateV2(payload []byte) ([]byte, error) {
+	var v3 stateV3
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&v3); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v3); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newStateV3(s SavedNetworkState) (stateV3, error) {
+	v3 := stateV3{
+		Network: newNetworkRecord(s.Network),
+		Config:  newConfigRecord(s.Config),
+		MyNode:  newNodeRecord(s.MyNode),
+	}
+	if s.PrivateKey != nil {
+		v3.PrivateKey = x509.MarshalPKCS1PrivateKey(s.PrivateKey)
+	}
+	for _, sync := range s.FolderSyncs {
+		v3.FolderSyncs = append(v3.FolderSyncs, newFolderSyncRecord(sync))
+	}
+	for cloudPath, store := range s.FileStorage {
+		r := storeRecord{CloudPath: cloudPath}
+		switch st := store.(type) {
+		case *datastore.SyncFileStore:
+			r.Kind = storeKindSync
+			r.FileID, r.Chunks = st.FileID, st.Chunks
+			r.FilePath, r.LastEdit, r.Paused = st.FilePath, st.LastEdit, st.Paused
+		case *datastore.FullFileStore:
+			r.Kind = storeKindFull
+			r.FileID, r.Chunks = st.FileID, st.Chunks
+			r.FilePath = st.FilePath
+		case *datastore.PartialFileStore:
+			r.Kind = storeKindPartial
+			r.FileID, r.Chunks = st.FileID, st.Chunks
+			r.FolderPath = st.FolderPath
+		default:
+			return v3, fmt.Errorf("unsupported file store %T for %v", store, cloudPath)
+		}
+		v3.Stores = append(v3.Stores, r)
+	}
+	for _, sync := range s.FileSyncs {
+		v3.FileSyncs = append(v3.FileSyncs, sync.CloudPath)
+	}
+	return v3, nil
+}
+
+func (v3 stateV3) savedNetworkState() (SavedNetworkState, error) {
+	s := SavedNetworkState{
+		Network:     v3.Network.network(),
+		Config:      v3.Config.config(),
+		MyNode:      v3.MyNode.node(),
+		FileStorage: make(map[string]datastore.FileStore),
+	}
+	for _, sync := range v3.FolderSyncs {
+		s.FolderSyncs = append(s.FolderSyncs, sync.folderSync())
+	}
+	if len(v3.PrivateKey) != 0 {
+		key, err := x509.ParsePKCS1PrivateKey(v3.PrivateKey)
+		if err != nil {
+			return s, err
+		}
+		s.PrivateKey = key
+	}
+	for _, r := range v3.Stores {
+		base := datastore.BaseFileStore{FileID: r.FileID, Chunks: r.Chunks}
+		switch r.Kind {
+		case storeKindSync:
+			s.FileStorage[r.CloudPath] = &datastore.SyncFileStore{
+				FullFileStore: datastore.FullFileStore{BaseFileStore: base, FilePath: r.FilePath},
+				CloudPath:     r.CloudPath,
+				LastEdit:      r.LastEdit,
+				Paused:        r.Paused,
+			}
+		case storeKindFull:
+			s.FileStorage[r.CloudPath] = &datastore.FullFileStore{BaseFileStore: base, FilePath: r.FilePath}
+		case storeKindPartial:
+			s.FileStorage[r.CloudPath] = &datastore.PartialFileStore{BaseFileStore: base, FolderPath: r.FolderPath}
+		default:
+			return s, fmt.Errorf("unknown file store kind %v for %v", r.Kind, r.CloudPath)
+		}
+	}
+	// Synced files share their store with the file storage.
+	for _, cloudPath := range v3.FileSyncs {
+		sync, ok := s.FileStorage[cloudPath].(*datastore.SyncFileStore)
+		if !ok {
+			return s, fmt.Errorf("file sync %v has no sync store", cloudPath)
+		}
+		s.FileSyncs = append(s.FileSyncs, sync)
+	}
+	return s, nil
+}
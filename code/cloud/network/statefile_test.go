@@ -0,0 +1,193 @@
+package network
+
+import (
+	"bytes"
+	"cloud/datastore"
+	"cloud/utils"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFileMigration(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_statefile_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	path := filepath.Join(dirs[0], "state")
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := &datastore.SyncFileStore{
+		FullFileStore: datastore.FullFileStore{BaseFileStore: datastore.BaseFileStore{FileID: "synced"}, FilePath: "/tmp/a"},
+		CloudPath:     "/a",
+	}
+	legacy := SavedNetworkState{
+		Network:    Network{Name: "legacy"},
+		MyNode:     Node{ID: "me"},
+		PrivateKey: key,
+		FileStorage: map[string]datastore.FileStore{
+			"/a": sync,
+			"/b": &datastore.PartialFileStore{BaseFileStore: datastore.BaseFileStore{FileID: "partial"}, FolderPath: "/tmp"},
+		},
+		FileSyncs: []*datastore.SyncFileStore{sync},
+	}
+
+	// Version 1 files are a raw gob encoding.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectStateFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 1 {
+		t.Errorf("Got version %d; want 1.", info.Version)
+	}
+	s := info.State
+	if s.Network.Name != "legacy" || s.MyNode.ID != "me" || s.PrivateKey.N.Cmp(key.N) != 0 {
+		t.Errorf("Migrated state does not match: %v.", s)
+	}
+	if _, ok := s.FileStorage["/b"].(*datastore.PartialFileStore); !ok {
+		t.Errorf("Got store %T for /b; want partial store.", s.FileStorage["/b"])
+	}
+	if len(s.FileSyncs) != 1 || s.FileSyncs[0] != s.FileStorage["/a"] {
+		t.Error("File sync does not share the store in the file storage.")
+	}
+
+	if version, err := UpgradeStateFile(path, nil); err != nil || version != 1 {
+		t.Fatalf("Upgrade returned version %d, error %v.", version, err)
+	}
+	info, err = InspectStateFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != CurrentStateVersion {
+		t.Errorf("Got version %d after upgrade; want %d.", info.Version, CurrentStateVersion)
+	}
+	if len(info.State.FileStorage) != 2 {
+		t.Errorf("Got %d stores after upgrade; want 2.", len(info.State.FileStorage))
+	}
+
+	// Files from newer versions are refused.
+	buf.Reset()
+	buf.Write(stateMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(CurrentStateVersion+1))
+	if _, err := decodeState(buf.Bytes(), nil); err == nil {
+		t.Error("Expected error when reading a newer state version.")
+	}
+}
+
+func TestStateFilePausedSyncs(t *testing.T) {
+	sync := &datastore.SyncFileStore{
+		FullFileStore: datastore.FullFileStore{BaseFileStore: datastore.BaseFileStore{FileID: "synced"}, FilePath: "/tmp/a"},
+		CloudPath:     "/a",
+		Paused:        true,
+	}
+	data, err := encodeState(SavedNetworkState{
+		FileStorage: map[string]datastore.FileStore{"/a": sync},
+		FileSyncs:   []*datastore.SyncFileStore{sync},
+		FolderSyncs: []fileSync{{CloudPath: "/p", LocalPath: "/tmp/p", Paused: true}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := decodeState(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := info.State; len(s.FileSyncs) != 1 || !s.FileSyncs[0].Paused {
+		t.Error("Paused file sync was resumed by saving the state.")
+	}
+	if s := info.State; len(s.FolderSyncs) != 1 || !s.FolderSyncs[0].Paused {
+		t.Error("Paused folder sync was resumed by saving the state.")
+	}
+}
+
+func TestStateFileMigrationV2(t *testing.T) {
+	// Version 2 files encoded the cloud's own types.
+	type legacyStateV2 struct {
+		Network     Network
+		Config      CloudConfig
+		MyNode      Node
+		PrivateKey  []byte
+		Stores      []storeRecord
+		FileSyncs   []string
+		FolderSyncs []fileSync
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	root := &NetworkFolder{Name: "/", SubFolders: []*NetworkFolder{{Name: "docs"}}}
+	root.SubFolders[0].Files.Add(&datastore.File{ID: "f", Name: "a.txt", Modified: modified, Metadata: map[string]string{"k": "v"}})
+	legacy := legacyStateV2{
+		Network: Network{Name: "legacy", Nodes: []Node{{ID: "me", IP: "127.0.0.1:1"}}, RootFolder: root,
+			DrainingNodes: map[string]bool{"old": true}},
+		Config: CloudConfig{FileStorageDir: "/tmp/storage", WatchMode: WatchPoll, PollInterval: time.Minute,
+			BackupJobs: []BackupJob{{Name: "job", Schedule: "@daily", Retention: BackupRetention{Daily: 7}}}},
+		MyNode:    Node{ID: "me"},
+		Stores:    []storeRecord{{CloudPath: "/a", Kind: storeKindSync, FileID: "synced", FilePath: "/tmp/a", Paused: true}},
+		FileSyncs: []string{"/a"},
+		FolderSyncs: []fileSync{{CloudPath: "/docs", LocalPath: "/tmp/docs", Exclude: []string{"/docs/x"},
+			Index: map[string]SyncEntry{"/docs/a.txt": {LocalPath: "/tmp/docs/a.txt", Size: 3, FileID: "f"}}}},
+	}
+	var buf bytes.Buffer
+	buf.Write(stateMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(s SavedNetworkState) {
+		t.Helper()
+		f, err := s.Network.GetFile("/docs/a.txt")
+		if err != nil || !f.Modified.Equal(modified) || f.Metadata["k"] != "v" {
+			t.Errorf("Unexpected file %+v, error %v.", f, err)
+		}
+		if s.Network.Name != "legacy" || len(s.Network.Nodes) != 1 || s.Network.Nodes[0].IP != "127.0.0.1:1" ||
+			!s.Network.DrainingNodes["old"] {
+			t.Errorf("Unexpected network %+v.", s.Network)
+		}
+		if c := s.Config; c.FileStorageDir != "/tmp/storage" || c.WatchMode != WatchPoll || c.PollInterval != time.Minute ||
+			len(c.BackupJobs) != 1 || c.BackupJobs[0].Retention.Daily != 7 {
+			t.Errorf("Unexpected config %+v.", c)
+		}
+		if len(s.FileSyncs) != 1 || !s.FileSyncs[0].Paused {
+			t.Errorf("Unexpected file syncs %v.", s.FileSyncs)
+		}
+		if len(s.FolderSyncs) != 1 || len(s.FolderSyncs[0].Exclude) != 1 ||
+			s.FolderSyncs[0].Index["/docs/a.txt"].Size != 3 {
+			t.Errorf("Unexpected folder syncs %+v.", s.FolderSyncs)
+		}
+	}
+	info, err := decodeState(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 {
+		t.Errorf("Got version %d; want 2.", info.Version)
+	}
+	check(info.State)
+
+	// The state is written with the records of the current version.
+	data, err := encodeState(info.State, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = decodeState(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != CurrentStateVersion {
+		t.Errorf("Got version %d; want %d.", info.Version, CurrentStateVersion)
+	}
+	check(info.State)
+}
@@ -0,0 +1,307 @@
+package network
+
+import (
+	"cloud/datastore"
+	"crypto"
+	"os"
+	"time"
+)
+
+// The records below are the schema of the network, config and folder syncs in a state file. They are separate from
+// the types the cloud works with, so that changing those does not change the state file without a new version.
+// Version 2 files encoded the cloud's types directly. The records keep their field names, so they decode version 2
+// payloads too.
+
+// nodeRecord is the schema of a node in a state file.
+type nodeRecord struct {
+	ID        string
+	IP        string
+	Name      string
+	PublicKey crypto.PublicKey
+}
+
+// fileRecord is the schema of a cloud file in a state file.
+type fileRecord struct {
+	ID          datastore.FileID
+	Base        datastore.FileID
+	Name        string
+	Path        string
+	Size        uint64
+	Chunks      datastore.Chunks
+	Created     time.Time
+	Modified    time.Time
+	Mode        os.FileMode
+	ContentType string
+	Owner       string
+	Metadata    map[string]string
+}
+
+// filesRecord is the schema of the files of a cloud folder in a state file.
+type filesRecord struct {
+	Files []*fileRecord
+}
+
+// folderRecord is the schema of a cloud folder in a state file.
+type folderRecord struct {
+	Name       string
+	SubFolders []*folderRecord
+	Files      filesRecord
+}
+
+// networkRecord is the schema of the network in a state file.
+type networkRecord struct {
+	Name          string
+	Nodes         []nodeRecord
+	RequireAuth   bool
+	Whitelist     bool
+	WhitelistIDs  []string
+	RootFolder    *folderRecord
+	ChunkNodes    map[datastore.ChunkID][]string
+	FileNodes     map[datastore.FileID][]string
+	DrainingNodes map[string]bool
+	RevokedKeys   []string
+}
+
+// backupRetentionRecord is the schema of the retention of a backup job in a state file.
+type backupRetentionRecord struct {
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+// backupJobRecord is the schema of a backup job in a state file.
+type backupJobRecord struct {
+	Name      string
+	LocalPath string
+	CloudPath string
+	Schedule  string
+	Retention backupRetentionRecord
+}
+
+// configRecord is the schema of the config in a state file.
+type configRecord struct {
+	FileStorageDir      string
+	FileStorageCapacity int64
+	SaveFile            string
+	FileChunkSize       int
+	CaseCollisions      int
+	SyncConflicts       int
+	WatchMode           int
+	PollInterval        time.Duration
+	BackupJobs          []backupJobRecord
+}
+
+// syncEntryRecord is the schema of an entry of a folder sync's index in a state file.
+type syncEntryRecord struct {
+	LocalPath string
+	Size      int64
+	ModTime   time.Time
+	FileID    datastore.FileID
+	Chunks    datastore.Chunks
+}
+
+// folderSyncRecord is the schema of a folder sync in a state file.
+type folderSyncRecord struct {
+	CloudPath    string
+	LocalPath    string
+	Renamed      map[string]string
+	Index        map[string]syncEntryRecord
+	Ignore       []string
+	Paused       bool
+	Exclude      []string
+	Placeholders bool
+}
+
+func newNodeRecord(n Node) nodeRecord {
+	return nodeRecord{ID: n.ID, IP: n.IP, Name: n.Name, PublicKey: n.PublicKey}
+}
+
+func (r nodeRecord) node() Node {
+	return Node{ID: r.ID, IP: r.IP, Name: r.Name, PublicKey: r.PublicKey}
+}
+
+func newFolderRecord(folder *NetworkFolder) *folderRecord {
+	if folder == nil {
+		return nil
+	}
+	r := &folderRecord{Name: folder.Name}
+	for _, sub := range folder.SubFolders {
+		r.SubFolders = append(r.SubFolders, newFolderRecord(sub))
+	}
+	for _, f := range folder.Files.Files {
+		r.Files.Files = append(r.Files.Files, &fileRecord{
+			ID:          f.ID,
+			Base:        f.Base,
+			Name:        f.Name,
+			Path:        f.Path,
+			Size:        f.Size,
+			Chunks:      f.Chunks,
+			Created:     f.Created,
+			Modified:    f.Modified,
+			Mode:        f.Mode,
+			ContentType: f.ContentType,
+			Owner:       f.Owner,
+			Metadata:    f.Metadata,
+		})
+	}
+	return r
+}
+
+func (r *folderRecord) folder() *NetworkFolder {
+	if r == nil {
+		return nil
+	}
+	folder := &NetworkFolder{Name: r.Name}
+	for _, sub := range r.SubFolders {
+		folder.SubFolders = append(folder.SubFolders, sub.folder())
+	}
+	for _, f := range r.Files.Files {
+		folder.Files.Files = append(folder.Files.Files, &datastore.File{
+			ID:          f.ID,
+			Base:        f.Base,
+			Name:        f.Name,
+			Path:        f.Path,
+			Size:        f.Size,
+			Chunks:      f.Chunks,
+			Created:     f.Created,
+			Modified:    f.Modified,
+			Mode:        f.Mode,
+			ContentType: f.ContentType,
+			Owner:       f.Owner,
+			Metadata:    f.Metadata,
+		})
+	}
+	return folder
+}
+
+func newNetworkRecord(n Network) networkRecord {
+	r := networkRecord{
+		Name:          n.Name,
+		RequireAuth:   n.RequireAuth,
+		Whitelist:     n.Whitelist,
+		WhitelistIDs:  n.WhitelistIDs,
+		RootFolder:    newFolderRecord(n.RootFolder),
+		ChunkNodes:    n.ChunkNodes,
+		FileNodes:     n.FileNodes,
+		DrainingNodes: n.DrainingNodes,
+		RevokedKeys:   n.RevokedKeys,
+	}
+	for _, node := range n.Nodes {
+		r.Nodes = append(r.Nodes, newNodeRecord(node))
+	}
+	return r
+}
+
+func (r networkRecord) network() Network {
+	n := Network{
+		Name:          r.Name,
+		RequireAuth:   r.RequireAuth,
+		Whitelist:     r.Whitelist,
+		WhitelistIDs:  r.WhitelistIDs,
+		RootFolder:    r.RootFolder.folder(),
+		ChunkNodes:    r.ChunkNodes,
+		FileNodes:     r.FileNodes,
+		DrainingNodes: r.DrainingNodes,
+		RevokedKeys:   r.RevokedKeys,
+	}
+	for _, node := range r.Nodes {
+		n.Nodes = append(n.Nodes, node.node())
+	}
+	return n
+}
+
+func newConfigRecord(config CloudConfig) configRecord {
+	r := configRecord{
+		FileStorageDir:      config.FileStorageDir,
+		FileStorageCapacity: config.FileStorageCapacity,
+		SaveFile:            config.SaveFile,
+		FileChunkSize:       config.FileChunkSize,
+		CaseCollisions:      int(config.CaseCollisions),
+		SyncConflicts:       int(config.SyncConflicts),
+		WatchMode:           int(config.WatchMode),
+		PollInterval:        config.PollInterval,
+	}
+	for _, job := range config.BackupJobs {
+		r.BackupJobs = append(r.BackupJobs, backupJobRecord{
+			Name:      job.Name,
+			LocalPath: job.LocalPath,
+			CloudPath: job.CloudPath,
+			Schedule:  job.Schedule,
+			Retention: backupRetentionRecord(job.Retention),
+		})
+	}
+	return r
+}
+
+func (r configRecord) config() CloudConfig {
+	config := CloudConfig{
+		FileStorageDir:      r.FileStorageDir,
+		FileStorageCapacity: r.FileStorageCapacity,
+		SaveFile:            r.SaveFile,
+		FileChunkSize:       r.FileChunkSize,
+		CaseCollisions:      CaseCollisionPolicy(r.CaseCollisions),
+		SyncConflicts:       ConflictPolicy(r.SyncConflicts),
+		WatchMode:           WatchMode(r.WatchMode),
+		PollInterval:        r.PollInterval,
+	}
+	for _, j := range r.BackupJobs {
+		config.BackupJobs = append(config.BackupJobs, BackupJob{
+			Name:      j.Name,
+			LocalPath: j.LocalPath,
+			CloudPath: j.CloudPath,
+			Schedule:  j.Schedule,
+			Retention: BackupRetention(j.Retention),
+		})
+	}
+	return config
+}
+
+func newFolderSyncRecord(sync fileSync) folderSyncRecord {
+	r := folderSyncRecord{
+		CloudPath:    sync.CloudPath,
+		LocalPath:    sync.LocalPath,
+		Renamed:      sync.Renamed,
+		Ignore:       sync.Ignore,
+		Paused:       sync.Paused,
+		Exclude:      sync.Exclude,
+		Placeholders: sync.Placeholders,
+	}
+	if sync.Index != nil {
+		r.Index = make(map[string]syncEntryRecord, len(sync.Index))
+		for cloudPath, e := range sync.Index {
+			r.Index[cloudPath] = syncEntryRecord{
+				LocalPath: e.LocalPath,
+				Size:      e.Size,
+				ModTime:   e.ModTime,
+				FileID:    e.FileID,
+				Chunks:    e.Chunks,
+			}
+		}
+	}
+	return r
+}
+
+func (r folderSyncRecord) folderSync() fileSync {
+	sync := fileSync{
+		CloudPath:    r.CloudPath,
+		LocalPath:    r.LocalPath,
+		Renamed:      r.Renamed,
+		Ignore:       r.Ignore,
+		Paused:       r.Paused,
+		Exclude:      r.Exclude,
+		Placeholders: r.Placeholders,
+	}
+	if r.Index != nil {
+		sync.Index = make(map[string]SyncEntry, len(r.Index))
+		for cloudPath, e := range r.Index {
+			sync.Index[cloudPath] = SyncEntry{
+				LocalPath: e.LocalPath,
+				Size:      e.Size,
+				ModTime:   e.ModTime,
+				FileID:    e.FileID,
+				Chunks:    e.Chunks,
+			}
+		}
+	}
+	return sync
+}
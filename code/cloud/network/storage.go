@@ -7,11 +7,10 @@ import (
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"io"
+	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 // DownloadFile downloads the file from the cloud.
@@ -33,155 +32,216 @@ func (c *cloud) DownloadFile(cloudPath string, w io.Writer) error {
 	return nil
 }
 
+// isInFolderSync returns whether the cloud file is synced by a folder sync, and its local path. Ignored files and files
+// of paused syncs are not. None of the cloud's mutexes may be held.
 func (c *cloud) isInFolderSync(cloudPath string) (ok bool, filePath string) {
+	var sync fileSync
+	found := false
+	c.Mutex.RLock()
 	for i := range c.folderSyncs {
-		if strings.HasPrefix(cloudPath, c.folderSyncs[i].CloudPath) {
-			relPath := strings.TrimPrefix(cloudPath, c.folderSyncs[i].CloudPath)
-			fpath := filepath.Join(c.folderSyncs[i].LocalPath, relPath)
-			return true, fpath
+		if cloudPath == c.folderSyncs[i].CloudPath || isSubPath(c.folderSyncs[i].CloudPath, cloudPath) {
+			sync, found = c.folderSyncs[i].snapshot(), true
+			break
 		}
 	}
-	return false, ""
+	c.Mutex.RUnlock()
+	if !found || sync.Paused || sync.ignoresCloud(c.syncRules(&sync), cloudPath, false) {
+		return false, ""
+	}
+	return true, c.syncLocalPath(&sync, cloudPath)
+}
+
+// localCopy returns the file store if it stores the whole file at the user's local path.
+func localCopy(fs datastore.FileStore) (*datastore.FullFileStore, bool) {
+	switch f := fs.(type) {
+	case *datastore.FullFileStore:
+		return f, true
+	case *datastore.SyncFileStore:
+		return &f.FullFileStore, true
+	}
+	return nil, false
 }
 
+// watcherEvent handles a watcher event of a local path of the folder syncs. The syncs are handled from snapshots, so
+// that they can be changed while the event is handled.
 func (c *cloud) watcherEvent(event *fsnotify.Event) {
+	c.Mutex.RLock()
+	syncs := make([]fileSync, 0, 1)
 	for i := range c.folderSyncs {
-		if strings.HasPrefix(event.Name, c.folderSyncs[i].LocalPath) {
-			relativePath := strings.TrimPrefix(event.Name, c.folderSyncs[i].LocalPath)
-			relativePath = filepath.ToSlash(relativePath)
-			cloudPath := path.Join(c.folderSyncs[i].CloudPath, relativePath)
-			cloudPath = CleanNetworkPath(cloudPath)
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				stat, err := os.Stat(event.Name)
-				if err != nil {
-					continue
-				}
-				if stat.IsDir() {
-					continue
-				}
-				utils.GetLogger().Println("[INFO] modified file:", event.Name, c.folderSyncs[i].LocalPath, relativePath, cloudPath)
-
-				time.Sleep(time.Millisecond * 50)
-				f, err := c.GetFile(cloudPath)
-				if err != nil {
-					continue
-				}
-				reader, err := os.Open(event.Name)
-				if err != nil {
-					continue
-				}
-				info, err := reader.Stat()
-				if err != nil {
-					continue
-				}
-				if info.ModTime() == c.folderSyncs[i].LastEditTime {
-					continue
-				}
-				c.folderSyncs[i].LastEditTime = info.ModTime()
+		// Changes of paused syncs are found by the rescan when they are resumed.
+		if strings.HasPrefix(event.Name, c.folderSyncs[i].LocalPath) && !c.folderSyncs[i].Paused {
+			syncs = append(syncs, c.folderSyncs[i].snapshot())
+		}
+	}
+	c.Mutex.RUnlock()
+	for i := range syncs {
+		sync := &syncs[i]
+		stat, err := os.Stat(event.Name)
+		isDir := err == nil && stat.IsDir()
+		if sync.ignoresLocal(c.syncRules(sync), event.Name, isDir) {
+			continue
+		}
+		relativePath := strings.TrimPrefix(event.Name, sync.LocalPath)
+		relativePath = filepath.ToSlash(relativePath)
+		cloudPath := syncCloudPath(sync, event.Name)
+		// Files replaced by a new file, like editors save them, are edits of the synced file.
+		if local, ok := localCopy(c.FileStore(cloudPath)); ok && local.FilePath == event.Name &&
+			event.Op&fsnotify.Create == fsnotify.Create && !isDir {
+			event.Op = event.Op&^fsnotify.Create | fsnotify.Write
+		}
+		if event.Op&fsnotify.Write == fsnotify.Write {
+			stat, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if stat.IsDir() {
+				continue
+			}
+			utils.GetLogger().Println("[INFO] modified file:", event.Name, sync.LocalPath, relativePath, cloudPath)
 
-				f2, err := datastore.NewFile(reader, f.Name, f.Chunks.ChunkSize)
-				if len(f2.Chunks.Chunks) == 0 {
-					continue
-				}
+			f, err := c.GetFile(cloudPath)
+			if err != nil {
+				continue
+			}
+			store, ok := localCopy(c.FileStore(cloudPath))
+			if !ok || store.Writing() {
+				continue
+			}
+			c.fileStorageMutex.RLock()
+			base := store.FileID
+			c.fileStorageMutex.RUnlock()
+			reader, err := os.Open(event.Name)
+			if err != nil {
+				continue
+			}
+			info, err := reader.Stat()
+			if err != nil {
 				reader.Close()
-				if err == nil {
-					if c.LockFile(cloudPath) {
-						err := c.UpdateFile(f2, cloudPath)
-						if err != nil {
-							utils.GetLogger().Println("[ERROR] UpdateFile:", err)
-						}
-					}
-					c.UnlockFile(cloudPath)
-				}
+				continue
 			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				stat, err := os.Stat(event.Name)
-				if err != nil {
-					continue
-				}
-				if stat.IsDir() {
-					utils.GetLogger().Println("[INFO] created dir:", event.Name)
-					c.watcher.Add(event.Name)
-					c.CreateDirectory(cloudPath)
-					continue
-				}
-				utils.GetLogger().Println("[INFO] created file:", event.Name, c.folderSyncs[i].LocalPath, relativePath, cloudPath)
-				reader, err := os.Open(event.Name)
-				if err != nil {
-					continue
-				}
-				f2, err := datastore.NewFile(reader, filepath.Base(event.Name), 4*1024*1024)
-				if err != nil {
-					utils.GetLogger().Println("[ERROR] getfile on created file:", err)
-					continue
-				}
-				c.LockFile(cloudPath)
-				err = c.AddFileSync(f2, cloudPath, event.Name)
-				fmt.Println("Create: ", cloudPath, event.Name, err)
-				c.UnlockFile(cloudPath)
+
+			f2, err := datastore.NewFile(reader, f.Name, f.Chunks.ChunkSize)
+			reader.Close()
+			if err != nil || len(f2.Chunks.Chunks) == 0 {
+				continue
 			}
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				stat, err := os.Stat(event.Name)
-				if err != nil {
-					continue
-				}
-				if stat.IsDir() {
-					utils.GetLogger().Println("[INFO] removed dir:", event.Name)
-					c.watcher.Remove(event.Name)
-					c.DeleteDirectory(cloudPath)
-					continue
-				}
-				utils.GetLogger().Println("[INFO] remove file:", event.Name, c.folderSyncs[i].LocalPath, relativePath, cloudPath)
-				c.LockFile(cloudPath)
-				c.DeleteFile(cloudPath)
-				c.UnlockFile(cloudPath)
+			f2.Base = base
+			f2.SetFileInfo(info)
+			c.pushLocalEdit(cloudPath, store, f2)
+		}
+		if event.Op&fsnotify.Create == fsnotify.Create {
+			stat, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			// A file or folder that was renamed in the sync is moved on the cloud instead of uploaded again.
+			if c.moveRenamed(cloudPath, event.Name, stat) {
+				continue
+			}
+			if stat.IsDir() {
+				utils.GetLogger().Println("[INFO] created dir:", event.Name)
+				c.watcher.Add(event.Name)
+				c.CreateDirectory(cloudPath)
+				c.queueCreatedContents(sync, event.Name)
+				continue
+			}
+			utils.GetLogger().Println("[INFO] created file:", event.Name, sync.LocalPath, relativePath, cloudPath)
+			reader, err := os.Open(event.Name)
+			if err != nil {
+				continue
+			}
+			f2, err := datastore.NewFile(reader, filepath.Base(event.Name), syncChunkSize)
+			reader.Close()
+			if err != nil {
+				utils.GetLogger().Println("[ERROR] getfile on created file:", err)
+				continue
+			}
+			f2.SetFileInfo(stat)
+			finish := c.trackTransfer(event.Name, false)
+			c.LockFile(cloudPath)
+			err = c.AddFileSync(f2, cloudPath, event.Name)
+			fmt.Println("Create: ", cloudPath, event.Name, err)
+			c.UnlockFile(cloudPath)
+			finish(err)
+			if err == nil {
+				c.recordSynced(cloudPath, event.Name, f2)
 			}
 		}
+		if event.Op&fsnotify.Remove == fsnotify.Remove {
+			stat, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if stat.IsDir() {
+				utils.GetLogger().Println("[INFO] removed dir:", event.Name)
+				c.watcher.Remove(event.Name)
+				c.DeleteDirectory(cloudPath, false)
+				continue
+			}
+			utils.GetLogger().Println("[INFO] remove file:", event.Name, sync.LocalPath, relativePath, cloudPath)
+			c.LockFile(cloudPath)
+			c.DeleteFile(cloudPath)
+			c.UnlockFile(cloudPath)
+		}
+		if event.Op&fsnotify.Rename == fsnotify.Rename {
+			utils.GetLogger().Println("[INFO] renamed:", event.Name, sync.LocalPath, relativePath, cloudPath)
+			c.localRenamed(cloudPath, event.Name)
+		}
+	}
+}
+
+// queueCreatedContents queues the contents of a created folder as created. The watcher only reports the files created
+// after the folder is watched, and a polling watcher takes the ones already in it as its first snapshot.
+func (c *cloud) queueCreatedContents(sync *fileSync, dir string) {
+	if c.watchQueue == nil {
+		return
+	}
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		name := filepath.Join(dir, child.Name())
+		// Files whose events were handled before are already uploaded.
+		if local, ok := localCopy(c.FileStore(syncCloudPath(sync, name))); ok && local.FilePath == name {
+			continue
+		}
+		c.watchQueue.add(fsnotify.Event{Name: name, Op: fsnotify.Create})
+	}
+}
+
+// handleWatcherEvent handles the coalesced watcher events of a local path of the syncs.
+func (c *cloud) handleWatcherEvent(event fsnotify.Event) {
+	c.watcherEvent(&event)
+	c.Mutex.RLock()
+	stores := make([]*datastore.SyncFileStore, 0, 1)
+	for _, fs := range c.fileSyncs {
+		if fs.FilePath == event.Name && !fs.Paused {
+			stores = append(stores, fs)
+		}
+	}
+	c.Mutex.RUnlock()
+	for _, fs := range stores {
+		fa, err := c.GetFile(fs.CloudPath)
+		if err != nil {
+			continue
+		}
+		f2, err := fs.WatcherEvent(&event, fa)
+		if err == nil && f2 != nil {
+			c.pushLocalEdit(fs.CloudPath, &fs.FullFileStore, f2)
+		}
 	}
 }
 
 func (c *cloud) createWatcher() error {
 	if c.watcher == nil {
-		var err error
-		c.watcher, err = fsnotify.NewWatcher()
+		queue := newWatchQueue(c.handleWatcherEvent, watchQuietPeriod, watchWorkers)
+		watcher, err := c.newFileWatcher(queue.add)
 		if err != nil {
 			return err
 		}
-
-		go func() {
-			for {
-				select {
-				case event, ok := <-c.watcher.Events:
-					if !ok {
-						return
-					}
-					c.watcherEvent(&event)
-					for _, fs := range c.fileSyncs {
-						if fs.FilePath == event.Name {
-							fa, err := c.GetFile(fs.CloudPath)
-							if err != nil {
-								continue
-							}
-							f2, err := fs.WatcherEvent(&event, fa)
-							if err == nil && f2 != nil {
-								if c.LockFile(fs.CloudPath) {
-									err := c.UpdateFile(f2, fs.CloudPath)
-									if err != nil {
-										utils.GetLogger().Println("[ERROR] UpdateFile:", err)
-									}
-								}
-								c.UnlockFile(fs.CloudPath)
-							}
-						}
-					}
-				case err, ok := <-c.watcher.Errors:
-					if !ok {
-						return
-					}
-					utils.GetLogger().Println("[INFO] error:", err)
-				}
-			}
-		}()
+		c.watchQueue = queue
+		c.watcher = watcher
 	}
 	return nil
 }
@@ -190,98 +250,43 @@ func (c *cloud) createWatcher() error {
 // to either will reflect upon the other, the sync is constant.
 // If cloud path exists but local path does not, the file will be downloaded.
 // If local path exists but cloud path does not, the file will be uploaded to the cloud.
-// If both exist, the content MUST be the same.
+// If both exist and differ, the side that changed since the file was last synced wins. If both changed, or the file
+// was never synced, the conflict policy of the config decides.
 // If neither exist, an error will be thrown.
-// This function returns before download/upload is completed. TODO: another function to check status.
+// This function returns before download/upload is completed, Syncs reports whether it is still in progress.
 func (c *cloud) SyncFile(cloudPath string, localPath string) error {
 	if c.watcher == nil {
 		if err := c.createWatcher(); err != nil {
 			return err
 		}
 	}
-	cloudPath = CleanNetworkPath(cloudPath)
-	_, name := path.Split(cloudPath)
-	var localFile *datastore.File
-
-	if f, err := os.Open(localPath); err == nil {
-		file, err := datastore.NewFile(f, name, 4*1024*1024)
-		if err == nil {
-			localFile = file
-		}
-		f.Close()
-	}
-
-	cloudFile, err := c.GetFile(cloudPath)
-	if err != nil && localFile == nil {
-		return errors.New("file does not exist on the cloud nor locally")
-	}
-
-	if cloudFile != nil && localFile != nil {
-		if cloudFile.ID != localFile.ID {
-			return errors.New("local file and cloud file are not the same")
-		}
+	plan, err := c.PlanSyncFile(cloudPath, localPath)
+	if err != nil {
+		return err
 	}
 
-	if cloudFile == nil {
-		go func() {
-			c.fileStorageMutex.Lock()
-			c.fileStorage[cloudPath] = &datastore.SyncFileStore{
-				FullFileStore: datastore.FullFileStore{
-					BaseFileStore: datastore.BaseFileStore{
-						FileID: localFile.ID,
-						Chunks: localFile.Chunks.Chunks,
-					},
-					FilePath: localPath,
-				},
-				CloudPath: cloudPath,
-			}
-			c.fileStorageMutex.Unlock()
-			c.AddFile(localFile, cloudPath, localPath)
-			c.watcher.Add(localPath)
-		}()
-	} else if localFile == nil {
-		osFile, err := os.Create(localPath)
-		if err != nil {
-			return err
-		}
-		go func(cloudPath string, osFile *os.File) {
-			err = c.DownloadFile(cloudPath, osFile)
-			osFile.Close()
-			c.fileStorageMutex.Lock()
-			c.fileStorage[cloudPath].DeleteAllContent()
-			c.fileStorage[cloudPath] = &datastore.SyncFileStore{
-				FullFileStore: datastore.FullFileStore{
-					BaseFileStore: datastore.BaseFileStore{
-						FileID: cloudFile.ID,
-						Chunks: cloudFile.Chunks.Chunks,
-					},
-					FilePath: localPath,
-				},
-				CloudPath: cloudPath,
-			}
-			c.fileStorageMutex.Unlock()
-			c.watcher.Add(localPath)
-		}(cloudPath, osFile)
-	} else {
-		c.fileStorageMutex.Lock()
-		c.fileStorage[cloudPath] = &datastore.SyncFileStore{
-			FullFileStore: datastore.FullFileStore{
-				BaseFileStore: datastore.BaseFileStore{
-					FileID: localFile.ID,
-					Chunks: localFile.Chunks.Chunks,
-				},
-				FilePath: localPath,
-			},
-			CloudPath: cloudPath,
-		}
-		c.fileStorageMutex.Unlock()
+	store, err := c.reconcile(plan.Actions[0], func() {
 		c.watcher.Add(localPath)
+	})
+	if err != nil {
+		return err
 	}
-	c.fileSyncs = append(c.fileSyncs, c.fileStorage[cloudPath].(*datastore.SyncFileStore))
+	c.Mutex.Lock()
+	c.fileSyncs = append(c.fileSyncs, store)
+	c.Mutex.Unlock()
+	c.stateChanged()
 	return nil
 }
 
+// SyncFolder syncs a cloud folder and a local folder. Files that only exist on one side are copied to the other, and
+// files that differ are reconciled like in SyncFile.
 func (c *cloud) SyncFolder(cloudPath string, localPath string) error {
+	return c.SyncFolderWithOptions(cloudPath, localPath, SyncOptions{})
+}
+
+// SyncFolderWithOptions syncs a cloud folder and a local folder like SyncFolder, except for the excluded sub-folders.
+// With placeholders, cloud files that are not stored locally are not downloaded, placeholders are written instead.
+func (c *cloud) SyncFolderWithOptions(cloudPath string, localPath string, options SyncOptions) error {
 	if c.watcher == nil {
 		if err := c.createWatcher(); err != nil {
 			return err
@@ -289,119 +294,42 @@ func (c *cloud) SyncFolder(cloudPath string, localPath string) error {
 	}
 
 	cloudPath = CleanNetworkPath(cloudPath)
-	//if empty, err := IsDirEmpty(localPath); err != nil || !empty {
-	//	if err != nil {
-	//		return err
-	//	}
-	//	return errors.New("directory is not empty")
-	//}
-	filesAdded := make(map[string]struct{})
-	filepath.Walk(localPath, func(fpath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		f, err := filepath.Rel(localPath, fpath)
-		if err != nil {
-			return err
-		}
-		if f == "." {
-			return nil
-		}
-		cloudFilePath := path.Join(cloudPath, f)
-		cloudFilePath = CleanNetworkPath(cloudFilePath)
-		if info.IsDir() {
-			c.CreateDirectory(cloudFilePath)
-			c.watcher.Add(fpath)
-			return nil
-		}
-
-		var localFile *datastore.File
-		if f, err := os.Open(fpath); err == nil {
-			file, err := datastore.NewFile(f, path.Base(fpath), 4*1024*1024)
-			localFile = file
-			f.Close()
-			if err != nil {
-				return err
-			}
+	exclude := make([]string, 0, len(options.Exclude))
+	for _, folder := range options.Exclude {
+		folder = CleanNetworkPath(folder)
+		if !isSubPath(cloudPath, folder) {
+			return errors.New(folder + " is not a sub-folder of " + cloudPath)
 		}
-
-		c.fileStorage[cloudFilePath] = &datastore.SyncFileStore{
-			FullFileStore: datastore.FullFileStore{
-				BaseFileStore: datastore.BaseFileStore{
-					FileID: localFile.ID,
-					Chunks: localFile.Chunks.Chunks,
-				},
-				FilePath: fpath,
-			},
-		}
-		fmt.Println(cloudFilePath, "set to", fpath)
-		c.AddFile(localFile, cloudFilePath, fpath)
-		filesAdded[cloudFilePath] = struct{}{}
-		return nil
-	})
-
-	f, err := c.GetFolder(cloudPath)
+		exclude = append(exclude, folder)
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+	if _, err := c.GetFolder(cloudPath); err != nil {
+		return err
+	}
+	newSync := fileSync{
+		CloudPath:    cloudPath,
+		LocalPath:    localPath,
+		Exclude:      exclude,
+		Placeholders: options.Placeholders,
+	}
+	scanned := c.trackScan(localPath)
+	plan, err := c.planSyncFolder(&newSync)
+	scanned()
 	if err != nil {
 		return err
 	}
 
-	c.folderSyncs = append(c.folderSyncs, fileSync{
-		CloudPath: cloudPath,
-		LocalPath: localPath,
-	})
-
-	var syncFolder func(f *NetworkFolder, folderpath string)
-	syncFolder = func(folder *NetworkFolder, folderpath string) {
-		localFolder := filepath.Join(localPath, folderpath)
-		folderpath = CleanNetworkPath(folderpath)
-		for _, sf := range folder.SubFolders {
-			syncFolder(sf, folderpath+"/"+sf.Name)
-			//localFolder = path.Join(LocalPath, folderpath, folder.Name)
-			os.MkdirAll(filepath.Join(localPath, folderpath), 0666)
-		}
-
-		downloadsRem := 0
-		if len(folder.Files.Files) == 0 {
-			c.watcher.Add(localFolder)
-		}
-		for _, f := range folder.Files.Files {
-			downloadsRem++
-			cloudFilePath := path.Join(cloudPath, folderpath, f.Name)
-			cloudFilePath = CleanNetworkPath(cloudFilePath)
-			localFilePath := path.Join(localPath, folderpath, f.Name)
+	c.Mutex.Lock()
+	c.folderSyncs = append(c.folderSyncs, newSync)
+	sync := c.folderSyncs[len(c.folderSyncs)-1].snapshot()
+	c.Mutex.Unlock()
+	c.stateChanged()
 
-			c.fileStorageMutex.Lock()
-			if _, ok := c.fileStorage[cloudFilePath]; ok {
-				c.fileStorage[cloudFilePath].DeleteAllContent()
-			} else {
-				utils.GetLogger().Println("[ERROR] File", cloudFilePath, "not found in fileStorage")
-			}
-			if _, ok := filesAdded[cloudFilePath]; ok {
-				downloadsRem--
-				c.fileStorageMutex.Unlock()
-				continue
-			}
-			c.downloadManager.QueueDownload(cloudFilePath, localFilePath, func(event DownloadEvent) {
-				if event == DownloadCompleted {
-					downloadsRem--
-					if downloadsRem <= 0 {
-						c.watcher.Add(localFolder)
-					}
-				}
-			})
-			c.fileStorage[cloudFilePath] = &datastore.SyncFileStore{
-				FullFileStore: datastore.FullFileStore{
-					BaseFileStore: datastore.BaseFileStore{
-						FileID: f.ID,
-						Chunks: f.Chunks.Chunks,
-					},
-					FilePath: localFilePath,
-				},
-			}
-			c.fileStorageMutex.Unlock()
-		}
-	}
-	syncFolder(f, "/")
+	c.reconcileAll(plan, c.reconcileFolders(&sync))
+	// Files could have been renamed because of case collisions.
+	c.stateChanged()
 	return nil
 }
 
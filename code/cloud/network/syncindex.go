@@ -0,0 +1,208 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SyncEntry is the state of a file of a folder sync when it was last synced. Folder syncs keep an index of them, so
+// that changes made while the node was offline can be told apart from files that were never synced.
+type SyncEntry struct {
+	LocalPath string
+	// Size and ModTime are the local file's size and modification time. If they did not change, the local file is
+	// assumed to have the same contents.
+	Size    int64
+	ModTime time.Time
+
+	FileID datastore.FileID
+	Chunks datastore.Chunks
+}
+
+// file returns the version of the file that was synced.
+func (e SyncEntry) file() *datastore.File {
+	return &datastore.File{
+		ID:     e.FileID,
+		Name:   filepath.Base(e.LocalPath),
+		Size:   uint64(e.Size),
+		Chunks: e.Chunks,
+	}
+}
+
+// unchanged returns whether the local file looks the same as when it was synced.
+func (e SyncEntry) unchanged(info os.FileInfo) bool {
+	return info.Size() == e.Size && info.ModTime().Equal(e.ModTime)
+}
+
+// folderSyncOf returns the folder sync that the cloud file is part of. Mutex must be held.
+func (c *cloud) folderSyncOf(cloudPath string) *fileSync {
+	for i := range c.folderSyncs {
+		if isSubPath(c.folderSyncs[i].CloudPath, cloudPath) {
+			return &c.folderSyncs[i]
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the folder sync that can be used without holding Mutex. The index is not copied, it is
+// read from the folder sync. Mutex must be held.
+func (sync *fileSync) snapshot() fileSync {
+	s := *sync
+	s.Index = nil
+	s.Renamed = make(map[string]string, len(sync.Renamed))
+	for cloudPath, localPath := range sync.Renamed {
+		s.Renamed[cloudPath] = localPath
+	}
+	s.Ignore = append([]string(nil), sync.Ignore...)
+	s.Exclude = append([]string(nil), sync.Exclude...)
+	return s
+}
+
+// recordSynced records that the local file has the version of the cloud file, if it is part of a folder sync.
+func (c *cloud) recordSynced(cloudPath, localPath string, file *datastore.File) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return
+	}
+	c.Mutex.Lock()
+	sync := c.folderSyncOf(cloudPath)
+	if sync != nil {
+		if sync.Index == nil {
+			sync.Index = make(map[string]SyncEntry)
+		}
+		sync.Index[cloudPath] = SyncEntry{
+			LocalPath: localPath,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			FileID:    file.ID,
+			Chunks:    file.Chunks,
+		}
+	}
+	c.Mutex.Unlock()
+	if sync != nil {
+		c.stateChanged()
+	}
+}
+
+// forgetSynced removes the cloud file from the index of its folder sync.
+func (c *cloud) forgetSynced(cloudPath string) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if sync := c.folderSyncOf(cloudPath); sync != nil {
+		delete(sync.Index, cloudPath)
+	}
+}
+
+// indexOf returns the folder sync whose index is used for the sync, which can be a snapshot of it. Mutex must be held.
+func (c *cloud) indexOf(sync *fileSync) *fileSync {
+	if registered, err := c.syncByLocalPath(sync.LocalPath); err == nil {
+		return registered
+	}
+	return sync
+}
+
+// syncEntry returns the index entry of the cloud file in the folder sync, or nil if it was not synced to the local
+// path.
+func (c *cloud) syncEntry(sync *fileSync, cloudPath, localPath string) *SyncEntry {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	entry, ok := c.indexOf(sync).Index[cloudPath]
+	if !ok || filepath.Clean(entry.LocalPath) != filepath.Clean(localPath) {
+		return nil
+	}
+	return &entry
+}
+
+// rescan reconciles the syncs with the changes made to the local and cloud files while the node was offline. Local
+// files are watched once they are reconciled.
+func (c *cloud) rescan() {
+	c.Mutex.RLock()
+	stores := append([]*datastore.SyncFileStore(nil), c.fileSyncs...)
+	folders := make([]fileSync, len(c.folderSyncs))
+	for i := range c.folderSyncs {
+		folders[i] = c.folderSyncs[i].snapshot()
+	}
+	c.Mutex.RUnlock()
+
+	fileSyncs := make([]*datastore.SyncFileStore, 0, len(stores))
+	for _, store := range stores {
+		if store.Paused {
+			c.syncTracker.setPaused(filepath.Clean(store.FilePath), true)
+			fileSyncs = append(fileSyncs, store)
+			continue
+		}
+		if synced, ok := c.rescanFileSync(store); ok {
+			fileSyncs = append(fileSyncs, synced)
+		}
+	}
+	c.Mutex.Lock()
+	c.fileSyncs = fileSyncs
+	c.Mutex.Unlock()
+
+	for i := range folders {
+		sync := &folders[i]
+		if sync.Paused {
+			c.syncTracker.setPaused(filepath.Clean(sync.LocalPath), true)
+			continue
+		}
+		c.rescanFolderSync(sync)
+	}
+	c.stateChanged()
+}
+
+// rescanFileSync reconciles the changes made to the synced file while it was not watched. Returns the store of the
+// sync, and false if the file was deleted on either side and is no longer synced.
+func (c *cloud) rescanFileSync(store *datastore.SyncFileStore) (*datastore.SyncFileStore, bool) {
+	scanned := c.trackScan(store.FilePath)
+	plan, err := c.planSyncFile(store.CloudPath, store.FilePath, &SyncEntry{
+		LocalPath: store.FilePath,
+		FileID:    store.FileID,
+	})
+	scanned()
+	if err != nil {
+		utils.GetLogger().Printf("[WARN] Dropping sync of %v: %v.", store.CloudPath, err)
+		return nil, false
+	}
+	a := plan.Actions[0]
+	localPath := a.LocalPath
+	synced, err := c.reconcile(a, func() {
+		c.watcher.Add(localPath)
+	})
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Syncing %v with %v: %v.", a.CloudPath, a.LocalPath, err)
+	}
+	// A file deleted on either side while it was not watched is no longer synced.
+	return synced, a.Op != ReconcileDeleteLocal && a.Op != ReconcileDeleteCloud
+}
+
+// rescanFolderSync reconciles the changes made to the synced folder while it was not watched. sync is a snapshot of the
+// folder sync.
+func (c *cloud) rescanFolderSync(sync *fileSync) {
+	scanned := c.trackScan(sync.LocalPath)
+	plan, err := c.planSyncFolder(sync)
+	scanned()
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] Scanning folder sync %v: %v.", sync.LocalPath, err)
+		return
+	}
+	c.pruneSyncIndex(sync, plan)
+	c.reconcileAll(plan, c.reconcileFolders(sync))
+}
+
+// pruneSyncIndex removes the entries of files that no longer exist on either side from the index of the folder sync.
+func (c *cloud) pruneSyncIndex(sync *fileSync, plan SyncPlan) {
+	planned := make(map[string]bool)
+	for _, a := range plan.Actions {
+		planned[a.CloudPath] = true
+	}
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	index := c.indexOf(sync).Index
+	for cloudPath := range index {
+		if !planned[cloudPath] {
+			delete(index, cloudPath)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"cloud/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForIndex waits until the folder sync's index has entries for all of the cloud paths.
+func waitForIndex(t *testing.T, c *cloud, paths ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		missing := ""
+		c.Mutex.RLock()
+		for _, p := range paths {
+			if _, ok := c.folderSyncs[0].Index[p]; !ok {
+				missing = p
+			}
+		}
+		c.Mutex.RUnlock()
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v is not in the sync index.", missing)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRescanFolderSync(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_rescan_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	localDir := dirs[1]
+
+	if err := c.CreateDirectory("/p"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, localDir, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+		"c.txt": "c",
+	})
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/a.txt", "/p/b.txt", "/p/c.txt")
+
+	// The index is saved with the state.
+	data, err := encodeState(c.SavedNetworkState(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := decodeState(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := info.State.FolderSyncs[0].Index["/p/a.txt"]; entry.LocalPath != filepath.Join(localDir, "a.txt") ||
+		entry.Size != 1 {
+		t.Errorf("Unexpected saved index entry %+v.", entry)
+	}
+
+	// The node goes offline, the files change locally and on the cloud.
+	c.watcher.Close()
+	c.watcher = nil
+	time.Sleep(100 * time.Millisecond)
+	writeTestFiles(t, localDir, map[string]string{
+		"a.txt": "edited offline",
+		"d.txt": "created offline",
+	})
+	if err := os.Remove(filepath.Join(localDir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	c.networkMutex.Lock()
+	_, err = c.network.removeFile("/p/c.txt")
+	c.networkMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]ReconcileOp{
+		"/p/a.txt": ReconcileUpload,
+		"/p/b.txt": ReconcileDeleteCloud,
+		"/p/c.txt": ReconcileDeleteLocal,
+		"/p/d.txt": ReconcileUpload,
+	}
+	plan, err := c.planSyncFolder(&c.folderSyncs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != len(expected) {
+		t.Errorf("Expected %d actions, got %d.", len(expected), len(plan.Actions))
+	}
+	for _, a := range plan.Actions {
+		if op, ok := expected[a.CloudPath]; !ok || op != a.Op {
+			t.Errorf("Unexpected action %v for %v.", a.Op, a.CloudPath)
+		}
+	}
+
+	if err := c.createWatcher(); err != nil {
+		t.Fatal(err)
+	}
+	c.rescan()
+	if f, err := c.GetFile("/p/a.txt"); err != nil || f.Size != uint64(len("edited offline")) {
+		t.Errorf("Offline edit was not uploaded: %v.", err)
+	}
+	if _, err := c.GetFile("/p/b.txt"); err == nil {
+		t.Error("File deleted offline is still on the cloud.")
+	}
+	if _, err := c.GetFile("/p/d.txt"); err != nil {
+		t.Errorf("File created offline was not uploaded: %v.", err)
+	}
+	if _, err := os.Stat(filepath.Join(localDir, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("File deleted on the cloud was not deleted locally: %v.", err)
+	}
+	waitForIndex(t, c, "/p/a.txt", "/p/d.txt")
+	c.Mutex.RLock()
+	_, hasB := c.folderSyncs[0].Index["/p/b.txt"]
+	_, hasC := c.folderSyncs[0].Index["/p/c.txt"]
+	c.Mutex.RUnlock()
+	if hasB || hasC {
+		t.Error("Deleted files are still in the sync index.")
+	}
+
+	// Once rescanned, nothing changes on the next start.
+	plan, err = c.planSyncFolder(&c.folderSyncs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range plan.Actions {
+		if a.Op != ReconcileSkip {
+			t.Errorf("Expected %v to be unchanged, got %v.", a.CloudPath, a.Op)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(localDir, "a.txt")); err != nil || string(b) != "edited offline" {
+		t.Errorf("Local a.txt has %q, %v.", b, err)
+	}
+}
+
+func TestRescanFileSyncDeletedOnBothSides(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_rescan_deleted_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	localPath := filepath.Join(dirs[1], "a.txt")
+	writeTestFiles(t, dirs[1], map[string]string{"a.txt": "a"})
+	if err := c.SyncFile("/a.txt", localPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node goes offline, the file is deleted locally and on the cloud.
+	c.watcher.Close()
+	c.watcher = nil
+	if err := os.Remove(localPath); err != nil {
+		t.Fatal(err)
+	}
+	c.networkMutex.Lock()
+	_, err = c.network.removeFile("/a.txt")
+	c.networkMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.createWatcher(); err != nil {
+		t.Fatal(err)
+	}
+	c.rescan()
+	if len(c.fileSyncs) != 0 {
+		t.Errorf("File deleted on both sides is still synced: %v.", c.fileSyncs)
+	}
+	if c.FileStore("/a.txt") != nil {
+		t.Error("File deleted on both sides is still stored.")
+	}
+}
@@ -0,0 +1,411 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SyncState is what a sync is doing.
+type SyncState int
+
+const (
+	// SyncIdle is a sync whose local and cloud files are the same.
+	SyncIdle SyncState = iota
+	// SyncScanning is a sync that compares its local and cloud files.
+	SyncScanning
+	// SyncUploading is a sync that adds local changes to the cloud.
+	SyncUploading
+	// SyncDownloading is a sync that applies cloud changes to the local files.
+	SyncDownloading
+	// SyncPaused is a sync that was paused. Changes on either side are synced once it is resumed.
+	SyncPaused
+	// SyncError is a sync whose last transfer failed.
+	SyncError
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncIdle:
+		return "idle"
+	case SyncScanning:
+		return "scanning"
+	case SyncUploading:
+		return "uploading"
+	case SyncDownloading:
+		return "downloading"
+	case SyncPaused:
+		return "paused"
+	case SyncError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// SyncStatus is the status of a file or folder sync.
+type SyncStatus struct {
+	CloudPath string
+	LocalPath string
+	// Folder is set for folder syncs.
+	Folder bool
+	State  SyncState
+	// PendingUploads and PendingDownloads are the number of files that are being transferred.
+	PendingUploads   int
+	PendingDownloads int
+	// Error is the error of the last failed transfer, empty if the transfers since succeeded.
+	Error string
+}
+
+// syncActivity is what a sync is doing.
+type syncActivity struct {
+	paused    bool
+	scanning  int
+	uploads   int
+	downloads int
+	err       string
+}
+
+// syncTracker tracks the activity of the syncs, by the local path of the sync.
+type syncTracker struct {
+	activity map[string]*syncActivity
+	mutex    sync.Mutex
+}
+
+// update updates the activity of the sync.
+func (t *syncTracker) update(key string, f func(a *syncActivity)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.activity == nil {
+		t.activity = make(map[string]*syncActivity)
+	}
+	a, ok := t.activity[key]
+	if !ok {
+		a = &syncActivity{}
+		t.activity[key] = a
+	}
+	f(a)
+}
+
+// get returns the activity of the sync.
+func (t *syncTracker) get(key string) syncActivity {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if a, ok := t.activity[key]; ok {
+		return *a
+	}
+	return syncActivity{}
+}
+
+// setPaused records whether the sync is paused.
+func (t *syncTracker) setPaused(key string, paused bool) {
+	t.update(key, func(a *syncActivity) {
+		a.paused = paused
+	})
+}
+
+// forget forgets the activity of a removed sync.
+func (t *syncTracker) forget(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.activity, key)
+}
+
+// syncKey returns the local path of the sync that the local file is part of. Files that are not part of a folder sync
+// are their own file sync. Mutex must not be held, nor fileStorageMutex.
+func (c *cloud) syncKey(localPath string) string {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	for i := range c.folderSyncs {
+		root := filepath.Clean(c.folderSyncs[i].LocalPath)
+		if filepath.Clean(localPath) == root || strings.HasPrefix(localPath, root+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return filepath.Clean(localPath)
+}
+
+// trackTransfer records that a file of a sync is uploaded or downloaded. The returned function must be called with
+// the result once it completes.
+func (c *cloud) trackTransfer(localPath string, download bool) func(err error) {
+	return c.syncTracker.transfer(c.syncKey(localPath), download)
+}
+
+// transfer records that a file of the sync is uploaded or downloaded. The returned function must be called with the
+// result once it completes.
+func (t *syncTracker) transfer(key string, download bool) func(err error) {
+	t.update(key, func(a *syncActivity) {
+		if download {
+			a.downloads++
+		} else {
+			a.uploads++
+		}
+	})
+	return func(err error) {
+		t.update(key, func(a *syncActivity) {
+			if download {
+				a.downloads--
+			} else {
+				a.uploads--
+			}
+			a.err = ""
+			if err != nil {
+				a.err = err.Error()
+			}
+		})
+	}
+}
+
+// trackScan records that a sync is being scanned. The returned function must be called once the scan completes.
+func (c *cloud) trackScan(localPath string) func() {
+	key := c.syncKey(localPath)
+	c.syncTracker.update(key, func(a *syncActivity) {
+		a.scanning++
+	})
+	return func() {
+		c.syncTracker.update(key, func(a *syncActivity) {
+			a.scanning--
+		})
+	}
+}
+
+func (a syncActivity) state() SyncState {
+	switch {
+	case a.paused:
+		return SyncPaused
+	case a.scanning > 0:
+		return SyncScanning
+	case a.downloads > 0:
+		return SyncDownloading
+	case a.uploads > 0:
+		return SyncUploading
+	case a.err != "":
+		return SyncError
+	}
+	return SyncIdle
+}
+
+func (c *cloud) syncStatus(cloudPath, localPath string, folder bool) SyncStatus {
+	a := c.syncTracker.get(filepath.Clean(localPath))
+	return SyncStatus{
+		CloudPath:        cloudPath,
+		LocalPath:        localPath,
+		Folder:           folder,
+		State:            a.state(),
+		PendingUploads:   a.uploads,
+		PendingDownloads: a.downloads,
+		Error:            a.err,
+	}
+}
+
+// Syncs returns the status of the file and folder syncs.
+func (c *cloud) Syncs() []SyncStatus {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	statuses := make([]SyncStatus, 0, len(c.fileSyncs)+len(c.folderSyncs))
+	for _, store := range c.fileSyncs {
+		statuses = append(statuses, c.syncStatus(store.CloudPath, store.FilePath, false))
+	}
+	for _, sync := range c.folderSyncs {
+		statuses = append(statuses, c.syncStatus(sync.CloudPath, sync.LocalPath, true))
+	}
+	return statuses
+}
+
+// findSync returns the file or folder sync of the local path. Mutex must be held.
+func (c *cloud) findSync(localPath string) (*datastore.SyncFileStore, *fileSync, error) {
+	if sync, err := c.syncByLocalPath(localPath); err == nil {
+		return nil, sync, nil
+	}
+	for _, store := range c.fileSyncs {
+		if filepath.Clean(store.FilePath) == filepath.Clean(localPath) {
+			return store, nil, nil
+		}
+	}
+	return nil, nil, errors.New("local path is not synced")
+}
+
+// PauseSync pauses the sync of the local file or folder. Changes on either side are not synced until it is resumed.
+func (c *cloud) PauseSync(localPath string) error {
+	c.Mutex.Lock()
+	store, sync, err := c.findSync(localPath)
+	if err == nil {
+		if sync != nil {
+			sync.Paused = true
+		} else {
+			store.Paused = true
+		}
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	c.syncTracker.setPaused(filepath.Clean(localPath), true)
+	c.stateChanged()
+	return nil
+}
+
+// ResumeSync resumes the paused sync of the local file or folder, and syncs the changes made on either side while it
+// was paused.
+func (c *cloud) ResumeSync(localPath string) error {
+	c.Mutex.Lock()
+	store, sync, err := c.findSync(localPath)
+	var s fileSync
+	if err == nil {
+		if sync != nil {
+			sync.Paused = false
+			s = sync.snapshot()
+		} else {
+			store.Paused = false
+		}
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	c.syncTracker.setPaused(filepath.Clean(localPath), false)
+	if err := c.createWatcher(); err != nil {
+		return err
+	}
+	if sync != nil {
+		c.rescanFolderSync(&s)
+	} else {
+		synced, keep := c.rescanFileSync(store)
+		c.Mutex.Lock()
+		for i := range c.fileSyncs {
+			if c.fileSyncs[i] == store {
+				if keep {
+					c.fileSyncs[i] = synced
+				} else {
+					c.fileSyncs = append(c.fileSyncs[:i], c.fileSyncs[i+1:]...)
+				}
+				break
+			}
+		}
+		c.Mutex.Unlock()
+	}
+	c.stateChanged()
+	return nil
+}
+
+// RemoveSync stops syncing the local file or folder. The local and cloud files are kept. The chunks of the local files
+// are copied to the file storage, so that this node keeps storing them.
+func (c *cloud) RemoveSync(localPath string) error {
+	c.Mutex.Lock()
+	store, sync, err := c.findSync(localPath)
+	var removed fileSync
+	if err == nil {
+		if sync != nil {
+			removed = *sync
+			for i := range c.folderSyncs {
+				if &c.folderSyncs[i] == sync {
+					c.folderSyncs = append(c.folderSyncs[:i], c.folderSyncs[i+1:]...)
+					break
+				}
+			}
+		} else {
+			for i := range c.fileSyncs {
+				if c.fileSyncs[i] == store {
+					c.fileSyncs = append(c.fileSyncs[:i], c.fileSyncs[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	c.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if store != nil {
+		if c.watcher != nil {
+			c.watcher.Remove(store.FilePath)
+		}
+		c.releaseLocalCopy(store.CloudPath)
+	} else {
+		if c.watcher != nil {
+			filepath.Walk(removed.LocalPath, func(p string, info os.FileInfo, err error) error {
+				if err == nil && info.IsDir() {
+					c.watcher.Remove(p)
+				}
+				return nil
+			})
+		}
+		c.fileStorageMutex.RLock()
+		files := make([]string, 0)
+		for cloudPath := range c.fileStorage {
+			if isSubPath(removed.CloudPath, cloudPath) {
+				files = append(files, cloudPath)
+			}
+		}
+		c.fileStorageMutex.RUnlock()
+		for _, cloudPath := range files {
+			c.releaseLocalCopy(cloudPath)
+		}
+	}
+	c.syncTracker.forget(filepath.Clean(localPath))
+	c.stateChanged()
+	return nil
+}
+
+// releaseLocalCopy replaces the local copy of a cloud file, if this node has one, with a partial file store that holds
+// its chunks, so that the local file is no longer used by the cloud. Local copies with changes that were not synced do
+// not hold the chunks of the cloud file, and are dropped, as are copies that do not fit in the node's storage.
+func (c *cloud) releaseLocalCopy(cloudPath string) {
+	c.fileStorageMutex.RLock()
+	storage := c.fileStorage[cloudPath]
+	local, ok := localCopy(storage)
+	var chunks []datastore.Chunk
+	if ok {
+		chunks = local.Chunks
+	}
+	c.fileStorageMutex.RUnlock()
+	if !ok {
+		return
+	}
+	file, err := c.GetFile(cloudPath)
+	var partial *datastore.PartialFileStore
+	if err == nil && local.FileID == file.ID {
+		partial, err = c.copyLocalChunks(storage, file)
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] Copying the chunks of %v: %v.", cloudPath, err)
+		}
+	}
+	c.fileStorageMutex.Lock()
+	if partial != nil {
+		c.fileStorage[cloudPath] = partial
+	} else {
+		delete(c.fileStorage, cloudPath)
+	}
+	c.fileStorageMutex.Unlock()
+	if partial != nil {
+		return
+	}
+	// The node no longer holds the chunks of the dropped copy.
+	for _, chunk := range chunks {
+		if err := c.releaseChunkNode(cloudPath, chunk.ID); err != nil {
+			utils.GetLogger().Printf("[ERROR] Removing the location of chunk %v: %v.", chunk.ID, err)
+		}
+	}
+}
+
+// copyLocalChunks copies the chunks of the file from its local copy to a partial file store, within the node's storage
+// capacity.
+func (c *cloud) copyLocalChunks(storage datastore.FileStore, file *datastore.File) (*datastore.PartialFileStore, error) {
+	if err := c.reserveStorage(file.Size); err != nil {
+		return nil, err
+	}
+	partial, copied, err := datastore.CopyFileStore(storage, file.Chunks.Chunks, file.ID, c.config.FileStorageDir)
+	if err != nil {
+		c.releaseStorage(file.Size)
+		return nil, err
+	}
+	// Hard linked chunks do not take up more space.
+	if copied < file.Size {
+		c.releaseStorage(file.Size - copied)
+	}
+	return partial, nil
+}
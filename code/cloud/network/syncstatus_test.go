@@ -0,0 +1,172 @@
+package network
+
+import (
+	"cloud/datastore"
+	"cloud/utils"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncActivityState(t *testing.T) {
+	tests := []struct {
+		activity syncActivity
+		expected SyncState
+	}{
+		{syncActivity{}, SyncIdle},
+		{syncActivity{uploads: 1}, SyncUploading},
+		{syncActivity{uploads: 1, downloads: 2}, SyncDownloading},
+		{syncActivity{scanning: 1, downloads: 2}, SyncScanning},
+		{syncActivity{err: "failed"}, SyncError},
+		{syncActivity{uploads: 1, err: "failed"}, SyncUploading},
+		{syncActivity{paused: true, scanning: 1, err: "failed"}, SyncPaused},
+	}
+	for _, test := range tests {
+		if state := test.activity.state(); state != test.expected {
+			t.Errorf("Expected %v for %+v, got %v.", test.expected, test.activity, state)
+		}
+	}
+}
+
+func TestSyncTracking(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	c.folderSyncs = []fileSync{{CloudPath: "/p", LocalPath: filepath.FromSlash("/tmp/p")}}
+
+	upload := c.trackTransfer(filepath.FromSlash("/tmp/p/a.txt"), false)
+	download := c.trackTransfer(filepath.FromSlash("/tmp/p/sub/b.txt"), true)
+	status := c.Syncs()[0]
+	if status.State != SyncDownloading || status.PendingUploads != 1 || status.PendingDownloads != 1 {
+		t.Errorf("Unexpected status %+v.", status)
+	}
+	download(errors.New("failed"))
+	upload(nil)
+	if status := c.Syncs()[0]; status.State != SyncIdle || status.Error != "" {
+		t.Errorf("Expected the sync to be idle after a successful transfer, got %+v.", status)
+	}
+	c.trackTransfer(filepath.FromSlash("/tmp/p/a.txt"), false)(errors.New("failed"))
+	if status := c.Syncs()[0]; status.State != SyncError || status.Error != "failed" {
+		t.Errorf("Expected the sync to have failed, got %+v.", status)
+	}
+}
+
+func TestPauseResumeRemoveSync(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_syncstatus_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0]})
+	localDir := dirs[1]
+
+	if err := c.CreateDirectory("/p"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "a"})
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/a.txt")
+	if err := c.PauseSync(filepath.Join(localDir, "missing")); err == nil {
+		t.Error("Paused a path that is not synced.")
+	}
+
+	// Changes made while paused are not synced.
+	if err := c.PauseSync(localDir); err != nil {
+		t.Fatal(err)
+	}
+	if status := c.Syncs()[0]; status.State != SyncPaused || !status.Folder {
+		t.Errorf("Expected a paused folder sync, got %+v.", status)
+	}
+	writeTestFiles(t, localDir, map[string]string{"b.txt": "created while paused"})
+	time.Sleep(watchQuietPeriod + 300*time.Millisecond)
+	if c.FileStore("/p/b.txt") != nil {
+		t.Error("File created while the sync was paused was uploaded.")
+	}
+
+	// They are synced once it is resumed.
+	if err := c.ResumeSync(localDir); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/b.txt")
+	if status := c.Syncs()[0]; status.State == SyncPaused {
+		t.Error("Sync is still paused.")
+	}
+
+	// Removed syncs keep the files, but the local copies are no longer used.
+	if err := c.RemoveSync(localDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Syncs()) != 0 {
+		t.Error("Removed sync is still listed.")
+	}
+	if _, err := c.GetFile("/p/a.txt"); err != nil {
+		t.Errorf("Cloud file of the removed sync was deleted: %v.", err)
+	}
+	if _, ok := localCopy(c.FileStore("/p/a.txt")); ok {
+		t.Error("Local copy is still used after the sync was removed.")
+	}
+	if partial, ok := c.FileStore("/p/a.txt").(*datastore.PartialFileStore); !ok || partial.StoredSize() != 1 {
+		t.Error("Chunks of the removed sync were not kept.")
+	}
+	writeTestFiles(t, localDir, map[string]string{"c.txt": "created after removal"})
+	time.Sleep(watchQuietPeriod + 300*time.Millisecond)
+	if c.FileStore("/p/c.txt") != nil {
+		t.Error("File created after the sync was removed was uploaded.")
+	}
+}
+
+func TestRemoveSyncWithoutStorage(t *testing.T) {
+	clouds, err := CreateTestClouds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clouds[0].(*cloud)
+	dirs, err := utils.GetTestDirs("cloud_test_remove_sync_", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	c.SetConfig(CloudConfig{FileStorageDir: dirs[0], FileStorageCapacity: 5})
+	localDir := dirs[1]
+
+	if err := c.CreateDirectory("/p"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, localDir, map[string]string{"a.txt": "does not fit"})
+	if err := c.SyncFolder("/p", localDir); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndex(t, c, "/p/a.txt")
+	file, err := c.GetFile("/p/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkID := file.Chunks.Chunks[0].ID
+	if !containsString(c.Network().ChunkNodes[chunkID], c.MyNode().ID) {
+		t.Fatal("Expected the node to hold the chunk of the synced file.")
+	}
+
+	// The chunks do not fit in the node's storage, so the node stops holding them.
+	if err := c.RemoveSync(localDir); err != nil {
+		t.Fatal(err)
+	}
+	if c.FileStore("/p/a.txt") != nil {
+		t.Error("Expected the local copy to be dropped.")
+	}
+	if containsString(c.Network().ChunkNodes[chunkID], c.MyNode().ID) {
+		t.Error("Expected the node to no longer be listed as holding the chunk.")
+	}
+	if used := c.BenchmarkState().StorageSpaceUsed; used > 5 {
+		t.Errorf("Storage used is %d, over the capacity.", used)
+	}
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// watchQuietPeriod is how long a file has to be left unchanged before its watcher events are handled.
+	watchQuietPeriod = 200 * time.Millisecond
+	// watchWorkers is how many watcher events are handled at the same time.
+	watchWorkers = 4
+)
+
+// queuedEvent is the merged watcher events of a path that were not handled yet.
+type queuedEvent struct {
+	op fsnotify.Op
+	// size and modTime are the file's size and modification time after the last event, -1 if it did not exist.
+	size    int64
+	modTime time.Time
+	timer   *time.Timer
+	// running is set while the events are handled. Events that arrive meanwhile are handled again afterwards.
+	running bool
+	again   bool
+}
+
+// watchQueue coalesces the watcher events of each path, and handles them once the file was left unchanged for the
+// quiet period. A program writing a file in many small writes is handled once, after it is done. Renames, removals and
+// created folders are handled right away, one at a time in the order they happen, so that renames are seen before the
+// new names are created.
+type watchQueue struct {
+	handle  func(event fsnotify.Event)
+	quiet   time.Duration
+	workers chan struct{}
+
+	pending map[string]*queuedEvent
+	// ordered is the renames, removals and created folders that were not handled yet, oldest first. draining is set
+	// while a goroutine handles them.
+	ordered  []fsnotify.Event
+	draining bool
+	mutex    sync.Mutex
+}
+
+// newWatchQueue creates a queue that handles events with handle, at most workers at a time.
+func newWatchQueue(handle func(event fsnotify.Event), quiet time.Duration, workers int) *watchQueue {
+	return &watchQueue{
+		handle:  handle,
+		quiet:   quiet,
+		workers: make(chan struct{}, workers),
+		pending: make(map[string]*queuedEvent),
+	}
+}
+
+// fileState returns the size and modification time of the file, or -1 if it does not exist.
+func fileState(name string) (int64, time.Time, bool) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return -1, time.Time{}, false
+	}
+	return info.Size(), info.ModTime(), info.IsDir()
+}
+
+// add queues the event.
+func (q *watchQueue) add(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	size, modTime, isDir := fileState(event.Name)
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 || event.Op&fsnotify.Create != 0 && isDir {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		// Queued events of the path are obsolete.
+		if e, ok := q.pending[event.Name]; ok && !e.running {
+			e.timer.Stop()
+			delete(q.pending, event.Name)
+		}
+		// The watcher's events are not held up while the event is handled.
+		q.ordered = append(q.ordered, event)
+		if !q.draining {
+			q.draining = true
+			go q.drain()
+		}
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	e, ok := q.pending[event.Name]
+	if !ok {
+		e = &queuedEvent{}
+		q.pending[event.Name] = e
+	}
+	e.op |= event.Op
+	e.size, e.modTime = size, modTime
+	if e.running {
+		e.again = true
+	} else if e.timer == nil {
+		e.timer = time.AfterFunc(q.quiet, func() {
+			q.flush(event.Name)
+		})
+	} else {
+		e.timer.Reset(q.quiet)
+	}
+}
+
+// drain handles the renames, removals and created folders in the order they happened, until there are none left.
+func (q *watchQueue) drain() {
+	for {
+		q.mutex.Lock()
+		if len(q.ordered) == 0 {
+			q.draining = false
+			q.mutex.Unlock()
+			return
+		}
+		event := q.ordered[0]
+		q.ordered = q.ordered[1:]
+		q.mutex.Unlock()
+
+		q.workers <- struct{}{}
+		q.handle(event)
+		<-q.workers
+	}
+}
+
+// flush handles the queued events of the path, if the file did not change since the last event.
+func (q *watchQueue) flush(name string) {
+	q.mutex.Lock()
+	e, ok := q.pending[name]
+	if !ok || e.running {
+		q.mutex.Unlock()
+		return
+	}
+	// The file can change without events, for example if it is written through a memory map.
+	size, modTime, _ := fileState(name)
+	if size != e.size || !modTime.Equal(e.modTime) {
+		e.size, e.modTime = size, modTime
+		e.timer.Reset(q.quiet)
+		q.mutex.Unlock()
+		return
+	}
+	op := e.op
+	e.op = 0
+	e.running = true
+	q.mutex.Unlock()
+
+	// A created file is uploaded as it is, so its writes need not be handled.
+	if op&fsnotify.Create != 0 {
+		op &^= fsnotify.Write
+	}
+	q.workers <- struct{}{}
+	q.handle(fsnotify.Event{Name: name, Op: op})
+	<-q.workers
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	e.running = false
+	if e.again {
+		e.again = false
+		e.timer.Reset(q.quiet)
+	} else {
+		delete(q.pending, name)
+	}
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"cloud/utils"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedEvents records the events handled by a watch queue.
+type recordedEvents struct {
+	events []fsnotify.Event
+	times  []time.Time
+	mutex  sync.Mutex
+}
+
+func (r *recordedEvents) handle(event fsnotify.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+	r.times = append(r.times, time.Now())
+}
+
+func (r *recordedEvents) get() ([]fsnotify.Event, []time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]fsnotify.Event(nil), r.events...), append([]time.Time(nil), r.times...)
+}
+
+func TestWatchQueue(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_watchqueue_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	quiet := 50 * time.Millisecond
+	name := filepath.Join(dirs[0], "file.txt")
+
+	// Many small writes are handled once, with the creation.
+	recorded := &recordedEvents{}
+	q := newWatchQueue(recorded.handle, quiet, 2)
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.add(fsnotify.Event{Name: name, Op: fsnotify.Create})
+	for i := 0; i < 10; i++ {
+		f.Write([]byte("chunk"))
+		q.add(fsnotify.Event{Name: name, Op: fsnotify.Write})
+		time.Sleep(quiet / 5)
+	}
+	f.Close()
+	time.Sleep(4 * quiet)
+	events, _ := recorded.get()
+	if len(events) != 1 || events[0].Op != fsnotify.Create {
+		t.Errorf("Expected a single create event, got %v.", events)
+	}
+
+	// Writes without events delay the handling until the file is stable.
+	recorded = &recordedEvents{}
+	q = newWatchQueue(recorded.handle, quiet, 2)
+	q.add(fsnotify.Event{Name: name, Op: fsnotify.Write})
+	time.Sleep(quiet / 2)
+	if err := ioutil.WriteFile(name, []byte("changed without an event"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := time.Now()
+	time.Sleep(4 * quiet)
+	events, times := recorded.get()
+	if len(events) != 1 || events[0].Op != fsnotify.Write {
+		t.Fatalf("Expected a single write event, got %v.", events)
+	}
+	if times[0].Sub(changed) < quiet {
+		t.Errorf("Expected the event to be handled once the file is stable, it was handled after %v.",
+			times[0].Sub(changed))
+	}
+
+	// Removals are handled right away, and drop the queued events of the path.
+	recorded = &recordedEvents{}
+	q = newWatchQueue(recorded.handle, quiet, 2)
+	q.add(fsnotify.Event{Name: name, Op: fsnotify.Write})
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	q.add(fsnotify.Event{Name: name, Op: fsnotify.Remove})
+	waitFor(t, "Expected the removal to be handled right away.", func() bool {
+		events, _ := recorded.get()
+		return len(events) == 1 && events[0].Op == fsnotify.Remove
+	})
+	time.Sleep(4 * quiet)
+	if events, _ := recorded.get(); len(events) != 1 {
+		t.Errorf("Expected the queued write to be dropped, got %v.", events)
+	}
+}
+
+func TestWatchQueueOrder(t *testing.T) {
+	dirs, err := utils.GetTestDirs("cloud_test_watchqueue_order_", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.GetTestDirsCleanup(dirs)
+	newDir := filepath.Join(dirs[0], "new")
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The events are handled off the watcher's goroutine, in the order they happened.
+	recorded := &recordedEvents{}
+	release := make(chan struct{})
+	q := newWatchQueue(func(event fsnotify.Event) {
+		<-release
+		recorded.handle(event)
+	}, time.Hour, 4)
+	expected := []fsnotify.Event{
+		{Name: filepath.Join(dirs[0], "old"), Op: fsnotify.Rename},
+		{Name: newDir, Op: fsnotify.Create},
+		{Name: filepath.Join(dirs[0], "gone"), Op: fsnotify.Remove},
+	}
+	added := make(chan struct{})
+	go func() {
+		for _, e := range expected {
+			q.add(e)
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Adding the events waited for them to be handled.")
+	}
+	close(release)
+	waitFor(t, "Expected the events to be handled.", func() bool {
+		events, _ := recorded.get()
+		return len(events) == len(expected)
+	})
+	events, _ := recorded.get()
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("Expected %v, got %v.", expected[i], events[i])
+		}
+	}
+}
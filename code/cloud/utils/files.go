@@ -1,22 +1,39 @@
 package utils
 
 import (
+	"github.com/ricochet2200/go-disk-usage/du"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"github.com/ricochet2200/go-disk-usage/du"
+	"strings"
 )
 
+// TempFileSuffix marks temporary files created by WriteFileAtomic. Left over temporary files belong to writes that
+// never completed and can be removed.
+const TempFileSuffix = ".tmp"
+
 // https://stackoverflow.com/questions/32482673/how-to-get-directory-total-size
 func DirSize(path string) (uint64, error) {
 	var size uint64 = 0
+	// Files with several hard links are only counted once.
+	linked := make([]os.FileInfo, 0)
 	err := filepath.Walk(path, func(subpath string, info os.FileInfo, err error) error {
 		GetLogger().Printf("[DEBUG] Walking path: %v.", subpath)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			size += uint64(info.Size())
+		if info.IsDir() {
+			return nil
 		}
+		if LinkCount(info) > 1 {
+			for _, l := range linked {
+				if os.SameFile(l, info) {
+					return nil
+				}
+			}
+			linked = append(linked, info)
+		}
+		size += uint64(info.Size())
 		return nil
 	})
 	return size, err
@@ -27,3 +44,57 @@ func AvailableDisk(path string) uint64 {
 	usage := du.NewDiskUsage(path)
 	return usage.Available()
 }
+
+// WriteFileAtomic writes data to the file at path, so that the file either has its old content or all of the new
+// content, even if the machine crashes during the write. The data is written to a temporary file in the same
+// directory, synced to disk, and renamed over the target.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".*"+TempFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir flushes the directory entries of dir to disk, making renames and removals in it durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Syncing a directory is not supported on every platform. The rename itself has already happened.
+	if err := d.Sync(); err != nil && !os.IsPermission(err) {
+		GetLogger().Printf("[DEBUG] Syncing directory %v: %v.", dir, err)
+	}
+	return nil
+}
+
+// IsTempFile returns true if the file name belongs to a temporary file created by WriteFileAtomic.
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, TempFileSuffix)
+}
@@ -0,0 +1,16 @@
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// LinkCount returns the number of hard links to the file.
+func LinkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
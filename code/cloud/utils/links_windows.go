@@ -0,0 +1,13 @@
+// +build windows
+
+package utils
+
+import (
+	"os"
+)
+
+// LinkCount returns the number of hard links to the file. Hard links are not counted on Windows, every file is
+// assumed to have one.
+func LinkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Data encrypted with a passphrase starts with the magic bytes, followed by the scrypt cost parameters, the salt and
+// the nonce. The rest is the AES-256-GCM ciphertext. The header is authenticated as additional data.
+var encryptedMagic = []byte("CLOUDENC1")
+
+// scrypt cost parameters for new encryptions, as recommended for interactive logins.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+const (
+	saltSize  = 16
+	nonceSize = 12
+	keySize   = 32
+)
+
+// ErrWrongPassphrase is returned when encrypted data can not be decrypted with the given passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted data")
+
+// IsEncrypted returns true if the data was encrypted with EncryptWithPassphrase.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// EncryptWithPassphrase encrypts and authenticates the data with a key derived from the passphrase using scrypt.
+func EncryptWithPassphrase(plaintext []byte, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	header := bytes.NewBuffer(nil)
+	header.Write(encryptedMagic)
+	binary.Write(header, binary.BigEndian, [3]uint32{scryptN, scryptR, scryptP})
+	salt := make([]byte, saltSize)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header.Write(salt)
+	header.Write(nonce)
+
+	aead, err := passphraseAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	h := header.Bytes()
+	return aead.Seal(h, nonce, plaintext, h), nil
+}
+
+// DecryptWithPassphrase decrypts data encrypted with EncryptWithPassphrase.
+func DecryptWithPassphrase(data []byte, passphrase []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, errors.New("data is not encrypted")
+	}
+	headerSize := len(encryptedMagic) + 12 + saltSize + nonceSize
+	if len(data) < headerSize {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	var params [3]uint32
+	binary.Read(bytes.NewReader(data[len(encryptedMagic):]), binary.BigEndian, &params)
+	// Refuse cost parameters that would take unreasonable resources to derive the key.
+	if params[0] > 1<<20 || params[1] > 32 || params[2] > 16 {
+		return nil, errors.New("unsupported encryption parameters")
+	}
+	salt := data[len(encryptedMagic)+12 : len(encryptedMagic)+12+saltSize]
+	nonce := data[headerSize-nonceSize : headerSize]
+
+	aead, err := passphraseAEAD(passphrase, salt, int(params[0]), int(params[1]), int(params[2]))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func passphraseAEAD(passphrase []byte, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
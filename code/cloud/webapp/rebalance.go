@@ -0,0 +1,151 @@
+package webapp
+
+import (
+	"cloud/network"
+	"cloud/utils"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type WebNodeStorage struct {
+	ID       string  `json:"id"`
+	Used     uint64  `json:"used"`
+	Capacity uint64  `json:"capacity"`
+	Fill     float64 `json:"fill"`
+}
+
+type WebChunkMove struct {
+	Key      string `json:"key"`
+	Sequence int    `json:"sequence"`
+	Size     uint64 `json:"size"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+type WebRebalancePlan struct {
+	Moves []WebChunkMove   `json:"moves"`
+	Bytes uint64           `json:"bytes"`
+	Nodes []WebNodeStorage `json:"nodes"`
+}
+
+type WebRebalanceStatus struct {
+	Running  bool      `json:"running"`
+	DryRun   bool      `json:"dryRun"`
+	Planned  int       `json:"planned"`
+	Moved    int       `json:"moved"`
+	Failed   int       `json:"failed"`
+	Bytes    uint64    `json:"bytes"`
+	Error    string    `json:"error"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// RebalanceStatus API call returns the progress of the last storage rebalance.
+// Endpoint: /rebalance
+// Method: GET.
+// Headers: Authorization.
+// Query parameters: None.
+// Response:
+// - JSON containing the rebalance status.
+func (wapp *webapp) RebalanceStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s := wapp.cloud.RebalanceStatus()
+	data, err := json.Marshal(WebRebalanceStatus{
+		Running:  s.Running,
+		DryRun:   s.DryRun,
+		Planned:  s.Planned,
+		Moved:    s.Moved,
+		Failed:   s.Failed,
+		Bytes:    s.Bytes,
+		Error:    s.Error,
+		Started:  s.Started,
+		Finished: s.Finished,
+	})
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// Rebalance API call starts a storage rebalance, moving chunks from fuller nodes to emptier nodes.
+// Endpoint: /rebalance
+// Method: POST.
+// Headers: Authorization.
+// Query parameters:
+// - budget=int (optional), the maximum amount of bytes to move. Unlimited if not set.
+// - dryRun=bool (optional), only compute the plan without moving any chunks.
+// Response:
+// - JSON containing the rebalance plan.
+// - 409 if a rebalance is already running.
+// - 503 if the network can not be rebalanced, because there are not enough online nodes or no storage capacity.
+func (wapp *webapp) Rebalance(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var budget uint64
+	var dryRun bool
+	if s, err := GetQueryParam(req.URL, "budget"); err == nil {
+		budget, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if s, err := GetQueryParam(req.URL, "dryRun"); err == nil {
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	plan, err := wapp.cloud.Rebalance(budget, dryRun)
+	if err == network.ErrRebalanceRunning {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := json.Marshal(toWebRebalancePlan(plan))
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func toWebRebalancePlan(plan network.RebalancePlan) WebRebalancePlan {
+	webPlan := WebRebalancePlan{
+		Moves: make([]WebChunkMove, 0),
+		Bytes: plan.Bytes,
+		Nodes: make([]WebNodeStorage, 0),
+	}
+	for _, m := range plan.Moves {
+		webPlan.Moves = append(webPlan.Moves, WebChunkMove{
+			Key:      m.CloudPath,
+			Sequence: m.Chunk.SequenceNumber,
+			Size:     m.Chunk.ContentSize,
+			From:     m.From,
+			To:       m.To,
+		})
+	}
+	for _, n := range plan.Nodes {
+		webPlan.Nodes = append(webPlan.Nodes, WebNodeStorage{
+			ID:       n.ID,
+			Used:     n.Used,
+			Capacity: n.Capacity,
+			Fill:     n.Fill(),
+		})
+	}
+	return webPlan
+}
@@ -0,0 +1,109 @@
+package webapp
+
+import (
+	"cloud/network"
+	"cloud/utils"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultSearchLimit and maxSearchLimit are the default and maximum number of files returned per page of a search.
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 1000
+)
+
+type WebSearchResult struct {
+	Files  []WebFile `json:"files"`
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+// Search API call searches the files on the cloud.
+// Endpoint: /search
+// Method: GET.
+// Headers: Authorization.
+// Query parameters (all optional):
+// - name=string, matches files whose name contains it, ignoring case.
+// - glob=string, matches files whose name matches the shell pattern.
+// - regex=string, matches files whose full path matches the regular expression.
+// - folder=string, only matches files in the folder or its sub-folders.
+// - type=string, matches files whose MIME type starts with it.
+// - minSize=int and maxSize=int, match files with sizes in the range, in bytes.
+// - modifiedAfter=int and modifiedBefore=int, match files modified in the range, in milliseconds since the epoch.
+// - offset=int, the number of matches to skip.
+// - limit=int, the maximum number of matches to return, at most 1000. Defaults to 50.
+// Response:
+// - JSON containing a page of the matching files, sorted by path, and the total number of matches.
+func (wapp *webapp) Search(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	qs := req.URL.Query()
+	query := network.SearchQuery{
+		Name:        qs.Get("name"),
+		Glob:        qs.Get("glob"),
+		Regex:       qs.Get("regex"),
+		Folder:      qs.Get("folder"),
+		ContentType: qs.Get("type"),
+		Limit:       defaultSearchLimit,
+	}
+
+	var err error
+	intParam := func(name string, dst *int) {
+		if v := qs.Get(name); v != "" && err == nil {
+			*dst, err = strconv.Atoi(v)
+		}
+	}
+	uintParam := func(name string, dst *uint64) {
+		if v := qs.Get(name); v != "" && err == nil {
+			*dst, err = strconv.ParseUint(v, 10, 64)
+		}
+	}
+	timeParam := func(name string, dst *time.Time) {
+		if v := qs.Get(name); v != "" && err == nil {
+			var ms int64
+			ms, err = strconv.ParseInt(v, 10, 64)
+			*dst = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	intParam("offset", &query.Offset)
+	intParam("limit", &query.Limit)
+	uintParam("minSize", &query.MinSize)
+	uintParam("maxSize", &query.MaxSize)
+	timeParam("modifiedAfter", &query.ModifiedAfter)
+	timeParam("modifiedBefore", &query.ModifiedBefore)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if query.Limit <= 0 || query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+
+	result, err := wapp.cloud.Search(query)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	webResult := WebSearchResult{
+		Files:  make([]WebFile, 0, len(result.Files)),
+		Total:  result.Total,
+		Offset: query.Offset,
+		Limit:  query.Limit,
+	}
+	for _, f := range result.Files {
+		webResult.Files = append(webResult.Files, toWebFile(f))
+	}
+
+	data, err := json.Marshal(webResult)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
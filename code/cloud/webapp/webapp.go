@@ -11,6 +11,7 @@ import (
 	"os"
 	"io/ioutil"
 	"io"
+	"time"
 
 	"github.com/gorilla/mux"
 	gorillaHandlers "github.com/gorilla/handlers"
@@ -31,6 +32,11 @@ type WebApp interface {
 type WebFile struct {
 	Key	string `json:"key"`
 	Size int `json:"size"`
+	LastModified int64 `json:"lastModified"` // Milliseconds since the Unix epoch.
+	Type string `json:"type"`
+	Mode uint32 `json:"mode"`
+	Owner string `json:"owner"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type WebFolder struct {
@@ -85,11 +91,23 @@ func (wapp *webapp) Serve(port int) error {
 	s.HandleFunc("/downloadlink", wapp.FileDownloadLink).Methods(http.MethodGet).
 																  Queries("fileKey", "")
 
+	s.HandleFunc("/search", wapp.Search).Methods(http.MethodGet)
+
 	s.HandleFunc("/directories", wapp.ReadDirectories).Methods(http.MethodGet)
 	s.HandleFunc("/directories", wapp.CreateDirectory).Methods(http.MethodPost).
 													   Queries("path", "")
 	s.HandleFunc("/directories", wapp.DeleteDirectory).Methods(http.MethodDelete).
 													   Queries("path", "")
+	s.HandleFunc("/directories", wapp.MoveDirectory).Methods(http.MethodPut).
+													 Queries("path", "", "newPath", "")
+	s.HandleFunc("/directories/copy", wapp.CopyDirectory).Methods(http.MethodPost).
+														  Queries("path", "", "newPath", "")
+	s.HandleFunc("/files/{fileKey}/copy", wapp.CopyFile).Methods(http.MethodPost).
+														 Queries("path", "")
+	s.HandleFunc("/files/{fileKey}/metadata", wapp.SetFileMetadata).Methods(http.MethodPut)
+
+	s.HandleFunc("/rebalance", wapp.RebalanceStatus).Methods(http.MethodGet)
+	s.HandleFunc("/rebalance", wapp.Rebalance).Methods(http.MethodPost)
 
 	// FIXME: passing paths as fileKey's might not be good (need to encode/escape the URL. Might mess parameters up.)
 
@@ -121,8 +139,8 @@ func (wapp *webapp) CloudInfo(w http.ResponseWriter, req *http.Request) {
 // Query parameters:
 // - name=string, the path of the file on the cloud (also the file's key).
 // - size=int, the expected size of the file's contents.
-// - type=string (optional), the file type (extension).
-// - lastModified=date (optional), the date the file was last modified or uploaded.
+// - type=string (optional), the MIME type of the file, detected from the name and contents if not set.
+// - lastModified=int (optional), the time the file was last modified, in milliseconds since the Unix epoch.
 // Body:
 // - File contents as POST body, encoded using post data.
 // Response:
@@ -150,9 +168,6 @@ func (wapp *webapp) CreateFile(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// fType := GetQueryParam(req.URL, "type")
-	// lastModified := GetQueryParam(req.URL, "lastModified")
-
 	multipartFileReader, _, _ := req.FormFile("file")
 	defer multipartFileReader.Close()
 
@@ -163,6 +178,18 @@ func (wapp *webapp) CreateFile(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if fType, err := GetQueryParam(req.URL, "type"); err == nil && fType != "" {
+		file.ContentType = fType
+	}
+	if lastModified, err := GetQueryParam(req.URL, "lastModified"); err == nil {
+		ms, err := strconv.ParseInt(lastModified, 10, 64)
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file.Modified = time.Unix(0, ms*int64(time.Millisecond))
+	}
 	utils.GetLogger().Printf("[DEBUG] Created file: %v", file)
 	// Verify size
 	if int(file.Size) != size {
@@ -223,7 +250,7 @@ func (wapp *webapp) CreateFile(w http.ResponseWriter, req *http.Request) {
 // Query parameters: None.
 // Response:
 // - JSON containing a list of Files.
-// - A File contains a key (here, filepath), size, and lastModified time (TODO).
+// - A File contains a key (here, filepath), size, lastModified time, MIME type, mode, owner and user metadata.
 func (wapp *webapp) ReadFiles(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -234,11 +261,7 @@ func (wapp *webapp) ReadFiles(w http.ResponseWriter, req *http.Request) {
 	// Put into web API file struct format.
 	filesWeb := make([]WebFile, 0)
 	for _, file := range files {
-		webFile := WebFile{
-			Key: file.Path, // FIXME: need to include full path
-			Size: int(file.File.Size),
-		}
-		filesWeb = append(filesWeb, webFile)
+		filesWeb = append(filesWeb, toWebFile(file))
 	}
 	utils.GetLogger().Printf("[DEBUG] Got %d web files.", len(filesWeb))
 
@@ -251,6 +274,22 @@ func (wapp *webapp) ReadFiles(w http.ResponseWriter, req *http.Request) {
 	w.Write(data)
 }
 
+// toWebFile puts a file into the web API file struct format.
+func toWebFile(file *network.NetworkFile) WebFile {
+	webFile := WebFile{
+		Key: file.Path, // FIXME: need to include full path
+		Size: int(file.File.Size),
+		Type: file.File.ContentType,
+		Mode: uint32(file.File.Mode),
+		Owner: file.File.Owner,
+		Metadata: file.File.Metadata,
+	}
+	if !file.File.Modified.IsZero() {
+		webFile.LastModified = file.File.Modified.UnixNano() / int64(time.Millisecond)
+	}
+	return webFile
+}
+
 // ReadFile API call reads the metadata of a single file.
 func (wapp *webapp) ReadFile(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNotImplemented)
@@ -389,7 +428,14 @@ func (wapp *webapp) ReadDirectories(w http.ResponseWriter, req *http.Request) {
 }
 
 // DeleteDirectory API call deletes a directory.
-// FIXME: delete all directory contents first, else delete fails
+// Endpoint: /directories
+// Method: DELETE.
+// Headers: Authorization.
+// Query parameters:
+// - path=string, the cloud path of the directory.
+// - recursive=bool (optional), delete the directory with all of its contents. Else the directory must not contain files.
+// Response:
+// - 200 if directory was deleted successfully.
 // Note that cannot pass the directory path as part of the endpoint URL, else get 404 no route matched.
 // Need to pass as a query string or another parameter.
 func (wapp *webapp) DeleteDirectory(w http.ResponseWriter, req *http.Request) {
@@ -399,13 +445,152 @@ func (wapp *webapp) DeleteDirectory(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	recursive := false
+	if recursiveStr, err := GetQueryParam(req.URL, "recursive"); err == nil {
+		recursive, err = strconv.ParseBool(recursiveStr)
+		if err != nil {
+			utils.GetLogger().Printf("[ERROR] %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 	utils.GetLogger().Printf("[DEBUG] Deleting directory: %s", path)
-	err = wapp.cloud.DeleteDirectory(path)
+
+	if recursive {
+		locked := wapp.cloud.LockFile(path)
+		if !locked {
+			utils.GetLogger().Printf("[WARN] Could not acquire directory lock: %s", path)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer wapp.cloud.UnlockFile(path)
+	}
+	err = wapp.cloud.DeleteDirectory(path, recursive)
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// MoveDirectory API call moves a directory, with all of its contents.
+// Endpoint: /directories
+// Method: PUT.
+// Headers: Authorization.
+// Query parameters:
+// - path=string, the cloud path of the directory.
+// - newPath=string, the new cloud path of the directory.
+// Response:
+// - 200 if directory was moved successfully.
+func (wapp *webapp) MoveDirectory(w http.ResponseWriter, req *http.Request) {
+	wapp.transfer(w, req, wapp.cloud.MoveDirectory)
+}
+
+// CopyDirectory API call copies a directory, with all of its contents. The copies reuse the chunks of the files.
+// Endpoint: /directories/copy
+// Method: POST.
+// Headers: Authorization.
+// Query parameters:
+// - path=string, the cloud path of the directory.
+// - newPath=string, the cloud path of the copy.
+// Response:
+// - 200 if directory was copied successfully.
+func (wapp *webapp) CopyDirectory(w http.ResponseWriter, req *http.Request) {
+	wapp.transfer(w, req, wapp.cloud.CopyDirectory)
+}
+
+// transfer moves or copies the directory from the path to the newPath query parameters, holding the locks of both.
+func (wapp *webapp) transfer(w http.ResponseWriter, req *http.Request, transfer func(path, newPath string) error) {
+	path, err := GetQueryParam(req.URL, "path")
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	newPath, err := GetQueryParam(req.URL, "newPath")
 	if err != nil {
 		utils.GetLogger().Printf("[ERROR] %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	wapp.lockedTransfer(w, path, newPath, transfer)
+}
+
+// lockedTransfer acquires the locks of both paths and moves or copies path to newPath.
+func (wapp *webapp) lockedTransfer(w http.ResponseWriter, path, newPath string, transfer func(path, newPath string) error) {
+	utils.GetLogger().Printf("[DEBUG] Want to transfer %s to %s", path, newPath)
+	locked := wapp.cloud.LockFile(path)
+	if !locked {
+		utils.GetLogger().Printf("[WARN] Could not acquire lock: %s", path)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer wapp.cloud.UnlockFile(path)
+	locked = wapp.cloud.LockFile(newPath)
+	if !locked {
+		utils.GetLogger().Printf("[WARN] Could not acquire lock: %s", newPath)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer wapp.cloud.UnlockFile(newPath)
+
+	if err := transfer(path, newPath); err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// CopyFile API call copies a file on the cloud. The copy reuses the chunks of the file.
+// Endpoint: /files/{fileKey}/copy
+// - where fileKey is currently the path of the file on the cloud.
+// Method: POST.
+// Headers: Authorization.
+// Query parameters:
+// - path=string, the cloud path of the copy.
+// Response:
+// - 200 if file was copied successfully.
+func (wapp *webapp) CopyFile(w http.ResponseWriter, req *http.Request) {
+	fileKey := mux.Vars(req)["fileKey"]
+	newPath, err := GetQueryParam(req.URL, "path")
+	if err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wapp.lockedTransfer(w, fileKey, newPath, wapp.cloud.CopyFile)
+}
+
+// SetFileMetadata API call replaces the user metadata of a file on the cloud.
+// Endpoint: /files/{fileKey}/metadata
+// - where fileKey is currently the path of the file on the cloud.
+// Method: PUT.
+// Headers: Authorization.
+// Body: JSON object of string keys and values, an empty object clears the metadata.
+// Response:
+// - 200 if the metadata was set successfully.
+func (wapp *webapp) SetFileMetadata(w http.ResponseWriter, req *http.Request) {
+	fileKey := mux.Vars(req)["fileKey"]
+	var metadata map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	locked := wapp.cloud.LockFile(fileKey)
+	if !locked {
+		utils.GetLogger().Printf("[WARN] Could not acquire lock: %s", fileKey)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer wapp.cloud.UnlockFile(fileKey)
+	if err := wapp.cloud.SetFileMetadata(fileKey, metadata); err != nil {
+		utils.GetLogger().Printf("[ERROR] %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 